@@ -0,0 +1,238 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// weekdayNames maps the abbreviated day names accepted in access windows to their values.
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// accessWindow is a recurring period of time during which the agent can be used.
+type accessWindow struct {
+	// days indicates on which days of the week the window starts.
+	days [7]bool
+
+	// start and end are the limits of the window in minutes since midnight, local time.  If
+	// end is before start, the window extends past midnight into the next day.
+	start int
+	end   int
+}
+
+// parseWeekday parses an abbreviated day name.
+func parseWeekday(s string) (time.Weekday, error) {
+	day, ok := weekdayNames[strings.ToLower(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown day %q", s)
+	}
+	return day, nil
+}
+
+// parseDays parses a comma-separated list of days or day ranges such as "Mon-Fri,Sun".
+func parseDays(s string) ([7]bool, error) {
+	var days [7]bool
+	for _, part := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(part, "-")
+		from, err := parseWeekday(first)
+		if err != nil {
+			return days, err
+		}
+		to := from
+		if isRange {
+			to, err = parseWeekday(last)
+			if err != nil {
+				return days, err
+			}
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			days[day] = true
+			if day == to {
+				break
+			}
+		}
+	}
+	return days, nil
+}
+
+// parseTimeOfDay parses an HH:MM time and returns the minutes since midnight.
+func parseTimeOfDay(s string) (int, error) {
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// parseAccessWindow parses a window such as "Mon-Fri 09:00-18:00" or "22:00-02:00".  Windows
+// without days apply to every day of the week.
+func parseAccessWindow(s string) (accessWindow, error) {
+	var w accessWindow
+
+	fields := strings.Fields(s)
+	var hours string
+	switch len(fields) {
+	case 1:
+		for i := range w.days {
+			w.days[i] = true
+		}
+		hours = fields[0]
+	case 2:
+		days, err := parseDays(fields[0])
+		if err != nil {
+			return w, fmt.Errorf("invalid access window %q: %v", s, err)
+		}
+		w.days = days
+		hours = fields[1]
+	default:
+		return w, fmt.Errorf("invalid access window %q: must be [DAYS] HH:MM-HH:MM", s)
+	}
+
+	startText, endText, ok := strings.Cut(hours, "-")
+	if !ok {
+		return w, fmt.Errorf("invalid access window %q: hours must be HH:MM-HH:MM", s)
+	}
+	var err error
+	if w.start, err = parseTimeOfDay(startText); err != nil {
+		return w, fmt.Errorf("invalid access window %q: %v", s, err)
+	}
+	if w.end, err = parseTimeOfDay(endText); err != nil {
+		return w, fmt.Errorf("invalid access window %q: %v", s, err)
+	}
+	if w.start == w.end {
+		return w, fmt.Errorf("invalid access window %q: empty range", s)
+	}
+	return w, nil
+}
+
+// contains returns true if "t" falls within the window.
+func (w *accessWindow) contains(t time.Time) bool {
+	day := t.Weekday()
+	minute := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return w.days[day] && minute >= w.start && minute < w.end
+	}
+	yesterday := (day + 6) % 7
+	return (w.days[day] && minute >= w.start) || (w.days[yesterday] && minute < w.end)
+}
+
+// accessWindows is a flag that accumulates access windows.
+type accessWindows struct {
+	texts   []string
+	windows []accessWindow
+}
+
+// String returns the textual representation of the windows.
+func (f *accessWindows) String() string {
+	return strings.Join(f.texts, ", ")
+}
+
+// Set parses and adds a new window.
+func (f *accessWindows) Set(value string) error {
+	w, err := parseAccessWindow(value)
+	if err != nil {
+		return err
+	}
+	f.texts = append(f.texts, value)
+	f.windows = append(f.windows, w)
+	return nil
+}
+
+// accessSchedule restricts the use of the agent to certain periods of time.
+type accessSchedule struct {
+	// windows lists the periods of time during which the agent can be used.  If empty, the
+	// agent can be used at any time.
+	windows accessWindows
+
+	// mu protects overrideUntil.
+	mu sync.Mutex
+
+	// overrideUntil is the time until which the agent can be used regardless of the windows.
+	overrideUntil time.Time
+}
+
+// isRestricted returns true if the schedule limits when the agent can be used.
+func (s *accessSchedule) isRestricted() bool {
+	return len(s.windows.windows) > 0
+}
+
+// check returns an error if the agent cannot be used at "now".
+func (s *accessSchedule) check(now time.Time) error {
+	if !s.isRestricted() {
+		return nil
+	}
+	for i := range s.windows.windows {
+		if s.windows.windows[i].contains(now) {
+			return nil
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if now.Before(s.overrideUntil) {
+		return nil
+	}
+	return fmt.Errorf("agent use not allowed at %s", now.Format("Mon 15:04"))
+}
+
+// override allows the use of the agent outside of the access windows for "duration" from now.
+// A zero duration cancels any active override.
+func (s *accessSchedule) override(duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if duration == 0 {
+		s.overrideUntil = time.Time{}
+	} else {
+		s.overrideUntil = time.Now().Add(duration)
+	}
+}
+
+// accessLock cuts off all access to the agents while engaged.
+type accessLock struct {
+	engaged atomic.Bool
+}
+
+// check returns an error if the lock is engaged.
+func (l *accessLock) check() error {
+	if l.engaged.Load() {
+		return errors.New("all agent access is locked")
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// agentLocks tracks the agents that clients have locked through us with SSH_AGENTC_LOCK.
+//
+// Clients see a single agent behind our socket, so locking it must not be undone by silently
+// switching them over to a different agent that is not locked.
+type agentLocks struct {
+	// mu protects locked.
+	mu sync.Mutex
+
+	// locked is the set of paths to the sockets of the locked agents.
+	locked map[string]bool
+}
+
+// lockedAgents tracks the agents that clients have locked through us.
+var lockedAgents = &agentLocks{locked: make(map[string]bool)}
+
+// set records whether the agent at "path" is locked.
+func (l *agentLocks) set(path string, locked bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if locked {
+		l.locked[path] = true
+	} else {
+		delete(l.locked, path)
+	}
+}
+
+// list returns the paths to the locked agents in a stable order.
+func (l *agentLocks) list() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	paths := make([]string, 0, len(l.locked))
+	for path := range l.locked {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,134 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// agentAlias gives a human-readable name to the agent sockets that match a glob.
+type agentAlias struct {
+	name    string
+	pattern string
+}
+
+// agentAliasFlag is a flag that can be given multiple times to name agents, each time with a
+// value of the form NAME=PATTERN.
+type agentAliasFlag []agentAlias
+
+// String implements flag.Value.
+func (f *agentAliasFlag) String() string {
+	var values []string
+	for _, alias := range *f {
+		values = append(values, alias.name+"="+alias.pattern)
+	}
+	return strings.Join(values, ",")
+}
+
+// Set implements flag.Value.
+func (f *agentAliasFlag) Set(value string) error {
+	name, pattern, ok := strings.Cut(value, "=")
+	if !ok || name == "" || pattern == "" {
+		return fmt.Errorf("invalid alias %q; must be of the form NAME=PATTERN", value)
+	}
+	if strings.ContainsAny(name, "/ \t") {
+		return fmt.Errorf("invalid alias name %q; must not contain slashes or spaces", name)
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid alias pattern %q: %v", pattern, err)
+	}
+	for _, alias := range *f {
+		if alias.name == name {
+			return fmt.Errorf("duplicate alias name %q", name)
+		}
+	}
+	*f = append(*f, agentAlias{name: name, pattern: pattern})
+	return nil
+}
+
+// nameOf returns the name of the first alias whose pattern matches "path", or empty if none
+// does.
+func (f agentAliasFlag) nameOf(path string) string {
+	for _, alias := range f {
+		if matched, _ := filepath.Match(alias.pattern, path); matched {
+			return alias.name
+		}
+	}
+	return ""
+}
+
+// resolve returns the socket named by the alias "name" or false if there is no such alias.
+// If the pattern of the alias matches several sockets, the newest one wins, like it does for
+// -agentsGlob.
+func (f agentAliasFlag) resolve(name string) (string, bool) {
+	for _, alias := range f {
+		if alias.name != name {
+			continue
+		}
+		matches, _ := filepath.Glob(alias.pattern)
+		var newest string
+		var newestTime int64
+		for _, match := range matches {
+			fi, err := os.Stat(match)
+			if err != nil || fi.Mode()&os.ModeSocket == 0 {
+				continue
+			}
+			if newest == "" || fi.ModTime().UnixNano() > newestTime {
+				newest, newestTime = match, fi.ModTime().UnixNano()
+			}
+		}
+		if newest == "" {
+			// Let the caller try the pattern itself so that the failure to open it is
+			// reported as usual.
+			return alias.pattern, true
+		}
+		return newest, true
+	}
+	return "", false
+}
+
+// agentLabel returns "path" annotated with its alias, if any, for use in logs and status
+// output.
+func agentLabel(path string) string {
+	if name := agentAliases.nameOf(path); name != "" {
+		return fmt.Sprintf("%s (%s)", name, path)
+	}
+	return path
+}
+
+// resolvePin returns the socket for the value "pinned" read from the pin file, which is either
+// the path to a socket or the name of an alias.
+func resolvePin(pinned string) string {
+	if pinned == "" || filepath.IsAbs(pinned) {
+		return pinned
+	}
+	if path, ok := agentAliases.resolve(pinned); ok {
+		return path
+	}
+	logOncef(levelWarn, "Ignoring pinned agent %q: not an absolute path nor a known -agentAlias", pinned)
+	return ""
+}
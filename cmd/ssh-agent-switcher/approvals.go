@@ -0,0 +1,155 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// approvals tracks which clients the user has allowed to use the agents when running in
+// deny-by-default mode.
+type approvals struct {
+	// duration is how long an approval lasts.
+	duration time.Duration
+
+	// prompt asks the user to approve unknown clients.  If nil, clients can only be approved
+	// via the control socket.
+	prompt *confirmer
+
+	// mu protects approved and pending.
+	mu sync.Mutex
+
+	// approved maps the clients that have been approved to the time their approval expires.
+	approved map[string]time.Time
+
+	// pending records the clients that have been denied and are awaiting approval.
+	pending map[string]bool
+}
+
+// newApprovals creates an empty set of approvals that last for "duration".
+func newApprovals(duration time.Duration, prompt *confirmer) *approvals {
+	return &approvals{
+		duration: duration,
+		prompt:   prompt,
+		approved: make(map[string]time.Time),
+		pending:  make(map[string]bool),
+	}
+}
+
+// approvalKey returns the identifier under which the approval for "client" is recorded.
+// Clients are identified by executable so that approvals survive across invocations.
+func approvalKey(client clientInfo) string {
+	if client.remote != "" {
+		return "tls:" + client.remote
+	}
+	if client.exe != "" {
+		return client.exe
+	}
+	return fmt.Sprintf("pid:%d", client.pid)
+}
+
+// isApproved returns true if "key" has a current approval.
+func (a *approvals) isApproved(key string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	until, ok := a.approved[key]
+	if !ok {
+		return false
+	}
+	if !now.Before(until) {
+		delete(a.approved, key)
+		return false
+	}
+	return true
+}
+
+// authorize returns an error unless "client" has been approved, asking the user to approve it
+// if prompts are enabled.
+func (a *approvals) authorize(client clientInfo) error {
+	if client.pid == 0 && client.remote == "" {
+		return fmt.Errorf("cannot identify client for approval")
+	}
+
+	key := approvalKey(client)
+	if a.isApproved(key, time.Now()) {
+		return nil
+	}
+
+	if a.prompt != nil {
+		ok, err := a.prompt.ask(fmt.Sprintf("Allow %s to use the SSH agent for %v?", client, a.duration))
+		if err != nil {
+			errorf("Cannot ask for approval of %s with %s: %v", client, a.prompt.program, err)
+		} else if ok {
+			a.approve(key)
+			return nil
+		}
+	}
+
+	a.mu.Lock()
+	a.pending[key] = true
+	a.mu.Unlock()
+	return fmt.Errorf("%s has not been approved", client)
+}
+
+// approve allows the client identified by "key" to use the agents.
+func (a *approvals) approve(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	until := time.Now().Add(a.duration)
+	a.approved[key] = until
+	delete(a.pending, key)
+	infof("Approved %s until %s", key, until.Format(time.RFC3339))
+}
+
+// revoke removes the approval of the client identified by "key".  Returns false if there was
+// no such approval.
+func (a *approvals) revoke(key string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.approved[key]; !ok {
+		return false
+	}
+	delete(a.approved, key)
+	infof("Revoked approval of %s", key)
+	return true
+}
+
+// listPending returns the sorted identifiers of the clients awaiting approval.
+func (a *approvals) listPending() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var keys []string
+	for key := range a.pending {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,163 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"log/syslog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Outcomes of the sign requests recorded in the audit log.
+const (
+	auditSigned   = "signed"
+	auditFailed   = "failed"
+	auditRejected = "rejected"
+)
+
+// auditEvent is a single record in the audit log.
+type auditEvent struct {
+	// Time is when the outcome of the request was known.
+	Time time.Time `json:"time"`
+
+	// Key is the fingerprint of the key used in the request.
+	Key string `json:"key"`
+
+	// ClientPid is the process identifier of the client, if known.
+	ClientPid int `json:"clientPid,omitempty"`
+
+	// ClientExe is the executable run by the client, if known.
+	ClientExe string `json:"clientExe,omitempty"`
+
+	// Agent is the path to the socket of the agent that the client was connected to.
+	Agent string `json:"agent"`
+
+	// Host is the name of the host that the client was authenticating to, if known.
+	Host string `json:"host,omitempty"`
+
+	// HostKey is the fingerprint of the host key that the client was authenticating to, if
+	// known.
+	HostKey string `json:"hostKey,omitempty"`
+
+	// Outcome is one of auditSigned, auditFailed, or auditRejected.
+	Outcome string `json:"outcome"`
+
+	// Reason explains why the request was rejected.
+	Reason string `json:"reason,omitempty"`
+}
+
+// auditSink is a destination for audit events.
+type auditSink interface {
+	// record delivers "event" to the sink.  Failures are logged but otherwise ignored because
+	// they must not interrupt the service.
+	record(event auditEvent)
+}
+
+// auditSinks delivers audit events to multiple sinks.
+type auditSinks []auditSink
+
+// record delivers "event" to all sinks.
+func (s auditSinks) record(event auditEvent) {
+	for _, sink := range s {
+		sink.record(event)
+	}
+}
+
+// fileAuditSink records audit events to an append-only file as JSON lines.
+type fileAuditSink struct {
+	// mu serializes writes so that concurrent connections do not interleave their records.
+	mu sync.Mutex
+
+	// file is the open audit file.
+	file *os.File
+
+	// chain links each record to the previous one, or is nil to write plain records.
+	chain *auditChain
+}
+
+// openFileAuditSink opens the audit file at "path" for appending, creating it if necessary.
+// Records are hash-chained if "chain" is not nil.
+func openFileAuditSink(path string, chain *auditChain) (*fileAuditSink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileAuditSink{file: file, chain: chain}, nil
+}
+
+// record appends "event" to the audit file.
+func (s *fileAuditSink) record(event auditEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var line []byte
+	var hash string
+	var err error
+	if s.chain != nil {
+		line, hash, err = s.chain.seal(event)
+	} else {
+		line, err = json.Marshal(event)
+	}
+	if err != nil {
+		errorf("Cannot encode audit event: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	if _, err := s.file.Write(line); err != nil {
+		errorf("Cannot write to audit log %s: %v", s.file.Name(), err)
+		return
+	}
+	if s.chain != nil {
+		s.chain.advance(hash)
+	}
+}
+
+// syslogAuditSink sends audit events to the system logger as JSON messages.
+type syslogAuditSink struct {
+	writer *syslog.Writer
+}
+
+// openSyslogAuditSink connects to the system logger.
+func openSyslogAuditSink() (*syslogAuditSink, error) {
+	writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "ssh-agent-switcher")
+	if err != nil {
+		return nil, err
+	}
+	return &syslogAuditSink{writer: writer}, nil
+}
+
+// record sends "event" to the system logger.
+func (s *syslogAuditSink) record(event auditEvent) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		errorf("Cannot encode audit event: %v", err)
+		return
+	}
+	if err := s.writer.Info(string(line)); err != nil {
+		errorf("Cannot send audit event to syslog: %v", err)
+	}
+}
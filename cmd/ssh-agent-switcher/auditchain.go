@@ -0,0 +1,347 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"time"
+)
+
+// maxAuditLine is the longest record that we accept when reading a chained audit log.
+const maxAuditLine = 64 * 1024
+
+// chainedAuditEntry is the part of a record in a chained audit log that is covered by its hash.
+type chainedAuditEntry struct {
+	auditEvent
+
+	// Seq is the position of the record in the log, starting at 1.
+	Seq uint64 `json:"seq"`
+
+	// Prev is the hash of the previous record, or empty for the first one.
+	Prev string `json:"prev"`
+}
+
+// chainedAuditRecord is a single line in a chained audit log.
+type chainedAuditRecord struct {
+	// Entry is the encoded chainedAuditEntry, kept verbatim so that its hash can be recomputed.
+	Entry json.RawMessage `json:"entry"`
+
+	// Hash is the hex-encoded SHA-256 digest of Entry.
+	Hash string `json:"hash"`
+
+	// Sig is the base64-encoded Ed25519 signature of the digest, if the log is signed.
+	Sig string `json:"sig,omitempty"`
+}
+
+// auditChain tracks the tail of a chained audit log so that new records can link to it.
+type auditChain struct {
+	// seq is the position of the last record in the log.
+	seq uint64
+
+	// prev is the hash of the last record in the log.
+	prev string
+
+	// key signs the records, if not nil.
+	key ed25519.PrivateKey
+}
+
+// loadAuditSigningKey reads the PKCS #8 PEM-encoded Ed25519 private key at "path".
+func loadAuditSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM block", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %v", path, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain an Ed25519 private key", path)
+	}
+	return edKey, nil
+}
+
+// loadAuditPublicKey reads the PKIX PEM-encoded Ed25519 public key at "path".
+func loadAuditPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s does not contain a PEM block", path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %v", path, err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain an Ed25519 public key", path)
+	}
+	return edKey, nil
+}
+
+// lastLine returns the last line of "file" without its terminating newline, or nil if the file
+// is empty.  Reads backwards from the end so that the cost does not grow with the log.
+func lastLine(file *os.File) ([]byte, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+	if size == 0 {
+		return nil, nil
+	}
+
+	n := int64(maxAuditLine + 1)
+	if n > size {
+		n = size
+	}
+	buf := make([]byte, n)
+	if _, err := file.ReadAt(buf, size-n); err != nil && err != io.EOF {
+		return nil, err
+	}
+	if buf[len(buf)-1] != '\n' {
+		return nil, errors.New("last record is incomplete")
+	}
+	buf = buf[:len(buf)-1]
+	start := bytes.LastIndexByte(buf, '\n')
+	if start == -1 && n < size {
+		return nil, errors.New("last record is too long")
+	}
+	return buf[start+1:], nil
+}
+
+// openAuditChain prepares to append chained records to the audit log at "path", continuing
+// from its last record if the log already exists.  Records are signed with the key at "keyPath"
+// if not empty.
+func openAuditChain(path string, keyPath string) (*auditChain, error) {
+	chain := &auditChain{}
+	if keyPath != "" {
+		key, err := loadAuditSigningKey(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		chain.key = key
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return chain, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	line, err := lastLine(file)
+	if err == nil && line != nil {
+		var record chainedAuditRecord
+		var entry chainedAuditEntry
+		if err = json.Unmarshal(line, &record); err == nil {
+			err = json.Unmarshal(record.Entry, &entry)
+		}
+		if err == nil && (entry.Seq == 0 || record.Hash == "") {
+			err = errors.New("last record is not part of a chain")
+		}
+		chain.seq = entry.Seq
+		chain.prev = record.Hash
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot continue the audit chain in %s: %v; verify it with verify-audit and move it aside", path, err)
+	}
+	return chain, nil
+}
+
+// seal wraps "event" into the next record of the chain.  Returns the
+// line to append and the hash to pass to advance once the line has been written.
+func (c *auditChain) seal(event auditEvent) ([]byte, string, error) {
+	entry, err := json.Marshal(chainedAuditEntry{auditEvent: event, Seq: c.seq + 1, Prev: c.prev})
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(entry)
+	record := chainedAuditRecord{Entry: entry, Hash: hex.EncodeToString(sum[:])}
+	if c.key != nil {
+		record.Sig = base64.StdEncoding.EncodeToString(ed25519.Sign(c.key, sum[:]))
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return nil, "", err
+	}
+	return line, record.Hash, nil
+}
+
+// advance records that the record with hash "hash" was appended to the log.
+func (c *auditChain) advance(hash string) {
+	c.seq++
+	c.prev = hash
+}
+
+// head returns the position and the hash of the last record in the chained log of "s".
+func (s *fileAuditSink) head() (uint64, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.chain.seq, s.chain.prev
+}
+
+// anchorAudit reports the head of the chained log of "s" to our log and to the system logger
+// every "interval" if it changed, starting right away.  Someone who can rewrite the log file
+// can recompute all of its hashes, and anyone can drop records from its end, but neither goes
+// unnoticed if the head was recorded elsewhere: verify-audit -expectHead checks that the log
+// still contains it.
+func (s *fileAuditSink) anchorAudit(interval time.Duration) {
+	writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_AUTH, "ssh-agent-switcher")
+	if err != nil {
+		warnf("Cannot send the head of audit log %s to syslog: %v", s.file.Name(), err)
+	}
+
+	var last string
+	for {
+		seq, hash := s.head()
+		if hash != last {
+			message := fmt.Sprintf("Audit log %s head is record %d with hash %s", s.file.Name(), seq, hash)
+			infof("%s", message)
+			if writer != nil {
+				if err := writer.Info(message); err != nil {
+					logOncef(levelWarn, "Cannot send the head of audit log %s to syslog: %v", s.file.Name(), err)
+				}
+			}
+			last = hash
+		}
+		time.Sleep(interval)
+	}
+}
+
+// verifyAuditChain checks that the records read from "r" form an unbroken chain starting at the
+// first record and, if "key" is not nil, that all of them are signed by it.  If "expectHead" is
+// not empty, the chain must also contain a record with that hash, as reported by anchorAudit
+// when the log was written.  Returns the number of records and the hash of the last one.
+func verifyAuditChain(r io.Reader, key ed25519.PublicKey, expectHead string) (uint64, string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxAuditLine)
+
+	var seq uint64
+	prev := ""
+	found := expectHead == ""
+	for lineno := 1; scanner.Scan(); lineno++ {
+		var record chainedAuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return seq, prev, fmt.Errorf("line %d: invalid record: %v", lineno, err)
+		}
+
+		sum := sha256.Sum256(record.Entry)
+		if hex.EncodeToString(sum[:]) != record.Hash {
+			return seq, prev, fmt.Errorf("line %d: hash does not match the entry", lineno)
+		}
+
+		var entry chainedAuditEntry
+		if err := json.Unmarshal(record.Entry, &entry); err != nil {
+			return seq, prev, fmt.Errorf("line %d: invalid entry: %v", lineno, err)
+		}
+		if entry.Seq != seq+1 {
+			return seq, prev, fmt.Errorf("line %d: expected sequence number %d but found %d", lineno, seq+1, entry.Seq)
+		}
+		if entry.Prev != prev {
+			return seq, prev, fmt.Errorf("line %d: entry does not link to the previous one", lineno)
+		}
+
+		if key != nil {
+			sig, err := base64.StdEncoding.DecodeString(record.Sig)
+			if err != nil || !ed25519.Verify(key, sum[:], sig) {
+				return seq, prev, fmt.Errorf("line %d: missing or invalid signature", lineno)
+			}
+		}
+
+		seq = entry.Seq
+		prev = record.Hash
+		if prev == expectHead {
+			found = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return seq, prev, err
+	}
+	if !found {
+		return seq, prev, fmt.Errorf("no record has the expected head hash %s; records were removed or rewritten", expectHead)
+	}
+	return seq, prev, nil
+}
+
+// runVerifyAudit implements the verify-audit subcommand.
+func runVerifyAudit(args []string) error {
+	fs := flag.NewFlagSet("verify-audit", flag.ExitOnError)
+	publicKey := fs.String("publicKey", "", "path to the PEM-encoded Ed25519 public key that must have signed all records")
+	expectHead := fs.String("expectHead", "", "hash of a record that the log must contain, as reported by the daemon while writing it")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: verify-audit [-expectHead HASH] [-publicKey PATH] FILE")
+	}
+
+	var key ed25519.PublicKey
+	if *publicKey != "" {
+		var err error
+		key, err = loadAuditPublicKey(*publicKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	count, last, err := verifyAuditChain(file, key, *expectHead)
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(0), err)
+	}
+	what := "records"
+	if key != nil {
+		what = "signed records"
+	}
+	fmt.Fprintf(os.Stdout, "%s: %d %s verified; last hash %s\n", fs.Arg(0), count, what, last)
+	return nil
+}
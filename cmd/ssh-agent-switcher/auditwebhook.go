@@ -0,0 +1,171 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !nowebhooks && !minimal
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// webhookBatchSize is the maximum number of events sent in a single request.
+	webhookBatchSize = 100
+
+	// webhookFlushInterval is how long events can wait in the queue before being sent.
+	webhookFlushInterval = 5 * time.Second
+
+	// webhookQueueSize is the number of events that can be waiting to be sent.  Events that
+	// arrive while the queue is full are dropped.
+	webhookQueueSize = 1024
+
+	// webhookAttempts is the number of times we try to deliver a batch before dropping it.
+	webhookAttempts = 5
+
+	// webhookInitialBackoff is the delay before the first retry of a failed delivery, which
+	// doubles with every subsequent retry.
+	webhookInitialBackoff = time.Second
+)
+
+// webhookAuditSink posts audit events in batches to an HTTP endpoint as JSON arrays.
+type webhookAuditSink struct {
+	// url is the endpoint that receives the events.
+	url string
+
+	// client is the HTTP client used to deliver the events.
+	client *http.Client
+
+	// events queues the events that have yet to be sent.
+	events chan auditEvent
+}
+
+// checkWebhookURL returns an error if "endpoint" is not an HTTP or HTTPS URL.
+func checkWebhookURL(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return errors.New("scheme must be https or http")
+	}
+	return nil
+}
+
+// newWebhookAuditSink creates a sink that posts events to "endpoint" and starts delivering
+// them in the background.
+func newWebhookAuditSink(endpoint string) (*webhookAuditSink, error) {
+	if err := checkWebhookURL(endpoint); err != nil {
+		return nil, fmt.Errorf("invalid audit webhook %s: %v", endpoint, err)
+	}
+
+	s := &webhookAuditSink{
+		url:    endpoint,
+		client: &http.Client{Timeout: 10 * time.Second},
+		events: make(chan auditEvent, webhookQueueSize),
+	}
+	go s.run()
+	return s, nil
+}
+
+// record queues "event" for delivery.
+func (s *webhookAuditSink) record(event auditEvent) {
+	select {
+	case s.events <- event:
+	default:
+		errorf("Dropping audit event for %s: webhook queue is full", event.Key)
+	}
+}
+
+// run collects queued events into batches and delivers them.  Never returns.
+func (s *webhookAuditSink) run() {
+	ticker := time.NewTicker(webhookFlushInterval)
+	defer ticker.Stop()
+
+	var batch []auditEvent
+	for {
+		select {
+		case event := <-s.events:
+			batch = append(batch, event)
+			if len(batch) < webhookBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		s.deliver(batch)
+		batch = nil
+	}
+}
+
+// deliver posts "batch" to the endpoint, retrying with exponential backoff on failure.
+func (s *webhookAuditSink) deliver(batch []auditEvent) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		errorf("Cannot encode audit events: %v", err)
+		return
+	}
+
+	backoff := webhookInitialBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := s.post(body)
+		if err == nil {
+			return
+		}
+		if !retry || attempt == webhookAttempts {
+			errorf("Dropping %d audit events: %v", len(batch), err)
+			return
+		}
+		warnf("Cannot deliver audit events (attempt %d); retrying in %v: %v", attempt, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post sends "body" to the endpoint once.  The returned boolean indicates whether the failure,
+// if any, is worth retrying.
+func (s *webhookAuditSink) post(body []byte) (bool, error) {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("webhook returned %s", resp.Status)
+	default:
+		return false, fmt.Errorf("webhook returned %s", resp.Status)
+	}
+}
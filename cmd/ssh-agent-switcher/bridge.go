@@ -0,0 +1,128 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// defaultRemoteCommand is the command that the bridge runs on the remote host to reach the
+// agent that it selects.  Its informational messages would be printed for every connection.
+const defaultRemoteCommand = "ssh-agent-switcher -quiet stdio"
+
+// bridgeConnection serves the local "client" by running "remoteCommand" on "host" via the
+// ssh binary at "sshProgram" and connecting the client to its stdin and stdout.
+func bridgeConnection(client net.Conn, sshProgram string, host string, remoteCommand string) {
+	logger := newConnLogger(nextConnectionID.Add(1))
+	defer client.Close()
+
+	peers := clientPolicy{checkUid: *checkPeer}
+	if err := peers.authorize(client); err != nil {
+		logger.infof("Rejecting connection: %v", err)
+		return
+	}
+
+	cmd := exec.Command(sshProgram, "-T", host, remoteCommand)
+	cmd.Stdout = client
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		logger.errorf("Cannot bridge to %s: %v", host, err)
+		return
+	}
+	if err := cmd.Start(); err != nil {
+		logger.errorf("Cannot bridge to %s: %v", host, err)
+		return
+	}
+	logger.infof("Bridging client connection to %s", host)
+
+	go func() {
+		io.Copy(stdin, client)
+		stdin.Close()
+	}()
+	if err := cmd.Wait(); err != nil {
+		logger.warnf("Bridge to %s ended: %v", host, err)
+		return
+	}
+	logger.debugf("Closing client connection")
+}
+
+// runBridge implements the bridge subcommand, which exposes the agent that a remote host
+// can reach (usually one forwarded to it) as a local socket by tunneling every client
+// connection over ssh.
+func runBridge(args []string) error {
+	fs := flag.NewFlagSet("bridge", flag.ExitOnError)
+	socket := fs.String("socket", "", "path to the local socket to create")
+	sshProgram := fs.String("sshProgram", "ssh", "ssh binary to use to connect to the remote host")
+	remoteCommand := fs.String("remoteCommand", defaultRemoteCommand, "command to run on the remote host to connect to its agent")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: bridge -socket PATH [-sshProgram PATH] [-remoteCommand CMD] HOST")
+	}
+	host := fs.Arg(0)
+	if *socket == "" {
+		return errors.New("-socket is required")
+	}
+	if strings.HasPrefix(host, "-") {
+		return fmt.Errorf("invalid host %q", host)
+	}
+	if err := checkPeerSupported(); err != nil {
+		return err
+	}
+
+	listener, err := listenPrivate(*socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(*socket)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		infof("Shutting down bridge")
+		listener.Close()
+	}()
+
+	infof("Bridging %s to the agent of %s", *socket, host)
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go bridgeConnection(client, *sshProgram, host, *remoteCommand)
+	}
+}
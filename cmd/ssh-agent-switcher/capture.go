@@ -0,0 +1,223 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+)
+
+// captureHeader is the first line of every capture file.
+const captureHeader = "# ssh-agent-switcher capture v1"
+
+// Directions of the messages recorded in a capture file.
+const (
+	captureRequest  = '>'
+	captureResponse = '<'
+)
+
+// captureRedactedSize is how many bytes of every message are kept when redacting payloads:
+// enough for the length prefix and the message type.
+const captureRedactedSize = 5
+
+// trafficCapture records the agent protocol messages exchanged with a client to a file.
+//
+// Capture files are line-oriented text files.  Lines starting with # are comments.  Every
+// other line holds one message as "DIRECTION MILLIS HEX [redacted]" where DIRECTION is > for
+// the requests sent by the client and < for the responses sent to the client, MILLIS is the
+// time since the connection was accepted, and HEX is the message as seen on the wire.  When
+// payloads are redacted, HEX only covers the length prefix and the message type.
+//
+// A nil trafficCapture records nothing.
+type trafficCapture struct {
+	// file is the capture file.
+	file *os.File
+
+	// w buffers the writes to file.
+	w *bufio.Writer
+
+	// start is when the connection was accepted.
+	start time.Time
+
+	// redact causes the payloads of the messages to be omitted.
+	redact bool
+
+	// log reports problems with the capture.
+	log *connLogger
+}
+
+// openCapture creates a new capture file in "dir" for the connection "logger" reports on,
+// which was established by "client" at "start" and proxied to the agent at "agentPath".
+func openCapture(dir string, logger *connLogger, start time.Time, client clientInfo, agentPath string, redact bool) (*trafficCapture, error) {
+	name := fmt.Sprintf("%s-conn-%d.capture", start.Format("20060102T150405"), logger.id)
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create capture file: %v", err)
+	}
+
+	c := &trafficCapture{file: file, w: bufio.NewWriter(file), start: start, redact: redact, log: logger}
+	fmt.Fprintln(c.w, captureHeader)
+	fmt.Fprintf(c.w, "# started: %s\n", start.Format(time.RFC3339))
+	fmt.Fprintf(c.w, "# client: %s\n", client)
+	fmt.Fprintf(c.w, "# agent: %s\n", agentPath)
+	if redact {
+		fmt.Fprintln(c.w, "# payloads: redacted")
+	}
+	return c, nil
+}
+
+// record appends the message "msg", which flowed in "direction", to the capture.
+func (c *trafficCapture) record(direction byte, msg []byte) {
+	if c == nil || c.w == nil {
+		return
+	}
+
+	elapsed := time.Since(c.start).Milliseconds()
+	if c.redact && len(msg) > captureRedactedSize {
+		fmt.Fprintf(c.w, "%c %d %s redacted\n", direction, elapsed, hex.EncodeToString(msg[:captureRedactedSize]))
+	} else {
+		fmt.Fprintf(c.w, "%c %d %s\n", direction, elapsed, hex.EncodeToString(msg))
+	}
+
+	// Flush after every message so that the capture is useful even if we crash.
+	if err := c.w.Flush(); err != nil {
+		c.log.errorf("Stopping traffic capture: %v", err)
+		c.w = nil
+	}
+}
+
+// close finishes the capture.
+func (c *trafficCapture) close() {
+	if c == nil {
+		return
+	}
+	if c.w != nil {
+		c.w.Flush()
+	}
+	if err := c.file.Close(); err != nil {
+		c.log.errorf("Cannot close capture file: %v", err)
+	}
+}
+
+// capturedMessage is a message read back from a capture file.
+type capturedMessage struct {
+	// line is the line of the capture file that holds the message.
+	line int
+
+	// direction is either captureRequest or captureResponse.
+	direction byte
+
+	// data is the message as seen on the wire, or only its first captureRedactedSize bytes
+	// if redacted.
+	data []byte
+
+	// redacted is true if the payload of the message was not recorded.
+	redacted bool
+}
+
+// matches returns true if "msg", a complete message as seen on the wire, is the same as the
+// captured one.  Only the recorded prefix is compared for redacted messages.
+func (m capturedMessage) matches(msg []byte) bool {
+	if m.redacted {
+		return bytes.HasPrefix(msg, m.data)
+	}
+	return bytes.Equal(msg, m.data)
+}
+
+// String describes the captured message.
+func (m capturedMessage) String() string {
+	if len(m.data) < 4 {
+		return fmt.Sprintf("truncated message (%d bytes)", len(m.data))
+	}
+	if m.redacted {
+		return fmt.Sprintf("%s (%d bytes, redacted)", codec.MessageName(m.data[4]), binary.BigEndian.Uint32(m.data))
+	}
+	return codec.Describe(m.data[4:])
+}
+
+// readCapture parses the capture file in "r" written by a trafficCapture.
+func readCapture(r io.Reader) ([]capturedMessage, error) {
+	scanner := bufio.NewScanner(r)
+	// Unredacted captures hold whole messages, hex-encoded, on a single line.
+	scanner.Buffer(nil, 2*(int(config.MaxMessageSize)+4)+64)
+
+	var messages []capturedMessage
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+		if line == 1 {
+			if text != captureHeader {
+				return nil, errors.New("not a capture file")
+			}
+			continue
+		}
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) < 3 || len(fields) > 4 || len(fields[0]) != 1 {
+			return nil, fmt.Errorf("line %d: invalid message", line)
+		}
+		m := capturedMessage{line: line, direction: fields[0][0]}
+		if m.direction != captureRequest && m.direction != captureResponse {
+			return nil, fmt.Errorf("line %d: invalid direction %q", line, fields[0])
+		}
+		if _, err := strconv.ParseInt(fields[1], 10, 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid time %q", line, fields[1])
+		}
+		data, err := hex.DecodeString(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid message data: %v", line, err)
+		}
+		m.data = data
+		if len(fields) == 4 {
+			if fields[3] != "redacted" {
+				return nil, fmt.Errorf("line %d: unknown marker %q", line, fields[3])
+			}
+			m.redacted = true
+		}
+		messages = append(messages, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if line == 0 {
+		return nil, errors.New("not a capture file")
+	}
+	return messages, nil
+}
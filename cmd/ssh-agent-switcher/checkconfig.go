@@ -0,0 +1,198 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/jmmv/ssh-agent-switcher/policy"
+)
+
+// accessWriteOK is W_OK from unistd.h, which the syscall package does not define.
+const accessWriteOK = 0x2
+
+// checkCreatable returns an error if the file "path" given to "-flagName" does not exist and
+// cannot be created because its closest existing parent is not a directory that we can
+// write to.
+func checkCreatable(flagName string, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+		return fmt.Errorf("invalid -%s %s: %v", flagName, path, err)
+	}
+
+	dir := filepath.Dir(path)
+	for {
+		fi, err := os.Stat(dir)
+		if err == nil {
+			if !fi.IsDir() {
+				return fmt.Errorf("invalid -%s %s: %s is not a directory", flagName, path, dir)
+			}
+			if err := syscall.Access(dir, accessWriteOK); err != nil {
+				return fmt.Errorf("invalid -%s %s: cannot create files in %s: %v", flagName, path, dir, err)
+			}
+			return nil
+		} else if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+			return fmt.Errorf("invalid -%s %s: %v", flagName, path, err)
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// checkProgram returns an error if the program "path" given to "-flagName" cannot be found or
+// is not executable.
+func checkProgram(flagName string, path string) error {
+	if _, err := exec.LookPath(path); err != nil {
+		return fmt.Errorf("invalid -%s: %v", flagName, err)
+	}
+	return nil
+}
+
+// checkGlobs returns an error for every pattern in "patterns" given to "-flagName" that is
+// malformed.
+func checkGlobs(flagName string, patterns []string) []error {
+	var errs []error
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			errs = append(errs, fmt.Errorf("invalid -%s %q: %v", flagName, pattern, err))
+		}
+	}
+	return errs
+}
+
+// checkFiles checks the files and programs that the flags refer to without modifying them and
+// returns all problems found.
+func checkFiles() []error {
+	var errs []error
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	for _, path := range socketPaths.paths() {
+		add(checkCreatable("socketPath", path))
+	}
+	creatable := []struct {
+		flagName string
+		path     string
+	}{
+		{"restrictedSocketPath", *restrictedSocketPath},
+		{"controlSocket", *controlSocket},
+		{"gpgSocketPath", *gpgSocketPath},
+		{"pinFile", *pinFile},
+		{"auditFile", *auditFile},
+		{"statsFile", *statsFile},
+		{"logFile", *logFilePath},
+		{"environmentFile", *environmentFile},
+		{"captureDir", *captureDir},
+	}
+	for _, file := range creatable {
+		if file.path != "" {
+			add(checkCreatable(file.flagName, file.path))
+		}
+	}
+
+	if *policyFile != "" {
+		_, err := policy.Load(*policyFile)
+		add(err)
+	}
+	if *statsFile != "" {
+		_, err := loadUsageStats(*statsFile)
+		add(err)
+	}
+	if *profilesFile != "" {
+		loaded, err := loadProfiles(*profilesFile)
+		add(err)
+		profiles = loaded
+	}
+	for _, name := range profileNames() {
+		_, err := resolveProfile(name)
+		add(err)
+	}
+	if _, err := resolveProfile(*initialProfile); err != nil {
+		add(fmt.Errorf("invalid -profile: %v", err))
+	}
+	if *tlsAddress != "" {
+		_, err := loadTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		add(err)
+	}
+
+	if *confirmSign || *restrictedConfirmSign || *approvalPrompt {
+		add(checkProgram("confirmProgram", *confirmProgram))
+	}
+	if *eventCommand != "" {
+		add(checkProgram("eventCommand", *eventCommand))
+	}
+	if *discoveryPluginPath != "" {
+		add(checkProgram("discoveryPlugin", *discoveryPluginPath))
+	}
+	if *policyPluginPath != "" {
+		add(checkProgram("policyPlugin", *policyPluginPath))
+	}
+
+	if *auditWebhook != "" {
+		if err := checkWebhookURL(*auditWebhook); err != nil {
+			add(fmt.Errorf("invalid -auditWebhook %s: %v", *auditWebhook, err))
+		}
+	}
+	if *eventWebhook != "" {
+		if err := checkWebhookURL(*eventWebhook); err != nil {
+			add(fmt.Errorf("invalid -eventWebhook %s: %v", *eventWebhook, err))
+		}
+	}
+
+	errs = append(errs, checkGlobs("hideKey", hideKey)...)
+	errs = append(errs, checkGlobs("restrictedHideKey", restrictedHideKey)...)
+	errs = append(errs, checkGlobs("allowClientExe", allowClientExe)...)
+	errs = append(errs, checkGlobs("tlsAllowClient", tlsAllowClient)...)
+	if *gpgAgentsGlob != "" {
+		errs = append(errs, checkGlobs("gpgAgentsGlob", []string{*gpgAgentsGlob})...)
+	}
+	return errs
+}
+
+// runCheckConfig implements the check-config subcommand, which validates the flags and the
+// files they refer to without starting the daemon.
+func runCheckConfig(args []string) error {
+	if len(args) != 0 {
+		return errors.New("check-config takes no arguments")
+	}
+
+	problems := append(validateFlags(), checkFiles()...)
+	for _, problem := range problems {
+		errorf("%v", problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("found %d problems in the configuration", len(problems))
+	}
+	fmt.Fprintln(os.Stdout, "Configuration OK")
+	return nil
+}
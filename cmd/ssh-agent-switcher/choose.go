@@ -0,0 +1,169 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+)
+
+// probeTimeout is the maximum time we wait for an agent to answer a probe.
+const probeTimeout = 2 * time.Second
+
+// candidateInfo holds the details about a candidate agent that we show to the user.
+type candidateInfo struct {
+	path    string
+	session string
+	err     error
+	latency time.Duration
+	keys    []codec.Identity
+}
+
+// sessionPID returns the PID of the session process that owns the agent socket at "path", or
+// an error if its name does not include one.
+//
+// sshd names the socket agent.PID and Teleport names it teleport-PID.socket.  Other servers,
+// like Dropbear, do not include the PID in the name.
+func sessionPID(path string) (int, error) {
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, "teleport-") {
+		return strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, "teleport-"), ".socket"))
+	}
+	return strconv.Atoi(strings.TrimPrefix(filepath.Ext(name), "."))
+}
+
+// sessionInfo returns a description of the SSH session that owns the agent socket at "path",
+// or empty if unknown.
+//
+// The socket is named after the PID of the session process, whose command line in turn
+// describes the session (e.g. "sshd: jmmv@pts/3" or "teleport").
+func sessionInfo(path string) string {
+	pid, err := sessionPID(path)
+	if err != nil {
+		return ""
+	}
+
+	cmdline, err := os.ReadFile(procFile(pid, "cmdline"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(bytes.ReplaceAll(cmdline, []byte{0}, []byte{' '})))
+}
+
+// nottySession returns true if the agent socket at "path" belongs to an SSH session without a
+// terminal.  These are the sessions of tools like VS Code Remote and of "ssh host command".
+//
+// The session process holds the terminals that it allocates open, so we look for them among
+// its file descriptors.  If we cannot inspect those, we fall back to the process title, which
+// sshd sets to "sshd: jmmv@notty" for these sessions.
+func nottySession(path string) bool {
+	pid, err := sessionPID(path)
+	if err != nil {
+		return false
+	}
+	if hasTerminal, err := holdsTerminal(pid); err == nil {
+		return !hasTerminal
+	}
+	return strings.HasSuffix(sessionInfo(path), "@notty")
+}
+
+// holdsTerminal returns true if the process "pid" has a pseudo-terminal open.
+func holdsTerminal(pid int) (bool, error) {
+	fdDir := procFile(pid, "fd")
+	entries, err := os.ReadDir(fdDir)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		target, err := os.Readlink(filepath.Join(fdDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		if target == "/dev/ptmx" || strings.HasPrefix(target, "/dev/pts/") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// probeCandidate connects to the agent at "path" and queries its keys.
+func probeCandidate(path string) candidateInfo {
+	info := candidateInfo{path: path, session: sessionInfo(path)}
+
+	start := time.Now()
+	conn, err := net.DialTimeout("unix", path, probeTimeout)
+	if err != nil {
+		info.err = err
+		return info
+	}
+	defer conn.Close()
+	conn.SetDeadline(start.Add(probeTimeout))
+
+	info.keys, info.err = requestIdentities(conn)
+	info.latency = time.Since(start)
+	return info
+}
+
+// pinAgent pins the agent "target", which is the name of an -agentAlias or the absolute path to
+// a socket, without showing the interactive chooser.
+//
+// Aliases are recorded by name so that the pin follows the agent if its socket changes.
+func pinAgent(pinFile string, target string) error {
+	if !filepath.IsAbs(target) {
+		if _, ok := agentAliases.resolve(target); !ok {
+			return fmt.Errorf("cannot pin %q: not an absolute path nor a known -agentAlias", target)
+		}
+	}
+	if err := writePin(pinFile, target); err != nil {
+		return fmt.Errorf("cannot pin %s: %v", target, err)
+	}
+	fmt.Fprintf(os.Stdout, "Pinned %s\n", target)
+	return nil
+}
+
+// runChooser implements the choose subcommand, which shows an interactive list of candidate
+// agents and lets the user pin one of them.
+func runChooser(args []string) error {
+	fs := flag.NewFlagSet("choose", flag.ExitOnError)
+	fs.Parse(args)
+	switch fs.NArg() {
+	case 0:
+	case 1:
+		return pinAgent(*pinFile, fs.Arg(0))
+	default:
+		return errors.New("usage: choose [NAME|PATH]")
+	}
+
+	return runInteractiveChooser()
+}
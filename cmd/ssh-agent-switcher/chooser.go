@@ -0,0 +1,205 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !notui && !minimal
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// chooser holds the state of the interactive agent chooser.
+type chooser struct {
+	agentsDir string
+	pinFile   string
+	out       io.Writer
+
+	candidates []candidateInfo
+	pinned     string
+	message    string
+}
+
+// pinnedPath returns the socket of the pinned agent, resolving its alias if it was pinned by
+// name.
+func (c *chooser) pinnedPath() string {
+	return resolvePin(c.pinned)
+}
+
+// refresh rescans the agents directory and probes all candidates.
+func (c *chooser) refresh() {
+	c.pinned = readPin(c.pinFile)
+
+	paths, err := findCandidates(c.agentsDir)
+	if err != nil {
+		c.message = fmt.Sprintf("Cannot scan %s: %v", c.agentsDir, err)
+	}
+
+	c.candidates = nil
+	seenPinned := false
+	for _, path := range paths {
+		c.candidates = append(c.candidates, probeCandidate(path))
+		if path == c.pinnedPath() {
+			seenPinned = true
+		}
+	}
+	if pinned := c.pinnedPath(); pinned != "" && !seenPinned {
+		c.candidates = append(c.candidates, probeCandidate(pinned))
+	}
+}
+
+// render draws the list of candidates.
+func (c *chooser) render() {
+	fmt.Fprint(c.out, "\033[H\033[2J")
+	fmt.Fprintf(c.out, "Candidate agents in %s:\r\n\r\n", c.agentsDir)
+
+	if len(c.candidates) == 0 {
+		fmt.Fprintf(c.out, "  (none found)\r\n")
+	}
+	for i, info := range c.candidates {
+		mark := " "
+		if info.path == c.pinnedPath() {
+			mark = "*"
+		}
+		fmt.Fprintf(c.out, "%s [%d] %s\r\n", mark, i+1, agentLabel(info.path))
+		if info.session != "" {
+			fmt.Fprintf(c.out, "      session: %s\r\n", info.session)
+		}
+		if info.err != nil {
+			fmt.Fprintf(c.out, "      health:  dead (%v)\r\n", info.err)
+			continue
+		}
+		fmt.Fprintf(c.out, "      health:  alive (%v), %d keys\r\n", info.latency.Round(10*time.Microsecond), len(info.keys))
+		for _, key := range info.keys {
+			fmt.Fprintf(c.out, "      key:     %s %s %s\r\n", key.KeyType(), key.Fingerprint(), key.Comment)
+		}
+	}
+
+	fmt.Fprintf(c.out, "\r\n")
+	if c.pinned != "" {
+		fmt.Fprintf(c.out, "Pinned: %s\r\n", c.pinned)
+	} else {
+		fmt.Fprintf(c.out, "Pinned: none (automatic selection)\r\n")
+	}
+	if c.message != "" {
+		fmt.Fprintf(c.out, "%s\r\n", c.message)
+		c.message = ""
+	}
+	fmt.Fprintf(c.out, "\r\n[1-9] pin agent, [u] unpin, [r] refresh, [q] quit\r\n")
+}
+
+// handleKey processes a single keystroke and returns false if the chooser should exit.
+func (c *chooser) handleKey(key byte) bool {
+	switch {
+	case key == 'q' || key == 'Q' || key == 3 || key == 4:
+		return false
+
+	case key == 'r' || key == 'R':
+		c.refresh()
+
+	case key == 'u' || key == 'U':
+		if err := writePin(c.pinFile, ""); err != nil {
+			c.message = fmt.Sprintf("Cannot unpin: %v", err)
+		} else {
+			c.pinned = ""
+			c.message = "Agent unpinned"
+		}
+
+	case key >= '1' && key <= '9':
+		i := int(key - '1')
+		if i >= len(c.candidates) {
+			c.message = fmt.Sprintf("No candidate %c", key)
+			break
+		}
+		path := c.candidates[i].path
+		if err := writePin(c.pinFile, path); err != nil {
+			c.message = fmt.Sprintf("Cannot pin %s: %v", path, err)
+		} else {
+			c.pinned = path
+			c.message = fmt.Sprintf("Pinned %s", path)
+		}
+	}
+	return true
+}
+
+// stty runs the stty command against the terminal in stdin and returns its output.
+func stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	output, err := cmd.Output()
+	return strings.TrimSpace(string(output)), err
+}
+
+// runInteractiveChooser shows the list of candidate agents on the terminal and lets the user
+// pin one of them until they quit.
+func runInteractiveChooser() error {
+	// The "Ignoring ..." diagnostics emitted during discovery would trash the screen.
+	silenceLogs()
+
+	c := &chooser{agentsDir: config.AgentsDir, pinFile: *pinFile, out: os.Stdout}
+	c.refresh()
+
+	// Put the terminal in raw mode so that we can react to single keystrokes.  If this fails,
+	// we are probably not attached to a terminal and fall back to reading whole lines.
+	raw := false
+	if saved, err := stty("-g"); err == nil {
+		if _, err := stty("-icanon", "-echo", "min", "1"); err == nil {
+			raw = true
+			defer stty(saved)
+		}
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	for {
+		c.render()
+
+		var key byte
+		if raw {
+			b, err := in.ReadByte()
+			if err != nil {
+				return nil
+			}
+			key = b
+		} else {
+			line, err := in.ReadString('\n')
+			line = strings.TrimSpace(line)
+			if line == "" {
+				if err != nil {
+					return nil
+				}
+				continue
+			}
+			key = line[0]
+		}
+
+		if !c.handleKey(key) {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// churnDetector watches the selected agent and warns when it changes too often, which usually
+// means that two half-dead sessions are fighting over the clients.
+type churnDetector struct {
+	// window is the period over which changes are counted.
+	window time.Duration
+
+	// threshold is the number of changes within window that triggers a warning, or zero to
+	// never warn.
+	threshold int
+
+	// mu protects all the fields below.
+	mu sync.Mutex
+
+	// started is true once the initial selection has been seen, which is not a change.
+	started bool
+
+	// changes holds the times of the changes within the last window.
+	changes []time.Time
+
+	// lastWarning is when we last warned about churn.
+	lastWarning time.Time
+}
+
+// changed records that the selected agent is now "current".  Suitable for use as a
+// selectionTracker watcher.
+func (d *churnDetector) changed(current string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.started {
+		d.started = true
+		return
+	}
+	metricSelectionChanges.inc()
+
+	now := time.Now()
+	cutoff := now.Add(-d.window)
+	i := 0
+	for i < len(d.changes) && d.changes[i].Before(cutoff) {
+		i++
+	}
+	d.changes = append(d.changes[i:], now)
+
+	if d.threshold == 0 || len(d.changes) < d.threshold || now.Sub(d.lastWarning) < d.window {
+		return
+	}
+	d.lastWarning = now
+	if current == "" {
+		current = "no agent"
+	}
+	warnf("Selected agent changed %d times in the last %v and is now %s; some sessions may be half-dead", len(d.changes), d.window, current)
+}
@@ -0,0 +1,244 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jmmv/ssh-agent-switcher/internal/peercred"
+	"github.com/jmmv/ssh-agent-switcher/policy"
+)
+
+// clientPolicy describes which clients are allowed to use the proxy.
+type clientPolicy struct {
+	// checkUid requires clients to run as the same user as us.
+	checkUid bool
+
+	// sharedGroup is the ID of the group whose members are also allowed when checkUid is
+	// set, or empty for none.
+	sharedGroup string
+
+	// allowedExes lists the executables, as exact paths or glob patterns, that clients can
+	// run.  If empty and allowedCgroups is also empty, any executable is allowed.
+	allowedExes []string
+
+	// allowedCgroups lists the cgroups in which clients can live, including any of their
+	// descendants.  If empty and allowedExes is also empty, any cgroup is allowed.
+	allowedCgroups []string
+}
+
+// hasAllowlist returns true if the policy restricts clients by executable or cgroup.
+func (p *clientPolicy) hasAllowlist() bool {
+	return len(p.allowedExes) > 0 || len(p.allowedCgroups) > 0
+}
+
+// inSharedGroup returns true if the user "uid" is a member of sharedGroup.
+func (p *clientPolicy) inSharedGroup(uid int) bool {
+	if p.sharedGroup == "" {
+		return false
+	}
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return false
+	}
+	if u.Gid == p.sharedGroup {
+		return true
+	}
+	groups, err := u.GroupIds()
+	if err != nil {
+		return false
+	}
+	for _, group := range groups {
+		if group == p.sharedGroup {
+			return true
+		}
+	}
+	return false
+}
+
+// procFile returns the path to the file "name" that describes the process "pid" in -procDir.
+func procFile(pid int, name string) string {
+	return filepath.Join(*procDir, strconv.Itoa(pid), name)
+}
+
+// processExe returns the path to the executable run by the process "pid".
+func processExe(pid int) (string, error) {
+	return os.Readlink(procFile(pid, "exe"))
+}
+
+// processCgroups returns the paths of all the cgroups the process "pid" belongs to.
+func processCgroups(pid int) ([]string, error) {
+	f, err := os.Open(procFile(pid, "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Each line has the form "hierarchy-ID:controller-list:cgroup-path".
+	var cgroups []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) == 3 {
+			cgroups = append(cgroups, fields[2])
+		}
+	}
+	return cgroups, scanner.Err()
+}
+
+// cgroupWithin returns true if "cgroup" is "parent" or one of its descendants.
+func cgroupWithin(cgroup string, parent string) bool {
+	parent = strings.TrimSuffix(parent, "/")
+	return cgroup == parent || strings.HasPrefix(cgroup, parent+"/") || parent == ""
+}
+
+// checkAllowlist verifies that the process "pid" matches any of the executables or cgroups
+// allowed by the policy.
+//
+// Note that the process may have exited and its PID may have been reused by the time we get
+// here.  There is nothing we can do about that, but the replacement process would have to
+// match the allowlist as well, which limits the damage.
+func (p *clientPolicy) checkAllowlist(pid int) error {
+	if pid == 0 {
+		return errors.New("cannot determine client pid")
+	}
+
+	var exe string
+	if len(p.allowedExes) > 0 {
+		var err error
+		exe, err = processExe(pid)
+		if err != nil {
+			return fmt.Errorf("cannot determine executable of pid %d: %v", pid, err)
+		}
+		if policy.MatchExe(p.allowedExes, exe) {
+			return nil
+		}
+	}
+
+	if len(p.allowedCgroups) > 0 {
+		cgroups, err := processCgroups(pid)
+		if err != nil {
+			return fmt.Errorf("cannot determine cgroups of pid %d: %v", pid, err)
+		}
+		for _, cgroup := range cgroups {
+			for _, allowed := range p.allowedCgroups {
+				if cgroupWithin(cgroup, allowed) {
+					return nil
+				}
+			}
+		}
+	}
+
+	if exe != "" {
+		return fmt.Errorf("client pid %d running %s is not allowed", pid, exe)
+	}
+	return fmt.Errorf("client pid %d is not allowed", pid)
+}
+
+// authorize checks whether the client connected via "conn" is allowed to use the proxy.
+func (p *clientPolicy) authorize(conn net.Conn) error {
+	// Remote clients were already authorized by their certificates and have no local
+	// credentials to check.  The client of a stdio connection is whoever started us.
+	switch conn.(type) {
+	case *tls.Conn, *stdioConn:
+		return nil
+	}
+
+	if !p.checkUid && !p.hasAllowlist() {
+		return nil
+	}
+
+	creds, err := peercred.Get(conn)
+	if err != nil {
+		return err
+	}
+
+	if p.checkUid && creds.UID != os.Getuid() && !p.inSharedGroup(creds.UID) {
+		return fmt.Errorf("peer uid %d (pid %d) is not current user %d", creds.UID, creds.PID, os.Getuid())
+	}
+
+	if p.hasAllowlist() {
+		return p.checkAllowlist(creds.PID)
+	}
+	return nil
+}
+
+// clientInfo describes the process on the other side of a client connection, as far as we
+// can tell.
+type clientInfo struct {
+	// pid is the process identifier of the client, or 0 if unknown.
+	pid int
+
+	// exe is the path to the executable run by the client, or empty if unknown.
+	exe string
+
+	// remote is the name in the certificate of a client connected over TLS, or empty for
+	// local clients.
+	remote string
+
+	// remoteAddr is the network address of a client connected over TLS.
+	remoteAddr net.Addr
+}
+
+// identifyClient gathers information about the client connected via "conn".
+func identifyClient(conn net.Conn) clientInfo {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		return clientInfo{remote: tlsClientName(tlsConn), remoteAddr: conn.RemoteAddr()}
+	}
+	if _, ok := conn.(*stdioConn); ok {
+		pid := os.Getppid()
+		exe, _ := processExe(pid)
+		return clientInfo{pid: pid, exe: exe}
+	}
+
+	creds, err := peercred.Get(conn)
+	if err != nil {
+		return clientInfo{}
+	}
+	exe, _ := processExe(creds.PID)
+	return clientInfo{pid: creds.PID, exe: exe}
+}
+
+// String returns a human-readable description of the client.
+func (c clientInfo) String() string {
+	switch {
+	case c.remote != "":
+		return fmt.Sprintf("TLS client %s (%v)", c.remote, c.remoteAddr)
+	case c.pid == 0:
+		return "unknown client"
+	case c.exe == "":
+		return fmt.Sprintf("pid %d", c.pid)
+	default:
+		return fmt.Sprintf("%s (pid %d)", c.exe, c.pid)
+	}
+}
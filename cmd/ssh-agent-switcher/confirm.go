@@ -0,0 +1,218 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+)
+
+// confirmer asks the user whether a sign request should be forwarded to the agent.
+type confirmer struct {
+	// program is the path to the askpass or pinentry program used to display the prompts.
+	program string
+
+	// mu serializes the prompts so that concurrent requests do not pile up dialogs.
+	mu sync.Mutex
+}
+
+// defaultConfirmProgram returns the program to use for confirmations when none is configured.
+func defaultConfirmProgram() string {
+	if program := os.Getenv("SSH_ASKPASS"); program != "" {
+		return program
+	}
+	return "ssh-askpass"
+}
+
+// isPinentry returns true if the confirmation program speaks the Assuan protocol of pinentry
+// instead of following the SSH_ASKPASS conventions.
+func (c *confirmer) isPinentry() bool {
+	return strings.HasPrefix(filepath.Base(c.program), "pinentry")
+}
+
+// signRequestPrompt builds the text of the confirmation prompt for the SSH_AGENTC_SIGN_REQUEST
+// message "msg", which includes the length prefix, issued by "client" in the session described
+// by "binding", which may be nil.
+func signRequestPrompt(msg []byte, client clientInfo, binding *sessionBinding) (string, error) {
+	request, err := codec.ParseSignRequest(msg)
+	if err != nil {
+		return "", err
+	}
+	data := request.Data
+
+	key := codec.Identity{Blob: request.KeyBlob}
+	prompt := fmt.Sprintf("Allow %s to use key %s %s", client, key.KeyType(), key.Fingerprint())
+
+	if bytes.HasPrefix(data, []byte("SSHSIG")) {
+		// Signature generated by ssh-keygen -Y sign.
+		r := codec.NewReader(data[6:])
+		if namespace, err := r.ReadString(); err == nil {
+			prompt += fmt.Sprintf(" to sign data in namespace %q", namespace)
+		}
+	} else {
+		// Public key authentication as described in RFC 4252, section 7.
+		r := codec.NewReader(data)
+		_, sessionErr := r.ReadString()
+		msgType, typeErr := r.ReadByte()
+		if sessionErr == nil && typeErr == nil && msgType == 50 {
+			if user, err := r.ReadString(); err == nil {
+				prompt += fmt.Sprintf(" to log in as %q", user)
+			}
+		}
+		if binding != nil {
+			prompt += fmt.Sprintf(" on %s", binding)
+		}
+	}
+
+	return prompt + "?", nil
+}
+
+// confirmSign asks the user whether the SSH_AGENTC_SIGN_REQUEST message "msg", which includes
+// the length prefix, issued by "client" in the session described by "binding", which may be
+// nil, can be forwarded to the agent.
+func (c *confirmer) confirmSign(msg []byte, client clientInfo, binding *sessionBinding) error {
+	prompt, err := signRequestPrompt(msg, client, binding)
+	if err != nil {
+		return fmt.Errorf("cannot parse sign request: %v", err)
+	}
+
+	ok, err := c.ask(prompt)
+	if err != nil {
+		return fmt.Errorf("cannot confirm sign request with %s: %v", c.program, err)
+	}
+	if !ok {
+		return errors.New("sign request not confirmed by the user")
+	}
+	return nil
+}
+
+// ask displays "prompt" and returns whether the user accepted it.
+func (c *confirmer) ask(prompt string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.isPinentry() {
+		return c.askPinentry(prompt)
+	}
+	return c.askAskpass(prompt)
+}
+
+// askAskpass displays "prompt" using an SSH_ASKPASS program and returns whether the user
+// accepted it.
+func (c *confirmer) askAskpass(prompt string) (bool, error) {
+	cmd := exec.Command(c.program, prompt)
+	cmd.Env = append(os.Environ(), "SSH_ASKPASS_PROMPT=confirm")
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// assuanEscape percent-encodes the characters that cannot appear in an Assuan command.
+func assuanEscape(s string) string {
+	return strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A").Replace(s)
+}
+
+// assuanResponse reads lines from "r" until it finds the final response to a command and
+// returns whether it was OK or an error.
+func assuanResponse(r *bufio.Reader) (bool, error) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return false, err
+		}
+		line = strings.TrimRight(line, "\n")
+		if line == "OK" || strings.HasPrefix(line, "OK ") {
+			return true, nil
+		}
+		if strings.HasPrefix(line, "ERR ") {
+			return false, nil
+		}
+	}
+}
+
+// askPinentry displays "prompt" using a pinentry program and returns whether the user
+// accepted it.
+func (c *confirmer) askPinentry(prompt string) (bool, error) {
+	cmd := exec.Command(c.program)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return false, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return false, err
+	}
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+
+	r := bufio.NewReader(stdout)
+	if ok, err := assuanResponse(r); err != nil {
+		return false, err
+	} else if !ok {
+		return false, errors.New("pinentry rejected the connection")
+	}
+
+	commands := []string{
+		"SETTITLE ssh-agent-switcher",
+		"SETDESC " + assuanEscape(prompt),
+	}
+	for _, command := range commands {
+		if _, err := io.WriteString(stdin, command+"\n"); err != nil {
+			return false, err
+		}
+		if ok, err := assuanResponse(r); err != nil {
+			return false, err
+		} else if !ok {
+			return false, fmt.Errorf("pinentry rejected %s", strings.Fields(command)[0])
+		}
+	}
+
+	if _, err := io.WriteString(stdin, "CONFIRM\n"); err != nil {
+		return false, err
+	}
+	ok, err := assuanResponse(r)
+	if err != nil {
+		return false, err
+	}
+	io.WriteString(stdin, "BYE\n")
+	return ok, nil
+}
@@ -0,0 +1,190 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+)
+
+// privateKeyFields describes the layout of the private keys that can be added to an agent, by
+// key type.  Each character represents one field following the key type: 's' for a string or
+// mpint and 'b' for a single byte.  The key comment is not included.
+var privateKeyFields = map[string]string{
+	"ssh-dss":                                     "sssss",
+	"ssh-rsa":                                     "ssssss",
+	"ssh-ed25519":                                 "ss",
+	"ecdsa-sha2-nistp256":                         "sss",
+	"ecdsa-sha2-nistp384":                         "sss",
+	"ecdsa-sha2-nistp521":                         "sss",
+	"sk-ecdsa-sha2-nistp256@openssh.com":          "sssbss",
+	"sk-ssh-ed25519@openssh.com":                  "ssbss",
+	"ssh-dss-cert-v01@openssh.com":                "ss",
+	"ssh-rsa-cert-v01@openssh.com":                "sssss",
+	"ssh-ed25519-cert-v01@openssh.com":            "sss",
+	"ecdsa-sha2-nistp256-cert-v01@openssh.com":    "ss",
+	"ecdsa-sha2-nistp384-cert-v01@openssh.com":    "ss",
+	"ecdsa-sha2-nistp521-cert-v01@openssh.com":    "ss",
+	"sk-ecdsa-sha2-nistp256-cert-v01@openssh.com": "ssbss",
+	"sk-ssh-ed25519-cert-v01@openssh.com":         "sssbss",
+}
+
+// keyConstraints holds the constraints to add to the keys that clients add via the proxy.
+type keyConstraints struct {
+	// lifetime is the default lifetime of the keys in seconds, or zero for no default.
+	lifetime uint32
+
+	// confirm requires the agent to confirm every use of the keys.
+	confirm bool
+}
+
+// isEmpty returns true if there are no constraints to add.
+func (c *keyConstraints) isEmpty() bool {
+	return c.lifetime == 0 && !c.confirm
+}
+
+// skipFields advances "r" past the fields described by "layout", which follows the format of
+// privateKeyFields.
+func skipFields(r *codec.Reader, layout string) error {
+	for _, field := range layout {
+		switch field {
+		case 's':
+			if _, err := r.ReadString(); err != nil {
+				return err
+			}
+		case 'b':
+			if _, err := r.ReadByte(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// existingConstraints parses the constraints at the end of an add request and returns whether
+// they already set a lifetime and a confirmation requirement.
+func existingConstraints(r *codec.Reader) (bool, bool, error) {
+	var lifetime, confirm bool
+	for r.Len() > 0 {
+		constraint, _ := r.ReadByte()
+		switch constraint {
+		case codec.ConstrainLifetime:
+			if _, err := r.ReadUint32(); err != nil {
+				return false, false, err
+			}
+			lifetime = true
+		case codec.ConstrainConfirm:
+			confirm = true
+		case codec.ConstrainMaxsign:
+			if _, err := r.ReadUint32(); err != nil {
+				return false, false, err
+			}
+		case codec.ConstrainExtension:
+			name, err := r.ReadString()
+			if err != nil {
+				return false, false, err
+			}
+			if _, err := skipConstraintExtension(r, string(name)); err != nil {
+				return false, false, err
+			}
+		default:
+			return false, false, fmt.Errorf("unsupported key constraint %d", constraint)
+		}
+	}
+	return lifetime, confirm, nil
+}
+
+// isAddRequest returns true if "msgType" is one of the requests that add keys to the agent.
+func isAddRequest(msgType byte) bool {
+	switch msgType {
+	case codec.AgentcAddIdentity, codec.AgentcAddIDConstrained, codec.AgentcAddSmartcardKey, codec.AgentcAddSmartcardKeyConstrained:
+		return true
+	}
+	return false
+}
+
+// rewriteAddRequest converts the add request "msg", which includes the length prefix, into its
+// constrained variant with the constraints that it does not set yet.  Other messages are
+// returned unmodified.
+func (c *keyConstraints) rewriteAddRequest(msg []byte) ([]byte, error) {
+	if c.isEmpty() || len(msg) < 5 {
+		return msg, nil
+	}
+
+	msgType := msg[4]
+	if !isAddRequest(msgType) {
+		return msg, nil
+	}
+	if binary.BigEndian.Uint32(msg) != uint32(len(msg)-4) {
+		return nil, errors.New("incomplete add request")
+	}
+
+	var newType byte
+	var layout string
+	switch msgType {
+	case codec.AgentcAddIdentity, codec.AgentcAddIDConstrained:
+		newType = codec.AgentcAddIDConstrained
+		r := codec.NewReader(msg[5:])
+		keyType, err := r.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		fields, ok := privateKeyFields[string(keyType)]
+		if !ok {
+			return nil, fmt.Errorf("cannot add constraints to key of type %s", keyType)
+		}
+		layout = "s" + fields + "s" // Key type, private key, and comment.
+	case codec.AgentcAddSmartcardKey, codec.AgentcAddSmartcardKeyConstrained:
+		newType = codec.AgentcAddSmartcardKeyConstrained
+		layout = "ss" // Reader ID and PIN.
+	}
+
+	r := codec.NewReader(msg[5:])
+	if err := skipFields(r, layout); err != nil {
+		return nil, fmt.Errorf("invalid add request: %v", err)
+	}
+	if msgType == codec.AgentcAddIdentity || msgType == codec.AgentcAddSmartcardKey {
+		if r.Len() > 0 {
+			return nil, errors.New("invalid add request: trailing data")
+		}
+	}
+	hasLifetime, hasConfirm, err := existingConstraints(r)
+	if err != nil {
+		return nil, err
+	}
+
+	body := append([]byte{newType}, msg[5:]...)
+	if c.lifetime > 0 && !hasLifetime {
+		body = append(body, codec.ConstrainLifetime)
+		body = binary.BigEndian.AppendUint32(body, c.lifetime)
+	}
+	if c.confirm && !hasConfirm {
+		body = append(body, codec.ConstrainConfirm)
+	}
+
+	return codec.Frame(body), nil
+}
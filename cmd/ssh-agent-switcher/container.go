@@ -0,0 +1,297 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultContainerSocket is the path inside the container at which the agent is published.
+const defaultContainerSocket = "/run/ssh-agent.sock"
+
+// detectContainerRuntime returns the first container runtime found in the path.
+func detectContainerRuntime() (string, error) {
+	for _, runtime := range []string{"docker", "podman"} {
+		if _, err := exec.LookPath(runtime); err == nil {
+			return runtime, nil
+		}
+	}
+	return "", errors.New("cannot find docker nor podman; use -runtime")
+}
+
+// selinuxEnabled returns true if the host enforces SELinux labels, in which case containers
+// can only use bind-mounted files that have been relabeled for them.
+func selinuxEnabled() bool {
+	_, err := os.Stat("/sys/fs/selinux/enforce")
+	return err == nil
+}
+
+// shellQuote quotes "arg" so that a POSIX shell interprets it as a single word.
+func shellQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\n\"'\\$;&|<>()*?[]#~`!{}") {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// daemonSocket returns the absolute path to the socket of the running daemon.
+func daemonSocket() (string, error) {
+	socket, err := filepath.Abs(*socketPath)
+	if err != nil {
+		return "", err
+	}
+	if fi, err := os.Stat(socket); err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return "", fmt.Errorf("no ssh-agent-switcher socket at %s; is the daemon running?", socket)
+	}
+	return socket, nil
+}
+
+// containerRunOptions returns the options to pass to the "run" command of "runtime" so that
+// the container "name" can use the agent via a bind mount of "socket" at "target".
+func containerRunOptions(runtime string, name string, socket string, target string) []string {
+	mount := socket + ":" + target
+	if selinuxEnabled() {
+		mount += ":z"
+	}
+	options := []string{"--name", name, "-v", mount, "-e", "SSH_AUTH_SOCK=" + target}
+
+	// Our socket is only accessible by the current user and we reject clients that run as
+	// somebody else by default, so processes in the container must map to us.
+	if uid := os.Getuid(); uid != 0 {
+		if strings.HasSuffix(runtime, "podman") {
+			options = append(options, "--userns=keep-id")
+		} else {
+			options = append(options, "--user", fmt.Sprintf("%d:%d", uid, os.Getgid()))
+		}
+	}
+	return options
+}
+
+// relayToContainer waits for a client to connect to "target" inside the running container
+// "name" and relays its connection to the daemon listening on "socket".
+//
+// Returns whether a client connected at all, which is what tells a failure to set up the
+// listener inside the container apart from a failure to serve a single client.
+func relayToContainer(runtime string, name string, target string, socket string) (bool, error) {
+	cmd := exec.Command(runtime, "exec", "-i", name, "socat", "UNIX-LISTEN:"+target+",unlink-early", "STDIO")
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return false, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return false, err
+	}
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+
+	// Only connect to the daemon once the client sends its first request so that we don't
+	// make the daemon select an agent for a connection that may never come.
+	first := make([]byte, 1)
+	n, err := stdout.Read(first)
+	if n == 0 {
+		stdin.Close()
+		if err := cmd.Wait(); err != nil {
+			return false, err
+		}
+		return false, fmt.Errorf("listener exited without a client: %v", err)
+	}
+
+	daemon, err := net.Dial("unix", socket)
+	if err != nil {
+		stdin.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return true, err
+	}
+	defer daemon.Close()
+
+	go func() {
+		if _, err := daemon.Write(first[:n]); err == nil {
+			io.Copy(daemon, stdout)
+		}
+		daemon.(*net.UnixConn).CloseWrite()
+	}()
+	io.Copy(stdin, daemon)
+	stdin.Close()
+	return true, cmd.Wait()
+}
+
+// containerPID returns the PID of the main process of the running container "name", which can
+// also be given as a PID directly.
+func containerPID(runtime string, name string) (int, error) {
+	if pid, err := strconv.Atoi(name); err == nil && pid > 0 {
+		return pid, nil
+	}
+	output, err := exec.Command(runtime, "inspect", "--format", "{{.State.Pid}}", name).Output()
+	if err != nil {
+		return 0, fmt.Errorf("cannot find the process of container %s: %v", name, err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(output)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("container %s is not running", name)
+	}
+	return pid, nil
+}
+
+// relayClient forwards the connection of "client" to the daemon listening on "socket".
+func relayClient(client net.Conn, socket string) {
+	defer client.Close()
+	daemon, err := net.Dial("unix", socket)
+	if err != nil {
+		warnf("Cannot relay client to %s: %v", socket, err)
+		return
+	}
+	defer daemon.Close()
+
+	go func() {
+		io.Copy(daemon, client)
+		daemon.(*net.UnixConn).CloseWrite()
+	}()
+	io.Copy(client, daemon)
+}
+
+// serveInContainer creates the socket "target" inside the file system of the container whose
+// main process is "pid" and relays all clients that connect to it to the daemon listening on
+// "socket" until the container exits.
+//
+// A multithreaded Go program cannot join the user and mount namespaces of the container with
+// setns, but resolving "target" through /proc/PID/root walks the container's mount namespace
+// all the same, and the socket created there is reachable by the processes inside.  This works
+// for rootless containers whose file systems are out of reach of bind mounts.
+func serveInContainer(pid int, target string, socket string) error {
+	root := filepath.Join("/proc", strconv.Itoa(pid), "root")
+	path := filepath.Join(root, target)
+	if err := reclaimSocket(path); err != nil {
+		return err
+	}
+	listener, err := listenPrivate(path)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		listener.Close()
+	}()
+	go func() {
+		// The root of a process that exited is gone even if nobody reaped it yet.
+		for {
+			if _, err := os.Stat(root); err != nil {
+				break
+			}
+			time.Sleep(time.Second)
+		}
+		infof("Container process %d is gone", pid)
+		listener.Close()
+	}()
+
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go relayClient(client, socket)
+	}
+}
+
+// runContainer implements the container subcommand, which makes the daemon's socket usable
+// from a container.
+func runContainer(args []string) error {
+	fs := flag.NewFlagSet("container", flag.ExitOnError)
+	runtime := fs.String("runtime", "", "container runtime to use; docker or podman if empty")
+	target := fs.String("target", defaultContainerSocket, "path of the agent socket inside the container")
+	useExec := fs.Bool("exec", false, "relay clients into a running container via exec instead of printing bind mount options")
+	join := fs.Bool("join", false, "create the socket inside the file system of a running container, given by name or PID, and relay its clients")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: container [-runtime PATH] [-target PATH] [-exec | -join] NAME")
+	}
+	name := fs.Arg(0)
+	if *useExec && *join {
+		return errors.New("-exec and -join are mutually exclusive")
+	}
+
+	if *runtime == "" {
+		detected, err := detectContainerRuntime()
+		if err != nil {
+			return err
+		}
+		*runtime = detected
+	}
+
+	socket, err := daemonSocket()
+	if err != nil {
+		return err
+	}
+
+	if *join {
+		pid, err := containerPID(*runtime, name)
+		if err != nil {
+			return err
+		}
+		infof("Relaying clients of %s in container %s to %s; set SSH_AUTH_SOCK=%s in the container", *target, name, socket, *target)
+		return serveInContainer(pid, *target, socket)
+	}
+
+	if !*useExec {
+		var quoted []string
+		for _, option := range containerRunOptions(*runtime, name, socket, *target) {
+			quoted = append(quoted, shellQuote(option))
+		}
+		fmt.Fprintln(os.Stdout, strings.Join(quoted, " "))
+		return nil
+	}
+
+	infof("Relaying clients of %s in container %s to %s; set SSH_AUTH_SOCK=%s in the container", *target, name, socket, *target)
+	for {
+		connected, err := relayToContainer(*runtime, name, *target, socket)
+		if !connected {
+			return fmt.Errorf("cannot listen on %s in container %s: %v", *target, name, err)
+		}
+		if err != nil {
+			warnf("Client in container %s disconnected: %v", name, err)
+		}
+	}
+}
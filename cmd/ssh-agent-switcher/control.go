@@ -0,0 +1,266 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// controlTimeout is how long a control client has to send its command before we give up.
+const controlTimeout = 10 * time.Second
+
+// controlCommand implements a command accepted by the control socket.  Returns the text to
+// send back to the client on success.
+type controlCommand func(args []string) (string, error)
+
+// controlCommands maps the names of the control commands to their implementations.
+var controlCommands = map[string]controlCommand{
+	"approve":         approveCommand,
+	"connections":     connectionsCommand,
+	"history":         historyCommand,
+	"keys":            keysCommand,
+	"lock":            lockCommand,
+	"override-access": overrideAccessCommand,
+	"pending":         pendingCommand,
+	"profile":         profileCommand,
+	"revoke":          revokeCommand,
+	"stats":           statsCommand,
+	"unlock":          unlockCommand,
+}
+
+// approvalsEnabled returns an error if the daemon is not running in deny-by-default mode.
+func approvalsEnabled() error {
+	if clientApprovals == nil {
+		return errors.New("approvals are not enabled; see -requireApproval")
+	}
+	return nil
+}
+
+// approveCommand implements the "approve CLIENT" control command.
+func approveCommand(args []string) (string, error) {
+	if err := approvalsEnabled(); err != nil {
+		return "", err
+	}
+	if len(args) == 0 {
+		return "", errors.New("usage: approve CLIENT")
+	}
+	// Executable paths may contain spaces, which the protocol does not preserve.
+	key := strings.Join(args, " ")
+	clientApprovals.approve(key)
+	return "approved " + key, nil
+}
+
+// revokeCommand implements the "revoke CLIENT" control command.
+func revokeCommand(args []string) (string, error) {
+	if err := approvalsEnabled(); err != nil {
+		return "", err
+	}
+	if len(args) == 0 {
+		return "", errors.New("usage: revoke CLIENT")
+	}
+	key := strings.Join(args, " ")
+	if !clientApprovals.revoke(key) {
+		return "", fmt.Errorf("%s is not approved", key)
+	}
+	return "revoked " + key, nil
+}
+
+// pendingCommand implements the "pending" control command.
+func pendingCommand(args []string) (string, error) {
+	if err := approvalsEnabled(); err != nil {
+		return "", err
+	}
+	if len(args) != 0 {
+		return "", errors.New("usage: pending")
+	}
+	pending := clientApprovals.listPending()
+	if len(pending) == 0 {
+		return "no clients awaiting approval", nil
+	}
+	return "awaiting approval: " + strings.Join(pending, ", "), nil
+}
+
+// historyCommand implements the "history" control command.
+func historyCommand(args []string) (string, error) {
+	if decisions == nil {
+		return "", errors.New("the selection history is disabled; see -selectionHistory")
+	}
+	if len(args) != 0 {
+		return "", errors.New("usage: history")
+	}
+	entries := decisions.List()
+	if len(entries) == 0 {
+		return "no agent selections yet", nil
+	}
+	lines := make([]string, len(entries))
+	for i, entry := range entries {
+		lines[i] = entry.String()
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// lockCommand implements the "lock" control command.
+func lockCommand(args []string) (string, error) {
+	if len(args) != 0 {
+		return "", errors.New("usage: lock")
+	}
+	emergencyLock.engaged.Store(true)
+	warnf("All agent access locked via the control socket")
+	return "all agent access locked", nil
+}
+
+// unlockCommand implements the "unlock" control command.
+func unlockCommand(args []string) (string, error) {
+	if len(args) != 0 {
+		return "", errors.New("usage: unlock")
+	}
+	emergencyLock.engaged.Store(false)
+	infof("Agent access unlocked via the control socket")
+	return "agent access unlocked", nil
+}
+
+// overrideAccessCommand implements the "override-access DURATION" control command.
+func overrideAccessCommand(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("usage: override-access DURATION")
+	}
+	duration, err := time.ParseDuration(args[0])
+	if err != nil || duration < 0 {
+		return "", fmt.Errorf("invalid duration %q", args[0])
+	}
+
+	schedule.override(duration)
+	if duration == 0 {
+		infof("Access window override cancelled")
+		return "override cancelled", nil
+	}
+	until := time.Now().Add(duration).Format(time.RFC3339)
+	infof("Access windows overridden until %s", until)
+	return "access allowed until " + until, nil
+}
+
+// runControlCommand executes the control command given in "fields".
+func runControlCommand(fields []string) (string, error) {
+	if len(fields) == 0 {
+		return "", errors.New("empty command")
+	}
+	command, ok := controlCommands[fields[0]]
+	if !ok {
+		var names []string
+		for name := range controlCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("unknown command %q; valid commands are: %s", fields[0], strings.Join(names, ", "))
+	}
+	return command(fields[1:])
+}
+
+// handleControlConnection reads a single command from the control client "conn", executes it,
+// and sends back the result.
+func handleControlConnection(conn net.Conn) {
+	defer conn.Close()
+
+	// The control socket grants more power than the agent socket so we always require
+	// clients to run as the same user, regardless of -checkPeer.
+	policy := clientPolicy{checkUid: true}
+	if err := policy.authorize(conn); err != nil {
+		infof("Rejecting control connection: %v", err)
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		errorf("Dropping control connection: %v", err)
+		return
+	}
+
+	reply, err := runControlCommand(strings.Fields(line))
+	if err != nil {
+		fmt.Fprintf(conn, "ERROR %v\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "OK %s\n", reply)
+}
+
+// serveControl accepts connections on the control socket "socket" until it fails.
+func serveControl(socket net.Listener) {
+	for {
+		// Not subject to clientSlots so that the daemon can be inspected when it is saturated.
+		conn, err := acceptClient(socket)
+		if err != nil {
+			errorf("Control socket failed: %v", err)
+			return
+		}
+		go handleControlConnection(conn)
+	}
+}
+
+// runControl implements the control subcommand, which sends the command given in "args" to a
+// running daemon via its control socket.
+func runControl(args []string) error {
+	if *controlSocket == "" {
+		return errors.New("-controlSocket must be set to the control socket of the daemon")
+	}
+	if len(args) == 0 {
+		return errors.New("usage: control COMMAND [ARGS...]")
+	}
+
+	conn, err := net.Dial("unix", *controlSocket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := fmt.Fprintf(conn, "%s\n", strings.Join(args, " ")); err != nil {
+		return err
+	}
+	// Replies may span multiple lines and the daemon closes the connection after sending one.
+	data, err := io.ReadAll(conn)
+	if err != nil {
+		return fmt.Errorf("no reply from daemon: %v", err)
+	}
+	if len(data) == 0 {
+		return errors.New("no reply from daemon: connection closed")
+	}
+	reply := strings.TrimSuffix(string(data), "\n")
+
+	if text, ok := strings.CutPrefix(reply, "OK "); ok {
+		fmt.Fprintln(os.Stdout, text)
+		return nil
+	}
+	if text, ok := strings.CutPrefix(reply, "ERROR "); ok {
+		return errors.New(text)
+	}
+	return fmt.Errorf("invalid reply from daemon: %s", reply)
+}
@@ -0,0 +1,590 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !nodbus && !minimal
+
+package main
+
+// This file implements the bare minimum of the D-Bus wire protocol needed to register a service
+// on the session bus, answer simple method calls, and emit signals.  We do this by hand instead
+// of pulling in a D-Bus library to keep ssh-agent-switcher free of dependencies.
+//
+// See https://dbus.freedesktop.org/doc/dbus-specification.html for details on the format.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Types of D-Bus messages.
+const (
+	dbusMethodCall   = 1
+	dbusMethodReturn = 2
+	dbusError        = 3
+	dbusSignal       = 4
+)
+
+// Flags that can be set on D-Bus messages.
+const (
+	dbusFlagNoReplyExpected = 0x1
+)
+
+// Codes for the fields that can appear in a D-Bus message header.
+const (
+	dbusFieldPath        = 1
+	dbusFieldInterface   = 2
+	dbusFieldMember      = 3
+	dbusFieldErrorName   = 4
+	dbusFieldReplySerial = 5
+	dbusFieldDestination = 6
+	dbusFieldSender      = 7
+	dbusFieldSignature   = 8
+)
+
+// maxDBusMessageSize is the maximum size of a D-Bus message as defined by the specification.
+const maxDBusMessageSize = 128 * 1024 * 1024
+
+// dbusMessage represents a single D-Bus message.
+//
+// Only the header fields that we care about are represented.  The body is kept in its raw
+// encoded form and must be decoded by the caller according to the signature.
+type dbusMessage struct {
+	order       binary.ByteOrder
+	msgType     byte
+	flags       byte
+	serial      uint32
+	path        string
+	iface       string
+	member      string
+	errorName   string
+	replySerial uint32
+	destination string
+	sender      string
+	signature   string
+	body        []byte
+}
+
+// dbusEncoder serializes values in the D-Bus wire format.
+//
+// Alignment is computed relative to the beginning of the buffer, so the encoder must be used
+// to encode either a whole message header or a whole message body.
+type dbusEncoder struct {
+	buf []byte
+}
+
+// align pads the buffer with zeros until its length is a multiple of "n".
+func (e *dbusEncoder) align(n int) {
+	for len(e.buf)%n != 0 {
+		e.buf = append(e.buf, 0)
+	}
+}
+
+// putByte appends a BYTE.
+func (e *dbusEncoder) putByte(b byte) {
+	e.buf = append(e.buf, b)
+}
+
+// putUint32 appends a UINT32.
+func (e *dbusEncoder) putUint32(v uint32) {
+	e.align(4)
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+// putUint64 appends a UINT64.
+func (e *dbusEncoder) putUint64(v uint64) {
+	e.align(8)
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, v)
+}
+
+// putString appends a STRING or an OBJECT_PATH.
+func (e *dbusEncoder) putString(s string) {
+	e.putUint32(uint32(len(s)))
+	e.buf = append(e.buf, s...)
+	e.buf = append(e.buf, 0)
+}
+
+// putSignature appends a SIGNATURE.
+func (e *dbusEncoder) putSignature(s string) {
+	e.putByte(byte(len(s)))
+	e.buf = append(e.buf, s...)
+	e.buf = append(e.buf, 0)
+}
+
+// putStringArray appends an ARRAY of STRINGs.
+func (e *dbusEncoder) putStringArray(ss []string) {
+	e.putArray(4, func() {
+		for _, s := range ss {
+			e.putString(s)
+		}
+	})
+}
+
+// putArray appends an ARRAY whose elements, aligned to "alignment" bytes, are appended by
+// "putElements".
+func (e *dbusEncoder) putArray(alignment int, putElements func()) {
+	e.putUint32(0)
+	lengthPos := len(e.buf) - 4
+	e.align(alignment)
+	start := len(e.buf)
+	putElements()
+	binary.LittleEndian.PutUint32(e.buf[lengthPos:], uint32(len(e.buf)-start))
+}
+
+// putHeaderField appends a header field entry with a value of a basic type.
+func (e *dbusEncoder) putHeaderField(code byte, signature string, value any) {
+	e.align(8)
+	e.putByte(code)
+	e.putSignature(signature)
+	switch v := value.(type) {
+	case string:
+		if signature == "g" {
+			e.putSignature(v)
+		} else {
+			e.putString(v)
+		}
+	case uint32:
+		e.putUint32(v)
+	default:
+		panic(fmt.Sprintf("unsupported header field type %T", value))
+	}
+}
+
+// dbusDecoder deserializes values in the D-Bus wire format.
+type dbusDecoder struct {
+	buf   []byte
+	pos   int
+	order binary.ByteOrder
+}
+
+// errDBusTruncated indicates that a message is shorter than what its contents claim.
+var errDBusTruncated = errors.New("truncated D-Bus message")
+
+// align skips padding until the current position is a multiple of "n".
+func (d *dbusDecoder) align(n int) {
+	d.pos = (d.pos + n - 1) / n * n
+}
+
+// getByte reads a BYTE.
+func (d *dbusDecoder) getByte() (byte, error) {
+	if d.pos+1 > len(d.buf) {
+		return 0, errDBusTruncated
+	}
+	b := d.buf[d.pos]
+	d.pos++
+	return b, nil
+}
+
+// getUint32 reads a UINT32.
+func (d *dbusDecoder) getUint32() (uint32, error) {
+	d.align(4)
+	if d.pos+4 > len(d.buf) {
+		return 0, errDBusTruncated
+	}
+	v := d.order.Uint32(d.buf[d.pos:])
+	d.pos += 4
+	return v, nil
+}
+
+// getString reads a STRING or an OBJECT_PATH.
+func (d *dbusDecoder) getString() (string, error) {
+	n, err := d.getUint32()
+	if err != nil {
+		return "", err
+	}
+	if uint64(d.pos)+uint64(n)+1 > uint64(len(d.buf)) {
+		return "", errDBusTruncated
+	}
+	s := string(d.buf[d.pos : d.pos+int(n)])
+	d.pos += int(n) + 1
+	return s, nil
+}
+
+// getSignature reads a SIGNATURE.
+func (d *dbusDecoder) getSignature() (string, error) {
+	n, err := d.getByte()
+	if err != nil {
+		return "", err
+	}
+	if d.pos+int(n)+1 > len(d.buf) {
+		return "", errDBusTruncated
+	}
+	s := string(d.buf[d.pos : d.pos+int(n)])
+	d.pos += int(n) + 1
+	return s, nil
+}
+
+// getBasic reads a value of the basic type identified by "signature".
+func (d *dbusDecoder) getBasic(signature string) (any, error) {
+	switch signature {
+	case "s", "o":
+		return d.getString()
+	case "g":
+		return d.getSignature()
+	case "u":
+		return d.getUint32()
+	case "b":
+		v, err := d.getUint32()
+		return v != 0, err
+	case "y":
+		return d.getByte()
+	default:
+		return nil, fmt.Errorf("unsupported D-Bus type %q", signature)
+	}
+}
+
+// getVariant reads a VARIANT that holds a value of a basic type.
+func (d *dbusDecoder) getVariant() (any, error) {
+	signature, err := d.getSignature()
+	if err != nil {
+		return nil, err
+	}
+	return d.getBasic(signature)
+}
+
+// encode serializes the message with the given serial number.
+func (m *dbusMessage) encode(serial uint32) []byte {
+	var h dbusEncoder
+	h.putByte('l')
+	h.putByte(m.msgType)
+	h.putByte(m.flags)
+	h.putByte(1)
+	h.putUint32(uint32(len(m.body)))
+	h.putUint32(serial)
+
+	h.putUint32(0)
+	fieldsLengthPos := len(h.buf) - 4
+	fieldsStart := len(h.buf)
+	if m.path != "" {
+		h.putHeaderField(dbusFieldPath, "o", m.path)
+	}
+	if m.iface != "" {
+		h.putHeaderField(dbusFieldInterface, "s", m.iface)
+	}
+	if m.member != "" {
+		h.putHeaderField(dbusFieldMember, "s", m.member)
+	}
+	if m.errorName != "" {
+		h.putHeaderField(dbusFieldErrorName, "s", m.errorName)
+	}
+	if m.replySerial != 0 {
+		h.putHeaderField(dbusFieldReplySerial, "u", m.replySerial)
+	}
+	if m.destination != "" {
+		h.putHeaderField(dbusFieldDestination, "s", m.destination)
+	}
+	if m.signature != "" {
+		h.putHeaderField(dbusFieldSignature, "g", m.signature)
+	}
+	binary.LittleEndian.PutUint32(h.buf[fieldsLengthPos:], uint32(len(h.buf)-fieldsStart))
+	h.align(8)
+
+	return append(h.buf, m.body...)
+}
+
+// readDBusMessage reads and parses a single message from "r".
+func readDBusMessage(r io.Reader) (*dbusMessage, error) {
+	fixed := make([]byte, 16)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	var order binary.ByteOrder
+	switch fixed[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("invalid D-Bus endianness marker %q", fixed[0])
+	}
+
+	bodyLength := order.Uint32(fixed[4:])
+	fieldsLength := order.Uint32(fixed[12:])
+	headerLength := (16 + uint64(fieldsLength) + 7) / 8 * 8
+	if headerLength+uint64(bodyLength) > maxDBusMessageSize {
+		return nil, fmt.Errorf("D-Bus message too large")
+	}
+
+	buf := make([]byte, headerLength+uint64(bodyLength))
+	copy(buf, fixed)
+	if _, err := io.ReadFull(r, buf[16:]); err != nil {
+		return nil, err
+	}
+
+	m := &dbusMessage{
+		order:   order,
+		msgType: fixed[1],
+		flags:   fixed[2],
+		serial:  order.Uint32(fixed[8:]),
+		body:    buf[headerLength:],
+	}
+
+	d := dbusDecoder{buf: buf[:16+fieldsLength], pos: 16, order: order}
+	for d.pos < len(d.buf) {
+		d.align(8)
+		code, err := d.getByte()
+		if err != nil {
+			return nil, err
+		}
+		signature, err := d.getSignature()
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.getBasic(signature)
+		if err != nil {
+			return nil, err
+		}
+
+		switch code {
+		case dbusFieldPath:
+			m.path, _ = value.(string)
+		case dbusFieldInterface:
+			m.iface, _ = value.(string)
+		case dbusFieldMember:
+			m.member, _ = value.(string)
+		case dbusFieldErrorName:
+			m.errorName, _ = value.(string)
+		case dbusFieldReplySerial:
+			m.replySerial, _ = value.(uint32)
+		case dbusFieldDestination:
+			m.destination, _ = value.(string)
+		case dbusFieldSender:
+			m.sender, _ = value.(string)
+		case dbusFieldSignature:
+			m.signature, _ = value.(string)
+		}
+	}
+
+	return m, nil
+}
+
+// dbusConn is a connection to a message bus.
+type dbusConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// mu protects writes to the connection and the serial counter.
+	mu     sync.Mutex
+	serial uint32
+}
+
+// sessionBusAddress returns the address of the session bus for the current user.
+func sessionBusAddress() string {
+	if address := os.Getenv("DBUS_SESSION_BUS_ADDRESS"); address != "" {
+		return address
+	}
+	if runtimeDir := os.Getenv("XDG_RUNTIME_DIR"); runtimeDir != "" {
+		return "unix:path=" + runtimeDir + "/bus"
+	}
+	return ""
+}
+
+// systemBusAddress returns the address of the system-wide bus.
+func systemBusAddress() string {
+	if address := os.Getenv("DBUS_SYSTEM_BUS_ADDRESS"); address != "" {
+		return address
+	}
+	return "unix:path=/var/run/dbus/system_bus_socket"
+}
+
+// dialDBus connects to the first reachable Unix socket listed in the bus "address" and
+// authenticates with it.
+func dialDBus(address string) (*dbusConn, error) {
+	if address == "" {
+		return nil, errors.New("no D-Bus address available")
+	}
+
+	var lastErr error = fmt.Errorf("no supported transport in D-Bus address %s", address)
+	for _, entry := range strings.Split(address, ";") {
+		transport, params, ok := strings.Cut(entry, ":")
+		if !ok || transport != "unix" {
+			continue
+		}
+
+		var path string
+		for _, param := range strings.Split(params, ",") {
+			key, value, _ := strings.Cut(param, "=")
+			value, err := url.PathUnescape(value)
+			if err != nil {
+				continue
+			}
+			switch key {
+			case "path":
+				path = value
+			case "abstract":
+				path = "@" + value
+			}
+		}
+		if path == "" {
+			continue
+		}
+
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		c := &dbusConn{conn: conn, reader: bufio.NewReader(conn)}
+		if err := c.authenticate(); err != nil {
+			conn.Close()
+			lastErr = err
+			continue
+		}
+		return c, nil
+	}
+	return nil, lastErr
+}
+
+// authenticate performs the SASL handshake using the EXTERNAL mechanism, which relies on the
+// bus verifying our credentials via the Unix socket.
+func (c *dbusConn) authenticate() error {
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := fmt.Fprintf(c.conn, "\x00AUTH EXTERNAL %s\r\n", uid); err != nil {
+		return err
+	}
+
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return fmt.Errorf("D-Bus authentication failed: %s", strings.TrimSpace(line))
+	}
+
+	_, err = io.WriteString(c.conn, "BEGIN\r\n")
+	return err
+}
+
+// Close terminates the connection to the bus.
+func (c *dbusConn) Close() error {
+	return c.conn.Close()
+}
+
+// send writes a message to the bus and returns the serial number assigned to it.
+func (c *dbusConn) send(m *dbusMessage) (uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.serial++
+	_, err := c.conn.Write(m.encode(c.serial))
+	return c.serial, err
+}
+
+// receive reads the next message from the bus.
+func (c *dbusConn) receive() (*dbusMessage, error) {
+	return readDBusMessage(c.reader)
+}
+
+// call invokes a method and waits for its reply, discarding any other message that arrives in
+// the meantime.  This is only suitable for use before any other messages are processed.
+func (c *dbusConn) call(m *dbusMessage) (*dbusMessage, error) {
+	m.msgType = dbusMethodCall
+	serial, err := c.send(m)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		reply, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		if reply.replySerial != serial {
+			continue
+		}
+
+		switch reply.msgType {
+		case dbusMethodReturn:
+			return reply, nil
+		case dbusError:
+			return nil, fmt.Errorf("%s.%s failed: %s", m.iface, m.member, reply.errorName)
+		}
+	}
+}
+
+// dbusBus is a template for the messages addressed to the bus itself.
+var dbusBus = dbusMessage{
+	destination: "org.freedesktop.DBus",
+	path:        "/org/freedesktop/DBus",
+	iface:       "org.freedesktop.DBus",
+}
+
+// hello calls Hello on the bus, which must be the first call on a new connection.
+func (c *dbusConn) hello() error {
+	hello := dbusBus
+	hello.member = "Hello"
+	_, err := c.call(&hello)
+	return err
+}
+
+// requestName calls Hello on the bus and then claims the well-known "name" for ourselves.
+func (c *dbusConn) requestName(name string) error {
+	if err := c.hello(); err != nil {
+		return err
+	}
+
+	var body dbusEncoder
+	body.putString(name)
+	body.putUint32(0x4) // DBUS_NAME_FLAG_DO_NOT_QUEUE.
+	request := dbusBus
+	request.member = "RequestName"
+	request.signature = "su"
+	request.body = body.buf
+	reply, err := c.call(&request)
+	if err != nil {
+		return err
+	}
+
+	d := dbusDecoder{buf: reply.body, order: reply.order}
+	result, err := d.getUint32()
+	if err != nil {
+		return err
+	}
+	if result != 1 && result != 4 { // PRIMARY_OWNER or ALREADY_OWNER.
+		return fmt.Errorf("D-Bus name %s is already taken", name)
+	}
+	return nil
+}
+
+// reply sends a method return or error in response to "call" unless the caller indicated that
+// it does not want a reply.
+func (c *dbusConn) reply(call *dbusMessage, reply *dbusMessage) error {
+	if call.flags&dbusFlagNoReplyExpected != 0 {
+		return nil
+	}
+	reply.replySerial = call.serial
+	reply.destination = call.sender
+	_, err := c.send(reply)
+	return err
+}
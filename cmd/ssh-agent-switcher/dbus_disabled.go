@@ -0,0 +1,51 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build nodbus || minimal
+
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errNoDBus indicates that the binary was built without support for D-Bus.
+var errNoDBus = errors.New("built without D-Bus support")
+
+// startDBusService fails because D-Bus support was left out of the build.
+func startDBusService(agentsDir string, tracker *selectionTracker) error {
+	return errNoDBus
+}
+
+// checkPolkitAuthorization fails because polkit can only be reached over D-Bus, which was left
+// out of the build.
+func checkPolkitAuthorization(action string, client clientInfo, details map[string]string) error {
+	return fmt.Errorf("cannot ask polkit: %v", errNoDBus)
+}
+
+// connectLogind fails because logind can only be reached over D-Bus, which was left out of the
+// build.
+func connectLogind() (func(pid int) (int, string, error), func(), error) {
+	return nil, nil, errNoDBus
+}
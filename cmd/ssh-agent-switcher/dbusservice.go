@@ -0,0 +1,177 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !nodbus && !minimal
+
+package main
+
+import (
+	"fmt"
+)
+
+const (
+	// dbusServiceName is the well-known name that we claim on the session bus.
+	dbusServiceName = "io.github.jmmv.SshAgentSwitcher"
+
+	// dbusObjectPath is the path of the single object that we expose.
+	dbusObjectPath = "/io/github/jmmv/SshAgentSwitcher"
+
+	// dbusInterfaceName is the name of the interface implemented by our object.
+	dbusInterfaceName = "io.github.jmmv.SshAgentSwitcher"
+)
+
+// dbusIntrospection is the introspection data for our object.
+const dbusIntrospection = `<!DOCTYPE node PUBLIC "-//freedesktop//DTD D-BUS Object Introspection 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/introspect.dtd">
+<node>
+  <interface name="` + dbusInterfaceName + `">
+    <method name="GetCurrentAgent">
+      <arg name="path" type="s" direction="out"/>
+    </method>
+    <method name="ListCandidates">
+      <arg name="paths" type="as" direction="out"/>
+    </method>
+    <signal name="AgentChanged">
+      <arg name="path" type="s"/>
+    </signal>
+  </interface>
+  <interface name="org.freedesktop.DBus.Introspectable">
+    <method name="Introspect">
+      <arg name="data" type="s" direction="out"/>
+    </method>
+  </interface>
+  <interface name="org.freedesktop.DBus.Peer">
+    <method name="Ping"/>
+  </interface>
+</node>
+`
+
+// dbusService exposes the state of the switcher on the session bus.
+type dbusService struct {
+	conn      *dbusConn
+	agentsDir string
+	tracker   *selectionTracker
+}
+
+// startDBusService connects to the session bus, claims our well-known name, and starts
+// serving requests in the background.
+//
+// Selection changes recorded by "tracker" are broadcast as AgentChanged signals, and the
+// candidates reported to callers are looked up in "agentsDir".
+func startDBusService(agentsDir string, tracker *selectionTracker) error {
+	conn, err := dialDBus(sessionBusAddress())
+	if err != nil {
+		return err
+	}
+
+	if err := conn.requestName(dbusServiceName); err != nil {
+		conn.Close()
+		return err
+	}
+
+	s := &dbusService{conn: conn, agentsDir: agentsDir, tracker: tracker}
+	tracker.watch(s.agentChanged)
+	go s.serve()
+
+	infof("Registered %s on the D-Bus session bus", dbusServiceName)
+	return nil
+}
+
+// agentChanged emits the AgentChanged signal.
+func (s *dbusService) agentChanged(current string) {
+	var body dbusEncoder
+	body.putString(current)
+	signal := &dbusMessage{
+		msgType:   dbusSignal,
+		path:      dbusObjectPath,
+		iface:     dbusInterfaceName,
+		member:    "AgentChanged",
+		signature: "s",
+		body:      body.buf,
+	}
+	if _, err := s.conn.send(signal); err != nil {
+		errorf("Failed to emit D-Bus signal: %v", err)
+	}
+}
+
+// serve processes incoming messages until the connection to the bus is lost.
+func (s *dbusService) serve() {
+	defer s.conn.Close()
+
+	for {
+		m, err := s.conn.receive()
+		if err != nil {
+			errorf("Lost connection to the D-Bus session bus: %v", err)
+			return
+		}
+		if m.msgType != dbusMethodCall {
+			continue
+		}
+
+		if err := s.conn.reply(m, s.handle(m)); err != nil {
+			errorf("Failed to reply to D-Bus call: %v", err)
+			return
+		}
+	}
+}
+
+// dbusErrorReply builds an error reply with the given error "name" and human-readable message.
+func dbusErrorReply(name string, format string, args ...any) *dbusMessage {
+	var body dbusEncoder
+	body.putString(fmt.Sprintf(format, args...))
+	return &dbusMessage{msgType: dbusError, errorName: name, signature: "s", body: body.buf}
+}
+
+// handle processes a single method call and returns the reply to send back.
+func (s *dbusService) handle(m *dbusMessage) *dbusMessage {
+	if m.path != dbusObjectPath {
+		return dbusErrorReply("org.freedesktop.DBus.Error.UnknownObject", "No such object %s", m.path)
+	}
+
+	reply := &dbusMessage{msgType: dbusMethodReturn}
+	var body dbusEncoder
+	switch m.iface + "." + m.member {
+	case dbusInterfaceName + ".GetCurrentAgent":
+		body.putString(s.tracker.getCurrent())
+		reply.signature = "s"
+
+	case dbusInterfaceName + ".ListCandidates":
+		candidates, err := findCandidates(s.agentsDir)
+		if err != nil {
+			return dbusErrorReply("org.freedesktop.DBus.Error.Failed", "%v", err)
+		}
+		body.putStringArray(candidates)
+		reply.signature = "as"
+
+	case "org.freedesktop.DBus.Introspectable.Introspect":
+		body.putString(dbusIntrospection)
+		reply.signature = "s"
+
+	case "org.freedesktop.DBus.Peer.Ping":
+
+	default:
+		return dbusErrorReply("org.freedesktop.DBus.Error.UnknownMethod", "Unknown method %s.%s", m.iface, m.member)
+	}
+	reply.body = body.buf
+	return reply
+}
@@ -0,0 +1,86 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !nometrics && !minimal
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// publishMetrics exposes all metrics via expvar under the "metrics" variable and the latency
+// histograms of the agents under the "agent_latency" variable.
+func publishMetrics() {
+	expvar.Publish("metrics", expvar.Func(func() any {
+		values := make(map[string]int64, len(allMetrics))
+		for _, m := range allMetrics {
+			values[m.name] = m.get()
+		}
+		return values
+	}))
+	expvar.Publish("agent_latency", expvar.Func(func() any {
+		return agentLatencies.export()
+	}))
+}
+
+// listenLocal creates the listener for HTTP endpoints at "address", which can either be the
+// path to a Unix socket or a TCP host:port pair on the loopback interface.
+//
+// Only local listeners are allowed because the endpoints expose internal details of the daemon
+// and profiling can be expensive.
+func listenLocal(address string) (net.Listener, error) {
+	if isUnixSocketAddress(address) {
+		return listenPrivate(address)
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %s: %v", address, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("invalid address %s: must be on the loopback interface", address)
+	}
+	return net.Listen("tcp", address)
+}
+
+// serveDebug serves the pprof and expvar endpoints on "listener" until it fails.
+func serveDebug(listener net.Listener) {
+	publishMetrics()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	if err := http.Serve(listener, mux); err != nil {
+		errorf("Debug endpoints failed: %v", err)
+	}
+}
@@ -0,0 +1,460 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+	"github.com/jmmv/ssh-agent-switcher/discovery"
+	"github.com/jmmv/ssh-agent-switcher/selection"
+)
+
+// restrictDestinationExtension is the name of the key constraint that ssh-add -h uses to
+// restrict the hosts that a key can be used with.
+const restrictDestinationExtension = "restrict-destination-v00@openssh.com"
+
+// publicKeyFields lists, by key type, the indexes of the fields of the private keys described
+// by privateKeyFields that make up the public key.  Certificates are not listed because their
+// first field is the public key blob.
+var publicKeyFields = map[string][]int{
+	"ssh-dss":                            {0, 1, 2, 3},
+	"ssh-rsa":                            {1, 0},
+	"ssh-ed25519":                        {0},
+	"ecdsa-sha2-nistp256":                {0, 1},
+	"ecdsa-sha2-nistp384":                {0, 1},
+	"ecdsa-sha2-nistp521":                {0, 1},
+	"sk-ecdsa-sha2-nistp256@openssh.com": {0, 1, 2},
+	"sk-ssh-ed25519@openssh.com":         {0, 1},
+}
+
+// destinationHop is one end of a destination constraint.
+type destinationHop struct {
+	// user is the user name on the host, or empty for any.
+	user string
+
+	// host is the name of the host, or empty for the local host.
+	host string
+
+	// keys are the fingerprints of the host keys.
+	keys []string
+}
+
+// String formats the hop like ssh-add -h takes it.
+func (h destinationHop) String() string {
+	if h.user != "" {
+		return h.user + "@" + h.host
+	}
+	return h.host
+}
+
+// destinationConstraint is a single destination that a key is restricted to, as set by
+// ssh-add -h.
+type destinationConstraint struct {
+	from destinationHop
+	to   destinationHop
+}
+
+// String formats the constraint like ssh-add -h takes it.
+func (c destinationConstraint) String() string {
+	if c.from.host == "" {
+		return c.to.String()
+	}
+	return c.from.String() + ">" + c.to.String()
+}
+
+// parseDestinationHop decodes a hop of a destination constraint.
+func parseDestinationHop(data []byte) (destinationHop, error) {
+	var hop destinationHop
+	r := codec.NewReader(data)
+	user, err := r.ReadString()
+	if err != nil {
+		return hop, err
+	}
+	host, err := r.ReadString()
+	if err != nil {
+		return hop, err
+	}
+	if _, err := r.ReadString(); err != nil { // Reserved.
+		return hop, err
+	}
+	for r.Len() > 0 {
+		key, err := r.ReadString()
+		if err != nil {
+			return hop, err
+		}
+		if _, err := r.ReadByte(); err != nil { // Whether the key is a CA.
+			return hop, err
+		}
+		hop.keys = append(hop.keys, codec.Fingerprint(key))
+	}
+	hop.user = string(user)
+	hop.host = string(host)
+	return hop, nil
+}
+
+// parseDestinationConstraints decodes the data of a restrict-destination-v00@openssh.com key
+// constraint.
+func parseDestinationConstraints(data []byte) ([]destinationConstraint, error) {
+	var constraints []destinationConstraint
+	r := codec.NewReader(data)
+	for r.Len() > 0 {
+		encoded, err := r.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		cr := codec.NewReader(encoded)
+		from, err := cr.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		to, err := cr.ReadString()
+		if err != nil {
+			return nil, err
+		}
+
+		var c destinationConstraint
+		if c.from, err = parseDestinationHop(from); err != nil {
+			return nil, err
+		}
+		if c.to, err = parseDestinationHop(to); err != nil {
+			return nil, err
+		}
+		constraints = append(constraints, c)
+	}
+	return constraints, nil
+}
+
+// skipConstraintExtension advances "r" past the data of the key constraint extension "name"
+// and returns the data of the destination constraints, if that is what it carries.  The data
+// of extensions is in formats specific to each of them, so we can only skip those we know.
+func skipConstraintExtension(r *codec.Reader, name string) ([]byte, error) {
+	switch name {
+	case restrictDestinationExtension:
+		return r.ReadString()
+	case "sk-provider@openssh.com":
+		_, err := r.ReadString()
+		return nil, err
+	case "associated-certs-v01@openssh.com":
+		if _, err := r.ReadByte(); err != nil {
+			return nil, err
+		}
+		_, err := r.ReadString()
+		return nil, err
+	default:
+		return nil, fmt.Errorf("unsupported key constraint extension %s", name)
+	}
+}
+
+// parseAddedKey decodes the add request "msg", which includes the length prefix, and returns
+// the fingerprint of the key that it adds with its destination constraints.
+func parseAddedKey(msg []byte) (string, []destinationConstraint, error) {
+	if len(msg) < 5 || (msg[4] != codec.AgentcAddIdentity && msg[4] != codec.AgentcAddIDConstrained) {
+		return "", nil, errors.New("not a request to add a key")
+	}
+
+	r := codec.NewReader(msg[5:])
+	keyType, err := r.ReadString()
+	if err != nil {
+		return "", nil, err
+	}
+	layout, ok := privateKeyFields[string(keyType)]
+	if !ok {
+		return "", nil, fmt.Errorf("unsupported key type %s", keyType)
+	}
+	var fields [][]byte
+	for _, field := range layout {
+		var value []byte
+		switch field {
+		case 's':
+			value, err = r.ReadString()
+		case 'b':
+			var b byte
+			b, err = r.ReadByte()
+			value = []byte{b}
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		fields = append(fields, value)
+	}
+	if _, err := r.ReadString(); err != nil { // Comment.
+		return "", nil, err
+	}
+
+	var blob []byte
+	if indexes, ok := publicKeyFields[string(keyType)]; ok {
+		blob = codec.AppendString(nil, keyType)
+		for _, i := range indexes {
+			blob = codec.AppendString(blob, fields[i])
+		}
+	} else {
+		blob = fields[0]
+	}
+
+	var constraints []destinationConstraint
+	for r.Len() > 0 {
+		constraint, _ := r.ReadByte()
+		switch constraint {
+		case codec.ConstrainLifetime, codec.ConstrainMaxsign:
+			if _, err := r.ReadUint32(); err != nil {
+				return "", nil, err
+			}
+		case codec.ConstrainConfirm:
+		case codec.ConstrainExtension:
+			name, err := r.ReadString()
+			if err != nil {
+				return "", nil, err
+			}
+			data, err := skipConstraintExtension(r, string(name))
+			if err != nil {
+				return "", nil, err
+			}
+			if data != nil {
+				parsed, err := parseDestinationConstraints(data)
+				if err != nil {
+					return "", nil, fmt.Errorf("invalid destination constraints: %v", err)
+				}
+				constraints = append(constraints, parsed...)
+			}
+		default:
+			return "", nil, fmt.Errorf("unsupported key constraint %d", constraint)
+		}
+	}
+	return codec.Fingerprint(blob), constraints, nil
+}
+
+// destinationTracker remembers the destination constraints of the keys that clients added to
+// each agent through us.  Agents do not reveal the constraints of the keys they hold, so these
+// are the only ones that we know about.
+type destinationTracker struct {
+	mu sync.Mutex
+
+	// agents maps agent paths to the constraints of their keys by fingerprint.
+	agents map[string]map[string][]destinationConstraint
+}
+
+// destinationConstraints holds the destination constraints of the keys added through us.
+var destinationConstraints = &destinationTracker{agents: make(map[string]map[string][]destinationConstraint)}
+
+// record remembers that the key "fingerprint" was added to the agent at "path" with
+// "constraints", which replace any previous ones.
+func (t *destinationTracker) record(path string, fingerprint string, constraints []destinationConstraint) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys := t.agents[path]
+	if len(constraints) == 0 {
+		delete(keys, fingerprint)
+		if len(keys) == 0 {
+			delete(t.agents, path)
+		}
+		return
+	}
+	if keys == nil {
+		keys = make(map[string][]destinationConstraint)
+		t.agents[path] = keys
+	}
+	keys[fingerprint] = constraints
+}
+
+// forget drops the constraints of all keys of the agent at "path".
+func (t *destinationTracker) forget(path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.agents, path)
+}
+
+// hasAny returns true if we know about constrained keys in the agent at "path".
+func (t *destinationTracker) hasAny(path string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.agents[path]) > 0
+}
+
+// describe returns the destinations that the key "fingerprint" of the agent at "path" is
+// restricted to, or nil if unrestricted or unknown.
+func (t *destinationTracker) describe(path string, fingerprint string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var destinations []string
+	for _, c := range t.agents[path][fingerprint] {
+		destinations = append(destinations, c.String())
+	}
+	return destinations
+}
+
+// servesHost returns true if any of the "keys" of the agent at "path" can be used to
+// authenticate to the host with the key "hostKey", as far as we know.
+func (t *destinationTracker) servesHost(path string, keys []codec.Identity, hostKey string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, key := range keys {
+		constraints, ok := t.agents[path][key.Fingerprint()]
+		if !ok {
+			return true
+		}
+		for _, c := range constraints {
+			for _, k := range c.to.keys {
+				if k == hostKey {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// restrictedSuffix returns a note on the destinations that the key "fingerprint" of the agent
+// at "path" is restricted to, for appending to its description, or empty if none.
+func restrictedSuffix(path string, fingerprint string) string {
+	destinations := destinationConstraints.describe(path, fingerprint)
+	if len(destinations) == 0 {
+		return ""
+	}
+	return " (restricted to " + strings.Join(destinations, ", ") + ")"
+}
+
+// isPreferredForAny checks whether "path" is one of the agents in "preferred" for any reason.
+func isPreferredForAny(preferred []discovery.Candidate, path string) bool {
+	for _, p := range preferred {
+		if p.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// otherAgent is a discovery.Discoverer that drops the agent at "path" from the candidates of
+// another discoverer.
+type otherAgent struct {
+	discovery.Discoverer
+	path string
+}
+
+// Discover implements discovery.Discoverer.
+func (d otherAgent) Discover() ([]discovery.Candidate, []discovery.Skipped, error) {
+	candidates, skipped, err := d.Discoverer.Discover()
+	var others []discovery.Candidate
+	for _, candidate := range candidates {
+		if candidate.Path != d.path {
+			others = append(others, candidate)
+		}
+	}
+	return others, skipped, err
+}
+
+// avoidRestrictedAgent switches the connection of "filter" to another agent before the client
+// binds it to a session with the session-bind request "msg" if all the keys of the current
+// agent are restricted to other destinations.  The agent would otherwise hide those keys from
+// the client, which would then fail to authenticate for no apparent reason.
+func avoidRestrictedAgent(filter *messageFilter, msg []byte, trace *span) {
+	if filter.binding != nil || codec.ExtensionName(msg) != sessionBindExtension || !destinationConstraints.hasAny(filter.agentPath) {
+		return
+	}
+	binding, err := parseSessionBind(msg)
+	if err != nil || binding.forwarding {
+		return
+	}
+	hostKey := codec.Fingerprint(binding.hostKey)
+	keys, err := requestIdentities(filter.agent)
+	if err != nil || destinationConstraints.servesHost(filter.agentPath, keys, hostKey) {
+		return
+	}
+
+	selector := newSelector()
+	check := selector.Check
+	selector.Check = func(path string, conn net.Conn) error {
+		if check != nil {
+			if err := check(path, conn); err != nil {
+				return err
+			}
+		}
+		keys, err := requestIdentities(conn)
+		if err != nil {
+			return err
+		}
+		if !destinationConstraints.servesHost(path, keys, hostKey) {
+			return fmt.Errorf("no keys usable with %s", binding)
+		}
+		return nil
+	}
+	preferred := preferredAgents(*pinFile)
+	discoverer := otherAgent{newDiscoverer(config.AgentsDir, preferred), filter.agentPath}
+	agent, decision, err := selection.Find(discoverer, selector)
+	if err == nil && isPreferredForAny(preferred, decision.Winner) {
+		// The checks do not apply to the locked and pinned agents.
+		if keys, err := requestIdentities(agent); err != nil || !destinationConstraints.servesHost(decision.Winner, keys, hostKey) {
+			agent.Close()
+			agent = nil
+		}
+	}
+	if err != nil || agent == nil {
+		filter.log.warnf("All keys of %s are restricted to destinations other than %s and no other agent can be used instead", agentLabel(filter.agentPath), binding)
+		return
+	}
+
+	filter.log.infof("Switching to %s: all keys of %s are restricted to destinations other than %s", agentLabel(decision.Winner), agentLabel(filter.agentPath), binding)
+	filter.agent.Close()
+	filter.agent = agent
+	filter.agentPath = decision.Winner
+	filter.decision = decision
+	currentAgent.selected(filter.agentPath)
+	activeConnections.setAgent(filter.log.id, filter.agentPath)
+	trace.set("agent.socket", decision.Winner)
+}
+
+// keysCommand implements the "keys" control command, which lists the keys of the agent that
+// was last selected along with the destinations that they are restricted to, if we know.
+func keysCommand(args []string) (string, error) {
+	if len(args) != 0 {
+		return "", errors.New("usage: keys")
+	}
+	path := currentAgent.getCurrent()
+	if path == "" {
+		return "", errors.New("no agent selected yet")
+	}
+
+	conn, err := net.DialTimeout("unix", path, probeTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(probeTimeout))
+	keys, err := requestIdentities(conn)
+	if err != nil {
+		return "", fmt.Errorf("cannot list the keys of %s: %v", agentLabel(path), err)
+	}
+
+	lines := []string{"agent: " + agentLabel(path)}
+	for _, key := range keys {
+		fingerprint := key.Fingerprint()
+		lines = append(lines, fmt.Sprintf("key: %s %s %s%s", key.KeyType(), fingerprint, key.Comment, restrictedSuffix(path, fingerprint)))
+	}
+	return strings.Join(lines, "\n"), nil
+}
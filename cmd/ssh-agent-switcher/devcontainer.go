@@ -0,0 +1,96 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// devcontainerConfig is the subset of the devcontainer.json properties that give a dev
+// container access to the agent.
+type devcontainerConfig struct {
+	Mounts       []string          `json:"mounts,omitempty"`
+	RunArgs      []string          `json:"runArgs,omitempty"`
+	ContainerEnv map[string]string `json:"containerEnv"`
+	RemoteEnv    map[string]string `json:"remoteEnv"`
+}
+
+// newDevcontainerConfig returns the devcontainer.json properties that make "socket"
+// available at "target" in containers created by "runtime".
+func newDevcontainerConfig(runtime string, socket string, target string) devcontainerConfig {
+	env := map[string]string{"SSH_AUTH_SOCK": target}
+	config := devcontainerConfig{ContainerEnv: env, RemoteEnv: env}
+
+	// The "mounts" property cannot request relabeling, so we have to fall back to raw
+	// arguments for the runtime when SELinux is in use.
+	if selinuxEnabled() {
+		config.RunArgs = append(config.RunArgs, "-v", socket+":"+target+":z")
+	} else {
+		config.Mounts = append(config.Mounts, fmt.Sprintf("source=%s,target=%s,type=bind", socket, target))
+	}
+
+	// The IDE already maps the remote user to the local one under Docker, but rootless
+	// Podman needs to keep our uid for the container to be able to open the socket.
+	if strings.HasSuffix(runtime, "podman") && os.Getuid() != 0 {
+		config.RunArgs = append(config.RunArgs, "--userns=keep-id")
+	}
+	return config
+}
+
+// runDevcontainer implements the devcontainer subcommand, which prints the properties to
+// merge into a devcontainer.json file so that the dev container can use the agent.
+func runDevcontainer(args []string) error {
+	fs := flag.NewFlagSet("devcontainer", flag.ExitOnError)
+	runtime := fs.String("runtime", "", "container runtime used by the IDE; docker or podman if empty")
+	target := fs.String("target", defaultContainerSocket, "path of the agent socket inside the container")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("usage: devcontainer [-runtime PATH] [-target PATH]")
+	}
+
+	if *runtime == "" {
+		detected, err := detectContainerRuntime()
+		if err != nil {
+			return err
+		}
+		*runtime = detected
+	}
+
+	socket, err := daemonSocket()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(newDevcontainerConfig(*runtime, socket, *target), "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "%s\n", data)
+	return nil
+}
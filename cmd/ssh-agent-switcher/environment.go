@@ -0,0 +1,100 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// writeEnvironmentFile creates or replaces the file at "path" with a systemd environment.d
+// snippet that sets SSH_AUTH_SOCK to "socketPath".
+//
+// The file is written to a temporary location first and then renamed into place so that
+// readers never observe a partially-written file.
+func writeEnvironmentFile(path string, socketPath string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".ssh-agent-switcher.*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := fmt.Fprintf(tmp, "SSH_AUTH_SOCK=%s\n", socketPath); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// setSystemdEnvironment tells the systemd user instance to export SSH_AUTH_SOCK pointing to
+// "socketPath" to any services it starts from now on.
+func setSystemdEnvironment(socketPath string) error {
+	cmd := exec.Command("systemctl", "--user", "set-environment", "SSH_AUTH_SOCK="+socketPath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("systemctl failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// exportEnvironment publishes the location of our socket via the mechanisms requested by the
+// user so that processes not started from a login shell can find us.
+//
+// Failures are not fatal: the daemon is perfectly usable without these integrations.
+func exportEnvironment(socketPath string, environmentFile string, systemdEnvironment bool) {
+	absPath, err := filepath.Abs(socketPath)
+	if err != nil {
+		errorf("Cannot export environment: %v", err)
+		return
+	}
+
+	if environmentFile != "" {
+		if err := writeEnvironmentFile(environmentFile, absPath); err != nil {
+			errorf("Failed to write %s: %v", environmentFile, err)
+		} else {
+			infof("Wrote SSH_AUTH_SOCK to %s", environmentFile)
+		}
+	}
+
+	if systemdEnvironment {
+		if err := setSystemdEnvironment(absPath); err != nil {
+			errorf("Failed to update systemd user environment: %v", err)
+		} else {
+			infof("Set SSH_AUTH_SOCK in systemd user environment")
+		}
+	}
+}
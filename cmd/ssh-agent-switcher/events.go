@@ -0,0 +1,169 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Types of the events delivered to the -eventCommand and the -eventWebhook.
+const (
+	eventAgentAvailable = "agent-available"
+	eventAgentSwitched  = "agent-switched"
+	eventNoAgent        = "no-agent"
+	eventSignRejected   = "sign-rejected"
+)
+
+const (
+	// eventQueueSize is the number of events that can be waiting to be delivered.  Events that
+	// arrive while the queue is full are dropped.
+	eventQueueSize = 64
+
+	// eventTimeout is how long the -eventCommand and the -eventWebhook have to handle an
+	// event.
+	eventTimeout = 10 * time.Second
+)
+
+// event describes a notable change in the state of the daemon.
+type event struct {
+	// Time is when the event happened.
+	Time time.Time `json:"time"`
+
+	// Type is one of the event* constants.
+	Type string `json:"type"`
+
+	// Agent is the path to the socket of the agent that the event is about, if any.
+	Agent string `json:"agent,omitempty"`
+
+	// Previous is the path to the socket of the agent that was selected before a switch.
+	Previous string `json:"previous,omitempty"`
+
+	// Key is the fingerprint of the key used in a rejected sign request.
+	Key string `json:"key,omitempty"`
+
+	// Host describes the server that the client of a rejected sign request was
+	// authenticating to, if known.
+	Host string `json:"host,omitempty"`
+
+	// ClientPid is the process identifier of the client of a rejected sign request, if known.
+	ClientPid int `json:"clientPid,omitempty"`
+
+	// ClientExe is the executable run by the client of a rejected sign request, if known.
+	ClientExe string `json:"clientExe,omitempty"`
+
+	// Reason explains why a sign request was rejected.
+	Reason string `json:"reason,omitempty"`
+}
+
+// eventHooks delivers events to the program and the URL configured by the user, one at a time
+// and in the order in which they happen.
+//
+// A nil eventHooks discards all events.
+type eventHooks struct {
+	// command is the program to run for every event, or empty for none.
+	command string
+
+	// webhook is the URL to post every event to, or empty for none.
+	webhook string
+
+	// events queues the events that have yet to be delivered.
+	events chan event
+}
+
+// events delivers events to the hooks configured via -eventCommand and -eventWebhook, if any.
+var events *eventHooks
+
+// newEventHooks creates the hooks that deliver events to "command" and "webhook", either of
+// which may be empty, and starts delivering them in the background.
+func newEventHooks(command string, webhook string) (*eventHooks, error) {
+	if webhook != "" {
+		if err := checkWebhookURL(webhook); err != nil {
+			return nil, fmt.Errorf("invalid -eventWebhook %s: %v", webhook, err)
+		}
+	}
+
+	h := &eventHooks{
+		command: command,
+		webhook: webhook,
+		events:  make(chan event, eventQueueSize),
+	}
+	go h.run()
+	return h, nil
+}
+
+// emit queues "e" for delivery, filling in its time.
+func (h *eventHooks) emit(e event) {
+	if h == nil {
+		return
+	}
+	e.Time = time.Now()
+	select {
+	case h.events <- e:
+	default:
+		errorf("Dropping %s event: event queue is full", e.Type)
+	}
+}
+
+// run delivers queued events.  Never returns.
+func (h *eventHooks) run() {
+	for e := range h.events {
+		body, err := json.Marshal(e)
+		if err != nil {
+			errorf("Cannot encode %s event: %v", e.Type, err)
+			continue
+		}
+		if h.command != "" {
+			if err := h.runCommand(e.Type, body); err != nil {
+				errorf("-eventCommand failed for %s event: %v", e.Type, err)
+			}
+		}
+		if h.webhook != "" {
+			if err := postEvent(h.webhook, body); err != nil {
+				errorf("-eventWebhook failed for %s event: %v", e.Type, err)
+			}
+		}
+	}
+}
+
+// runCommand runs the -eventCommand with the event "body" on its stdin and its "eventType" in
+// the SSH_AGENT_SWITCHER_EVENT environment variable.
+func (h *eventHooks) runCommand(eventType string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), eventTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.command)
+	cmd.Env = append(os.Environ(), "SSH_AGENT_SWITCHER_EVENT="+eventType)
+	cmd.Stdin = bytes.NewReader(append(body, '\n'))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
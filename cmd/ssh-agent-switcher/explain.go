@@ -0,0 +1,104 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/jmmv/ssh-agent-switcher/selection"
+)
+
+// explainSelection writes every candidate in "decision" to "w" with why it was selected or
+// rejected, followed by the files that were not candidates at all.
+func explainSelection(w io.Writer, decision selection.Decision) {
+	rejected := make(map[string]error, len(decision.Rejected))
+	var skipped []selection.Rejection
+	for _, r := range decision.Rejected {
+		var skip *selection.SkippedError
+		if errors.As(r.Err, &skip) {
+			skipped = append(skipped, selection.Rejection{Path: r.Path, Err: errors.New(skip.Reason)})
+			continue
+		}
+		rejected[r.Path] = r.Err
+	}
+
+	fmt.Fprintf(w, "Candidates, in the order in which they are tried:\n")
+	if len(decision.Candidates) == 0 {
+		fmt.Fprintf(w, "  (none found)\n")
+	}
+	for _, path := range decision.Candidates {
+		switch {
+		case path == decision.Winner:
+			fmt.Fprintf(w, "  %s: selected: %s\n", path, decision.Reason)
+		case rejected[path] != nil:
+			fmt.Fprintf(w, "  %s: rejected: %v\n", path, rejected[path])
+		default:
+			fmt.Fprintf(w, "  %s: not tried\n", path)
+		}
+	}
+
+	if len(skipped) > 0 {
+		fmt.Fprintf(w, "Files that are not candidates:\n")
+		for _, skip := range skipped {
+			fmt.Fprintf(w, "  %s\n", skip)
+		}
+	}
+}
+
+// runSelect implements the select subcommand, which selects an agent like the daemon does for
+// every client connection and prints the outcome without serving any clients.
+func runSelect(args []string) error {
+	fs := flag.NewFlagSet("select", flag.ExitOnError)
+	explain := fs.Bool("explain", false, "print every candidate with why it was selected or rejected, and the files that are not candidates")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("select takes no arguments")
+	}
+
+	// Skip the socket of the running daemon, if any, like the daemon itself does.
+	ownSockets.Add(*socketPath)
+
+	discoverer := newDiscoverer(config.AgentsDir, preferredAgents(*pinFile))
+	conn, decision, err := selection.Find(discoverer, newSelector())
+	if err == nil {
+		conn.Close()
+	}
+
+	if *explain {
+		explainSelection(os.Stdout, decision)
+	}
+	if err != nil {
+		return fmt.Errorf("no agent would be selected: %v", err)
+	}
+	if *explain {
+		fmt.Printf("Selected %s\n", decision.Winner)
+	} else {
+		fmt.Println(decision.Winner)
+	}
+	return nil
+}
@@ -0,0 +1,638 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+	"github.com/jmmv/ssh-agent-switcher/policy"
+	"github.com/jmmv/ssh-agent-switcher/selection"
+)
+
+// Identifiers of the polkit actions that we check for, as defined in the policy file that
+// ships in the polkit directory.
+const (
+	polkitSignAction   = "io.github.jmmv.ssh-agent-switcher.sign"
+	polkitAddKeyAction = "io.github.jmmv.ssh-agent-switcher.add-key"
+)
+
+// mutatingRequests lists the client requests that modify the state of the agent.
+var mutatingRequests = map[byte]bool{
+	codec.AgentcAddIdentity:                true,
+	codec.AgentcRemoveIdentity:             true,
+	codec.AgentcRemoveAllIdentities:        true,
+	codec.AgentcAddSmartcardKey:            true,
+	codec.AgentcRemoveSmartcardKey:         true,
+	codec.AgentcLock:                       true,
+	codec.AgentcUnlock:                     true,
+	codec.AgentcAddIDConstrained:           true,
+	codec.AgentcAddSmartcardKeyConstrained: true,
+	codec.AgentcAddRSAIdentity:             true,
+	codec.AgentcRemoveRSAIdentity:          true,
+	codec.AgentcRemoveAllRSAIdentities:     true,
+	codec.AgentcAddRSAIDConstrained:        true,
+}
+
+// messageSet is a set of message types and extension names.
+//
+// messageSet implements flag.Value so that it can be populated from the command line with a
+// comma-separated list of entries.  Each entry can be a message number (e.g. "13"), a message
+// name with or without its prefix (e.g. "SSH_AGENTC_SIGN_REQUEST" or "sign_request"), or an
+// extension name (e.g. "extension:session-bind@openssh.com").  Including the extension message
+// type itself matches all extensions.
+type messageSet struct {
+	types      map[byte]bool
+	extensions map[string]bool
+}
+
+// isEmpty returns true if the set has no entries.
+func (s *messageSet) isEmpty() bool {
+	return len(s.types) == 0 && len(s.extensions) == 0
+}
+
+// contains returns true if the message of type "msgType" is in the set.  "extension" is the
+// name of the extension for SSH_AGENTC_EXTENSION messages and is ignored otherwise.
+func (s *messageSet) contains(msgType byte, extension string) bool {
+	if s.types[msgType] {
+		return true
+	}
+	return msgType == codec.AgentcExtension && s.extensions[extension]
+}
+
+// parseMessageType converts a message name or number to its number.
+func parseMessageType(name string) (byte, error) {
+	if n, err := strconv.ParseUint(name, 10, 8); err == nil {
+		return byte(n), nil
+	}
+
+	if msgType, ok := codec.MessageType(name); ok {
+		return msgType, nil
+	}
+	return 0, fmt.Errorf("unknown agent message %q", name)
+}
+
+// String implements flag.Value.
+func (s *messageSet) String() string {
+	var entries []string
+	for msgType := range s.types {
+		entries = append(entries, codec.MessageName(msgType))
+	}
+	for extension := range s.extensions {
+		entries = append(entries, "extension:"+extension)
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
+
+// Set implements flag.Value.
+func (s *messageSet) Set(value string) error {
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if extension, ok := strings.CutPrefix(entry, "extension:"); ok {
+			if extension == "" {
+				return fmt.Errorf("empty extension name in %q", entry)
+			}
+			if s.extensions == nil {
+				s.extensions = make(map[string]bool)
+			}
+			s.extensions[extension] = true
+			continue
+		}
+
+		msgType, err := parseMessageType(entry)
+		if err != nil {
+			return err
+		}
+		if s.types == nil {
+			s.types = make(map[byte]bool)
+		}
+		s.types[msgType] = true
+	}
+	return nil
+}
+
+// messageFilter decides which client requests are forwarded to the agent.
+type messageFilter struct {
+	// lock rejects all requests while engaged.  May be nil.
+	lock *accessLock
+
+	// schedule restricts when requests can be forwarded.  May be nil.
+	schedule *accessSchedule
+
+	// readOnly rejects all requests that would modify the state of the agent.
+	readOnly bool
+
+	// allowed lists the only requests that are forwarded.  If empty, all requests are
+	// forwarded unless denied by other settings.
+	allowed *messageSet
+
+	// denied lists requests that are never forwarded.
+	denied *messageSet
+
+	// policy decides whether sign requests can be issued.  May be nil.
+	policy policy.Checker
+
+	// limits restricts how often clients can issue sign requests.  May be nil.
+	limits *signLimits
+
+	// idle scrutinizes sign requests issued while the user is away.  May be nil.
+	idle *idleCheck
+
+	// confirmSign asks the user to approve every sign request.
+	confirmSign bool
+
+	// confirmer displays the prompts for requests that need to be approved by the user.
+	confirmer *confirmer
+
+	// polkitAddKey asks polkit to authorize every request that adds keys to the agent.
+	polkitAddKey bool
+
+	// client describes the client that issues the requests.
+	client clientInfo
+
+	// hidden lists the keys, by fingerprint or comment glob, that clients cannot see or use.
+	hidden []string
+
+	// agent is the connection to the real agent, to which requests are forwarded and which is
+	// used to look up the comments of keys.
+	agent net.Conn
+
+	// constraints lists the constraints to add to the keys added by the client.  May be nil.
+	constraints *keyConstraints
+
+	// chain lists the other ssh-agent-switcher instances that the connection went through
+	// before reaching us, the nearest to the client first.
+	chain []string
+
+	// owner, if not nil, is the ID of the user whose agents are the only ones to fail over to.
+	owner *int
+
+	// binding describes the session that the client last bound the connection to, if any.
+	binding *sessionBinding
+
+	// pendingBinding is the session binding that the agent has yet to accept.
+	pendingBinding *sessionBinding
+
+	// audit records the outcome of sign requests.  May be nil.
+	audit auditSink
+
+	// agentPath is the path to the socket of the agent, for use in audit records.
+	agentPath string
+
+	// decision explains why the agent was selected, for use in status queries.
+	decision selection.Decision
+
+	// log records the messages about the connection.  May be nil.
+	log *connLogger
+
+	// capture records the messages exchanged with the client.  May be nil.
+	capture *trafficCapture
+
+	// locks records the agents that the client locks and unlocks.  May be nil.
+	locks *agentLocks
+
+	// pendingLock is SSH_AGENTC_LOCK or SSH_AGENTC_UNLOCK if the agent has yet to answer
+	// one of these requests, or zero otherwise.
+	pendingLock byte
+
+	// pendingSign is the fingerprint of the key of the sign request that the agent has yet
+	// to answer, if any.
+	pendingSign string
+
+	// pendingKey is the fingerprint of the key that the agent has yet to add or remove, if
+	// any, and pendingDestinations are the destination constraints of the added key.
+	pendingKey          string
+	pendingDestinations []destinationConstraint
+
+	// pendingRemoveAll is true if the agent has yet to remove all keys.
+	pendingRemoveAll bool
+}
+
+// auditSign records the outcome of a sign request with the key "fingerprint" in the audit log.
+func (f *messageFilter) auditSign(fingerprint string, outcome string, reason string) {
+	if f.audit == nil {
+		return
+	}
+
+	event := auditEvent{
+		Time:      time.Now(),
+		Key:       fingerprint,
+		ClientPid: f.client.pid,
+		ClientExe: f.client.exe,
+		Agent:     f.agentPath,
+		Outcome:   outcome,
+		Reason:    reason,
+	}
+	if f.binding != nil {
+		event.Host = f.binding.hostName
+		event.HostKey = codec.Fingerprint(f.binding.hostKey)
+	}
+	f.audit.record(event)
+}
+
+// signRequestKey returns the fingerprint of the key used by the SSH_AGENTC_SIGN_REQUEST message
+// "msg", which includes the length prefix, or empty if malformed.
+func signRequestKey(msg []byte) string {
+	request, err := codec.ParseSignRequest(msg)
+	if err != nil {
+		return ""
+	}
+	return codec.Fingerprint(request.KeyBlob)
+}
+
+// isSecurityKeySign returns true if the client request "msg", which includes the length
+// prefix, asks for a signature with a FIDO security key.  The agent cannot answer these
+// until the user touches the key.
+func isSecurityKeySign(msg []byte) bool {
+	request, err := codec.ParseSignRequest(msg)
+	if err != nil {
+		return false
+	}
+	return codec.IsSecurityKey(request.KeyBlob)
+}
+
+// observeRejection records that the client request "msg", which includes the length prefix,
+// was not forwarded to the agent due to "reason".
+func (f *messageFilter) observeRejection(msg []byte, reason error) {
+	if len(msg) < 5 || msg[4] != codec.AgentcSignRequest {
+		return
+	}
+	fingerprint := signRequestKey(msg)
+	f.auditSign(fingerprint, auditRejected, reason.Error())
+
+	e := event{
+		Type:      eventSignRejected,
+		Agent:     f.agentPath,
+		Key:       fingerprint,
+		ClientPid: f.client.pid,
+		ClientExe: f.client.exe,
+		Reason:    reason.Error(),
+	}
+	if f.binding != nil {
+		e.Host = f.binding.String()
+	}
+	events.emit(e)
+}
+
+// observeRequest records the state carried by the client request "msg", which includes the
+// length prefix, once it has been accepted for forwarding to the agent.
+func (f *messageFilter) observeRequest(msg []byte) {
+	f.pendingBinding = nil
+	f.pendingLock = 0
+	f.pendingSign = ""
+	f.pendingKey = ""
+	f.pendingDestinations = nil
+	f.pendingRemoveAll = false
+	if len(msg) < 5 {
+		return
+	}
+
+	switch msg[4] {
+	case codec.AgentcLock, codec.AgentcUnlock:
+		f.pendingLock = msg[4]
+
+	case codec.AgentcAddIdentity, codec.AgentcAddIDConstrained:
+		fingerprint, destinations, err := parseAddedKey(msg)
+		if err != nil {
+			f.log.debugf("Cannot tell the destination constraints of the added key: %v", err)
+			return
+		}
+		f.pendingKey = fingerprint
+		f.pendingDestinations = destinations
+
+	case codec.AgentcRemoveIdentity:
+		blob, err := codec.NewReader(msg[5:]).ReadString()
+		if err != nil {
+			return
+		}
+		f.pendingKey = codec.Fingerprint(blob)
+
+	case codec.AgentcRemoveAllIdentities:
+		f.pendingRemoveAll = true
+
+	case codec.AgentcExtension:
+		if codec.ExtensionName(msg) != sessionBindExtension {
+			return
+		}
+		binding, err := parseSessionBind(msg)
+		if err != nil {
+			f.log.warnf("Ignoring invalid %s request: %v", sessionBindExtension, err)
+			return
+		}
+		f.pendingBinding = binding
+
+	case codec.AgentcSignRequest:
+		metricSignsForwarded.inc()
+		fingerprint := signRequestKey(msg)
+		if fingerprint == "" {
+			return
+		}
+		if f.binding != nil {
+			f.log.infof("Forwarding sign request with key %s for %s", fingerprint, f.binding)
+		} else {
+			f.log.infof("Forwarding sign request with key %s", fingerprint)
+		}
+		f.pendingSign = fingerprint
+	}
+}
+
+// observeResponse records the state carried by the agent response "msg", which includes the
+// length prefix, to the request last passed to observeRequest.
+func (f *messageFilter) observeResponse(msg []byte) {
+	if f.pendingSign != "" {
+		if len(msg) >= 5 && msg[4] == codec.AgentSignResponse {
+			f.auditSign(f.pendingSign, auditSigned, "")
+			host := ""
+			if f.binding != nil {
+				host = f.binding.String()
+			}
+			signStats.record(f.pendingSign, host, time.Now())
+		} else {
+			f.auditSign(f.pendingSign, auditFailed, "")
+		}
+		f.pendingSign = ""
+	}
+
+	if len(msg) >= 5 && msg[4] == codec.AgentSuccess {
+		if f.pendingKey != "" {
+			destinationConstraints.record(f.agentPath, f.pendingKey, f.pendingDestinations)
+		}
+		if f.pendingRemoveAll {
+			destinationConstraints.forget(f.agentPath)
+		}
+	}
+	f.pendingKey = ""
+	f.pendingDestinations = nil
+	f.pendingRemoveAll = false
+
+	if f.pendingLock != 0 {
+		if len(msg) >= 5 && msg[4] == codec.AgentSuccess && f.locks != nil {
+			locked := f.pendingLock == codec.AgentcLock
+			f.locks.set(f.agentPath, locked)
+			if locked {
+				f.log.infof("Client locked the agent")
+			} else {
+				f.log.infof("Client unlocked the agent")
+			}
+		}
+		f.pendingLock = 0
+	}
+
+	binding := f.pendingBinding
+	f.pendingBinding = nil
+	if binding == nil || len(msg) < 5 || msg[4] != codec.AgentSuccess {
+		// The agent verifies the signature of the session binding and we must not trust
+		// it unless the agent did.
+		return
+	}
+
+	f.binding = binding
+	if binding.forwarding {
+		f.log.infof("Client is forwarding the agent to %s", binding)
+	} else {
+		f.log.infof("Client is authenticating to %s", binding)
+	}
+}
+
+// rewriteRequest returns the client request "msg", which includes the length prefix, as it
+// has to be forwarded to the agent.
+func (f *messageFilter) rewriteRequest(msg []byte) ([]byte, error) {
+	if f.constraints == nil {
+		return msg, nil
+	}
+	return f.constraints.rewriteAddRequest(msg)
+}
+
+// isFingerprint returns true if the hidden key "pattern" is a fingerprint instead of a
+// comment glob.
+func isFingerprint(pattern string) bool {
+	return strings.HasPrefix(pattern, "SHA256:")
+}
+
+// hides returns true if the key "id" must not be exposed to clients.
+func (f *messageFilter) hides(id codec.Identity) bool {
+	for _, pattern := range f.hidden {
+		if isFingerprint(pattern) {
+			if pattern == id.Fingerprint() {
+				return true
+			}
+		} else if matched, _ := filepath.Match(pattern, id.Comment); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// hidesComments returns true if any hidden key is identified by its comment.
+func (f *messageFilter) hidesComments() bool {
+	for _, pattern := range f.hidden {
+		if !isFingerprint(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHiddenSign returns an error if the SSH_AGENTC_SIGN_REQUEST message "msg", which
+// includes the length prefix, uses a hidden key.
+func (f *messageFilter) checkHiddenSign(msg []byte) error {
+	request, err := codec.ParseSignRequest(msg)
+	if err != nil {
+		return fmt.Errorf("cannot parse sign request: %v", err)
+	}
+
+	key := codec.Identity{Blob: request.KeyBlob}
+	if f.hidesComments() {
+		// Sign requests do not carry the key comment so we have to ask the agent for it.
+		ids, err := requestIdentities(f.agent)
+		if err != nil {
+			return fmt.Errorf("cannot look up comment of key %s: %v", key.Fingerprint(), err)
+		}
+		for _, id := range ids {
+			if bytes.Equal(id.Blob, request.KeyBlob) {
+				key.Comment = id.Comment
+				break
+			}
+		}
+	}
+
+	if f.hides(key) {
+		return fmt.Errorf("key %s is hidden", key.Fingerprint())
+	}
+	return nil
+}
+
+// rewritesResponse returns true if the response to the client request "msg", which includes
+// the length prefix, must be passed through rewriteResponse.
+func (f *messageFilter) rewritesResponse(msg []byte) bool {
+	return len(f.hidden) > 0 && len(msg) >= 5 && msg[4] == codec.AgentcRequestIdentities
+}
+
+// rewriteResponse removes the hidden keys from the agent response "msg", which includes the
+// message type but not the length prefix.
+func (f *messageFilter) rewriteResponse(msg []byte) ([]byte, error) {
+	if msg[0] != codec.AgentIdentitiesAnswer {
+		return msg, nil
+	}
+
+	ids, err := codec.ParseIdentitiesAnswer(msg[1:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid identities answer: %v", err)
+	}
+	var visible []codec.Identity
+	for _, id := range ids {
+		if !f.hides(id) {
+			visible = append(visible, id)
+		}
+	}
+	return codec.EncodeIdentitiesAnswer(visible), nil
+}
+
+// checkRequest returns an error if the client request "msg", which includes the length
+// prefix, must not be forwarded to the agent.
+func (f *messageFilter) checkRequest(msg []byte) error {
+	if len(msg) < 5 {
+		return nil
+	}
+	msgType := msg[4]
+
+	if f.lock != nil {
+		if err := f.lock.check(); err != nil {
+			return err
+		}
+	}
+	if f.schedule != nil {
+		if err := f.schedule.check(time.Now()); err != nil {
+			return err
+		}
+	}
+
+	if f.readOnly && mutatingRequests[msgType] {
+		return fmt.Errorf("%s not allowed in read-only mode", codec.MessageName(msgType))
+	}
+
+	var extension string
+	description := codec.MessageName(msgType)
+	if msgType == codec.AgentcExtension {
+		extension = codec.ExtensionName(msg)
+		description = fmt.Sprintf("%s %q", description, extension)
+	}
+
+	if f.denied != nil && f.denied.contains(msgType, extension) {
+		return fmt.Errorf("%s denied by configuration", description)
+	}
+	if f.allowed != nil && !f.allowed.isEmpty() && !f.allowed.contains(msgType, extension) {
+		return fmt.Errorf("%s not in the list of allowed messages", description)
+	}
+
+	if msgType == codec.AgentcSignRequest {
+		if len(f.hidden) > 0 {
+			if err := f.checkHiddenSign(msg); err != nil {
+				return err
+			}
+		}
+
+		confirm := f.confirmSign
+		if f.idle != nil && f.idle.check(f.client, signRequestKey(msg)) {
+			confirm = true
+		}
+		polkit := false
+		var sign policy.Sign
+		if f.policy != nil {
+			fingerprint := signRequestKey(msg)
+			if fingerprint == "" {
+				return errors.New("cannot parse sign request")
+			}
+			sign = policy.Sign{
+				Fingerprint: fingerprint,
+				ClientExe:   f.client.exe,
+				Client:      f.client.String(),
+				Host:        f.binding.host(),
+			}
+			rule, err := f.policy.CheckSign(sign)
+			if err != nil {
+				return err
+			}
+			if rule != nil {
+				confirm = confirm || rule.Confirm
+				polkit = rule.Polkit
+			}
+		}
+		if polkit {
+			fingerprint := signRequestKey(msg)
+			details := map[string]string{"fingerprint": fingerprint, "client": f.client.String()}
+			if f.binding != nil {
+				details["host"] = f.binding.String()
+			}
+			if err := checkPolkitAuthorization(polkitSignAction, f.client, details); err != nil {
+				return fmt.Errorf("use of key %s: %v", fingerprint, err)
+			}
+		}
+		if confirm {
+			// Do not bother the user with requests that would be rejected anyway.
+			if f.limits != nil {
+				if err := f.limits.precheck(f.client); err != nil {
+					return err
+				}
+			}
+			if err := f.confirmer.confirmSign(msg, f.client, f.binding); err != nil {
+				return err
+			}
+		}
+
+		// Only count the requests that the user approved so that declining a prompt does
+		// not use up the allowance of the key or the client.
+		if recorder, ok := f.policy.(policy.Recorder); ok {
+			if err := recorder.RecordSign(sign); err != nil {
+				return err
+			}
+		}
+		if f.limits != nil {
+			if err := f.limits.check(f.client); err != nil {
+				return err
+			}
+		}
+	}
+
+	if f.polkitAddKey && isAddRequest(msgType) {
+		details := map[string]string{"client": f.client.String()}
+		if err := checkPolkitAuthorization(polkitAddKeyAction, f.client, details); err != nil {
+			return fmt.Errorf("%s: %v", description, err)
+		}
+	}
+	return nil
+}
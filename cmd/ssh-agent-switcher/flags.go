@@ -0,0 +1,128 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// stringListFlag is a flag that can be given multiple times and accumulates all the values
+// given to it.
+type stringListFlag []string
+
+// String implements flag.Value.
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+// Set implements flag.Value.
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// regexpListFlag is a flag that can be given multiple times and accumulates all the regular
+// expressions given to it, which are validated as they are set.
+type regexpListFlag []*regexp.Regexp
+
+// String implements flag.Value.
+func (f *regexpListFlag) String() string {
+	var exprs []string
+	for _, re := range *f {
+		exprs = append(exprs, re.String())
+	}
+	return strings.Join(exprs, ",")
+}
+
+// Set implements flag.Value.
+func (f *regexpListFlag) Set(value string) error {
+	re, err := regexp.Compile(value)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, re)
+	return nil
+}
+
+// matchesAny returns true if "s" matches any of the regular expressions in "f".
+func (f regexpListFlag) matchesAny(s string) bool {
+	for _, re := range f {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// socketPathFlag is a flag that can be given multiple times to listen on several sockets.  The
+// first value replaces the default and names the primary socket, which is the one that we
+// export to other programs and that the subcommands talk to.
+type socketPathFlag struct {
+	primary string
+	extra   []string
+	set     bool
+
+	// host is the host name that qualify appended to all paths, if any.
+	host string
+}
+
+// String implements flag.Value.
+func (f *socketPathFlag) String() string {
+	return strings.Join(f.paths(), ",")
+}
+
+// Set implements flag.Value.
+func (f *socketPathFlag) Set(value string) error {
+	if !f.set {
+		f.primary = value
+		f.set = true
+	} else {
+		f.extra = append(f.extra, value)
+	}
+	return nil
+}
+
+// paths returns the primary socket followed by the extra ones.
+func (f *socketPathFlag) paths() []string {
+	return append([]string{f.primary}, f.extra...)
+}
+
+// qualify appends the host name "host" to all paths so that several hosts can put their
+// sockets in the same shared directory.
+func (f *socketPathFlag) qualify(host string) {
+	f.host = host
+	f.primary += "." + host
+	for i := range f.extra {
+		f.extra[i] += "." + host
+	}
+}
+
+// unqualified returns "path" without the host name that qualify appended to it.
+func (f *socketPathFlag) unqualified(path string) string {
+	if f.host == "" {
+		return path
+	}
+	return strings.TrimSuffix(path, "."+f.host)
+}
@@ -0,0 +1,98 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+
+	"github.com/jmmv/ssh-agent-switcher/discovery"
+	"github.com/jmmv/ssh-agent-switcher/selection"
+)
+
+// findGpgAgent selects the gpg-agent socket to which to proxy a client among those matching
+// "pattern", with the same heuristics that we use for SSH agents.
+func findGpgAgent(pattern string, logger *connLogger) (net.Conn, selection.Decision, error) {
+	selector := &selection.FirstReachable{OwnSockets: ownSockets, SkipIdentify: true}
+	discoverer := &loggingDiscoverer{Discoverer: &discovery.Glob{Pattern: pattern}}
+	agent, decision, err := selection.Find(discoverer, selector)
+	for _, rejected := range decision.Rejected {
+		var skipped *selection.SkippedError
+		if !errors.As(rejected.Err, &skipped) {
+			logger.debugf("Ignoring %s: %v", rejected.Path, rejected.Err)
+		}
+	}
+	return agent, decision, err
+}
+
+// handleGpgConnection proxies the gpg-agent "client" to the selected gpg-agent socket.  The
+// Assuan protocol spoken by gpg-agent is forwarded verbatim: none of the request filters
+// apply to it.
+func handleGpgConnection(client net.Conn, pattern string) {
+	logger := newConnLogger(nextConnectionID.Add(1))
+	logger.infof("Accepted gpg-agent client connection")
+	defer client.Close()
+
+	peers := clientPolicy{
+		checkUid:       *checkPeer,
+		allowedExes:    allowClientExe,
+		allowedCgroups: allowClientCgroup,
+	}
+	if err := peers.authorize(client); err != nil {
+		logger.infof("Rejecting connection: %v", err)
+		return
+	}
+	if err := emergencyLock.check(); err != nil {
+		logger.infof("Rejecting connection: %v", err)
+		return
+	}
+
+	agent, decision, err := findGpgAgent(pattern, logger)
+	if err != nil {
+		logger.errorf("Dropping gpg-agent connection: %v", err)
+		return
+	}
+	defer agent.Close()
+	logger.infof("Successfully opened gpg-agent at %s (%s)", decision.Winner, decision.Reason)
+
+	go func() {
+		io.Copy(agent, client)
+		agent.(*net.UnixConn).CloseWrite()
+	}()
+	io.Copy(client, agent)
+	logger.infof("Closing gpg-agent client connection")
+}
+
+// serveGpg accepts gpg-agent clients on "listener" until it fails.
+func serveGpg(listener net.Listener, pattern string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			errorf("Cannot accept gpg-agent connections: %v", err)
+			return
+		}
+		go handleGpgConnection(conn, pattern)
+	}
+}
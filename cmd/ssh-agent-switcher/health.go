@@ -0,0 +1,111 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/selection"
+)
+
+// Exit codes of the healthcheck subcommand.  Usage errors exit with 1 like every other
+// subcommand does.
+const (
+	// healthOK indicates that the daemon is healthy.
+	healthOK = 0
+
+	// healthNotRunning indicates that nothing is listening on the daemon's socket.
+	healthNotRunning = 2
+
+	// healthNoAgent indicates that no agent is currently reachable.
+	healthNoAgent = 3
+
+	// healthNotAnswering indicates that the daemon accepted the connection but did not
+	// answer a request in time.
+	healthNotAnswering = 4
+)
+
+// findReachableAgent returns the path to the agent under "dir" that would be selected for a
+// new client, trying the locked agents and the agent named by "pinFile" first.  Unlike
+// findAgentSocket, this does not leave a trace in the logs or the selection history.
+func findReachableAgent(dir string, pinFile string) (string, error) {
+	conn, decision, err := selection.Find(newDiscoverer(dir, preferredAgents(pinFile)), newSelector())
+	if err != nil {
+		return "", err
+	}
+	conn.Close()
+	return decision.Winner, nil
+}
+
+// checkHealth checks whether the daemon listening on "socketPath" is running and able to
+// proxy requests to the agents under "dir", waiting at most "timeout" for it to answer.
+// Returns one of the health* exit codes and a description of the problem, if any.
+func checkHealth(socketPath string, dir string, timeout time.Duration) (int, error) {
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if err != nil {
+		return healthNotRunning, fmt.Errorf("daemon not running: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := findReachableAgent(dir, *pinFile); err != nil {
+		return healthNoAgent, fmt.Errorf("no agent reachable: %v", err)
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := requestIdentities(conn); err != nil {
+		return healthNotAnswering, fmt.Errorf("daemon not answering: %v", err)
+	}
+	return healthOK, nil
+}
+
+// runHealthcheck implements the healthcheck subcommand, which reports whether the daemon is
+// healthy via its exit code for the benefit of monitoring systems.
+func runHealthcheck(args []string) error {
+	fs := flag.NewFlagSet("healthcheck", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 5*time.Second, "how long to wait for the daemon to answer")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("healthcheck takes no arguments")
+	}
+	if *timeout <= 0 {
+		return errors.New("-timeout must be positive")
+	}
+
+	// Discovery diagnostics would get in the way of the one-line status that monitoring
+	// systems expect.
+	defer silenceLogs()()
+
+	code, err := checkHealth(*socketPath, config.AgentsDir, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stdout, "CRITICAL: %v\n", err)
+		os.Exit(code)
+	}
+	fmt.Fprintf(os.Stdout, "OK: daemon answering on %s\n", *socketPath)
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+)
+
+// cachedIdentities is the answer of an agent to an identities request.
+type cachedIdentities struct {
+	// response is the answer, including the length prefix.
+	response []byte
+
+	// expires is when the answer must be fetched from the agent again.
+	expires time.Time
+}
+
+// identitiesCache remembers the answers of the agents to identities requests for a short time
+// because clients like ssh send one before nearly every connection and most of them are the
+// same.  Requests that change the keys of an agent through us invalidate its answer right away.
+type identitiesCache struct {
+	// ttl is how long the answers are reused for.
+	ttl time.Duration
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// entries maps the paths to the agent sockets to their answers.
+	entries map[string]cachedIdentities
+
+	// generation counts the invalidations so that answers fetched before one are not stored.
+	generation uint64
+}
+
+// identitiesResponses caches the identities of the agents.  Nil if -identitiesCacheTTL is zero.
+var identitiesResponses *identitiesCache
+
+// newIdentitiesCache creates a cache that reuses the answers for "ttl".
+func newIdentitiesCache(ttl time.Duration) *identitiesCache {
+	return &identitiesCache{ttl: ttl, entries: make(map[string]cachedIdentities)}
+}
+
+// isIdentitiesRequest checks whether the client request "msg", which includes the length
+// prefix, asks for the identities of the agent.
+func isIdentitiesRequest(msg []byte) bool {
+	return len(msg) == 5 && msg[4] == codec.AgentcRequestIdentities
+}
+
+// lookup returns a copy of the cached answer of the agent at "path" to "request", or nil if
+// "request" is not an identities request or there is no valid answer.  In the latter case,
+// also returns the generation to pass to store once the answer has been fetched.
+func (c *identitiesCache) lookup(path string, request []byte) ([]byte, uint64) {
+	if c == nil || !isIdentitiesRequest(request) {
+		return nil, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[path]
+	if !ok || time.Now().After(entry.expires) {
+		delete(c.entries, path)
+		return nil, c.generation
+	}
+	return append([]byte{}, entry.response...), 0
+}
+
+// store caches "response", which includes the length prefix, as the answer of the agent at
+// "path" to "request" if it is a successful answer to an identities request and the cache was
+// not invalidated since "generation" was returned by lookup.
+func (c *identitiesCache) store(path string, request []byte, generation uint64, response []byte) {
+	if c == nil || !isIdentitiesRequest(request) || len(response) < 5 || response[4] != codec.AgentIdentitiesAnswer {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.generation != generation {
+		return
+	}
+	now := time.Now()
+	for other, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, other)
+		}
+	}
+	c.entries[path] = cachedIdentities{
+		response: append([]byte{}, response...),
+		expires:  now.Add(c.ttl),
+	}
+}
+
+// invalidate forgets the answer of the agent at "path" if "request" may change its keys.
+func (c *identitiesCache) invalidate(path string, request []byte) {
+	if c == nil || len(request) < 5 || !mutatingRequests[request[4]] {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, path)
+	c.generation++
+}
@@ -0,0 +1,71 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// errIdleTimeUnsupported indicates that we cannot determine session idle times on this
+// platform.
+var errIdleTimeUnsupported = errors.New("idle time detection not supported on this platform")
+
+// errNoSessions indicates that the user has no interactive sessions whose idle time we can
+// check.
+var errNoSessions = errors.New("no interactive sessions")
+
+// idleCheck scrutinizes sign requests that arrive while the user appears to be away.
+type idleCheck struct {
+	// threshold is how long the session of the user must have been idle for a sign request
+	// to be considered suspicious.
+	threshold time.Duration
+
+	// confirm asks the user to approve suspicious sign requests instead of just warning
+	// about them.
+	confirm bool
+
+	// tracker is used to send desktop notifications about suspicious sign requests.
+	tracker *selectionTracker
+}
+
+// check looks at how long the session of "client" has been idle when it issues a sign request
+// with the key "fingerprint".  Returns true if the user must confirm the request.
+func (c *idleCheck) check(client clientInfo, fingerprint string) bool {
+	idle, err := sessionIdleTime(client.pid)
+	if err != nil {
+		if err != errIdleTimeUnsupported && err != errNoSessions {
+			errorf("Cannot determine idle time of %s: %v", client, err)
+		}
+		return false
+	}
+	if idle < c.threshold {
+		return false
+	}
+
+	idle = idle.Truncate(time.Second)
+	warnf("%s requested a signature with key %s while the session was idle for %v", client, fingerprint, idle)
+	c.tracker.notifyf("Key used while idle", "%s requested a signature with key %s after %v of inactivity", client, fingerprint, idle)
+	return c.confirm
+}
@@ -0,0 +1,322 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// utmpPath is the location of the utmp database that records the active login sessions.
+const utmpPath = "/var/run/utmp"
+
+// utmpIdleThreshold is how long the terminal of a utmp session must go without input for the
+// agents of the session to be demoted as idle.
+const utmpIdleThreshold = time.Hour
+
+// Layout of a utmp record as defined by glibc.  Records are stored in the native byte order and
+// we assume that to be little-endian, as is the case in all the platforms we care about.
+const (
+	utmpRecordSize  = 384
+	utmpTypeOffset  = 0
+	utmpPidOffset   = 4
+	utmpLineOffset  = 8
+	utmpLineSize    = 32
+	utmpUserOffset  = 44
+	utmpUserSize    = 32
+	utmpUserProcess = 7
+)
+
+// processStat returns the fields of the stat file of the process "pid" that follow the command
+// name, starting with the state.
+func processStat(pid int) ([]string, error) {
+	stat, err := os.ReadFile(procFile(pid, "stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	// The command name can contain spaces and parenthesis so skip past the last one.
+	end := bytes.LastIndexByte(stat, ')')
+	if end == -1 {
+		return nil, errors.New("invalid stat file")
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 5 {
+		return nil, errors.New("invalid stat file")
+	}
+	return fields, nil
+}
+
+// processTty returns the device number of the controlling terminal of the process "pid", or
+// zero if it has none.
+func processTty(pid int) (uint64, error) {
+	fields, err := processStat(pid)
+	if err != nil {
+		return 0, err
+	}
+	// Fields after the command name: state, ppid, pgrp, session, tty_nr.
+	tty, err := strconv.ParseUint(fields[4], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid tty_nr: %v", err)
+	}
+	return tty, nil
+}
+
+// processParent returns the PID of the parent of the process "pid".
+func processParent(pid int) (int, error) {
+	fields, err := processStat(pid)
+	if err != nil {
+		return 0, err
+	}
+	ppid, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid ppid: %v", err)
+	}
+	return ppid, nil
+}
+
+// findTtyDevice returns the path to the terminal device with number "rdev".
+func findTtyDevice(rdev uint64) (string, error) {
+	var candidates []string
+	for _, pattern := range []string{"/dev/pts/*", "/dev/tty*"} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return "", err
+		}
+		candidates = append(candidates, matches...)
+	}
+
+	for _, path := range candidates {
+		var st syscall.Stat_t
+		if err := syscall.Stat(path, &st); err != nil {
+			continue
+		}
+		if st.Mode&syscall.S_IFMT == syscall.S_IFCHR && uint64(st.Rdev) == rdev {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("no device for terminal %d", rdev)
+}
+
+// ttyIdleTime returns how long ago the terminal at "path" last received input.
+func ttyIdleTime(path string, now time.Time) (time.Duration, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, err
+	}
+	atime := time.Unix(int64(st.Atim.Sec), int64(st.Atim.Nsec))
+	return now.Sub(atime), nil
+}
+
+// cString returns the NUL-terminated string at the beginning of "b".
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i != -1 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// utmpEntry is a login session recorded in utmp.
+type utmpEntry struct {
+	pid  int
+	user string
+	tty  string
+}
+
+// readUtmp returns the login sessions that are active according to utmp.
+func readUtmp() ([]utmpEntry, error) {
+	data, err := os.ReadFile(utmpPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var entries []utmpEntry
+	for len(data) >= utmpRecordSize {
+		record := data[:utmpRecordSize]
+		data = data[utmpRecordSize:]
+
+		if binary.LittleEndian.Uint16(record[utmpTypeOffset:]) != utmpUserProcess {
+			continue
+		}
+		line := cString(record[utmpLineOffset : utmpLineOffset+utmpLineSize])
+		if line == "" || strings.Contains(line, "/..") {
+			continue
+		}
+		entries = append(entries, utmpEntry{
+			pid:  int(int32(binary.LittleEndian.Uint32(record[utmpPidOffset:]))),
+			user: cString(record[utmpUserOffset : utmpUserOffset+utmpUserSize]),
+			tty:  filepath.Join("/dev", line),
+		})
+	}
+	return entries, nil
+}
+
+// userTtys returns the paths to the terminals in which "username" is logged in according to
+// utmp.
+func userTtys(username string) ([]string, error) {
+	entries, err := readUtmp()
+	if err != nil {
+		return nil, err
+	}
+
+	var ttys []string
+	for _, entry := range entries {
+		if entry.user == username {
+			ttys = append(ttys, entry.tty)
+		}
+	}
+	return ttys, nil
+}
+
+// utmpSessionOf returns the login session that utmp records for the session process "pid".
+//
+// sshd records the sessions that have a terminal under the PID of either the session process
+// or the shell that it spawns, so we match both.
+func utmpSessionOf(pid int) (*utmpEntry, error) {
+	entries, err := readUtmp()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.pid != pid {
+			if ppid, err := processParent(entry.pid); err != nil || ppid != pid {
+				continue
+			}
+		}
+		return &entry, nil
+	}
+	return nil, errors.New("not in utmp")
+}
+
+// utmpSessionRank returns how preferable the agents of the session process "pid" are based on
+// the login session that utmp records for it, along with a description of that login session.
+// A session whose terminal has not received input for utmpIdleThreshold is considered idle.
+func utmpSessionRank(pid int) (int, string, error) {
+	entry, err := utmpSessionOf(pid)
+	if err != nil {
+		return 0, "", err
+	}
+	idle, err := ttyIdleTime(entry.tty, time.Now())
+	if err != nil {
+		return 0, "", err
+	}
+	idle = idle.Truncate(time.Second)
+	if idle >= utmpIdleThreshold {
+		return rankIdle, fmt.Sprintf("a utmp session on %s that is idle for %v", entry.tty, idle), nil
+	}
+	return rankActive, fmt.Sprintf("a utmp session on %s that was active %v ago", entry.tty, idle), nil
+}
+
+// sessionTerminalIdleTime returns the path to the terminal of the SSH session whose session
+// process is "pid" and how long ago the terminal last received input.
+//
+// The terminal is the pseudo-terminal that the session process holds open, if we can see it,
+// or the one that utmp records for the session.
+func sessionTerminalIdleTime(pid int) (string, time.Duration, error) {
+	tty := ""
+	fds, _ := filepath.Glob(filepath.Join(procFile(pid, "fd"), "*"))
+	for _, fd := range fds {
+		if link, err := os.Readlink(fd); err == nil && strings.HasPrefix(link, "/dev/pts/") {
+			tty = link
+			break
+		}
+	}
+	if tty == "" {
+		entry, err := utmpSessionOf(pid)
+		if err != nil {
+			return "", 0, err
+		}
+		tty = entry.tty
+	}
+
+	idle, err := ttyIdleTime(tty, time.Now())
+	if err != nil {
+		return "", 0, err
+	}
+	return tty, idle, nil
+}
+
+// sessionIdleTime returns how long the interactive session of the process "pid" has been idle.
+//
+// If the process has a controlling terminal, this is the time since the terminal last received
+// input.  Otherwise, this is the shortest idle time of all the terminals in which the current
+// user is logged in.
+func sessionIdleTime(pid int) (time.Duration, error) {
+	now := time.Now()
+
+	if pid != 0 {
+		tty, err := processTty(pid)
+		if err != nil {
+			return 0, err
+		}
+		if tty != 0 {
+			path, err := findTtyDevice(tty)
+			if err != nil {
+				return 0, err
+			}
+			return ttyIdleTime(path, now)
+		}
+	}
+
+	current, err := user.Current()
+	if err != nil {
+		return 0, err
+	}
+	ttys, err := userTtys(current.Username)
+	if err != nil {
+		return 0, err
+	}
+	if len(ttys) == 0 {
+		return 0, errNoSessions
+	}
+
+	var shortest time.Duration
+	found := false
+	for _, tty := range ttys {
+		idle, err := ttyIdleTime(tty, now)
+		if err != nil {
+			continue
+		}
+		if !found || idle < shortest {
+			shortest = idle
+			found = true
+		}
+	}
+	if !found {
+		return 0, errors.New("cannot stat any terminal")
+	}
+	return shortest, nil
+}
@@ -0,0 +1,2771 @@
+# Copyright 2023 Julio Merino.
+# All rights reserved.
+#
+# Redistribution and use in source and binary forms, with or without modification, are permitted
+# provided that the following conditions are met:
+#
+# * Redistributions of source code must retain the above copyright notice, this list of conditions
+#   and the following disclaimer.
+# * Redistributions in binary form must reproduce the above copyright notice, this list of
+#   conditions and the following disclaimer in the documentation and/or other materials provided with
+#   the distribution.
+# * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+#   promote products derived from this software without specific prior written permission.
+#
+# THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+# IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+# FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+# CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+# DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+# DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+# WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+# WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+shtk_import unittest
+
+shtk_unittest_add_fixture standalone
+standalone_fixture() {
+    setup() {
+        # Unix domain socket names have tight length limitations so we must place them under
+        # /tmp (instead of the current work directory, which would be preferrable because then
+        # we would get automatic cleanup).
+        SOCKETS_ROOT="$(mktemp -d -p /tmp)"
+    }
+
+    teardown() {
+        [ ! -e pid ] || kill "$(cat pid)"
+
+        rm -rf "${SOCKETS_ROOT}"
+    }
+
+    shtk_unittest_add_test default_socket_path
+    default_socket_path_test() {
+        USER=fake-user ../ssh-agent-switcher_/ssh-agent-switcher 2>switcher.log &
+        echo "${!}" >pid  # For teardown.
+
+        while [ ! -e /tmp/ssh-agent.fake-user ]; do
+            sleep 0.01
+        done
+    }
+
+    shtk_unittest_add_test version
+    version_test() {
+        expect_command -s 0 -o match:"^ssh-agent-switcher " \
+            ../ssh-agent-switcher_/ssh-agent-switcher -version
+        expect_command -s 0 -o match:"^ssh-agent-switcher " \
+            ../ssh-agent-switcher_/ssh-agent-switcher version
+        expect_command -s 1 -e match:"version takes no arguments" \
+            ../ssh-agent-switcher_/ssh-agent-switcher version extra
+    }
+
+    shtk_unittest_add_test check_config
+    check_config_test() {
+        expect_command -s 0 -o inline:"Configuration OK\n" \
+            ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${SOCKETS_ROOT}/socket" \
+            check-config
+
+        echo '{"keys": [{"fingerprint": "SHA256:abc"}]}' >policy.json
+        touch not-a-dir
+        expect_command -s 1 -e save:check.log \
+            ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "$(pwd)/not-a-dir/socket" \
+            -scanTimeout=-1s -policyFile policy.json -hideKey '[' check-config
+        expect_file match:"invalid -scanTimeout -1s" check.log
+        expect_file match:"invalid -socketPath .*/not-a-dir/socket: .*/not-a-dir is not a directory" \
+            check.log
+        expect_file match:"fingerprint \"SHA256:abc\" is not a SHA256 fingerprint" check.log
+        expect_file match:"invalid -hideKey \"\[\"" check.log
+        expect_file match:"found 4 problems in the configuration" check.log
+    }
+
+    shtk_unittest_add_test ssh_config
+    ssh_config_test() {
+        mkdir -m 0700 ssh
+        printf 'Host example.com\n    User me\n' >ssh/config
+
+        for i in 1 2; do
+            expect_command -s 0 -o match:"ssh now uses the agent at ${SOCKETS_ROOT}/socket" \
+                ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${SOCKETS_ROOT}/socket" \
+                ssh-config -config ssh/config -fragment ssh/switcher.conf install
+        done
+        cat >expout <<EOF
+Include $(pwd)/ssh/switcher.conf
+Host example.com
+    User me
+EOF
+        expect_file file:expout ssh/config
+        expect_file match:"^    IdentityAgent ${SOCKETS_ROOT}/socket$" ssh/switcher.conf
+        expect_command -s 0 -o match:"identityagent ${SOCKETS_ROOT}/socket" -e ignore \
+            ssh -F ssh/config -G other.example.com
+
+        expect_command -s 0 -o match:"Removed" \
+            ../ssh-agent-switcher_/ssh-agent-switcher \
+            ssh-config -config ssh/config -fragment ssh/switcher.conf remove
+        printf 'Host example.com\n    User me\n' >expout
+        expect_file file:expout ssh/config
+        [ ! -e ssh/switcher.conf ] || fail "Fragment not removed"
+
+        echo "IdentityAgent none" >ssh/mine.conf
+        expect_command -s 1 -e match:"refusing to overwrite .*/ssh/mine.conf" \
+            ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${SOCKETS_ROOT}/socket" \
+            ssh-config -config ssh/config -fragment ssh/mine.conf install
+    }
+
+    shtk_unittest_add_test shell_init_per_host
+    shell_init_per_host_test() {
+        local socket="${SOCKETS_ROOT}/socket"
+        local host="$(hostname | cut -d . -f 1)"
+        ../ssh-agent-switcher_/ssh-agent-switcher -socketPathPerHost -socketPath "${socket}" \
+            -agentsDir "${SOCKETS_ROOT}" shell-init >init.sh
+        expect_file match:"SSH_AUTH_SOCK=${socket}.${host}; export SSH_AUTH_SOCK" init.sh
+
+        ( . ./init.sh )
+        while [ ! -e "${socket}.${host}" ]; do
+            sleep 0.01
+        done
+        pgrep -f -- "-socketPath=${socket}" >pid  # For teardown.
+        [ ! -e "${socket}" ] || fail "Unqualified socket created"
+
+        . ./init.sh
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+        [ "$(pgrep -f -- "-socketPath=${socket}" | wc -l)" -eq 1 ] || fail "Started a second daemon"
+    }
+
+    shtk_unittest_add_test ignore_sighup
+    ignore_sighup_test() {
+        local socket="${SOCKETS_ROOT}/socket"
+        ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${socket}" 2>switcher.log &
+        local pid="$!"
+        echo "${pid}" >pid  # For teardown.
+
+        # Wait for the socket to appear.
+        while [ ! -e "${socket}" ]; do
+            sleep 0.01
+        done
+
+        kill -HUP "${pid}"
+
+        # Wait a little bit to see if the socket is cleared.  This is racy and may fail to detect
+        # a legitimate bug, but it should not raise a false failure.
+        local i=0
+        while [ "${i}" -lt 10 ]; do
+            [ -e "${socket}" ] || fail "Daemon exited and deleted file"
+            sleep 0.01
+            i=$((i + 1))
+        done
+    }
+
+    shtk_unittest_add_test create_socket_dir
+    create_socket_dir_test() {
+        local socket="${SOCKETS_ROOT}/run/ssh-agent-switcher/socket"
+        ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${socket}" 2>switcher.log &
+        echo "${!}" >pid  # For teardown.
+
+        while [ ! -e "${socket}" ]; do
+            sleep 0.01
+        done
+        expect_command -s 0 -o inline:"700\n" stat -c "%a" "$(dirname "${socket}")"
+
+        mkdir -m 0770 "${SOCKETS_ROOT}/shared"
+        expect_command -s 1 -e match:"shared is writable by other users" \
+            ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${SOCKETS_ROOT}/shared/socket"
+    }
+
+    shtk_unittest_add_test reclaim_socket
+    reclaim_socket_test() {
+        local socket="${SOCKETS_ROOT}/socket"
+        ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${socket}" 2>first.log &
+        local pid="${!}"
+        while [ ! -e "${socket}" ]; do
+            sleep 0.01
+        done
+
+        expect_command -s 1 -e match:"another ssh-agent-switcher instance is listening on it" \
+            ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${socket}"
+
+        kill -9 "${pid}"
+        wait "${pid}" || true
+        [ -e "${socket}" ] || fail "Killed daemon removed its socket"
+        ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${socket}" 2>second.log &
+        echo "${!}" >pid  # For teardown.
+        while ! grep -q "Listening on" second.log; do
+            sleep 0.01
+        done
+        expect_file match:"Removing stale socket ${socket}" second.log
+
+        ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${socket}" -force \
+            2>third.log &
+        local third="${!}"
+        while ! grep -q "Listening on" third.log; do
+            sleep 0.01
+        done
+        expect_file match:"Replacing ${socket}, on which another ssh-agent-switcher instance is listening, because of -force" \
+            third.log
+        kill "${third}"
+    }
+
+    shtk_unittest_add_test recreate_deleted_socket
+    recreate_deleted_socket_test() {
+        local socket="${SOCKETS_ROOT}/socket"
+        ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${socket}" \
+            -socketCheckInterval 100ms 2>switcher.log &
+        echo "${!}" >pid  # For teardown.
+        while [ ! -e "${socket}" ]; do
+            sleep 0.01
+        done
+
+        rm "${socket}"
+        while [ ! -e "${socket}" ]; do
+            sleep 0.01
+        done
+        expect_file match:"Recreated socket ${socket} after it was deleted" switcher.log
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${socket}" ssh-add -l
+    }
+
+    shtk_unittest_add_test never_select_own_socket
+    never_select_own_socket_test() {
+        local socket="${SOCKETS_ROOT}/ssh-self/agent.self"
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-self"
+        ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${socket}" \
+            --agentsDir "${SOCKETS_ROOT}" 2>switcher.log &
+        echo "${!}" >pid  # For teardown.
+
+        while [ ! -e "${socket}" ]; do
+            sleep 0.01
+        done
+
+        export SSH_AUTH_SOCK="${socket}"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+        expect_file match:"Ignoring .*/agent.self: is our own socket" switcher.log
+    }
+}
+
+# Starts a real SSH agent and an ssh-agent-switcher instance that proxies to it.
+#
+# Any arguments are passed as extra flags to ssh-agent-switcher.
+start_agent_and_switcher() {
+    # Unix domain socket names have tight length limitations so we must place them under
+    # /tmp (instead of the current work directory, which would be preferrable because then
+    # we would get automatic cleanup).
+    SOCKETS_ROOT="$(mktemp -d -p /tmp)"
+
+    # Place the agent socket under an ssh-* directory that sorts last.  We need this for
+    # the unknown files test.
+    AGENT_AUTH_SOCK="${SOCKETS_ROOT}/ssh-zzz/agent.bar"
+
+    mkdir -p -m 0700 "$(dirname "${AGENT_AUTH_SOCK}")"
+    ssh-agent -a "${AGENT_AUTH_SOCK}" >agent.env
+
+    SWITCHER_AUTH_SOCK="${SOCKETS_ROOT}/switcher"
+    ../ssh-agent-switcher_/ssh-agent-switcher \
+        --socketPath "${SWITCHER_AUTH_SOCK}" \
+        --agentsDir "${SOCKETS_ROOT}" \
+        "${@}" \
+        2>switcher.log &
+    SWITCHER_AGENT_PID="${!}"
+
+    # Wait for the socket to appear so that tests don't race with the daemon's startup.
+    while [ ! -e "${SWITCHER_AUTH_SOCK}" ]; do
+        sleep 0.01
+    done
+
+    export SSH_AUTH_SOCK="${SWITCHER_AUTH_SOCK}"
+}
+
+# Stops the processes started by start_agent_and_switcher and checks that they behaved.
+stop_agent_and_switcher() {
+    # Check that the expected real agent was used.
+    expect_file match:"opened.*${AGENT_AUTH_SOCK}" switcher.log
+    # Check that we didn't leave an open connection behind due to EOF mishandling.  Give the
+    # daemon a chance to notice that the last client went away first.
+    local i=0
+    while [ "${i}" -lt 100 ] && ! grep -q "Closing client connection" switcher.log; do
+        sleep 0.01
+        i=$((i + 1))
+    done
+    expect_file match:"Closing client connection" switcher.log
+
+    kill "${SWITCHER_AGENT_PID}"
+    # Make sure the daemon deletes the socket on exit.
+    while [ -e "${SWITCHER_AUTH_SOCK}" ]; do
+        sleep 0.01
+    done
+    expect_file match:"Shutting down.*${SWITCHER_AUTH_SOCK}" switcher.log
+
+    . agent.env
+    kill "${SSH_AGENT_PID}"
+
+    rm -rf "${SOCKETS_ROOT}"
+}
+
+shtk_unittest_add_fixture integration
+integration_fixture() {
+    setup() {
+        start_agent_and_switcher -logLevel=debug
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test list_identities
+    list_identities_test() {
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+        expect_file match:"Forwarding SSH_AGENT_IDENTITIES_ANSWER with 0 keys .* to the client" \
+            switcher.log
+    }
+
+    shtk_unittest_add_test connection_ids
+    connection_ids_test() {
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+
+        expect_file match:"\[conn 1\] Successfully opened SSH agent" switcher.log
+        expect_file match:"\[conn 1\] Closing client connection" switcher.log
+        expect_file match:"\[conn 2\] Accepted client connection" switcher.log
+    }
+
+    shtk_unittest_add_test add_identity
+    add_identity_test() {
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t rsa -b 1024 -N '' -f ./id_rsa
+        expect_command -s 0 -e match:"Identity added" ssh-add ./id_rsa
+        expect_file match:"Forwarding SSH_AGENTC_ADD_IDENTITY of type \"ssh-rsa\" .* to the agent" \
+            switcher.log
+    }
+
+    shtk_unittest_add_test list_many_identities
+    list_many_identities_test() {
+        # Enough keys for the identities answer to not fit in a single read.
+        local i=0
+        while [ "${i}" -lt 80 ]; do
+            assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' \
+                -C "a rather long comment for key number ${i}" -f "./id_${i}"
+            i=$((i + 1))
+        done
+        assert_command -s 0 -o ignore -e ignore ssh-add ./id_*[0-9]
+
+        assert_command -s 0 -o save:identities.out ssh-add -l
+        [ "$(wc -l <identities.out)" -eq 80 ] || fail "Expected 80 identities"
+        expect_file match:"key number 79" identities.out
+    }
+
+    shtk_unittest_add_test ping
+    ping_test() {
+        assert_command -s 0 -o save:ping.out ../ssh-agent-switcher_/ssh-agent-switcher \
+            --socketPath "${SWITCHER_AUTH_SOCK}" --agentsDir "${SOCKETS_ROOT}" ping -count 2
+        expect_file match:"selected ${AGENT_AUTH_SOCK} in" ping.out
+        expect_file match:"direct: min/avg/max" ping.out
+        expect_file match:"proxied: min/avg/max" ping.out
+    }
+
+    shtk_unittest_add_test ping_without_agent
+    ping_without_agent_test() {
+        mv "${SOCKETS_ROOT}/ssh-zzz" "${SOCKETS_ROOT}/hidden"
+        expect_command -s exit:3 -e match:"cannot select an agent: agent not found" \
+            ../ssh-agent-switcher_/ssh-agent-switcher \
+            --socketPath "${SWITCHER_AUTH_SOCK}" --agentsDir "${SOCKETS_ROOT}" ping
+        mv "${SOCKETS_ROOT}/hidden" "${SOCKETS_ROOT}/ssh-zzz"
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test healthcheck
+    healthcheck_test() {
+        expect_command -s 0 -o match:"OK: daemon answering" ../ssh-agent-switcher_/ssh-agent-switcher \
+            --socketPath "${SWITCHER_AUTH_SOCK}" --agentsDir "${SOCKETS_ROOT}" healthcheck
+        expect_command -s 2 -o match:"CRITICAL: daemon not running" \
+            ../ssh-agent-switcher_/ssh-agent-switcher \
+            --socketPath "${SOCKETS_ROOT}/missing" --agentsDir "${SOCKETS_ROOT}" healthcheck
+
+        mkdir -m 0700 "${SOCKETS_ROOT}/empty"
+        expect_command -s 3 -o match:"CRITICAL: no agent reachable" \
+            ../ssh-agent-switcher_/ssh-agent-switcher \
+            --socketPath "${SWITCHER_AUTH_SOCK}" --agentsDir "${SOCKETS_ROOT}/empty" healthcheck
+    }
+
+    shtk_unittest_add_test dump_state_and_rescan
+    dump_state_and_rescan_test() {
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+        while ! grep -q "Closing client connection" switcher.log; do
+            sleep 0.01
+        done
+
+        kill -USR1 "${SWITCHER_AGENT_PID}"
+        kill -USR2 "${SWITCHER_AGENT_PID}"
+        while ! grep -q "Rescan found" switcher.log; do
+            sleep 0.01
+        done
+
+        expect_file match:"State: selected agent: ${AGENT_AUTH_SOCK}" switcher.log
+        expect_file match:"State: candidate ${AGENT_AUTH_SOCK}" switcher.log
+        expect_file match:"State: 0 active connections" switcher.log
+        expect_file match:"Rescan found agent at ${AGENT_AUTH_SOCK}" switcher.log
+    }
+
+    shtk_unittest_add_test empty_agent_without_upstream
+    empty_agent_without_upstream_test() {
+        mv "${SOCKETS_ROOT}/ssh-zzz" "${SOCKETS_ROOT}/hidden"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+        expect_command -s 1 -e match:"Failed to remove all identities" ssh-add -D
+        expect_file match:"Acting as an empty agent: agent not found" switcher.log
+        mv "${SOCKETS_ROOT}/hidden" "${SOCKETS_ROOT}/ssh-zzz"
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test query_status
+    query_status_test() {
+        expect_command -s 0 -o save:query.out ../ssh-agent-switcher_/ssh-agent-switcher query
+        expect_file match:"^upstream: ${AGENT_AUTH_SOCK}$" query.out
+        expect_file match:"^reason: first reachable candidate in ${SOCKETS_ROOT}$" query.out
+
+        mv "${SOCKETS_ROOT}/ssh-zzz" "${SOCKETS_ROOT}/hidden"
+        expect_command -s 0 -o save:query.out ../ssh-agent-switcher_/ssh-agent-switcher query
+        expect_file match:"^upstream: none$" query.out
+        expect_file match:"^reason: agent not found$" query.out
+        mv "${SOCKETS_ROOT}/hidden" "${SOCKETS_ROOT}/ssh-zzz"
+
+        expect_command -s 1 -e match:"not supported" \
+            ../ssh-agent-switcher_/ssh-agent-switcher query -socket "${AGENT_AUTH_SOCK}"
+    }
+
+    shtk_unittest_add_test ignore_unknown_files
+    ignore_unknown_files_test() {
+        # Create garbage in the sockets directory.
+        touch "${SOCKETS_ROOT}/file-unknown"
+        mkdir "${SOCKETS_ROOT}/dir-unknown"
+        touch "${SOCKETS_ROOT}/ssh-not-a-dir"
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-empty"
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-foo"
+        touch "${SOCKETS_ROOT}/ssh-foo/unknown"
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-bar"
+        touch "${SOCKETS_ROOT}/ssh-bar/agent.not-a-socket"
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+
+        # Ensure that the garbage was ignored for the correct reasons.
+        expect_file match:"Ignoring.*/file-unknown.*not a directory" switcher.log
+        expect_file match:"Ignoring.*/dir-unknown.*not start with.*ssh-" switcher.log
+        expect_file match:"Ignoring.*/ssh-not-a-dir.*not a directory" switcher.log
+        expect_file match:"Ignoring.*/ssh-empty.*no socket" switcher.log
+        expect_file match:"Ignoring.*/ssh-foo/unknown.*start with.*agent" switcher.log
+        expect_file match:"Ignoring.*/ssh-bar/agent.not-a-socket.*not a socket" switcher.log
+    }
+
+    shtk_unittest_add_test dropbear_session
+    dropbear_session_test() {
+        local dir="${SOCKETS_ROOT}/dropbear-Xy12Ab"
+        mkdir -m 0700 "${dir}"
+        ssh-agent -a "${dir}/auth-0a1b2c3d-0" >dropbear.env
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+        expect_file match:"Successfully opened SSH agent at ${dir}/auth-0a1b2c3d-0" switcher.log
+
+        kill "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' dropbear.env)"
+        rm -rf "${dir}"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test teleport_session
+    teleport_session_test() {
+        local dir="${SOCKETS_ROOT}/teleport-1234567"
+        mkdir -m 0700 "${dir}"
+        ssh-agent -a "${dir}/teleport-$$.socket" >teleport.env
+
+        # The session directories of sshd sort first.
+        mv "${SOCKETS_ROOT}/ssh-zzz" "${SOCKETS_ROOT}/hidden"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+        expect_file match:"Successfully opened SSH agent at ${dir}/teleport-$$.socket" switcher.log
+        mv "${SOCKETS_ROOT}/hidden" "${SOCKETS_ROOT}/ssh-zzz"
+
+        kill "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' teleport.env)"
+        rm -rf "${dir}"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test skip_gone_sessions
+    skip_gone_sessions_test() {
+        sleep 0 &
+        local gone="${!}"
+        wait "${gone}"
+
+        # A live agent in a newer session directory whose session process is gone.
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-aaa"
+        ssh-agent -a "${SOCKETS_ROOT}/ssh-aaa/agent.${gone}" >gone.env
+
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -logLevel=debug
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Ignoring ${SOCKETS_ROOT}/ssh-aaa/agent.${gone}: session process ${gone} is gone" \
+            other.log
+        expect_file match:"Successfully opened SSH agent at ${AGENT_AUTH_SOCK}" other.log
+        kill $(cat other.pids)
+
+        kill "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' gone.env)"
+        rm -rf "${SOCKETS_ROOT}/ssh-aaa"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test cleanup_stale
+    cleanup_stale_test() {
+        sleep 0 &
+        local gone="${!}"
+        wait "${gone}"
+
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-stale" "${SOCKETS_ROOT}/ssh-keep"
+        ssh-agent -a "${SOCKETS_ROOT}/ssh-stale/agent.${gone}" >stale.env
+        kill -9 "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' stale.env)"
+        ssh-agent -a "${SOCKETS_ROOT}/ssh-keep/agent.${gone}" >keep.env
+        kill -9 "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' keep.env)"
+        touch "${SOCKETS_ROOT}/ssh-keep/unknown"
+
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -cleanupStale
+        while ! grep -q "Removed stale session directory" other.log; do
+            sleep 0.01
+        done
+        [ ! -e "${SOCKETS_ROOT}/ssh-stale" ] || fail "Stale session directory not removed"
+        [ -e "${SOCKETS_ROOT}/ssh-keep/agent.${gone}" ] || fail "Unknown session directory removed"
+        [ -e "${SOCKETS_ROOT}/ssh-zzz" ] || fail "Live session directory removed"
+        kill $(cat other.pids)
+
+        rm -rf "${SOCKETS_ROOT}/ssh-keep"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test multiple_sockets
+    multiple_sockets_test() {
+        local primary="${SOCKETS_ROOT}/primary"
+        local legacy="${SOCKETS_ROOT}/legacy"
+        start_other_switcher "${primary}" other.log -socketPath "${legacy}"
+        while [ ! -e "${legacy}" ]; do
+            sleep 0.01
+        done
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${primary}" ssh-add -l
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${legacy}" ssh-add -l
+        expect_file match:"Also listening on ${legacy}" other.log
+        kill $(cat other.pids)
+        wait $(cat other.pids)
+        [ ! -e "${legacy}" ] || fail "Extra socket not removed on exit"
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test socket_permissions
+    socket_permissions_test() {
+        local shared="${SOCKETS_ROOT}/shared"
+        start_other_switcher "${shared}" other.log -socketMode 0660 -socketGroup "$(id -g)"
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${shared}" ssh-add -l
+        expect_command -s 0 -o inline:"660 $(id -g)\n" stat -c "%a %g" "${shared}"
+        kill $(cat other.pids)
+
+        expect_command -s 1 -e match:"cannot grant access to other users" \
+            ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${SOCKETS_ROOT}/bad" \
+            -socketMode 0666
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test wait_for_agent
+    wait_for_agent_test() {
+        mv "${SOCKETS_ROOT}/ssh-zzz" "${SOCKETS_ROOT}/later"
+
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -waitForAgent 10s
+        env SSH_AUTH_SOCK="${other}" ssh-add -l >ssh-add.out 2>&1 &
+        local client="${!}"
+        while ! grep -q "Waiting up to 10s for an agent to appear" other.log; do
+            sleep 0.01
+        done
+        mv "${SOCKETS_ROOT}/later" "${SOCKETS_ROOT}/ssh-zzz"
+        wait "${client}" || true
+        expect_file match:"no identities" ssh-add.out
+        expect_file match:"Successfully opened SSH agent at ${AGENT_AUTH_SOCK}" other.log
+        kill $(cat other.pids)
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test dial_retries
+    dial_retries_test() {
+        mv "${SOCKETS_ROOT}/ssh-zzz" "${SOCKETS_ROOT}/hidden"
+
+        # An agent whose socket cannot be opened yet, as if it were still being created.
+        local late="${SOCKETS_ROOT}/ssh-late/agent.$$"
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-late"
+        ssh-agent -a "${late}" >stale.env
+        kill -9 "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' stale.env)"
+
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -dialRetries 3 -dialBackoff 1s
+        env SSH_AUTH_SOCK="${other}" ssh-add -l >ssh-add.out 2>&1 &
+        local client="${!}"
+        sleep 0.2
+        rm "${late}"
+        ssh-agent -a "${late}" >late.env
+        wait "${client}" || true
+        expect_file match:"no identities" ssh-add.out
+        expect_file match:"Successfully opened SSH agent at ${late}" other.log
+        kill $(cat other.pids)
+
+        kill "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' late.env)"
+        rm -rf "${SOCKETS_ROOT}/ssh-late"
+        mv "${SOCKETS_ROOT}/hidden" "${SOCKETS_ROOT}/ssh-zzz"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test failure_cooldown
+    failure_cooldown_test() {
+        local stale="${SOCKETS_ROOT}/ssh-stale/agent.$$"
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-stale"
+        ssh-agent -a "${stale}" >stale.env
+        kill -9 "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' stale.env)"
+
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -logLevel=debug -failureCooldown 1h
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Ignoring ${stale}: open failed" other.log
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Ignoring ${stale}: failed recently; not trying again until" other.log
+        expect_file match:"Successfully opened SSH agent at ${AGENT_AUTH_SOCK}" other.log
+        kill $(cat other.pids)
+
+        rm -rf "${SOCKETS_ROOT}/ssh-stale"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test warm_agent
+    warm_agent_test() {
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -logLevel=debug -warmInterval 1h
+        while ! grep -q "Keeping the agent at ${AGENT_AUTH_SOCK} warm" other.log; do
+            sleep 0.01
+        done
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Reusing the agent selected in the background" other.log
+
+        # A new session invalidates the agent kept warm.
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-new"
+        ssh-agent -a "${SOCKETS_ROOT}/ssh-new/agent.$$" >new.env
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Successfully opened SSH agent at ${SOCKETS_ROOT}/ssh-new/agent.$$" \
+            other.log
+        kill $(cat other.pids)
+
+        kill "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' new.env)"
+        rm -rf "${SOCKETS_ROOT}/ssh-new"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test require_agent
+    require_agent_test() {
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -requireAgent
+        expect_file match:"Self-test: candidate ${AGENT_AUTH_SOCK}" other.log
+        expect_file match:"Self-test found agent at ${AGENT_AUTH_SOCK}" other.log
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        kill $(cat other.pids)
+
+        mkdir empty
+        expect_command -s 1 -e match:"no usable agent found, as required by -requireAgent" \
+            ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${SOCKETS_ROOT}/bad" \
+            -agentsDir "$(pwd)/empty" -requireAgent
+        [ ! -e "${SOCKETS_ROOT}/bad" ] || fail "Socket created despite -requireAgent failing"
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test missing_agents_dir
+    missing_agents_dir_test() {
+        local later="${SOCKETS_ROOT}/later"
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -agentsDir "${later}"
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Agents directory ${later} does not exist yet" other.log
+        expect_file not-match:"no such file or directory" other.log
+
+        mkdir -m 0700 "${later}" "${later}/ssh-new"
+        ssh-agent -a "${later}/ssh-new/agent.$$" >new.env
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Agents directory ${later} appeared" other.log
+        expect_file match:"Successfully opened SSH agent at ${later}/ssh-new/agent.$$" other.log
+        kill $(cat other.pids)
+
+        kill "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' new.env)"
+        rm -rf "${later}"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test select_explain
+    select_explain_test() {
+        local stale="${SOCKETS_ROOT}/ssh-stale/agent.$$"
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-stale"
+        ssh-agent -a "${stale}" >stale.env
+        kill -9 "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' stale.env)"
+        touch "${SOCKETS_ROOT}/garbage"
+
+        expect_command -s 0 -o inline:"${AGENT_AUTH_SOCK}\n" \
+            ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${SWITCHER_AUTH_SOCK}" \
+            --agentsDir "${SOCKETS_ROOT}" select
+        ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${SWITCHER_AUTH_SOCK}" \
+            --agentsDir "${SOCKETS_ROOT}" select -explain >explain.out
+        expect_file match:"${stale}: rejected: open failed" explain.out
+        expect_file match:"${AGENT_AUTH_SOCK}: selected: first reachable candidate" explain.out
+        expect_file match:"${SOCKETS_ROOT}/garbage: " explain.out
+        expect_file match:"^Selected ${AGENT_AUTH_SOCK}$" explain.out
+
+        expect_command -s 1 -o match:"Candidates" -e match:"no agent would be selected" \
+            ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${SWITCHER_AUTH_SOCK}" \
+            --agentsDir "${SOCKETS_ROOT}/ssh-stale" select -explain
+
+        rm -rf "${SOCKETS_ROOT}/ssh-stale" "${SOCKETS_ROOT}/garbage"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test console_log_format
+    console_log_format_test() {
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -logFormat=console
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"^[0-9]{2}:[0-9]{2}:[0-9]{2}\.[0-9]{3} INF \[conn 1\] Successfully opened SSH agent" \
+            other.log
+        expect_file not-match:"$(printf '\033')" other.log
+        kill $(cat other.pids)
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test key_stats
+    key_stats_test() {
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -f ./id_ed25519
+        assert_command -s 0 -e ignore env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add ./id_ed25519
+
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -statsFile "$(pwd)/stats.json" \
+            -controlSocket "$(pwd)/control"
+        expect_command -s 0 env SSH_AUTH_SOCK="${other}" ssh-add -T ./id_ed25519.pub
+        expect_command -s 0 env SSH_AUTH_SOCK="${other}" ssh-add -T ./id_ed25519.pub
+        expect_command -s 0 -o match:"^SHA256:.* for unknown hosts: 2 signatures, last at " \
+            ../ssh-agent-switcher_/ssh-agent-switcher -controlSocket "$(pwd)/control" stats
+        kill $(cat other.pids)
+        rm other.pids
+
+        expect_command -s 0 -o match:"^SHA256:.* for unknown hosts: 2 signatures, last at " \
+            ../ssh-agent-switcher_/ssh-agent-switcher -statsFile "$(pwd)/stats.json" stats
+
+        expect_command -s 0 -o match:"ED25519" ssh-add -l
+    }
+
+    shtk_unittest_add_test destination_constraints
+    destination_constraints_test() {
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -f ./hostkey
+        echo "host.example.com $(cat hostkey.pub)" >known_hosts
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -C restricted -f ./restricted
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -C free -f ./free
+
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -controlSocket "$(pwd)/control"
+        expect_command -s 0 -e ignore env SSH_AUTH_SOCK="${other}" \
+            ssh-add -H known_hosts -h host.example.com ./restricted
+        expect_command -s 0 -e ignore env SSH_AUTH_SOCK="${other}" ssh-add ./free
+        expect_command -s 0 -o save:keys.out \
+            ../ssh-agent-switcher_/ssh-agent-switcher -controlSocket "$(pwd)/control" control keys
+        expect_file match:"^agent: ${AGENT_AUTH_SOCK}$" keys.out
+        expect_file match:"^key: ssh-ed25519 SHA256:.* restricted \(restricted to host.example.com\)$" keys.out
+        expect_file match:"^key: ssh-ed25519 SHA256:.* free$" keys.out
+
+        expect_command -s 0 -e ignore env SSH_AUTH_SOCK="${other}" ssh-add -d ./restricted.pub
+        expect_command -s 0 -o not-match:"restricted to" \
+            ../ssh-agent-switcher_/ssh-agent-switcher -controlSocket "$(pwd)/control" control keys
+        kill $(cat other.pids)
+
+        expect_command -s 0 -o match:"ED25519" ssh-add -l
+    }
+
+    shtk_unittest_add_test event_command
+    event_command_test() {
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -f ./id_ed25519
+        assert_command -s 0 -e ignore env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add ./id_ed25519
+
+        cat >event-hook <<EOF
+#! /bin/sh
+echo "\${SSH_AGENT_SWITCHER_EVENT} \$(cat)" >>"$(pwd)/events"
+EOF
+        chmod +x event-hook
+
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -eventCommand "$(pwd)/event-hook" \
+            -confirmSign -confirmProgram /bin/false
+        expect_command -s 1 -e match:"agent refused operation" \
+            env SSH_AUTH_SOCK="${other}" ssh-add -T ./id_ed25519.pub
+        local i=0
+        while [ ! -e events -a "${i}" -lt 500 ]; do
+            sleep 0.01
+            i=$((i + 1))
+        done
+        expect_file match:'^sign-rejected \{"time":".*","type":"sign-rejected","agent":"'"${AGENT_AUTH_SOCK}"'","key":"SHA256:.*","clientPid":[0-9]+,"clientExe":".*ssh-add","reason":"sign request not confirmed by the user"\}$' \
+            events
+        kill $(cat other.pids)
+
+        expect_command -s 0 -o match:"ED25519" ssh-add -l
+    }
+
+    shtk_unittest_add_test switch_profiles
+    switch_profiles_test() {
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -f ./id_ed25519
+        assert_command -s 0 -e ignore env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add ./id_ed25519
+
+        cat >profiles.json <<EOF
+{
+    "profiles": {
+        "paranoid": {"confirmSign": true, "readOnly": true}
+    }
+}
+EOF
+
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -profilesFile profiles.json \
+            -controlSocket "$(pwd)/control" -confirmProgram /bin/false
+        expect_command -s 0 env SSH_AUTH_SOCK="${other}" ssh-add -T ./id_ed25519.pub
+
+        expect_command -s 0 -o inline:"switched to profile paranoid\n" \
+            ../ssh-agent-switcher_/ssh-agent-switcher -controlSocket "$(pwd)/control" \
+            control profile paranoid
+        expect_command -s 0 \
+            -o inline:"active profile: paranoid; available profiles: default, paranoid\n" \
+            ../ssh-agent-switcher_/ssh-agent-switcher -controlSocket "$(pwd)/control" \
+            control profile
+        expect_command -s 1 -e match:"agent refused operation" \
+            env SSH_AUTH_SOCK="${other}" ssh-add -T ./id_ed25519.pub
+        expect_file match:"Switched to profile paranoid via the control socket" other.log
+
+        expect_command -s 1 -e match:"unknown profile \"bogus\"; valid profiles are: default, paranoid" \
+            ../ssh-agent-switcher_/ssh-agent-switcher -controlSocket "$(pwd)/control" \
+            control profile bogus
+
+        expect_command -s 0 -o inline:"switched to profile default\n" \
+            ../ssh-agent-switcher_/ssh-agent-switcher -controlSocket "$(pwd)/control" \
+            control profile default
+        expect_command -s 0 env SSH_AUTH_SOCK="${other}" ssh-add -T ./id_ed25519.pub
+        kill $(cat other.pids)
+
+        expect_command -s 0 -o match:"ED25519" ssh-add -l
+    }
+
+    shtk_unittest_add_test fallback_to_inherited_agent
+    fallback_to_inherited_agent_test() {
+        local local_agent="${SOCKETS_ROOT}/local"
+        ssh-agent -a "${local_agent}" >local.env
+        ssh-keygen -t ed25519 -N '' -f key >/dev/null
+        expect_command -s 0 -e ignore env SSH_AUTH_SOCK="${local_agent}" ssh-add key
+
+        local other="${SOCKETS_ROOT}/other"
+        SSH_AUTH_SOCK="${local_agent}" start_other_switcher "${other}" other.log \
+            -fallbackToInheritedAgent
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Falling back to the inherited agent ${local_agent}" other.log
+        expect_file match:"Successfully opened SSH agent at ${AGENT_AUTH_SOCK}" other.log
+
+        mv "${SOCKETS_ROOT}/ssh-zzz" "${SOCKETS_ROOT}/hidden"
+        expect_command -s 0 -o match:"ED25519" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Successfully opened SSH agent at ${local_agent}" other.log
+        mv "${SOCKETS_ROOT}/hidden" "${SOCKETS_ROOT}/ssh-zzz"
+
+        local self="${SOCKETS_ROOT}/self"
+        SSH_AUTH_SOCK="${self}" start_other_switcher "${self}" self.log \
+            -fallbackToInheritedAgent
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${self}" ssh-add -l
+        if grep "Falling back" self.log >/dev/null; then
+            fail "Fell back to our own socket"
+        fi
+        kill $(cat other.pids)
+        kill "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' local.env)"
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test discovery_order
+    discovery_order_test() {
+        local local_agent="${SOCKETS_ROOT}/local"
+        ssh-agent -a "${local_agent}" >local.env
+        ssh-keygen -t ed25519 -N '' -f key >/dev/null
+        expect_command -s 0 -e ignore env SSH_AUTH_SOCK="${local_agent}" ssh-add key
+
+        local other="${SOCKETS_ROOT}/other"
+        SSH_AUTH_SOCK="${local_agent}" start_other_switcher "${other}" other.log \
+            -fallbackToInheritedAgent -discoveryOrder=inherited,sessions
+        expect_command -s 0 -o match:"ED25519" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Successfully opened SSH agent at ${local_agent}" other.log
+        kill $(cat other.pids)
+        kill "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' local.env)"
+
+        expect_command -s 1 -e match:"unknown backend \"forwarded\"" \
+            ../ssh-agent-switcher_/ssh-agent-switcher -discoveryOrder=forwarded,sessions
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test identities_cache
+    identities_cache_test() {
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -logLevel=debug -identitiesCacheTTL 1h
+
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        if grep "from the identities cache" other.log >/dev/null; then
+            fail "First identities request answered from the cache"
+        fi
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Answering SSH_AGENTC_REQUEST_IDENTITIES from the identities cache" other.log
+
+        ssh-keygen -t ed25519 -N '' -f key >/dev/null
+        expect_command -s 0 -e ignore env SSH_AUTH_SOCK="${other}" ssh-add key
+        expect_command -s 0 -o match:"ED25519" env SSH_AUTH_SOCK="${other}" ssh-add -l
+
+        # Changes that do not go through us are only seen once the answer expires.
+        expect_command -s 0 -e ignore env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add -D
+        expect_command -s 0 -o match:"ED25519" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        kill $(cat other.pids)
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test slow_agent_threshold
+    slow_agent_threshold_test() {
+        local fast="${SOCKETS_ROOT}/fast"
+        ssh-agent -a "${fast}" >fast.env
+        ssh-keygen -t ed25519 -N '' -f key >/dev/null
+        expect_command -s 0 -e ignore env SSH_AUTH_SOCK="${fast}" ssh-add key
+
+        # Every agent is slower than 1ns, so the preferred one is demoted below the glob one
+        # once it has answered enough requests.
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -logLevel=debug \
+            -agentsGlob "${fast}" -slowAgentThreshold 1ns
+        for i in 1 2 3; do
+            expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        done
+        expect_command -s 0 -o match:"ED25519" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Demoting ${AGENT_AUTH_SOCK}: it took .* on average to answer" other.log
+        kill $(cat other.pids)
+        kill "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' fast.env)"
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test quarantine_failing_agent
+    quarantine_failing_agent_test() {
+        local working="${SOCKETS_ROOT}/working"
+        ssh-agent -a "${working}" >working.env
+        ssh-keygen -t ed25519 -N '' -f key >/dev/null
+        expect_command -s 0 -e ignore env SSH_AUTH_SOCK="${working}" ssh-add key
+
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -agentsGlob "${working}" -quarantineAfter 2
+        for i in 1 2; do
+            expect_command -s 1 -e match:"agent refused operation" \
+                env SSH_AUTH_SOCK="${other}" ssh-add -T key.pub
+        done
+        expect_file match:"Quarantining ${AGENT_AUTH_SOCK} for 5m0s: it failed the last 2 sign requests" \
+            other.log
+        expect_command -s 0 env SSH_AUTH_SOCK="${other}" ssh-add -T key.pub
+        expect_file match:"Demoting ${AGENT_AUTH_SOCK}: it is quarantined" other.log
+        kill $(cat other.pids)
+        kill "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' working.env)"
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test verify_key
+    verify_key_test() {
+        ssh-keygen -t ed25519 -N '' -C 'deploy key' -f key >/dev/null
+        local fingerprint="$(ssh-keygen -lf key.pub | cut -d ' ' -f 2)"
+
+        expect_command -s 4 -e match:"key not found: SHA256:.* is not held by the selected agent" \
+            ../ssh-agent-switcher_/ssh-agent-switcher verify "${fingerprint}"
+
+        expect_command -s 0 -e ignore env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add key
+        expect_command -s 0 -o match:"^SHA256:.* ssh-ed25519 deploy key is reachable through ${AGENT_AUTH_SOCK}$" \
+            ../ssh-agent-switcher_/ssh-agent-switcher verify "${fingerprint}"
+        expect_command -s 0 \
+            -o match:"^\{\"fingerprint\":\"SHA256:.*\",\"found\":true,\"type\":\"ssh-ed25519\",\"comment\":\"deploy key\",\"upstream\":\"${AGENT_AUTH_SOCK}\",\"signed\":true\}$" \
+            ../ssh-agent-switcher_/ssh-agent-switcher verify -json -sign "${fingerprint}"
+        expect_command -s 0 -e ignore env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add -D
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test agent_alias
+    agent_alias_test() {
+        local alias="laptop=$(dirname "${AGENT_AUTH_SOCK}")/agent.*"
+
+        local named="${SOCKETS_ROOT}/named"
+        start_other_switcher "${named}" named.log -agentAlias "${alias}"
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${named}" ssh-add -l
+        expect_file match:"Successfully opened SSH agent at laptop \(${AGENT_AUTH_SOCK}\)" named.log
+        expect_command -s 0 -o match:"^upstream-name: laptop$" \
+            ../ssh-agent-switcher_/ssh-agent-switcher query -socket "${named}"
+
+        expect_command -s 1 -e match:"not an absolute path nor a known -agentAlias" \
+            ../ssh-agent-switcher_/ssh-agent-switcher -pinFile "$(pwd)/pinned" \
+            -agentAlias "${alias}" choose desktop
+        expect_command -s 0 -o inline:"Pinned laptop\n" \
+            ../ssh-agent-switcher_/ssh-agent-switcher -pinFile "$(pwd)/pinned" \
+            -agentAlias "${alias}" choose laptop
+        expect_file inline:"laptop\n" pinned
+
+        local pinned="${SOCKETS_ROOT}/pinned"
+        start_other_switcher "${pinned}" pinned.log -pinFile "$(pwd)/pinned" \
+            -agentAlias "${alias}"
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${pinned}" ssh-add -l
+        expect_file match:"Successfully opened pinned SSH agent at laptop \(${AGENT_AUTH_SOCK}\)" \
+            pinned.log
+        kill $(cat other.pids)
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test bounded_scan
+    bounded_scan_test() {
+        local crowded="${SOCKETS_ROOT}/crowded"
+        mkdir "${crowded}"
+        for i in $(seq 1000); do
+            touch "${crowded}/garbage.${i}"
+        done
+
+        local bounded="${SOCKETS_ROOT}/bounded"
+        start_other_switcher "${bounded}" bounded.log -logLevel=debug \
+            -agentsDir "${crowded}" -scanMaxEntries 100
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${bounded}" ssh-add -l
+        expect_file match:"Ignoring ${crowded}: stopped scanning after 100 entries" bounded.log
+
+        local early="${SOCKETS_ROOT}/early"
+        start_other_switcher "${early}" early.log -scanMaxCandidates 1
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${early}" ssh-add -l
+        expect_file match:"Successfully opened SSH agent at ${AGENT_AUTH_SOCK}" early.log
+        kill $(cat other.pids)
+
+        rm -rf "${crowded}"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test privacy_mode
+    privacy_mode_test() {
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -f ./id
+
+        expect_command -s 1 -e match:"-privacy cannot be used with -captureRedact=false" \
+            ../ssh-agent-switcher_/ssh-agent-switcher -privacy -captureRedact=false
+
+        local private="${SOCKETS_ROOT}/private"
+        start_other_switcher "${private}" private.log -logLevel=debug -privacy
+        expect_command -s 0 -e ignore env SSH_AUTH_SOCK="${private}" ssh-add ./id
+        expect_command -s 0 -o match:"ED25519" env SSH_AUTH_SOCK="${private}" ssh-add -l
+        expect_file match:"Forwarding SSH_AGENTC_ADD_IDENTITY \([0-9]+ bytes\) to the agent" \
+            private.log
+        expect_file match:"Forwarding SSH_AGENT_IDENTITIES_ANSWER \([0-9]+ bytes\) to the client" \
+            private.log
+        expect_file not-match:"ssh-ed25519" private.log
+        kill $(cat other.pids)
+
+        expect_command -s 0 -o match:"ED25519" ssh-add -l
+    }
+
+    shtk_unittest_add_test agents_glob
+    agents_glob_test() {
+        mv "${SOCKETS_ROOT}/ssh-zzz" "${SOCKETS_ROOT}/hidden"
+
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log \
+            -agentsGlob "${SOCKETS_ROOT}/hidden/agent.*"
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Successfully opened SSH agent at ${SOCKETS_ROOT}/hidden/agent.bar" \
+            other.log
+        kill $(cat other.pids)
+
+        mv "${SOCKETS_ROOT}/hidden" "${SOCKETS_ROOT}/ssh-zzz"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test exclude
+    exclude_test() {
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-aaa"
+        ssh-agent -a "${SOCKETS_ROOT}/ssh-aaa/agent.$$" >excluded.env
+
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -logLevel=debug \
+            -exclude "${SOCKETS_ROOT}/ssh-a*"
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Ignoring ${SOCKETS_ROOT}/ssh-aaa/agent.$$: excluded by ${SOCKETS_ROOT}/ssh-a\*" \
+            other.log
+        expect_file match:"Successfully opened SSH agent at ${AGENT_AUTH_SOCK}" other.log
+        kill $(cat other.pids)
+
+        kill "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' excluded.env)"
+        rm -rf "${SOCKETS_ROOT}/ssh-aaa"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test allow_owner_process
+    allow_owner_process_test() {
+        local allowed="${SOCKETS_ROOT}/allowed"
+        start_other_switcher "${allowed}" allowed.log -allowOwnerProcess '^ssh-agent$'
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${allowed}" ssh-add -l
+        expect_file match:"Successfully opened SSH agent at ${AGENT_AUTH_SOCK}" allowed.log
+
+        local denied="${SOCKETS_ROOT}/denied"
+        start_other_switcher "${denied}" denied.log -logLevel=debug \
+            -allowOwnerProcess '^sshd' -allowOwnerProcess '^etserver$'
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${denied}" ssh-add -l
+        expect_file match:"Ignoring ${AGENT_AUTH_SOCK}: served by ssh-agent \(pid [0-9]+\), which does not match -allowOwnerProcess" \
+            denied.log
+        expect_file match:"Acting as an empty agent" denied.log
+        kill $(cat other.pids)
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test skip_other_namespaces
+    skip_other_namespaces_test() {
+        local unshare="unshare --user --map-root-user --pid --mount --fork --mount-proc --kill-child"
+        ${unshare} true >/dev/null 2>&1 || skip "Cannot create namespaces"
+
+        # An agent of another container that shares the directory with us, named after our
+        # own process so that it looks like a live session.
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-aaa"
+        ${unshare} ssh-agent -D -a "${SOCKETS_ROOT}/ssh-aaa/agent.$$" >/dev/null 2>&1 &
+        local pid="${!}"
+        while [ ! -e "${SOCKETS_ROOT}/ssh-aaa/agent.$$" ]; do
+            sleep 0.01
+        done
+
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -logLevel=debug -skipOtherNamespaces
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Ignoring ${SOCKETS_ROOT}/ssh-aaa/agent.$$: served by pid [0-9]+ in (mnt|pid) namespace" \
+            other.log
+        expect_file match:"Successfully opened SSH agent at ${AGENT_AUTH_SOCK}" other.log
+        kill $(cat other.pids)
+
+        # unshare does not exit on SIGTERM, but it takes the agent down with it.
+        kill -9 "${pid}"
+        wait "${pid}"
+        rm -rf "${SOCKETS_ROOT}/ssh-aaa"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test skip_process_checks
+    skip_process_checks_test() {
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -skipProcessChecks \
+            -allowOwnerProcess '^etserver$'
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Ignoring -allowOwnerProcess and -skipOtherNamespaces because of -skipProcessChecks" \
+            other.log
+        expect_file match:"Successfully opened SSH agent at ${AGENT_AUTH_SOCK}" other.log
+        kill $(cat other.pids)
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test prefer_active_sessions_fall_back_to_utmp
+    prefer_active_sessions_fall_back_to_utmp_test() {
+        local other="${SOCKETS_ROOT}/other"
+        DBUS_SYSTEM_BUS_ADDRESS="unix:path=$(pwd)/missing-bus"; export DBUS_SYSTEM_BUS_ADDRESS
+        start_other_switcher "${other}" other.log -preferActiveSessions \
+            -agentsGlob "${AGENT_AUTH_SOCK}"
+        unset DBUS_SYSTEM_BUS_ADDRESS
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Ranking agents by utmp session: cannot connect to the system bus" \
+            other.log
+        expect_file match:"Successfully opened SSH agent at ${AGENT_AUTH_SOCK}" other.log
+        kill $(cat other.pids)
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test demote_notty_sessions
+    demote_notty_sessions_test() {
+        # Fake our own process as the session process of a newer agent so that it looks like
+        # "ssh host command", with a process title that does not say so.
+        mkdir -p proc/$$/fd
+        printf 'sshd: user\0' >proc/$$/cmdline
+        ln -s /dev/null proc/$$/fd/0
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-aaa"
+        ssh-agent -a "${SOCKETS_ROOT}/ssh-aaa/agent.$$" >notty.env
+
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -logLevel=debug -procDir "$(pwd)/proc" \
+            -demoteNottySessions
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Demoting ${SOCKETS_ROOT}/ssh-aaa/agent.$$: its session has no terminal" \
+            other.log
+        expect_file match:"Successfully opened SSH agent at ${AGENT_AUTH_SOCK}" other.log
+        kill $(cat other.pids)
+
+        kill "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' notty.env)"
+        rm -rf "${SOCKETS_ROOT}/ssh-aaa"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test keep_terminal_sessions
+    keep_terminal_sessions_test() {
+        # Fake our own process as the session process of a newer agent so that it holds a
+        # terminal open even if its process title claims otherwise.
+        mkdir -p proc/$$/fd
+        printf 'sshd: user@notty\0' >proc/$$/cmdline
+        ln -s /dev/pts/3 proc/$$/fd/7
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-aaa"
+        ssh-agent -a "${SOCKETS_ROOT}/ssh-aaa/agent.$$" >tty.env
+
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -procDir "$(pwd)/proc" -demoteNottySessions
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Successfully opened SSH agent at ${SOCKETS_ROOT}/ssh-aaa/agent.$$" \
+            other.log
+        kill $(cat other.pids)
+
+        kill "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' tty.env)"
+        rm -rf "${SOCKETS_ROOT}/ssh-aaa"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test prefer_recent_terminals
+    prefer_recent_terminals_test() {
+        # Fake the session process of an older agent so that it holds a terminal open.  The
+        # ptmx device of devpts is the only terminal that we can count on to exist.
+        sleep 60 &
+        local session="${!}"
+        mkdir -p "proc/${session}/fd"
+        ln -s /dev/pts/ptmx "proc/${session}/fd/3"
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-bbb"
+        ssh-agent -a "${SOCKETS_ROOT}/ssh-bbb/agent.${session}" >terminal.env
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-aaa"
+        ssh-agent -a "${SOCKETS_ROOT}/ssh-aaa/agent.$$" >noterminal.env
+
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -procDir "$(pwd)/proc" -preferRecentTerminals
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${other}" ssh-add -l
+        expect_file match:"Successfully opened SSH agent at ${SOCKETS_ROOT}/ssh-bbb/agent.${session}" \
+            other.log
+        kill $(cat other.pids)
+
+        kill "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' terminal.env)"
+        kill "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' noterminal.env)"
+        kill "${session}"
+        rm -rf "${SOCKETS_ROOT}/ssh-aaa" "${SOCKETS_ROOT}/ssh-bbb"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test ignore_messages_not_repeated
+    ignore_messages_not_repeated_test() {
+        mkdir "${SOCKETS_ROOT}/dir-unknown"
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+
+        [ "$(grep -c "Ignoring.*/dir-unknown" switcher.log)" -eq 1 ] \
+            || fail "Message about dir-unknown was logged more than once"
+    }
+
+    shtk_unittest_add_test ignore_insecure_dirs
+    ignore_insecure_dirs_test() {
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-open"
+        chmod 0770 "${SOCKETS_ROOT}/ssh-open"
+        mkdir -m 0700 "${SOCKETS_ROOT}/elsewhere"
+        ln -s "${SOCKETS_ROOT}/elsewhere" "${SOCKETS_ROOT}/ssh-link"
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+
+        expect_file match:"WARNING: Ignoring.*/ssh-open: mode 0770 is not 0700" switcher.log
+        expect_file match:"WARNING: Ignoring.*/ssh-link: is a symlink" switcher.log
+    }
+
+    shtk_unittest_add_test ignore_odd_sockets
+    ignore_odd_sockets_test() {
+        chmod u+s "${AGENT_AUTH_SOCK}"
+
+        if ssh-add -l >/dev/null 2>&1; then
+            fail "ssh-add succeeded with a setuid socket"
+        fi
+        expect_file match:"WARNING: Ignoring.*/agent.bar: has unexpected mode 04" switcher.log
+
+        chmod u-s "${AGENT_AUTH_SOCK}"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+}
+
+# Connects to the switcher, sends every argument, which is a string of hex bytes, in a write
+# of its own with a pause in between so that the switcher sees each of them in a separate read,
+# and saves the first "${2}" replies in the file "${1}", one per line as hex bytes.
+raw_exchange() {
+    local out="${1}"; shift
+    local replies="${1}"; shift
+
+    python3 - "${SSH_AUTH_SOCK}" "${replies}" "${@}" >"${out}" <<'EOF'
+import socket, struct, sys, time
+
+sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+sock.settimeout(5)
+sock.connect(sys.argv[1])
+for chunk in sys.argv[3:]:
+    sock.sendall(bytes.fromhex(chunk))
+    time.sleep(0.2)
+
+def read(n):
+    buf = b""
+    while len(buf) < n:
+        data = sock.recv(n - len(buf))
+        if not data:
+            sys.exit("connection closed")
+        buf += data
+    return buf
+
+for _ in range(int(sys.argv[2])):
+    header = read(4)
+    reply = header + read(struct.unpack(">I", header)[0])
+    print(" ".join("%02x" % b for b in reply))
+EOF
+}
+
+shtk_unittest_add_fixture readonly
+readonly_fixture() {
+    setup() {
+        start_agent_and_switcher -readOnly
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test list_identities
+    list_identities_test() {
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test add_identity_rejected
+    add_identity_rejected_test() {
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t rsa -b 1024 -N '' -f ./id_rsa
+        expect_command -s 1 -e match:"agent refused operation" ssh-add ./id_rsa
+        expect_file match:"Rejecting request: SSH_AGENTC_ADD_IDENTITY" switcher.log
+    }
+
+    shtk_unittest_add_test remove_all_rejected
+    remove_all_rejected_test() {
+        expect_command -s 1 -e match:"Failed to remove all identities" ssh-add -D
+        expect_file match:"Rejecting request: SSH_AGENTC_REMOVE_ALL_IDENTITIES" switcher.log
+    }
+
+    shtk_unittest_add_test split_request
+    split_request_test() {
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -f ./id_ed25519
+        assert_command -s 0 -e ignore env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add ./id_ed25519
+
+        # SSH_AGENTC_REMOVE_ALL_IDENTITIES split in the middle of its length.
+        raw_exchange reply.out 1 "00 00" "00 01 13"
+        expect_file match:"^00 00 00 01 05$" reply.out
+        expect_file match:"Rejecting request: SSH_AGENTC_REMOVE_ALL_IDENTITIES" switcher.log
+
+        expect_command -s 0 -o match:"ED25519" ssh-add -l
+    }
+
+    shtk_unittest_add_test pipelined_requests
+    pipelined_requests_test() {
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -f ./id_ed25519
+        assert_command -s 0 -e ignore env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add ./id_ed25519
+
+        # SSH_AGENTC_REMOVE_ALL_IDENTITIES and SSH_AGENTC_REQUEST_IDENTITIES in one write.
+        raw_exchange reply.out 2 "00 00 00 01 13 00 00 00 01 0b"
+        assert_command -s 0 -o save:replies.out sed -n '1p' reply.out
+        expect_file match:"^00 00 00 01 05$" replies.out
+        assert_command -s 0 -o save:replies.out sed -n '2p' reply.out
+        expect_file match:"^00 00 .. .. 0c 00 00 00 01 " replies.out
+        expect_file match:"Rejecting request: SSH_AGENTC_REMOVE_ALL_IDENTITIES" switcher.log
+
+        expect_command -s 0 -o match:"ED25519" ssh-add -l
+    }
+}
+
+shtk_unittest_add_fixture filter
+filter_fixture() {
+    setup() {
+        start_agent_and_switcher -allowMessages=request_identities -denyMessages=13
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test allowed_message
+    allowed_message_test() {
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test not_allowed_message
+    not_allowed_message_test() {
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t rsa -b 1024 -N '' -f ./id_rsa
+        expect_command -s 1 -e match:"agent refused operation" ssh-add ./id_rsa
+        expect_file match:"Rejecting request: SSH_AGENTC_ADD_IDENTITY not in the list" switcher.log
+    }
+
+    shtk_unittest_add_test split_denied_message
+    split_denied_message_test() {
+        # SSH_AGENTC_SIGN_REQUEST with an empty key and data, split after its type.
+        raw_exchange reply.out 1 "00 00 00 0d 0d" "00 00 00 00 00 00 00 00" "00 00 00 00"
+        expect_file match:"^00 00 00 01 05$" reply.out
+        expect_file match:"Rejecting request: SSH_AGENTC_SIGN_REQUEST" switcher.log
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test pipelined_denied_message
+    pipelined_denied_message_test() {
+        # SSH_AGENTC_SIGN_REQUEST and SSH_AGENTC_REQUEST_IDENTITIES in one write.
+        raw_exchange reply.out 2 \
+            "00 00 00 0d 0d 00 00 00 00 00 00 00 00 00 00 00 00 00 00 00 01 0b"
+        assert_command -s 0 -o save:replies.out sed -n '1p' reply.out
+        expect_file match:"^00 00 00 01 05$" replies.out
+        assert_command -s 0 -o save:replies.out sed -n '2p' reply.out
+        expect_file match:"^00 00 00 05 0c 00 00 00 00$" replies.out
+        expect_file match:"Rejecting request: SSH_AGENTC_SIGN_REQUEST" switcher.log
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+}
+
+shtk_unittest_add_fixture confirm
+confirm_fixture() {
+    setup() {
+        cat >askpass <<EOS
+#!/bin/sh
+echo "\${SSH_ASKPASS_PROMPT}: \${1}" >>"$(pwd)/askpass.log"
+i=0
+while [ -e "$(pwd)/askpass.hold" -a \${i} -lt 500 ]; do
+    sleep 0.01
+    i=\$((i + 1))
+done
+[ -e "$(pwd)/askpass.yes" ]
+EOS
+        chmod +x askpass
+        CONTROL_SOCKET="$(mktemp -u -p /tmp)"
+        start_agent_and_switcher -confirmSign -confirmProgram "$(pwd)/askpass" \
+            -controlSocket "${CONTROL_SOCKET}"
+
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -f ./id_ed25519
+        assert_command -s 0 -e ignore env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add ./id_ed25519
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test sign_confirmed
+    sign_confirmed_test() {
+        touch askpass.yes
+        expect_command -s 0 ssh-add -T ./id_ed25519.pub
+        expect_file match:"confirm: Allow .*ssh-add.* to use key ssh-ed25519 SHA256:" askpass.log
+    }
+
+    shtk_unittest_add_test sign_rejected
+    sign_rejected_test() {
+        expect_command -s 1 -e match:"agent refused operation" ssh-add -T ./id_ed25519.pub
+        expect_file match:"confirm: Allow .*ssh-add" askpass.log
+        expect_file match:"Rejecting request: sign request not confirmed" switcher.log
+    }
+
+    shtk_unittest_add_test declined_not_counted
+    declined_not_counted_test() {
+        local limited="${SOCKETS_ROOT}/limited"
+        start_other_switcher "${limited}" limited.log -maxClientSignsPerMinute 1 \
+            -confirmSign -confirmProgram "$(pwd)/askpass"
+
+        expect_command -s 1 -e match:"agent refused operation" \
+            env SSH_AUTH_SOCK="${limited}" ssh-add -T ./id_ed25519.pub
+        expect_file match:"Rejecting request: sign request not confirmed" limited.log
+
+        touch askpass.yes
+        expect_command -s 0 env SSH_AUTH_SOCK="${limited}" ssh-add -T ./id_ed25519.pub
+        expect_command -s 1 -e match:"agent refused operation" \
+            env SSH_AUTH_SOCK="${limited}" ssh-add -T ./id_ed25519.pub
+        expect_file match:"Rejecting request: .*ssh-add.* exceeded the limit" limited.log
+        [ "$(wc -l <askpass.log)" -eq 2 ] || fail "Asked to confirm a request over the limit"
+        kill $(cat other.pids)
+
+        expect_command -s 0 -o match:"ED25519" ssh-add -l
+    }
+
+    shtk_unittest_add_test connection_accounting
+    connection_accounting_test() {
+        expect_command -s 0 -o match:"no active connections" \
+            ../ssh-agent-switcher_/ssh-agent-switcher -controlSocket "${CONTROL_SOCKET}" control connections
+
+        touch askpass.hold askpass.yes
+        ssh-add -T ./id_ed25519.pub &
+        local pid="${!}"
+        local i=0
+        while [ ! -e askpass.log -a ${i} -lt 500 ]; do
+            sleep 0.01
+            i=$((i + 1))
+        done
+
+        ../ssh-agent-switcher_/ssh-agent-switcher -controlSocket "${CONTROL_SOCKET}" \
+            control connections >connections.out
+        rm askpass.hold
+        wait "${pid}" || fail "ssh-add -T failed"
+
+        expect_file match:"^\[conn 1\] .*ssh-add.* using ${AGENT_AUTH_SOCK} for [0-9]+s; [0-9]+ requests, [0-9]+ bytes in, [0-9]+ bytes out, .* busy, last request 0s ago$" \
+            connections.out
+    }
+
+    shtk_unittest_add_test max_connections
+    max_connections_test() {
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -maxConnections 1 \
+            -confirmSign -confirmProgram "$(pwd)/askpass"
+
+        touch askpass.hold askpass.yes
+        SSH_AUTH_SOCK="${other}" ssh-add -T ./id_ed25519.pub &
+        local signer="${!}"
+        local i=0
+        while [ ! -e askpass.log -a ${i} -lt 500 ]; do
+            sleep 0.01
+            i=$((i + 1))
+        done
+
+        SSH_AUTH_SOCK="${other}" ssh-add -l >list.out &
+        local lister="${!}"
+        i=0
+        while ! grep "connection slots are busy" other.log >/dev/null && [ ${i} -lt 500 ]; do
+            sleep 0.01
+            i=$((i + 1))
+        done
+        expect_file match:"All 1 connection slots are busy" other.log
+
+        rm askpass.hold
+        wait "${signer}" || fail "ssh-add -T failed"
+        wait "${lister}" || fail "ssh-add -l failed"
+        expect_file match:"ED25519" list.out
+        kill $(cat other.pids)
+
+        expect_command -s 0 -o match:"ED25519" ssh-add -l
+    }
+}
+
+shtk_unittest_add_fixture policy
+policy_fixture() {
+    setup() {
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -f ./denied
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -f ./limited
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -f ./hosts
+        cat >policy.json <<EOF
+{
+    "keys": [
+        {"fingerprint": "$(ssh-keygen -lf denied.pub | cut -d ' ' -f 2)", "deny": true},
+        {"fingerprint": "$(ssh-keygen -lf limited.pub | cut -d ' ' -f 2)", "maxSignsPerMinute": 1},
+        {"fingerprint": "$(ssh-keygen -lf hosts.pub | cut -d ' ' -f 2)", "allowHosts": ["*.example.com"]}
+    ]
+}
+EOF
+        start_agent_and_switcher -policyFile "$(pwd)/policy.json"
+
+        assert_command -s 0 -e ignore env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add ./denied ./limited ./hosts
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test denied_key
+    denied_key_test() {
+        expect_command -s 1 -e match:"agent refused operation" ssh-add -T ./denied.pub
+        expect_file match:"Rejecting request: use of key SHA256:.* denied by policy" switcher.log
+    }
+
+    shtk_unittest_add_test rate_limited_key
+    rate_limited_key_test() {
+        expect_command -s 0 ssh-add -T ./limited.pub
+        expect_command -s 1 -e match:"agent refused operation" ssh-add -T ./limited.pub
+        expect_file match:"Rejecting request: key SHA256:.* exceeded its limit of 1 signs" switcher.log
+    }
+
+    shtk_unittest_add_test host_restricted_key_without_binding
+    host_restricted_key_without_binding_test() {
+        # ssh-add does not bind the connection to any host so we cannot tell where the
+        # key is being used.
+        expect_command -s 1 -e match:"agent refused operation" ssh-add -T ./hosts.pub
+        expect_file match:"Rejecting request: key SHA256:.* is restricted to some hosts" switcher.log
+    }
+
+    shtk_unittest_add_test key_lists
+    key_lists_test() {
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -f ./free
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -f ./blocked
+        assert_command -s 0 -e ignore env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add ./free ./blocked
+        mkdir lists
+        ssh-keygen -lf free.pub >lists/allowed.keys
+        ssh-keygen -lf blocked.pub >>lists/allowed.keys
+        echo "from=\"10.0.0.1\" $(cat blocked.pub)" >lists/denied.keys
+        cat >lists/policy.json <<EOF
+{"allowKeysFiles": ["allowed.keys"], "denyKeysFiles": ["$(pwd)/lists/denied.keys"]}
+EOF
+
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -policyFile "$(pwd)/lists/policy.json"
+        expect_command -s 0 env SSH_AUTH_SOCK="${other}" ssh-add -T ./free.pub
+        expect_command -s 1 -e match:"agent refused operation" \
+            env SSH_AUTH_SOCK="${other}" ssh-add -T ./blocked.pub
+        expect_file match:"Rejecting request: use of key SHA256:.* denied by key list $(pwd)/lists/denied.keys" other.log
+        expect_command -s 1 -e match:"agent refused operation" \
+            env SSH_AUTH_SOCK="${other}" ssh-add -T ./limited.pub
+        expect_file match:"Rejecting request: use of key SHA256:.* denied: not in any allowed key list" other.log
+
+        cat free.pub >>lists/denied.keys
+        sleep 1.1
+        expect_command -s 1 -e match:"agent refused operation" \
+            env SSH_AUTH_SOCK="${other}" ssh-add -T ./free.pub
+        expect_file match:"Reloaded key list $(pwd)/lists/denied.keys" other.log
+        kill $(cat other.pids)
+
+        expect_command -s 0 -o match:"ED25519" ssh-add -l
+    }
+
+    shtk_unittest_add_test reload_policy
+    reload_policy_test() {
+        echo '{"keys": []}' >reloaded.json
+
+        local other="${SOCKETS_ROOT}/other"
+        start_other_switcher "${other}" other.log -policyFile "$(pwd)/reloaded.json" \
+            -policyCheckInterval 100ms
+        expect_command -s 0 env SSH_AUTH_SOCK="${other}" ssh-add -T ./denied.pub
+
+        cat >reloaded.json <<EOF
+{"keys": [{"fingerprint": "$(ssh-keygen -lf denied.pub | cut -d ' ' -f 2)", "deny": true}]}
+EOF
+        local i=0
+        while [ "${i}" -lt 500 ] && ! grep -q "Reloaded $(pwd)/reloaded.json" other.log; do
+            sleep 0.01
+            i=$((i + 1))
+        done
+        expect_command -s 1 -e match:"agent refused operation" \
+            env SSH_AUTH_SOCK="${other}" ssh-add -T ./denied.pub
+
+        echo '{"keys": [' >reloaded.json
+        i=0
+        while [ "${i}" -lt 500 ] && ! grep -q "Keeping the previous policies" other.log; do
+            sleep 0.01
+            i=$((i + 1))
+        done
+        expect_file match:"Keeping the previous policies after $(pwd)/reloaded.json changed: invalid policy file" \
+            other.log
+        expect_command -s 1 -e match:"agent refused operation" \
+            env SSH_AUTH_SOCK="${other}" ssh-add -T ./denied.pub
+        kill $(cat other.pids)
+
+        expect_command -s 0 -o match:"ED25519" ssh-add -l
+    }
+}
+
+shtk_unittest_add_fixture hide_key
+hide_key_fixture() {
+    setup() {
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -C visible@test -f ./visible
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -C secret@test -f ./secret
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -C other@test -f ./other
+        start_agent_and_switcher -hideKey 'secret@*' \
+            -hideKey "$(ssh-keygen -lf other.pub | cut -d ' ' -f 2)"
+
+        assert_command -s 0 -e ignore env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" \
+            ssh-add ./visible ./secret ./other
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test list_identities
+    list_identities_test() {
+        expect_command -s 0 -o save:stdout ssh-add -l
+        expect_file match:"visible@test" stdout
+        expect_file not-match:"secret@test" stdout
+        expect_file not-match:"other@test" stdout
+    }
+
+    shtk_unittest_add_test sign_visible
+    sign_visible_test() {
+        expect_command -s 0 ssh-add -T ./visible.pub
+    }
+
+    shtk_unittest_add_test sign_hidden_by_comment
+    sign_hidden_by_comment_test() {
+        expect_command -s 1 -e match:"agent refused operation" ssh-add -T ./secret.pub
+        expect_file match:"Rejecting request: key SHA256:.* is hidden" switcher.log
+    }
+
+    shtk_unittest_add_test sign_hidden_by_fingerprint
+    sign_hidden_by_fingerprint_test() {
+        expect_command -s 1 -e match:"agent refused operation" ssh-add -T ./other.pub
+        expect_file match:"Rejecting request: key SHA256:.* is hidden" switcher.log
+    }
+
+    shtk_unittest_add_test restricted_socket
+    restricted_socket_test() {
+        local restricted="${SOCKETS_ROOT}/restricted"
+        start_other_switcher "${SOCKETS_ROOT}/other" other.log \
+            -restrictedSocketPath "${restricted}" -restrictedHideKey 'visible@*'
+        while [ ! -e "${restricted}" ]; do
+            sleep 0.01
+        done
+
+        expect_command -s 0 -o save:stdout env SSH_AUTH_SOCK="${SOCKETS_ROOT}/other" ssh-add -l
+        expect_file match:"visible@test" stdout
+
+        expect_command -s 0 -o save:stdout env SSH_AUTH_SOCK="${restricted}" ssh-add -l
+        expect_file not-match:"visible@test" stdout
+        expect_file match:"secret@test" stdout
+        expect_command -s 1 -e match:"Failed to remove all identities" \
+            env SSH_AUTH_SOCK="${restricted}" ssh-add -D
+        expect_file match:"Accepted restricted client connection" other.log
+        expect_file match:"Rejecting request: SSH_AGENTC_REMOVE_ALL_IDENTITIES" other.log
+        kill $(cat other.pids)
+
+        expect_command -s 0 -o match:"visible@test" ssh-add -l
+    }
+}
+
+shtk_unittest_add_fixture add_constraints
+add_constraints_fixture() {
+    setup() {
+        start_agent_and_switcher -addLifetime 2s
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test default_lifetime
+    default_lifetime_test() {
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -C lifetime@test -f ./id
+        expect_command -s 0 -e match:"Identity added" ssh-add ./id
+        expect_command -s 0 -o match:"lifetime@test" env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add -l
+        sleep 3
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add -l
+    }
+
+    shtk_unittest_add_test lifetime_with_destination_constraints
+    lifetime_with_destination_constraints_test() {
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -f ./hostkey
+        echo "host.example.com $(cat hostkey.pub)" >known_hosts
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -C lifetime@test -f ./id
+        expect_command -s 0 -e match:"Identity added" ssh-add -H known_hosts -h host.example.com ./id
+        expect_command -s 0 -o match:"lifetime@test" env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add -l
+        sleep 3
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add -l
+    }
+}
+
+shtk_unittest_add_fixture audit
+audit_fixture() {
+    setup() {
+        start_agent_and_switcher -auditFile "$(pwd)/audit.log" -hideKey hidden@test
+
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -C visible@test -f ./visible
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -C hidden@test -f ./hidden
+        assert_command -s 0 -e ignore env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add ./visible ./hidden
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test signed
+    signed_test() {
+        expect_command -s 0 ssh-add -T ./visible.pub
+        expect_file match:"\"key\":\"SHA256:.*\"clientExe\":\"[^\"]*ssh-add\".*\"agent\":\"${AGENT_AUTH_SOCK}\",\"outcome\":\"signed\"" audit.log
+    }
+
+    shtk_unittest_add_test rejected
+    rejected_test() {
+        expect_command -s 1 -e ignore ssh-add -T ./hidden.pub
+        expect_file match:"\"key\":\"SHA256:.*\"outcome\":\"rejected\",\"reason\":\"key .* is hidden\"" audit.log
+    }
+
+    shtk_unittest_add_test chained
+    chained_test() {
+        expect_command -s 1 -e match:"-auditChain requires -auditFile" \
+            ../ssh-agent-switcher_/ssh-agent-switcher -auditChain
+
+        assert_command -s 0 -o ignore -e ignore openssl genpkey -algorithm ed25519 -out signing.pem
+        assert_command -s 0 -o ignore -e ignore openssl pkey -in signing.pem -pubout -out public.pem
+
+        local chained="${SOCKETS_ROOT}/chained"
+        start_other_switcher "${chained}" chained.log -auditFile "$(pwd)/chained.log.json" \
+            -auditChain -auditSigningKey "$(pwd)/signing.pem"
+        expect_command -s 0 env SSH_AUTH_SOCK="${chained}" ssh-add -T ./visible.pub
+        expect_command -s 0 env SSH_AUTH_SOCK="${chained}" ssh-add -T ./visible.pub
+        kill $(cat other.pids)
+        rm other.pids
+        expect_file match:"\"seq\":2,\"prev\":\"[0-9a-f]{64}\"},\"hash\":\"[0-9a-f]{64}\",\"sig\":" \
+            chained.log.json
+
+        expect_command -s 0 -o match:"2 signed records verified; last hash [0-9a-f]{64}" \
+            ../ssh-agent-switcher_/ssh-agent-switcher verify-audit -publicKey public.pem \
+            chained.log.json
+
+        local resumed="${SOCKETS_ROOT}/resumed"
+        start_other_switcher "${resumed}" resumed.log -auditFile "$(pwd)/chained.log.json" \
+            -auditChain
+        expect_command -s 0 env SSH_AUTH_SOCK="${resumed}" ssh-add -T ./visible.pub
+        kill $(cat other.pids)
+        expect_command -s 0 -o match:"3 records verified" \
+            ../ssh-agent-switcher_/ssh-agent-switcher verify-audit chained.log.json
+        expect_command -s 1 -e match:"line 3: missing or invalid signature" \
+            ../ssh-agent-switcher_/ssh-agent-switcher verify-audit -publicKey public.pem \
+            chained.log.json
+
+        expect_file match:"head is record 2 with hash [0-9a-f]{64}" resumed.log
+        local head="$(sed -n 's/.*head is record 2 with hash \([0-9a-f]*\).*/\1/p' resumed.log)"
+        expect_command -s 0 -o match:"3 records verified" \
+            ../ssh-agent-switcher_/ssh-agent-switcher verify-audit -expectHead "${head}" \
+            chained.log.json
+        head -n 1 chained.log.json >truncated.log.json
+        expect_command -s 1 -e match:"no record has the expected head hash ${head}" \
+            ../ssh-agent-switcher_/ssh-agent-switcher verify-audit -expectHead "${head}" \
+            truncated.log.json
+
+        sed '1s/"outcome":"signed"/"outcome":"failed"/' chained.log.json >tampered.log.json
+        expect_command -s 1 -e match:"line 1: hash does not match the entry" \
+            ../ssh-agent-switcher_/ssh-agent-switcher verify-audit tampered.log.json
+
+        expect_command -s 0 -o match:"ED25519" ssh-add -l
+    }
+}
+
+shtk_unittest_add_fixture rate_limit
+rate_limit_fixture() {
+    setup() {
+        start_agent_and_switcher -maxClientSignsPerMinute 1
+
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -f ./id
+        assert_command -s 0 -e ignore env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add ./id
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test per_client
+    per_client_test() {
+        expect_command -s 0 ssh-add -T ./id.pub
+        expect_command -s 1 -e match:"agent refused operation" ssh-add -T ./id.pub
+        expect_file match:"WARNING: .*ssh-add.* exceeded the limit of 1 signs per minute" switcher.log
+        expect_file match:"Rejecting request: .*ssh-add.* exceeded the limit" switcher.log
+    }
+}
+
+shtk_unittest_add_fixture access_window
+access_window_fixture() {
+    setup() {
+        # Only allow access tomorrow so that requests made now are rejected.
+        local days="Sun Mon Tue Wed Thu Fri Sat"
+        local tomorrow="$(echo ${days} | cut -d ' ' -f "$(( ($(date +%w) + 1) % 7 + 1 ))")"
+        CONTROL_SOCKET="$(mktemp -u -p /tmp)"
+        start_agent_and_switcher -accessWindow "${tomorrow} 00:00-24:00" \
+            -controlSocket "${CONTROL_SOCKET}"
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test outside_window
+    outside_window_test() {
+        expect_command -s 1 -e match:"agent refused operation" ssh-add -l
+        expect_file match:"Rejecting request: agent use not allowed" switcher.log
+    }
+
+    shtk_unittest_add_test override
+    override_test() {
+        expect_command -s 0 -o match:"access allowed until" \
+            ../ssh-agent-switcher_/ssh-agent-switcher -controlSocket "${CONTROL_SOCKET}" \
+            control override-access 1m
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+        expect_file match:"Access windows overridden" switcher.log
+    }
+}
+
+shtk_unittest_add_fixture lock
+lock_fixture() {
+    setup() {
+        CONTROL_SOCKET="$(mktemp -u -p /tmp)"
+        start_agent_and_switcher -controlSocket "${CONTROL_SOCKET}"
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test lock_and_unlock
+    lock_and_unlock_test() {
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+
+        expect_command -s 0 -o match:"all agent access locked" \
+            ../ssh-agent-switcher_/ssh-agent-switcher -controlSocket "${CONTROL_SOCKET}" lock
+        # The exact exit status of ssh-add depends on how it notices the connection drop.
+        if ssh-add -l >/dev/null 2>&1; then
+            fail "ssh-add succeeded while locked"
+        fi
+        expect_file match:"Rejecting connection: all agent access is locked" switcher.log
+
+        expect_command -s 0 -o match:"agent access unlocked" \
+            ../ssh-agent-switcher_/ssh-agent-switcher -controlSocket "${CONTROL_SOCKET}" unlock
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test client_lock_survives_new_agents
+    client_lock_survives_new_agents_test() {
+        printf '#! /bin/sh\necho the-passphrase\n' >askpass
+        chmod +x askpass
+        export SSH_ASKPASS="$(pwd)/askpass" SSH_ASKPASS_REQUIRE=force
+
+        expect_command -s 0 -e match:"Agent locked" ssh-add -x
+        expect_file match:"Client locked the agent" switcher.log
+
+        # A new agent that sorts first must not replace the locked one.
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-aaa"
+        ssh-agent -a "${SOCKETS_ROOT}/ssh-aaa/agent.foo" >other.env
+        expect_command -s 0 -e match:"Agent unlocked" ssh-add -X
+        expect_file match:"opened locked SSH agent at ${AGENT_AUTH_SOCK}" switcher.log
+        expect_file match:"Client unlocked the agent" switcher.log
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+        expect_file match:"opened SSH agent at ${SOCKETS_ROOT}/ssh-aaa/agent.foo" switcher.log
+        ( . ./other.env; kill "${SSH_AGENT_PID}" )
+    }
+}
+
+shtk_unittest_add_fixture approvals
+approvals_fixture() {
+    setup() {
+        CONTROL_SOCKET="$(mktemp -u -p /tmp)"
+        start_agent_and_switcher -requireApproval -controlSocket "${CONTROL_SOCKET}"
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    run_control() {
+        ../ssh-agent-switcher_/ssh-agent-switcher -controlSocket "${CONTROL_SOCKET}" control "${@}"
+    }
+
+    shtk_unittest_add_test approve_and_revoke
+    approve_and_revoke_test() {
+        if ssh-add -l >/dev/null 2>&1; then
+            fail "ssh-add succeeded before being approved"
+        fi
+        expect_file match:"Rejecting connection: .*ssh-add.* has not been approved" switcher.log
+
+        local exe="$(command -v ssh-add)"
+        expect_command -s 0 -o match:"awaiting approval: .*ssh-add" run_control pending
+        expect_command -s 0 -o match:"approved" run_control approve "$(readlink -f "${exe}")"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+
+        expect_command -s 0 -o match:"revoked" run_control revoke "$(readlink -f "${exe}")"
+        if ssh-add -l >/dev/null 2>&1; then
+            fail "ssh-add succeeded after being revoked"
+        fi
+    }
+}
+
+shtk_unittest_add_fixture polkit
+polkit_fixture() {
+    setup() {
+        export DBUS_SYSTEM_BUS_ADDRESS="unix:path=$(pwd)/missing-bus"
+        start_agent_and_switcher -polkitAddKey
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test add_key_fails_closed
+    add_key_fails_closed_test() {
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -f ./id
+        expect_command -s 1 -e match:"agent refused operation" ssh-add ./id
+        expect_file match:"Rejecting request: SSH_AGENTC_ADD_IDENTITY: cannot connect to the system bus" switcher.log
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+}
+
+shtk_unittest_add_fixture plugins
+plugins_fixture() {
+    setup() {
+        cat >plugin.sh <<'EOF'
+#! /bin/sh
+while read -r line; do
+    case "${line}" in
+        *'"method":"hello"'*)
+            echo '{"result":{"version":1,"methods":["discover","checkSign"]}}'
+            ;;
+        *'"method":"discover"'*)
+            echo "{\"result\":{\"candidates\":[{\"path\":\"$(cat agent.path)\"}]}}"
+            ;;
+        *'"method":"checkSign"'*)
+            echo '{"result":{"allow":false,"reason":"all keys revoked"}}'
+            ;;
+        *)
+            echo '{"error":"unknown method"}'
+            ;;
+    esac
+done
+EOF
+        chmod +x plugin.sh
+        echo /nonexistent >agent.path
+
+        start_agent_and_switcher -logLevel=debug \
+            -discoveryPlugin "$(pwd)/plugin.sh" -policyPlugin "$(pwd)/plugin.sh"
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test discover
+    discover_test() {
+        mv "${SOCKETS_ROOT}/ssh-zzz" "${SOCKETS_ROOT}/hidden"
+        echo "${SOCKETS_ROOT}/hidden/agent.bar" >agent.path
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+        expect_file match:"Successfully opened SSH agent at ${SOCKETS_ROOT}/hidden/agent.bar" \
+            switcher.log
+        mv "${SOCKETS_ROOT}/hidden" "${SOCKETS_ROOT}/ssh-zzz"
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test check_sign
+    check_sign_test() {
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -f ./id
+        assert_command -s 0 -e ignore env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add ./id
+
+        expect_command -s 1 -e match:"agent refused operation" ssh-add -T ./id.pub
+        expect_file match:"Rejecting request: use of key SHA256:.* denied by plugin .*: all keys revoked" \
+            switcher.log
+    }
+
+    shtk_unittest_add_test broken_plugin
+    broken_plugin_test() {
+        printf '#! /bin/sh\nread -r line\necho garbage\n' >broken.sh
+        chmod +x broken.sh
+        expect_command -s 1 -e match:"plugin .*/broken.sh sent an invalid response to hello" \
+            ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${SOCKETS_ROOT}/other" \
+            --discoveryPlugin "$(pwd)/broken.sh"
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+}
+
+# Creates a certificate named "${1}" signed by the test CA, creating the CA if necessary.
+make_certificate() {
+    local name="${1}"
+
+    if [ ! -e ca.pem ]; then
+        assert_command -s 0 -o ignore -e ignore openssl req -x509 -newkey ed25519 -nodes \
+            -keyout ca.key -out ca.pem -subj /CN=test-ca -days 1
+    fi
+    assert_command -s 0 -o ignore -e ignore openssl req -newkey ed25519 -nodes \
+        -keyout "${name}.key" -out "${name}.csr" -subj "/CN=${name}"
+    assert_command -s 0 -o ignore -e ignore openssl x509 -req -in "${name}.csr" \
+        -CA ca.pem -CAkey ca.key -out "${name}.pem" -days 1
+}
+
+# Sends an identities request to the TLS listener of the switcher and saves the raw reply in
+# the file "${1}".  The remaining arguments are passed to openssl s_client.
+tls_request_identities() {
+    local out="${1}"; shift
+
+    local address="$(sed -n 's/.*Accepting TLS clients on //p' switcher.log)"
+    printf '\000\000\000\001\013' \
+        | timeout 2 openssl s_client -quiet -connect "${address}" -CAfile ca.pem "${@}" \
+          2>/dev/null | od -An -tx1 >"${out}"
+}
+
+shtk_unittest_add_fixture tls
+tls_fixture() {
+    setup() {
+        make_certificate server
+        make_certificate buildvm
+        make_certificate laptop
+
+        start_agent_and_switcher -tlsAddress 127.0.0.1:0 -tlsCert server.pem \
+            -tlsKey server.key -tlsClientCA ca.pem -tlsAllowClient "build*"
+        while ! grep -q "Accepting TLS clients on" switcher.log; do
+            sleep 0.01
+        done
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test client_certificate
+    client_certificate_test() {
+        tls_request_identities reply.out -cert buildvm.pem -key buildvm.key
+        expect_file match:"00 00 00 05 0c 00 00 00 00" reply.out
+        expect_file match:"Accepted TLS client \"buildvm\" from 127.0.0.1" switcher.log
+        expect_file match:"Closing client connection" switcher.log
+    }
+
+    shtk_unittest_add_test no_client_certificate
+    no_client_certificate_test() {
+        tls_request_identities reply.out
+        expect_file empty reply.out
+        expect_file match:"Rejecting TLS connection from .*: tls: client didn't provide a certificate" \
+            switcher.log
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test client_not_allowed
+    client_not_allowed_test() {
+        tls_request_identities reply.out -cert laptop.pem -key laptop.key
+        expect_file empty reply.out
+        expect_file match:"Rejecting TLS connection from .*: client \"laptop\" is not allowed" \
+            switcher.log
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+}
+
+shtk_unittest_add_fixture log_level
+log_level_fixture() {
+    setup() {
+        start_agent_and_switcher
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test candidates_not_logged_by_default
+    candidates_not_logged_by_default_test() {
+        mkdir "${SOCKETS_ROOT}/dir-unknown"
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+
+        expect_file match:"Successfully opened SSH agent" switcher.log
+        expect_file not-match:"Ignoring.*/dir-unknown" switcher.log
+    }
+}
+
+shtk_unittest_add_fixture log_file
+log_file_fixture() {
+    setup() {
+        start_agent_and_switcher -logFile "$(pwd)/switcher.log"
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test reopen_on_sighup
+    reopen_on_sighup_test() {
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+        mv switcher.log old.log
+
+        kill -HUP "${SWITCHER_AGENT_PID}"
+        while [ ! -e switcher.log ]; do
+            sleep 0.01
+        done
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+
+        expect_file match:"Listening on" old.log
+        expect_file match:"Reopened log file" switcher.log
+        expect_file not-match:"Listening on" switcher.log
+    }
+}
+
+shtk_unittest_add_fixture log_format
+log_format_fixture() {
+    setup() {
+        start_agent_and_switcher -logFormat=json
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test json
+    json_test() {
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+
+        expect_file match:'"level":"INFO","msg":"Successfully opened SSH agent.*","conn":1}' \
+            switcher.log
+        expect_file not-match:'\[conn 1\]' switcher.log
+    }
+}
+
+shtk_unittest_add_fixture slow_threshold
+slow_threshold_fixture() {
+    setup() {
+        start_agent_and_switcher -slowThreshold=1ns
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test phases_logged
+    phases_logged_test() {
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+
+        expect_file match:"WARNING: .*Slow agent selection took .* \(scan .*, probe .*\)" switcher.log
+        expect_file match:"WARNING: .*Slow SSH_AGENTC_REQUEST_IDENTITIES took .* \(checks .*, agent .*\)" switcher.log
+    }
+}
+
+shtk_unittest_add_fixture history
+history_fixture() {
+    setup() {
+        CONTROL_SOCKET="$(mktemp -u -p /tmp)"
+        start_agent_and_switcher -controlSocket "${CONTROL_SOCKET}"
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test records_selections
+    records_selections_test() {
+        expect_command -s 0 -o match:"no agent selections yet" \
+            ../ssh-agent-switcher_/ssh-agent-switcher -controlSocket "${CONTROL_SOCKET}" control history
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+
+        ../ssh-agent-switcher_/ssh-agent-switcher -controlSocket "${CONTROL_SOCKET}" control history >history.out
+        expect_file match:"\[conn 1\] selected ${AGENT_AUTH_SOCK}; candidates: 1" history.out
+        expect_file match:"\[conn 2\] selected ${AGENT_AUTH_SOCK}" history.out
+    }
+
+    shtk_unittest_add_test records_skipped
+    records_skipped_test() {
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-bar"
+        touch "${SOCKETS_ROOT}/ssh-bar/agent.not-a-socket"
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+
+        ../ssh-agent-switcher_/ssh-agent-switcher -controlSocket "${CONTROL_SOCKET}" control history >history.out
+        expect_file match:"rejected: .*${SOCKETS_ROOT}/ssh-bar/agent.not-a-socket: not a candidate: .*not a socket" \
+            history.out
+
+        rm -rf "${SOCKETS_ROOT}/ssh-bar"
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+}
+
+shtk_unittest_add_fixture capture
+capture_fixture() {
+    setup() {
+        mkdir captures
+        start_agent_and_switcher -captureDir "$(pwd)/captures"
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test redacted_by_default
+    redacted_by_default_test() {
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+
+        cat captures/*-conn-1.capture >capture.out
+        expect_file match:"^# client: .*ssh-add" capture.out
+        expect_file match:"^> [0-9]+ 000000010b$" capture.out
+        expect_file match:"^< [0-9]+ 000000050c redacted$" capture.out
+    }
+
+    shtk_unittest_add_test replay
+    replay_test() {
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+
+        expect_command -s 0 -o match:"All 1 responses match" \
+            ../ssh-agent-switcher_/ssh-agent-switcher replay -agent "${AGENT_AUTH_SOCK}" \
+            captures/*-conn-1.capture
+
+        echo "# ssh-agent-switcher capture v1" >bogus.capture
+        echo "> 0 000000010b" >>bogus.capture
+        echo "< 0 0000000106" >>bogus.capture
+        expect_command -s 1 -o match:"SSH_AGENT_SUCCESS.*: differs" -e match:"1 of 1 responses differ" \
+            ../ssh-agent-switcher_/ssh-agent-switcher replay -agent "${AGENT_AUTH_SOCK}" bogus.capture
+    }
+}
+
+shtk_unittest_add_fixture churn
+churn_fixture() {
+    setup() {
+        start_agent_and_switcher -churnThreshold=2
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test warn_on_flapping
+    warn_on_flapping_test() {
+        mkdir -m 0700 "${SOCKETS_ROOT}/ssh-aaa"
+        ssh-agent -a "${SOCKETS_ROOT}/ssh-aaa/agent.foo" >other.env
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+
+        ( . ./other.env; kill "${SSH_AGENT_PID}" )
+        while [ -e "${SOCKETS_ROOT}/ssh-aaa/agent.foo" ]; do
+            sleep 0.01
+        done
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+        expect_file not-match:"Selected agent changed" switcher.log
+
+        ssh-agent -a "${SOCKETS_ROOT}/ssh-aaa/agent.foo" >other.env
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+        ( . ./other.env; kill "${SSH_AGENT_PID}" )
+
+        expect_file match:"WARNING: Selected agent changed 2 times in the last 1m0s" switcher.log
+    }
+}
+
+shtk_unittest_add_fixture max_message_size
+max_message_size_fixture() {
+    setup() {
+        start_agent_and_switcher -maxMessageSize=1024
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test large_request_rejected
+    large_request_rejected_test() {
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t rsa -b 4096 -N '' -f ./id_rsa
+        if ssh-add ./id_rsa >/dev/null 2>&1; then
+            fail "ssh-add succeeded with a message larger than the limit"
+        fi
+        expect_file match:"invalid request from .*: message too large \([0-9]+ bytes\)" switcher.log
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+}
+
+# Starts another ssh-agent-switcher instance listening on "socket" that finds agents in the
+# same directory as the one started by start_agent_and_switcher.
+#
+# The log goes to "log" and any other arguments are passed as extra flags.
+start_other_switcher() {
+    local socket="${1}"; shift
+    local log="${1}"; shift
+
+    ../ssh-agent-switcher_/ssh-agent-switcher \
+        --socketPath "${socket}" \
+        --agentsDir "${SOCKETS_ROOT}" \
+        "${@}" \
+        2>"${log}" &
+    echo "${!}" >>other.pids  # For teardown.
+
+    while [ ! -e "${socket}" ]; do
+        sleep 0.01
+    done
+}
+
+shtk_unittest_add_fixture switchers
+switchers_fixture() {
+    setup() {
+        start_agent_and_switcher
+
+        # Place the other instance in a session directory that sorts before the agent's.
+        OTHER_AUTH_SOCK="${SOCKETS_ROOT}/ssh-aaa/agent.other"
+        mkdir -m 0700 "$(dirname "${OTHER_AUTH_SOCK}")"
+        start_other_switcher "${OTHER_AUTH_SOCK}" other.log
+    }
+
+    teardown() {
+        kill $(cat other.pids)
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test skip_other_instances
+    skip_other_instances_test() {
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+        expect_file match:"Ignoring .*/agent.other: is another ssh-agent-switcher instance" \
+            switcher.log
+    }
+
+    shtk_unittest_add_test chain_through_other_instances
+    chain_through_other_instances_test() {
+        local chained="${SOCKETS_ROOT}/chained"
+        start_other_switcher "${chained}" chained.log -chainSwitchers
+
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${chained}" ssh-add -l
+        expect_file match:"Chaining through the ssh-agent-switcher instance at .*/agent.other" \
+            chained.log
+        expect_file match:"opened.*${AGENT_AUTH_SOCK}" other.log
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test upstream_switcher
+    upstream_switcher_test() {
+        mkdir empty
+        local chained="${SOCKETS_ROOT}/chained"
+        start_other_switcher "${chained}" chained.log -agentsDir "$(pwd)/empty" \
+            -upstreamSwitcher "${OTHER_AUTH_SOCK}"
+
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${chained}" ssh-add -l
+        expect_file match:"Chaining to the upstream ssh-agent-switcher instance at ${OTHER_AUTH_SOCK}" \
+            chained.log
+        expect_command -s 0 -o save:query.out \
+            ../ssh-agent-switcher_/ssh-agent-switcher query -socket "${chained}"
+        expect_file match:"^upstream: ${OTHER_AUTH_SOCK}$" query.out
+        expect_file match:"^hop: .* ${AGENT_AUTH_SOCK}$" query.out
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test upstream_switcher_loop
+    upstream_switcher_loop_test() {
+        local first="${SOCKETS_ROOT}/first"
+        local second="${SOCKETS_ROOT}/second"
+        start_other_switcher "${first}" first.log -upstreamSwitcher "${second}"
+        start_other_switcher "${second}" second.log -upstreamSwitcher "${first}"
+
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${first}" ssh-add -l
+        expect_file match:"Rejecting connection: loop detected" first.log
+        expect_file match:"Not chaining to -upstreamSwitcher ${first}: refused the connection" \
+            second.log
+        expect_file match:"Successfully opened SSH agent at ${AGENT_AUTH_SOCK}" second.log
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test upstream_switcher_refused_once
+    upstream_switcher_refused_once_test() {
+        local first="${SOCKETS_ROOT}/first"
+        local second="${SOCKETS_ROOT}/second"
+        start_other_switcher "${first}" first.log -upstreamSwitcher "${second}"
+        start_other_switcher "${second}" second.log -logLevel=debug -warmInterval 1h \
+            -upstreamSwitcher "${first}"
+        local i=0
+        while [ "${i}" -lt 100 ] && ! grep -q "Keeping the agent at ${first} warm" second.log; do
+            sleep 0.01
+            i=$((i + 1))
+        done
+        expect_file match:"Keeping the agent at ${first} warm" second.log
+
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${first}" ssh-add -l
+        expect_file match:"Successfully opened SSH agent at ${AGENT_AUTH_SOCK}" second.log
+        [ "$(grep -c "Rejecting connection: loop detected" first.log)" -eq 1 ] \
+            || fail "Tried the upstream again after it refused the connection"
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+}
+
+# Starts the bridge subcommand on "socket" using a fake ssh that runs ssh-agent-switcher in
+# stdio mode locally.
+#
+# The log goes to "log" and any other arguments are passed as extra flags to the stdio mode.
+start_bridge() {
+    local socket="${1}"; shift
+    local log="${1}"; shift
+
+    # Stand-in for ssh that ignores the host and runs the remote command locally.
+    cat >fake-ssh <<'EOF'
+#! /bin/sh
+[ "${1}" = -T ] || exit 255
+shift 2
+exec /bin/sh -c "${*}"
+EOF
+    chmod +x fake-ssh
+
+    ../ssh-agent-switcher_/ssh-agent-switcher bridge -socket "${socket}" \
+        -sshProgram "$(pwd)/fake-ssh" \
+        -remoteCommand "$(pwd)/../ssh-agent-switcher_/ssh-agent-switcher --agentsDir ${SOCKETS_ROOT} ${*} stdio" \
+        remote.example.com 2>"${log}" &
+    echo "${!}" >>other.pids  # For teardown.
+
+    while [ ! -e "${socket}" ]; do
+        sleep 0.01
+    done
+}
+
+shtk_unittest_add_fixture bridge
+bridge_fixture() {
+    setup() {
+        start_agent_and_switcher
+        assert_command -s 0 -o ignore -e ignore ssh-keygen -t ed25519 -N '' -f ./id
+    }
+
+    teardown() {
+        [ ! -e other.pids ] || kill $(cat other.pids)
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test forward_remote_agent
+    forward_remote_agent_test() {
+        assert_command -s 0 -e ignore env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add ./id
+
+        local bridged="${SOCKETS_ROOT}/bridged"
+        start_bridge "${bridged}" bridge.log
+        expect_command -s 0 -o match:"ED25519" env SSH_AUTH_SOCK="${bridged}" ssh-add -l
+        expect_file match:"Bridging client connection to remote.example.com" bridge.log
+
+        assert_command -s 0 -e ignore env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add -D
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test stdio_applies_filters
+    stdio_applies_filters_test() {
+        local bridged="${SOCKETS_ROOT}/bridged"
+        start_bridge "${bridged}" bridge.log -readOnly
+        expect_command -s 1 -e match:"agent refused operation" \
+            env SSH_AUTH_SOCK="${bridged}" ssh-add ./id
+        expect_command -s 1 -o match:"no identities" \
+            env SSH_AUTH_SOCK="${AGENT_AUTH_SOCK}" ssh-add -l
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test stdio_without_agent
+    stdio_without_agent_test() {
+        mv "${SOCKETS_ROOT}/ssh-zzz" "${SOCKETS_ROOT}/hidden"
+        local bridged="${SOCKETS_ROOT}/bridged"
+        start_bridge "${bridged}" bridge.log
+        expect_command -s 1 -o match:"no identities" env SSH_AUTH_SOCK="${bridged}" ssh-add -l
+        expect_file match:"Acting as an empty agent" bridge.log
+        mv "${SOCKETS_ROOT}/hidden" "${SOCKETS_ROOT}/ssh-zzz"
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+}
+
+shtk_unittest_add_fixture container
+container_fixture() {
+    setup() {
+        start_agent_and_switcher
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test publish_options
+    publish_options_test() {
+        expect_command -s 0 \
+            -o match:"--name builder -v ${SWITCHER_AUTH_SOCK}:/srv/agent.sock(:z)? -e SSH_AUTH_SOCK=/srv/agent.sock" \
+            ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${SWITCHER_AUTH_SOCK}" \
+            container -runtime docker -target /srv/agent.sock builder
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test devcontainer
+    devcontainer_test() {
+        expect_command -s 0 -o save:devcontainer.json \
+            ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${SWITCHER_AUTH_SOCK}" \
+            devcontainer -runtime docker -target /srv/agent.sock
+        expect_file match:"\"SSH_AUTH_SOCK\": \"/srv/agent.sock\"" devcontainer.json
+        expect_file match:"${SWITCHER_AUTH_SOCK}.*/srv/agent.sock" devcontainer.json
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test join_container
+    join_container_test() {
+        # Stand-in for a rootless container with a private /mnt.
+        local unshare="unshare --user --map-root-user --mount --fork --kill-child"
+        ${unshare} true >/dev/null 2>&1 || skip "Cannot create namespaces"
+        ${unshare} sh -c 'mount -t tmpfs none /mnt && exec sleep 60' &
+        local parent="${!}"
+        local pid
+        while ! pid="$(pgrep -x -P "${parent}" sleep)"; do
+            sleep 0.01
+        done
+
+        ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${SWITCHER_AUTH_SOCK}" \
+            container -runtime docker -join -target /mnt/agent.sock "${pid}" 2>join.log &
+        local join="${!}"
+        while ! grep -q "Relaying clients" join.log; do
+            sleep 0.01
+        done
+        [ ! -e /mnt/agent.sock ] || fail "Socket created outside of the container"
+        expect_command -s 1 -o match:"no identities" \
+            nsenter --preserve-credentials -t "${pid}" -U -m \
+            env SSH_AUTH_SOCK=/mnt/agent.sock ssh-add -l
+
+        # unshare does not exit on SIGTERM, but it takes the container down with it.
+        kill -9 "${parent}"
+        wait "${join}"
+        expect_file match:"Container process ${pid} is gone" join.log
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+
+    shtk_unittest_add_test no_daemon
+    no_daemon_test() {
+        expect_command -s 1 -e match:"no ssh-agent-switcher socket at ${SOCKETS_ROOT}/missing" \
+            ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${SOCKETS_ROOT}/missing" \
+            container -runtime docker builder
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+}
+
+shtk_unittest_add_fixture gpg
+gpg_fixture() {
+    setup() {
+        # Unix domain socket names have tight length limitations so we must place them under
+        # /tmp (instead of the current work directory, which would be preferrable because then
+        # we would get automatic cleanup).
+        GPG_ROOT="$(mktemp -d -p /tmp)"
+
+        mkdir -m 0700 "${GPG_ROOT}/gpg-live"
+        assert_command -s 0 -o ignore -e ignore env GNUPGHOME="${GPG_ROOT}/gpg-live" \
+            gpg-connect-agent /bye
+
+        # Leave behind the socket of a dead agent that is newer than the live one.
+        mkdir -m 0700 "${GPG_ROOT}/gpg-stale"
+        ssh-agent -a "${GPG_ROOT}/gpg-stale/S.gpg-agent" >stale.env
+        kill -9 "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' stale.env)"
+
+        start_agent_and_switcher -logLevel=debug -gpgSocketPath "${GPG_ROOT}/gpg" \
+            -gpgAgentsGlob "${GPG_ROOT}/gpg-*/S.gpg-agent"
+    }
+
+    teardown() {
+        env GNUPGHOME="${GPG_ROOT}/gpg-live" gpgconf --kill gpg-agent
+        stop_agent_and_switcher
+        rm -rf "${GPG_ROOT}"
+    }
+
+    shtk_unittest_add_test proxy_live_agent
+    proxy_live_agent_test() {
+        expect_command -s 0 -o match:"^OK" \
+            gpg-connect-agent -S "${GPG_ROOT}/gpg" "GETINFO version" /bye
+        expect_file match:"Ignoring ${GPG_ROOT}/gpg-stale/S.gpg-agent" switcher.log
+        expect_file match:"Successfully opened gpg-agent at ${GPG_ROOT}/gpg-live/S.gpg-agent" \
+            switcher.log
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+}
+
+shtk_unittest_add_fixture publish
+publish_fixture() {
+    setup() {
+        start_agent_and_switcher
+
+        # Stand-in for ssh that runs remote commands locally and records the forwardings that
+        # it is asked to set up instead of doing them.
+        cat >fake-ssh <<'EOF'
+#! /bin/sh
+case "${1}" in
+    -T) shift 2; exec /bin/sh -c "${*}" ;;
+    -N) echo "${*}" >>forwardings; exec sleep 60 ;;
+    *) exit 255 ;;
+esac
+EOF
+        chmod +x fake-ssh
+    }
+
+    teardown() {
+        stop_agent_and_switcher
+    }
+
+    shtk_unittest_add_test forward_and_clean_up
+    forward_and_clean_up_test() {
+        # Leave behind the socket of a dead forwarding.
+        local remote="${SOCKETS_ROOT}/remote"
+        ssh-agent -a "${remote}" >stale.env
+        kill -9 "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' stale.env)"
+
+        ../ssh-agent-switcher_/ssh-agent-switcher --socketPath "${SWITCHER_AUTH_SOCK}" \
+            publish -sshProgram "$(pwd)/fake-ssh" -remoteSocket "${remote}" \
+            remote.example.com 2>publish.log &
+        local pid="${!}"
+        while [ ! -e forwardings ]; do
+            sleep 0.01
+        done
+        [ ! -e "${remote}" ] || fail "Stale remote socket not removed"
+        expect_file match:"-R ${remote}:${SWITCHER_AUTH_SOCK} remote.example.com" forwardings
+
+        kill "${pid}"
+        wait "${pid}"
+        expect_file match:"Stopped publishing to remote.example.com" publish.log
+
+        expect_command -s 1 -o match:"no identities" ssh-add -l
+    }
+}
+
+shtk_unittest_add_fixture system
+system_fixture() {
+    setup() {
+        [ "$(id -u)" -eq 0 ] || skip "Requires root"
+
+        # The agents and their clients run as nobody, who must be able to reach them.
+        SYSTEM_ROOT="$(mktemp -d -p /tmp)"
+        chmod 0755 "${SYSTEM_ROOT}"
+        mkdir -m 1777 "${SYSTEM_ROOT}/tmp"
+        AS_NOBODY="setpriv --reuid=nobody --regid=nogroup --clear-groups"
+    }
+
+    teardown() {
+        [ ! -e other.pids ] || kill $(cat other.pids)
+        [ ! -e nobody.env ] || kill "$(sed -n 's/^SSH_AGENT_PID=\([0-9]*\);.*/\1/p' nobody.env)"
+        rm -rf "${SYSTEM_ROOT}"
+    }
+
+    shtk_unittest_add_test serve_every_user
+    serve_every_user_test() {
+        ${AS_NOBODY} mkdir -m 0700 "${SYSTEM_ROOT}/tmp/ssh-nobody"
+        ${AS_NOBODY} ssh-agent -a "${SYSTEM_ROOT}/tmp/ssh-nobody/agent.$$" >nobody.env
+
+        ../ssh-agent-switcher_/ssh-agent-switcher -agentsDir "${SYSTEM_ROOT}/tmp" \
+            -logLevel=debug system -usersDir "${SYSTEM_ROOT}/users" -minUid 1 \
+            -scanInterval 100ms 2>system.log &
+        echo "${!}" >other.pids
+        local socket="${SYSTEM_ROOT}/users/nobody"
+        while [ ! -e "${socket}" ]; do
+            sleep 0.01
+        done
+        expect_command -s 0 -o inline:"600 nobody\n" stat -c "%a %U" "${socket}"
+
+        expect_command -s 1 -o match:"no identities" \
+            ${AS_NOBODY} env SSH_AUTH_SOCK="${socket}" ssh-add -l
+        expect_file match:"Accepted client connection for user $(id -u nobody)" system.log
+        expect_file match:"Successfully opened SSH agent at .*/ssh-nobody/agent.$$" system.log
+
+        expect_command -s ignore -o ignore -e ignore env SSH_AUTH_SOCK="${socket}" ssh-add -l
+        expect_file match:"Rejecting connection: peer uid 0 .* is not user $(id -u nobody)" \
+            system.log
+    }
+
+    shtk_unittest_add_test filter_requests
+    filter_requests_test() {
+        ${AS_NOBODY} mkdir -m 0700 "${SYSTEM_ROOT}/tmp/ssh-nobody"
+        ${AS_NOBODY} ssh-agent -a "${SYSTEM_ROOT}/tmp/ssh-nobody/agent.$$" >nobody.env
+        ${AS_NOBODY} ssh-keygen -q -t ed25519 -N '' -f "${SYSTEM_ROOT}/tmp/ssh-nobody/id"
+
+        ../ssh-agent-switcher_/ssh-agent-switcher -agentsDir "${SYSTEM_ROOT}/tmp" \
+            -readOnly system -usersDir "${SYSTEM_ROOT}/users" -minUid 1 \
+            -scanInterval 100ms 2>system.log &
+        echo "${!}" >other.pids
+        local socket="${SYSTEM_ROOT}/users/nobody"
+        while [ ! -e "${socket}" ]; do
+            sleep 0.01
+        done
+
+        expect_command -s 1 -e match:"agent refused operation" \
+            ${AS_NOBODY} env SSH_AUTH_SOCK="${socket}" ssh-add "${SYSTEM_ROOT}/tmp/ssh-nobody/id"
+        expect_file match:"Rejecting request: SSH_AGENTC_ADD_IDENTITY not allowed in read-only mode" \
+            system.log
+        expect_command -s 1 -o match:"no identities" \
+            ${AS_NOBODY} env SSH_AUTH_SOCK="${socket}" ssh-add -l
+
+        expect_command -s 1 -e match:"-upstreamSwitcher cannot be used with system" \
+            ../ssh-agent-switcher_/ssh-agent-switcher -upstreamSwitcher /nonexistent system
+    }
+}
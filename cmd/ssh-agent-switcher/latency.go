@@ -0,0 +1,225 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+	"github.com/jmmv/ssh-agent-switcher/discovery"
+)
+
+// latencyBuckets are the upper bounds of the buckets of latencyHistogram.  Round trips slower
+// than the last one fall into an extra, unbounded bucket.
+var latencyBuckets = []time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+}
+
+// Parameters of the smoothed latency that decides whether an agent is slow.
+const (
+	// latencySmoothing is the weight of every new round trip in the smoothed latency.
+	latencySmoothing = 0.3
+
+	// minLatencySamples is how many round trips an agent needs before it can be demoted, so
+	// that a single hiccup doesn't.
+	minLatencySamples = 3
+
+	// latencyRetention is how long the latencies of an agent are kept after its last round
+	// trip, which keeps the agents of long-gone sessions from piling up.
+	latencyRetention = 24 * time.Hour
+)
+
+// latencyHistogram counts round trips by how long they took.
+type latencyHistogram struct {
+	// counts holds the number of round trips in each of latencyBuckets plus the unbounded one.
+	counts [13]uint64
+
+	// total is the sum of the durations of all round trips.
+	total time.Duration
+}
+
+// observe records a round trip that took "d".
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := sort.Search(len(latencyBuckets), func(i int) bool { return d <= latencyBuckets[i] })
+	h.counts[i]++
+	h.total += d
+}
+
+// export returns the histogram in the form published via expvar: the number of round trips,
+// their total duration in seconds, and the count of every bucket keyed by its upper bound in
+// seconds.
+func (h *latencyHistogram) export() map[string]any {
+	var count uint64
+	buckets := make(map[string]uint64, len(h.counts))
+	for i, n := range h.counts {
+		count += n
+		bound := "+Inf"
+		if i < len(latencyBuckets) {
+			bound = strconv.FormatFloat(latencyBuckets[i].Seconds(), 'f', -1, 64)
+		}
+		buckets[bound] = n
+	}
+	return map[string]any{"count": count, "sum_seconds": h.total.Seconds(), "buckets": buckets}
+}
+
+// agentLatency holds the latencies of the round trips to one agent.
+type agentLatency struct {
+	// list and sign are the latencies of identities and sign requests.
+	list latencyHistogram
+	sign latencyHistogram
+
+	// smoothed is the exponentially weighted average of the identities round trips.
+	smoothed time.Duration
+
+	// samples is the number of identities round trips included in "smoothed".
+	samples int
+
+	// last is when the latest round trip finished.
+	last time.Time
+}
+
+// latencyTracker measures how long the agents take to answer, by agent.
+type latencyTracker struct {
+	// mu protects agents.
+	mu sync.Mutex
+
+	// agents maps the paths to the agent sockets to their latencies.
+	agents map[string]*agentLatency
+}
+
+// agentLatencies measures the round trips of the requests forwarded to every agent.
+var agentLatencies = &latencyTracker{agents: make(map[string]*agentLatency)}
+
+// record accounts for the round trip of "request", which includes the length prefix, to the
+// agent at "path" that took "d".  Only identities and sign requests are measured, except for
+// the signs of security keys, which wait for the user to touch the key.
+func (t *latencyTracker) record(path string, request []byte, d time.Duration) {
+	if len(request) < 5 {
+		return
+	}
+	msgType := request[4]
+	if msgType != codec.AgentcRequestIdentities && (msgType != codec.AgentcSignRequest || isSecurityKeySign(request)) {
+		return
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for other, latency := range t.agents {
+		if now.Sub(latency.last) > latencyRetention {
+			delete(t.agents, other)
+		}
+	}
+	latency, ok := t.agents[path]
+	if !ok {
+		latency = &agentLatency{}
+		t.agents[path] = latency
+	}
+	latency.last = now
+	if msgType == codec.AgentcSignRequest {
+		latency.sign.observe(d)
+		return
+	}
+	latency.list.observe(d)
+	if latency.samples == 0 {
+		latency.smoothed = d
+	} else {
+		latency.smoothed += time.Duration(latencySmoothing * float64(d-latency.smoothed))
+	}
+	latency.samples++
+}
+
+// slow returns the smoothed latency of the agent at "path" and whether it exceeds "threshold"
+// consistently enough to demote the agent.
+func (t *latencyTracker) slow(path string, threshold time.Duration) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	latency, ok := t.agents[path]
+	if !ok || latency.samples < minLatencySamples {
+		return 0, false
+	}
+	return latency.smoothed, latency.smoothed > threshold
+}
+
+// export returns the latency histograms of all agents in the form published via expvar.
+func (t *latencyTracker) export() map[string]any {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	agents := make(map[string]any, len(t.agents))
+	for path, latency := range t.agents {
+		agent := map[string]any{
+			"list":             latency.list.export(),
+			"sign":             latency.sign.export(),
+			"smoothed_seconds": latency.smoothed.Seconds(),
+		}
+		if name := agentAliases.nameOf(path); name != "" {
+			agent["name"] = name
+		}
+		agents[path] = agent
+	}
+	return agents
+}
+
+// latencyRanker is a discovery.Discoverer that moves the candidates of another discoverer
+// whose agents have been consistently slower than "threshold" to answer identities requests
+// behind all others, such as agents forwarded over high-latency links.  The relative order of
+// the candidates is otherwise preserved.
+type latencyRanker struct {
+	discovery.Discoverer
+	threshold time.Duration
+}
+
+// Discover returns the candidates of the wrapped discoverer with the slow ones last.
+func (r *latencyRanker) Discover() ([]discovery.Candidate, []discovery.Skipped, error) {
+	candidates, skipped, err := r.Discoverer.Discover()
+	if len(candidates) < 2 {
+		return candidates, skipped, err
+	}
+
+	slow := make(map[string]bool, len(candidates))
+	for _, candidate := range candidates {
+		if latency, ok := agentLatencies.slow(candidate.Path, r.threshold); ok {
+			debugf("Demoting %s: it took %v on average to answer, more than -slowAgentThreshold", candidate.Path, latency.Round(time.Millisecond))
+			slow[candidate.Path] = true
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return !slow[candidates[i].Path] && slow[candidates[j].Path]
+	})
+	return candidates, skipped, err
+}
@@ -0,0 +1,189 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/switcher"
+)
+
+// Estimates used to derive the default of -maxConnections from the file descriptor limit.
+const (
+	// fdsPerConnection is how many file descriptors a client connection can hold at once: its
+	// own, the one of its agent, and one more for the scans and dials of agent selection.
+	fdsPerConnection = 3
+
+	// reservedFds is how many file descriptors to leave for the daemon itself, such as those of
+	// its listening sockets, log files, and plugins.
+	reservedFds = 64
+
+	// minMaxConnections is the smallest default of -maxConnections, even with tiny limits.
+	minMaxConnections = 16
+)
+
+// maxAcceptBackoff bounds the wait between retries of an Accept that failed due to a lack of
+// resources.
+const maxAcceptBackoff = time.Second
+
+// fileLimit returns the soft limit on the number of open file descriptors.
+//
+// The Go runtime already raises the soft limit to the hard limit at startup, so this is as
+// high as it can get without privileges.
+func fileLimit() (uint64, error) {
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err != nil {
+		return 0, err
+	}
+	return uint64(limit.Cur), nil
+}
+
+// defaultMaxConnections derives how many client connections we can serve at once from the
+// file descriptor limit "fds".
+func defaultMaxConnections(fds uint64) int {
+	n := minMaxConnections
+	if fds > reservedFds+fdsPerConnection*minMaxConnections {
+		n = int((fds - reservedFds) / fdsPerConnection)
+	}
+	return n
+}
+
+// connectionSlots bounds how many client connections are served at once, across all of the
+// agent sockets, so that a burst of clients cannot exhaust the file descriptors or spawn an
+// unbounded number of goroutines.  Clients beyond the limit wait in the listen backlog until
+// a slot is freed.
+type connectionSlots struct {
+	// free holds one token per connection that can be served.
+	free chan struct{}
+}
+
+// clientSlots limits the client connections being served.  Initialized from -maxConnections.
+var clientSlots *connectionSlots
+
+// newConnectionSlots creates the slots to serve "n" client connections at once.
+func newConnectionSlots(n int) *connectionSlots {
+	s := &connectionSlots{free: make(chan struct{}, n)}
+	for i := 0; i < n; i++ {
+		s.free <- struct{}{}
+	}
+	return s
+}
+
+// acquire blocks until a client connection can be served.  Does nothing if "s" is nil.
+func (s *connectionSlots) acquire() {
+	if s == nil {
+		return
+	}
+	select {
+	case <-s.free:
+		return
+	default:
+	}
+	logOncef(levelWarn, "All %d connection slots are busy; new clients wait until one is freed (see -maxConnections)", cap(s.free))
+	<-s.free
+}
+
+// release frees the slot taken by a client connection.  Does nothing if "s" is nil.
+func (s *connectionSlots) release() {
+	if s != nil {
+		s.free <- struct{}{}
+	}
+}
+
+// isResourceError returns true if "err" says that we ran out of a resource, such as file
+// descriptors, which is likely to be available again once other connections finish.
+func isResourceError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptClient waits for the next connection on "listener".  Failures due to a lack of
+// resources are retried with an increasing backoff instead of being returned so that a peak
+// of clients slows us down instead of taking us down.
+func acceptClient(listener net.Listener) (net.Conn, error) {
+	var wait time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err == nil || !isResourceError(err) {
+			return conn, err
+		}
+
+		if wait == 0 {
+			wait = 5 * time.Millisecond
+		} else if wait *= 2; wait > maxAcceptBackoff {
+			wait = maxAcceptBackoff
+		}
+		logOncef(levelWarn, "Cannot accept connections on %s: %v; retrying", listener.Addr(), err)
+		time.Sleep(wait)
+	}
+}
+
+// slotListener wraps a listener to only accept connections while there is a free slot in
+// clientSlots, which closeSession releases, and to retry the failures of acceptClient.
+type slotListener struct {
+	net.Listener
+}
+
+// Accept waits for a free slot and then for the next connection.
+func (l slotListener) Accept() (net.Conn, error) {
+	clientSlots.acquire()
+	conn, err := acceptClient(l.Listener)
+	if err != nil {
+		clientSlots.release()
+	}
+	return conn, err
+}
+
+// serveClients accepts connections on "listener" once there is a free slot in clientSlots and
+// serves each of them with "cfg", until accepting fails or "ctx" is done.
+func serveClients(ctx context.Context, listener net.Listener, cfg switcher.Config) error {
+	return switcher.Serve(ctx, slotListener{listener}, cfg)
+}
+
+// setupConnectionSlots initializes clientSlots to serve "n" client connections at once, or as
+// many as the file descriptor limit allows if zero.
+func setupConnectionSlots(n int) {
+	fds, err := fileLimit()
+	if err != nil {
+		warnf("Cannot determine the file descriptor limit: %v", err)
+	}
+	switch {
+	case n == 0 && err != nil:
+		return
+	case n == 0:
+		n = defaultMaxConnections(fds)
+	case err == nil && uint64(n)*fdsPerConnection+reservedFds > fds:
+		warnf("-maxConnections %d may exhaust the limit of %d file descriptors", n, fds)
+	}
+	debugf("Serving up to %d client connections at once with a limit of %d file descriptors", n, fds)
+	clientSlots = newConnectionSlots(n)
+}
@@ -0,0 +1,448 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel represents the severity of a log message.
+//
+// The zero value is not valid: levels are ordered so that more verbose levels have larger
+// values.
+type logLevel int
+
+// Severities of log messages, from the most to the least important.
+const (
+	levelError logLevel = iota + 1
+	levelWarn
+	levelInfo
+	levelDebug
+)
+
+// logLevelNames maps the names accepted by -logLevel to their levels.
+var logLevelNames = map[string]logLevel{
+	"error": levelError,
+	"warn":  levelWarn,
+	"info":  levelInfo,
+	"debug": levelDebug,
+}
+
+// currentLogLevel is the most verbose level of the messages that are logged.
+var currentLogLevel = levelInfo
+
+// String returns the name of the level as accepted by -logLevel.
+func (l *logLevel) String() string {
+	for name, level := range logLevelNames {
+		if level == *l {
+			return name
+		}
+	}
+	return ""
+}
+
+// Set parses a level name from a flag value.
+func (l *logLevel) Set(value string) error {
+	level, ok := logLevelNames[strings.ToLower(value)]
+	if !ok {
+		return fmt.Errorf("unknown log level %q; must be one of error, warn, info, or debug", value)
+	}
+	*l = level
+	return nil
+}
+
+// Level returns the slog level that matches "l", which lets the log handlers use the
+// current log level to decide whether messages are enabled.
+func (l *logLevel) Level() slog.Level {
+	switch *l {
+	case levelError:
+		return slog.LevelError
+	case levelWarn:
+		return slog.LevelWarn
+	case levelInfo:
+		return slog.LevelInfo
+	default:
+		return slog.LevelDebug
+	}
+}
+
+// logSink is a destination for log messages rendered as text.
+type logSink interface {
+	// logMessage emits "message", which is the text of the record "r" along with its
+	// attributes.
+	//
+	// The program counter of the record locates the code that logged the message.
+	logMessage(r slog.Record, message string)
+}
+
+// sinkHandler is a slog.Handler that renders log messages as text for a logSink.
+//
+// The connection identifier, if any, prefixes the message so that the messages of concurrent
+// connections can be told apart, and all other attributes follow it as key=value pairs.
+type sinkHandler struct {
+	// sink receives the rendered messages.
+	sink logSink
+
+	// attrs holds the attributes added via WithAttrs, already qualified by their group.
+	attrs []slog.Attr
+
+	// group is the prefix of the keys of the attributes added from now on, if not empty.
+	group string
+
+	// colors is true if the connection identifier and the attribute keys should be
+	// highlighted with terminal escape sequences.
+	colors bool
+}
+
+// Enabled returns true if messages of "level" are allowed by the current log level.
+func (h *sinkHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= currentLogLevel.Level()
+}
+
+// qualify prefixes the keys of "attrs" with the group of the handler.
+func (h *sinkHandler) qualify(attrs []slog.Attr) []slog.Attr {
+	if h.group == "" {
+		return attrs
+	}
+	qualified := make([]slog.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		qualified = append(qualified, slog.Attr{Key: h.group + attr.Key, Value: attr.Value})
+	}
+	return qualified
+}
+
+// WithAttrs returns a handler that adds "attrs" to every message.
+func (h *sinkHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	nh := *h
+	nh.attrs = append(append([]slog.Attr{}, h.attrs...), h.qualify(attrs)...)
+	return &nh
+}
+
+// WithGroup returns a handler that qualifies the keys of the attributes added from now on by
+// "name".
+func (h *sinkHandler) WithGroup(name string) slog.Handler {
+	nh := *h
+	nh.group = h.group + name + "."
+	return &nh
+}
+
+// Handle renders "r" and sends it to the sink.
+func (h *sinkHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := h.attrs
+	if r.NumAttrs() > 0 {
+		attrs = append([]slog.Attr{}, attrs...)
+		r.Attrs(func(attr slog.Attr) bool {
+			attrs = append(attrs, h.qualify([]slog.Attr{attr})...)
+			return true
+		})
+	}
+
+	var prefix, suffix string
+	for _, attr := range attrs {
+		switch {
+		case attr.Key == "conn" && h.colors:
+			prefix = fmt.Sprintf("%s[conn %v]%s ", colorCyan, attr.Value, colorReset)
+		case attr.Key == "conn":
+			prefix = fmt.Sprintf("[conn %v] ", attr.Value)
+		case h.colors:
+			suffix += fmt.Sprintf(" %s%s=%s%v", colorDim, attr.Key, colorReset, attr.Value)
+		default:
+			suffix += fmt.Sprintf(" %s=%v", attr.Key, attr.Value)
+		}
+	}
+	h.sink.logMessage(r, prefix+r.Message+suffix)
+	return nil
+}
+
+// writerLogSink writes log messages as lines of text in the format of the standard log
+// package, which is what ssh-agent-switcher has always printed.
+type writerLogSink struct {
+	// mu serializes writes so that lines do not interleave.
+	mu sync.Mutex
+
+	// w is where the lines are written to.
+	w io.Writer
+}
+
+// logMessage writes "message" prefixed by the time of the record and by its severity if it
+// is a warning or an error.
+func (s *writerLogSink) logMessage(r slog.Record, message string) {
+	line := r.Time.Format("2006/01/02 15:04:05 ")
+	switch {
+	case r.Level >= slog.LevelError:
+		line += "ERROR: "
+	case r.Level >= slog.LevelWarn:
+		line += "WARNING: "
+	}
+	line += message + "\n"
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	io.WriteString(s.w, line)
+}
+
+// currentLogger receives all log messages.  setupLogOutput replaces it with the handler for
+// the output chosen by the user.
+var currentLogger = slog.New(&sinkHandler{sink: &writerLogSink{w: os.Stderr}})
+
+// logCallerDepth is the number of stack frames between runtime.Callers in logf and the code
+// that logged the message.
+const logCallerDepth = 3
+
+// logf logs a message with the given severity and attributes if the current log level allows
+// it.
+//
+// This must be called directly by one of the errorf, warnf, infof, or debugf functions or
+// methods so that the log handlers can locate the caller that logged the message.
+func logf(level logLevel, attrs []slog.Attr, format string, args ...any) {
+	if level > currentLogLevel {
+		return
+	}
+	var pcs [1]uintptr
+	runtime.Callers(logCallerDepth, pcs[:])
+	r := slog.NewRecord(time.Now(), level.Level(), fmt.Sprintf(format, args...), pcs[0])
+	r.AddAttrs(attrs...)
+	currentLogger.Handler().Handle(context.Background(), r)
+}
+
+// silenceLogs discards all log messages until the returned function is called.  This is for
+// subcommands whose output would be trashed by diagnostics.
+func silenceLogs() func() {
+	old := currentLogger
+	currentLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	return func() { currentLogger = old }
+}
+
+// fatalf logs an error that keeps us from running at all and exits.
+func fatalf(format string, args ...any) {
+	logf(levelError, nil, format, args...)
+	os.Exit(1)
+}
+
+// errorf logs a failure that keeps us from doing what we were asked to do.
+func errorf(format string, args ...any) {
+	logf(levelError, nil, format, args...)
+}
+
+// warnf logs a condition that deserves the user's attention.
+func warnf(format string, args ...any) {
+	logf(levelWarn, nil, format, args...)
+}
+
+// infof logs a regular event, such as a new connection or a forwarded request.
+func infof(format string, args ...any) {
+	logf(levelInfo, nil, format, args...)
+}
+
+// debugf logs details that are only useful when troubleshooting, such as why each candidate
+// agent was skipped.
+func debugf(format string, args ...any) {
+	logf(levelDebug, nil, format, args...)
+}
+
+// connLogger logs messages about a single client connection.  Every message carries the
+// identifier of the connection as the "conn" attribute so that the messages of concurrent
+// connections can be told apart.
+//
+// A nil connLogger logs messages without attributes.
+type connLogger struct {
+	id    uint64
+	attrs []slog.Attr
+}
+
+// newConnLogger creates a logger for the connection identified by "id".
+func newConnLogger(id uint64) *connLogger {
+	return &connLogger{id: id, attrs: []slog.Attr{slog.Uint64("conn", id)}}
+}
+
+// fields returns the attributes to add to every message.
+//
+// The logging methods below must call the global logf directly so that log handlers can
+// locate the code that logged the message.
+func (l *connLogger) fields() []slog.Attr {
+	if l == nil {
+		return nil
+	}
+	return l.attrs
+}
+
+// errorf logs a failure like the global errorf.
+func (l *connLogger) errorf(format string, args ...any) {
+	logf(levelError, l.fields(), format, args...)
+}
+
+// warnf logs a condition that deserves attention like the global warnf.
+func (l *connLogger) warnf(format string, args ...any) {
+	logf(levelWarn, l.fields(), format, args...)
+}
+
+// infof logs a regular event like the global infof.
+func (l *connLogger) infof(format string, args ...any) {
+	logf(levelInfo, l.fields(), format, args...)
+}
+
+// debugf logs troubleshooting details like the global debugf.
+func (l *connLogger) debugf(format string, args ...any) {
+	logf(levelDebug, l.fields(), format, args...)
+}
+
+// phaseTimer measures how long each phase of an operation takes so that slow operations can
+// be reported along with the phase that caused the slowness.
+type phaseTimer struct {
+	// start is when the operation started.
+	start time.Time
+
+	// last is when the previous phase ended.
+	last time.Time
+
+	// phases describes the duration of each finished phase.
+	phases []string
+}
+
+// newPhaseTimer starts timing an operation.
+func newPhaseTimer() *phaseTimer {
+	now := time.Now()
+	return &phaseTimer{start: now, last: now}
+}
+
+// mark records the end of the phase called "name", which started when the previous phase
+// ended.
+func (t *phaseTimer) mark(name string) {
+	now := time.Now()
+	t.phases = append(t.phases, fmt.Sprintf("%s %v", name, now.Sub(t.last).Round(time.Millisecond)))
+	t.last = now
+}
+
+// warnIfSlow logs a warning via "logger" if "operation" took longer than -slowThreshold.
+func (t *phaseTimer) warnIfSlow(logger *connLogger, operation string) {
+	if *slowThreshold == 0 {
+		return
+	}
+	elapsed := time.Since(t.start)
+	if elapsed < *slowThreshold {
+		return
+	}
+	logger.warnf("Slow %s took %v (%s)", operation, elapsed.Round(time.Millisecond), strings.Join(t.phases, ", "))
+}
+
+// repeatedMessage tracks a message logged via logOncef.
+type repeatedMessage struct {
+	// logged is when the message was last logged.
+	logged time.Time
+
+	// suppressed is how many times the message was not logged since then.
+	suppressed int
+}
+
+// logDeduper suppresses repeated log messages.
+type logDeduper struct {
+	// interval is how long to suppress repeated messages for, or zero to never suppress them.
+	interval time.Duration
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// messages maps recently-logged messages to their state.
+	messages map[string]*repeatedMessage
+
+	// lastPrune is when "messages" was last cleaned up of old entries.
+	lastPrune time.Time
+}
+
+// repeatedMessages suppresses repeated messages logged via logOncef.
+var repeatedMessages = &logDeduper{interval: 10 * time.Minute}
+
+// shouldLog returns true if "message" has not been logged in the last interval, along with the
+// number of times it was suppressed since it was last logged.
+func (d *logDeduper) shouldLog(message string, now time.Time) (bool, int) {
+	if d.interval == 0 {
+		return true, 0
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.messages == nil {
+		d.messages = make(map[string]*repeatedMessage)
+	}
+	if now.Sub(d.lastPrune) >= d.interval {
+		// Forget messages that have not been repeated for a while.  If they were suppressed,
+		// give them one more interval to show up again so that we can report the count.
+		for key, m := range d.messages {
+			age := now.Sub(m.logged)
+			if age >= 2*d.interval || (age >= d.interval && m.suppressed == 0) {
+				delete(d.messages, key)
+			}
+		}
+		d.lastPrune = now
+	}
+
+	m, ok := d.messages[message]
+	if !ok {
+		d.messages[message] = &repeatedMessage{logged: now}
+		return true, 0
+	}
+	if now.Sub(m.logged) < d.interval {
+		m.suppressed++
+		return false, 0
+	}
+	suppressed := m.suppressed
+	m.logged = now
+	m.suppressed = 0
+	return true, suppressed
+}
+
+// reset forgets all recently-logged messages so that they are logged again the next time.
+func (d *logDeduper) reset() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.messages = nil
+}
+
+// logOncef logs a message like logf but only if the same message was not logged recently.
+// This is meant for messages that are emitted over and over again for the same reason, such
+// as those that explain why each candidate agent is skipped on every connection.
+func logOncef(level logLevel, format string, args ...any) {
+	if level > currentLogLevel {
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	ok, suppressed := repeatedMessages.shouldLog(message, time.Now())
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		logf(level, nil, "%s (repeated %d times since last logged)", message, suppressed)
+	} else {
+		logf(level, nil, "%s", message)
+	}
+}
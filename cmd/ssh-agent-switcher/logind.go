@@ -0,0 +1,179 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/discovery"
+)
+
+// logindTimeout is how long systemd-logind has to answer all of our queries about the
+// candidates of one discovery before we give up and keep the candidates in their original order.
+const logindTimeout = 2 * time.Second
+
+// Ranks of the candidates based on the state of the logind session that owns them, from most
+// to least preferred.
+const (
+	rankActive = iota
+	rankOnline
+	rankUnknown
+	rankIdle
+	rankClosing
+	rankNotty
+)
+
+// logindSession describes the state of a logind session.
+type logindSession struct {
+	state  string
+	idle   bool
+	remote bool
+}
+
+// rank returns how preferable the agents of the session are.
+func (s *logindSession) rank() int {
+	switch {
+	case s.state == "closing":
+		return rankClosing
+	case s.idle:
+		return rankIdle
+	case s.state == "active":
+		return rankActive
+	default:
+		return rankOnline
+	}
+}
+
+// String returns a description of the session for the logs.
+func (s *logindSession) String() string {
+	description := s.state
+	if s.idle {
+		description += ", idle"
+	}
+	if s.remote {
+		description += ", remote"
+	}
+	return description
+}
+
+// sessionRanker is a discovery.Discoverer that reorders the candidates of another discoverer
+// so that the agents of active sessions come first and the agents of idle or closing sessions
+// come last.  Candidates whose session is unknown stay in between.
+//
+// The sessions are looked up in logind or, if the system bus cannot be reached, in utmp.
+// Candidates with the same rank can additionally be sorted by how recently their terminals
+// received input.
+type sessionRanker struct {
+	discovery.Discoverer
+
+	// sessions enables ranking the candidates by the state of their sessions.
+	sessions bool
+
+	// demoteNotty ranks the agents of the sessions without a terminal below all others.
+	demoteNotty bool
+
+	// recentTerminals sorts the candidates with the same rank so that the agents of the
+	// sessions whose terminals most recently received input come first.
+	recentTerminals bool
+}
+
+// Discover returns the candidates of the wrapped discoverer sorted by rank.  The relative order
+// of the candidates with the same rank is preserved, unless recentTerminals is set.
+func (r *sessionRanker) Discover() ([]discovery.Candidate, []discovery.Skipped, error) {
+	candidates, skipped, err := r.Discoverer.Discover()
+	if len(candidates) < 2 {
+		return candidates, skipped, err
+	}
+
+	var lookup func(pid int) (int, string, error)
+	if r.sessions {
+		lookup = utmpSessionRank
+		logindLookup, done, dialErr := connectLogind()
+		if dialErr != nil {
+			logOncef(levelInfo, "Ranking agents by utmp session: cannot connect to the system bus: %v", dialErr)
+		} else {
+			defer done()
+			lookup = logindLookup
+		}
+	}
+
+	ranks := make(map[string]int, len(candidates))
+	idles := make(map[string]time.Duration, len(candidates))
+	for _, candidate := range candidates {
+		ranks[candidate.Path] = r.rank(candidate.Path, lookup)
+		if r.recentTerminals {
+			idles[candidate.Path] = terminalIdleTime(candidate.Path)
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i].Path, candidates[j].Path
+		if ranks[a] != ranks[b] {
+			return ranks[a] < ranks[b]
+		}
+		return idles[a] < idles[b]
+	})
+	return candidates, skipped, err
+}
+
+// terminalIdleTime returns how long the terminal of the session of the agent at "path" has been
+// idle, or the longest possible duration if the session has no terminal that we can find.
+func terminalIdleTime(path string) time.Duration {
+	pid, err := sessionPID(path)
+	if err != nil {
+		return math.MaxInt64
+	}
+	tty, idle, err := sessionTerminalIdleTime(pid)
+	if err != nil {
+		debugf("No terminal found for %s: %v", path, err)
+		return math.MaxInt64
+	}
+	debugf("Terminal %s of agent %s received input %v ago", tty, path, idle.Truncate(time.Second))
+	return idle
+}
+
+// rank computes the rank of the agent at "path" by looking up its session with "lookup", if
+// not nil.
+func (r *sessionRanker) rank(path string, lookup func(pid int) (int, string, error)) int {
+	if r.demoteNotty && nottySession(path) {
+		debugf("Demoting %s: its session has no terminal", path)
+		return rankNotty
+	}
+	if lookup == nil {
+		return rankUnknown
+	}
+
+	pid, err := sessionPID(path)
+	if err != nil {
+		return rankUnknown
+	}
+	rank, description, err := lookup(pid)
+	if err != nil {
+		debugf("No session found for %s: %v", path, err)
+		return rankUnknown
+	}
+	debugf("Agent %s belongs to %s", path, description)
+	return rank
+}
@@ -0,0 +1,117 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !nodbus && !minimal
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// connectLogind connects to systemd-logind over the system bus and returns a function that
+// looks up the rank of the session of a process, along with a description of the session, and a
+// function that closes the connection once done.
+func connectLogind() (func(pid int) (int, string, error), func(), error) {
+	conn, err := dialDBus(systemBusAddress())
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.conn.SetDeadline(time.Now().Add(logindTimeout))
+	if err := conn.hello(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	lookup := func(pid int) (int, string, error) {
+		session, err := logindSessionOf(conn, pid)
+		if err != nil {
+			return 0, "", err
+		}
+		return session.rank(), "a logind session that is " + session.String(), nil
+	}
+	return lookup, func() { conn.Close() }, nil
+}
+
+// logindSessionOf queries logind for the session that the process "pid" belongs to.
+func logindSessionOf(conn *dbusConn, pid int) (*logindSession, error) {
+	var body dbusEncoder
+	body.putUint32(uint32(pid))
+	reply, err := conn.call(&dbusMessage{
+		destination: "org.freedesktop.login1",
+		path:        "/org/freedesktop/login1",
+		iface:       "org.freedesktop.login1.Manager",
+		member:      "GetSessionByPID",
+		signature:   "u",
+		body:        body.buf,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reply.signature != "o" {
+		return nil, fmt.Errorf("unexpected logind reply signature %q", reply.signature)
+	}
+	d := dbusDecoder{buf: reply.body, order: reply.order}
+	path, err := d.getString()
+	if err != nil {
+		return nil, err
+	}
+
+	var values [3]any
+	for i, name := range []string{"State", "IdleHint", "Remote"} {
+		if values[i], err = logindProperty(conn, path, name); err != nil {
+			return nil, err
+		}
+	}
+	state, stateOk := values[0].(string)
+	idle, idleOk := values[1].(bool)
+	remote, remoteOk := values[2].(bool)
+	if !stateOk || !idleOk || !remoteOk {
+		return nil, fmt.Errorf("unexpected types of the properties of logind session %s", path)
+	}
+	return &logindSession{state: state, idle: idle, remote: remote}, nil
+}
+
+// logindProperty reads the property "name" of the logind session at "path".
+func logindProperty(conn *dbusConn, path string, name string) (any, error) {
+	var body dbusEncoder
+	body.putString("org.freedesktop.login1.Session")
+	body.putString(name)
+	reply, err := conn.call(&dbusMessage{
+		destination: "org.freedesktop.login1",
+		path:        path,
+		iface:       "org.freedesktop.DBus.Properties",
+		member:      "Get",
+		signature:   "ss",
+		body:        body.buf,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reply.signature != "v" {
+		return nil, fmt.Errorf("unexpected logind reply signature %q", reply.signature)
+	}
+	d := dbusDecoder{buf: reply.body, order: reply.order}
+	return d.getVariant()
+}
@@ -0,0 +1,369 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// syslogLogSink sends log messages to the system logger.
+type syslogLogSink struct {
+	writer *syslog.Writer
+}
+
+// openSyslogLogSink connects to the system logger.
+func openSyslogLogSink() (*syslogLogSink, error) {
+	writer, err := syslog.New(syslog.LOG_INFO|syslog.LOG_USER, "ssh-agent-switcher")
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to syslog: %v", err)
+	}
+	return &syslogLogSink{writer: writer}, nil
+}
+
+// logMessage sends "message" to the system logger with the priority that matches the level of
+// "r".
+func (s *syslogLogSink) logMessage(r slog.Record, message string) {
+	var err error
+	switch {
+	case r.Level >= slog.LevelError:
+		err = s.writer.Err(message)
+	case r.Level >= slog.LevelWarn:
+		err = s.writer.Warning(message)
+	case r.Level >= slog.LevelInfo:
+		err = s.writer.Info(message)
+	default:
+		err = s.writer.Debug(message)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot send log message to syslog: %v: %s\n", err, message)
+	}
+}
+
+// journalSocket is the path to the socket on which the systemd journal receives messages
+// using its native protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// journalLogSink sends log messages to the systemd journal along with structured fields that
+// describe where they come from.
+type journalLogSink struct {
+	conn net.Conn
+}
+
+// openJournalLogSink connects to the systemd journal.
+func openJournalLogSink() (*journalLogSink, error) {
+	conn, err := net.Dial("unixgram", journalSocket)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to the systemd journal: %v", err)
+	}
+	return &journalLogSink{conn: conn}, nil
+}
+
+// appendJournalField appends the field "name" with "value" to "buf" in the format of the
+// journal's native protocol.
+func appendJournalField(buf []byte, name string, value string) []byte {
+	buf = append(buf, name...)
+	if strings.Contains(value, "\n") {
+		// Values with newlines must be sent in binary form, prefixed by their length.
+		buf = append(buf, '\n')
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(len(value)))
+	} else {
+		buf = append(buf, '=')
+	}
+	buf = append(buf, value...)
+	return append(buf, '\n')
+}
+
+// logMessage sends "message" to the journal with the priority that matches the level of "r".
+func (s *journalLogSink) logMessage(r slog.Record, message string) {
+	priority := syslog.LOG_DEBUG
+	switch {
+	case r.Level >= slog.LevelError:
+		priority = syslog.LOG_ERR
+	case r.Level >= slog.LevelWarn:
+		priority = syslog.LOG_WARNING
+	case r.Level >= slog.LevelInfo:
+		priority = syslog.LOG_INFO
+	}
+
+	var buf []byte
+	buf = appendJournalField(buf, "MESSAGE", message)
+	buf = appendJournalField(buf, "PRIORITY", strconv.Itoa(int(priority)))
+	buf = appendJournalField(buf, "SYSLOG_IDENTIFIER", "ssh-agent-switcher")
+	if r.PC != 0 {
+		frame, _ := runtime.CallersFrames([]uintptr{r.PC}).Next()
+		buf = appendJournalField(buf, "CODE_FILE", filepath.Base(frame.File))
+		buf = appendJournalField(buf, "CODE_LINE", strconv.Itoa(frame.Line))
+		buf = appendJournalField(buf, "CODE_FUNC", frame.Function)
+	}
+
+	if _, err := s.conn.Write(buf); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot send log message to the journal: %v: %s\n", err, message)
+	}
+}
+
+// logFileBackups is the number of rotated log files that are kept around.
+const logFileBackups = 3
+
+// logFile writes log messages to a file, rotating it when it grows too large.
+type logFile struct {
+	// path is the location of the current log file.  Rotated files have a numeric suffix.
+	path string
+
+	// maxSize is the size in bytes after which the file is rotated, or zero to never rotate.
+	maxSize int64
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// file is the open log file.
+	file *os.File
+
+	// size is the current size of the open log file.
+	size int64
+}
+
+// openLogFile opens the log file at "path" for appending, creating it if necessary.
+func openLogFile(path string, maxSize int64) (*logFile, error) {
+	f := &logFile{path: path, maxSize: maxSize}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the log file and replaces the current one, if any, without closing it.  Must be
+// called with "mu" held, except during construction.
+func (f *logFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open log file: %v", err)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("cannot open log file: %v", err)
+	}
+	f.file = file
+	f.size = fi.Size()
+	return nil
+}
+
+// reopen closes the log file and opens it again, which picks up a new file if the old one was
+// moved away by an external log rotation tool.
+func (f *logFile) reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	old := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+// rotate renames the log file and its backups to make room for a new file, discarding the
+// oldest backup.  Must be called with "mu" held.
+func (f *logFile) rotate() error {
+	for i := logFileBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		return fmt.Errorf("cannot rotate log file: %v", err)
+	}
+
+	old := f.file
+	if err := f.open(); err != nil {
+		return err
+	}
+	old.Close()
+	return nil
+}
+
+// Write appends "p" to the log file, rotating the file first if it would grow too large.
+func (f *logFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			// Keep writing to the current file: losing messages would be worse than
+			// exceeding the size limit.
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Terminal escape sequences used by consoleLogSink.
+const (
+	colorReset  = "\x1b[0m"
+	colorDim    = "\x1b[2m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorCyan   = "\x1b[36m"
+)
+
+// consoleLogSink writes log messages as compact lines meant to be read by a person running
+// ssh-agent-switcher in the foreground.
+type consoleLogSink struct {
+	// mu serializes writes so that lines do not interleave.
+	mu sync.Mutex
+
+	// w is where the lines are written to.
+	w io.Writer
+
+	// colors is true if the severity of every message should be highlighted with terminal
+	// escape sequences.
+	colors bool
+}
+
+// useColors returns true if "w" is a terminal and the user did not ask for colors to be
+// disabled via the NO_COLOR environment variable.
+func useColors(w io.Writer) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := file.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// logMessage writes "message" prefixed by the time of the record, with milliseconds but
+// without the date, and by a short tag for its severity.
+func (s *consoleLogSink) logMessage(r slog.Record, message string) {
+	var tag, color string
+	switch {
+	case r.Level >= slog.LevelError:
+		tag, color = "ERR", colorRed
+	case r.Level >= slog.LevelWarn:
+		tag, color = "WRN", colorYellow
+	case r.Level >= slog.LevelInfo:
+		tag, color = "INF", colorGreen
+	default:
+		tag, color = "DBG", colorDim
+	}
+
+	var line string
+	if s.colors {
+		line = fmt.Sprintf("%s%s%s %s%s%s %s\n", colorDim, r.Time.Format("15:04:05.000"), colorReset,
+			color, tag, colorReset, message)
+	} else {
+		line = fmt.Sprintf("%s %s %s\n", r.Time.Format("15:04:05.000"), tag, message)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	io.WriteString(s.w, line)
+}
+
+// currentLogFile is the file that receives log messages, if any.
+var currentLogFile *logFile
+
+// checkLogOutput returns an error if the values of -logOutput, -logFormat, and -logFile, given
+// in "output", "format", and "path", are invalid or cannot be used together.
+func checkLogOutput(output string, format string, path string) error {
+	if format != "text" && format != "json" && format != "console" {
+		return fmt.Errorf("invalid -logFormat %q; must be one of text, json, or console", format)
+	}
+	switch output {
+	case "stderr":
+		return nil
+	case "syslog", "journal":
+		if path != "" {
+			return errors.New("-logFile cannot be used with -logOutput")
+		}
+		if format != "text" {
+			return fmt.Errorf("-logFormat=%s cannot be used with -logOutput=%s", format, output)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid -logOutput %q; must be one of stderr, syslog, or journal", output)
+	}
+}
+
+// setupLogOutput directs log messages to "output", which is one of the values accepted by
+// -logOutput, or to the file at "path" if not empty.  The file is rotated once it grows past
+// "maxSize" bytes unless that is zero.  Messages written to stderr or to the file are rendered
+// in "format", which is one of the values accepted by -logFormat.
+func setupLogOutput(output string, format string, path string, maxSize int64) error {
+	if err := checkLogOutput(output, format, path); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stderr
+	if path != "" {
+		file, err := openLogFile(path, maxSize)
+		if err != nil {
+			return err
+		}
+		w = file
+		currentLogFile = file
+	}
+
+	var sink logSink
+	switch output {
+	case "stderr":
+		if format == "json" {
+			currentLogger = slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: &currentLogLevel}))
+			return nil
+		}
+		if format == "console" {
+			colors := useColors(w)
+			currentLogger = slog.New(&sinkHandler{sink: &consoleLogSink{w: w, colors: colors}, colors: colors})
+			return nil
+		}
+		sink = &writerLogSink{w: w}
+	case "syslog":
+		var err error
+		if sink, err = openSyslogLogSink(); err != nil {
+			return err
+		}
+	case "journal":
+		var err error
+		if sink, err = openJournalLogSink(); err != nil {
+			return err
+		}
+	}
+	currentLogger = slog.New(&sinkHandler{sink: sink})
+	return nil
+}
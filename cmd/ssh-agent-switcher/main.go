@@ -0,0 +1,2202 @@
+// Copyright 2023 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// ssh-agent-switcher serves a Unix domain socket that proxies connections to any valid SSH agent
+// socket provided by sshd.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+	"github.com/jmmv/ssh-agent-switcher/discovery"
+	"github.com/jmmv/ssh-agent-switcher/internal/peercred"
+	"github.com/jmmv/ssh-agent-switcher/plugin"
+	"github.com/jmmv/ssh-agent-switcher/policy"
+	"github.com/jmmv/ssh-agent-switcher/proxy"
+	"github.com/jmmv/ssh-agent-switcher/selection"
+	"github.com/jmmv/ssh-agent-switcher/switcher"
+)
+
+// socketPaths holds the values of -socketPath, of which socketPath is the primary one.
+var socketPaths = socketPathFlag{primary: defaultSocketPath()}
+
+var (
+	socketPath = &socketPaths.primary
+	agentsDir  = flag.String("agentsDir", "/tmp", "directory where to look for running agents")
+	pinFile    = flag.String("pinFile", defaultPinFile(), "path to the file that records the agent pinned by the choose subcommand")
+	procDir    = flag.String("procDir", "/proc", "directory where the proc file system is mounted, which describes the clients and sessions")
+
+	scanTimeout       = flag.Duration("scanTimeout", 10*time.Second, "how long to wait for a scan of -agentsDir, which may be on a hung network file system, before giving up on it; zero to wait forever")
+	scanMaxEntries    = flag.Int("scanMaxEntries", 0, "maximum number of entries of -agentsDir to look at for every scan, which keeps a busy shared /tmp cheap to scan, in the order in which the file system returns them; zero for no limit")
+	scanMaxCandidates = flag.Int("scanMaxCandidates", 0, "stop scanning -agentsDir once this many candidate agents have been found, in the order in which the file system returns them; zero for no limit")
+
+	force               = flag.Bool("force", false, "replace the -socketPath sockets even if another process, such as another instance, is listening on them")
+	socketCheckInterval = flag.Duration("socketCheckInterval", 10*time.Second, "how often to check that the -socketPath sockets still exist and recreate them if deleted; 0 to never check")
+	socketPathPerHost   = flag.Bool("socketPathPerHost", false, "append the short host name to the -socketPath sockets so that hosts sharing their directory, such as an NFS home, don't fight over them")
+
+	restrictedSocketPath  = flag.String("restrictedSocketPath", "", "path to an additional read-only socket to which -restrictedHideKey and -restrictedConfirmSign also apply, meant to be forwarded onward or mounted into containers; empty for none")
+	restrictedConfirmSign = flag.Bool("restrictedConfirmSign", false, "ask the user to approve every sign request from the clients of -restrictedSocketPath")
+	restrictedHideKey     stringListFlag
+
+	socketMode  = flag.String("socketMode", "0600", "permissions of the -socketPath sockets, in octal, which cannot grant access to other users")
+	socketGroup = flag.String("socketGroup", "", "name or ID of a group whose members may also use the -socketPath sockets, given a -socketMode with group bits; empty for none")
+
+	agentsGlob        stringListFlag
+	agentAliases      agentAliasFlag
+	excludeGlob       stringListFlag
+	allowOwnerProcess regexpListFlag
+
+	preferActiveSessions  = flag.Bool("preferActiveSessions", false, "ask systemd-logind about the sessions that own the agents and try those of active sessions first and those of idle or closing sessions last")
+	demoteNottySessions   = flag.Bool("demoteNottySessions", false, "try the agents of SSH sessions without a terminal, such as those of VS Code Remote, after all others")
+	preferRecentTerminals = flag.Bool("preferRecentTerminals", false, "try the agents of the sessions whose terminals most recently received input first")
+	skipOtherNamespaces   = flag.Bool("skipOtherNamespaces", false, "only select agents served by processes in our mount and PID namespaces, skipping those of other containers that share -agentsDir")
+	skipProcessChecks     = flag.Bool("skipProcessChecks", false, "never look at the processes behind the agent sockets, ignoring -allowOwnerProcess and -skipOtherNamespaces, for systems where /proc is restricted")
+
+	cleanupStale    = flag.Bool("cleanupStale", false, "remove the session directories in -agentsDir that only contain sockets of sessions that are gone")
+	cleanupInterval = flag.Duration("cleanupInterval", time.Hour, "how often to look for stale session directories with -cleanupStale; zero to only look at startup")
+
+	environmentFile    = flag.String("environmentFile", "", "path to a systemd environment.d file in which to record SSH_AUTH_SOCK (e.g. $HOME/.config/environment.d/ssh-agent-switcher.conf)")
+	systemdEnvironment = flag.Bool("systemdEnvironment", false, "export SSH_AUTH_SOCK to the systemd user instance")
+
+	checkPeer         = flag.Bool("checkPeer", true, "reject clients that do not run as the current user")
+	allowClientExe    stringListFlag
+	allowClientCgroup stringListFlag
+
+	readOnly      = flag.Bool("readOnly", false, "reject requests that add, remove, lock, or unlock keys")
+	allowMessages messageSet
+	denyMessages  messageSet
+
+	confirmSign    = flag.Bool("confirmSign", false, "ask the user to approve every sign request before forwarding it")
+	confirmProgram = flag.String("confirmProgram", defaultConfirmProgram(), "askpass or pinentry program used to approve sign requests")
+	policyFile     = flag.String("policyFile", "", "path to a JSON file with per-key usage rules")
+	hideKey        stringListFlag
+
+	policyCheckInterval = flag.Duration("policyCheckInterval", 5*time.Second, "how often to check whether the policy files changed and reload them for new client connections; 0 to never check")
+
+	profilesFile   = flag.String("profilesFile", "", "path to a JSON file with named sets of settings that can be switched to at runtime via the control socket")
+	initialProfile = flag.String("profile", defaultProfile, "name of the profile from -profilesFile to use at startup; default for the settings given via flags")
+
+	discoveryPluginPath = flag.String("discoveryPlugin", "", "path to a plugin executable that finds agents besides those forwarded by sshd")
+	discoveryOrder      = flag.String("discoveryOrder", strings.Join(discoveryBackends, ","), "comma-separated order in which to try the agents found by each discovery backend; omitted backends go last in their default order")
+	policyPluginPath    = flag.String("policyPlugin", "", "path to a plugin executable that decides whether sign requests are allowed")
+	pluginTimeout       = flag.Duration("pluginTimeout", plugin.DefaultTimeout, "how long plugins have to answer each request")
+
+	maxSignsPerMinute       = flag.Int("maxSignsPerMinute", 0, "maximum number of sign requests per minute across all clients; zero for no limit")
+	maxClientSignsPerMinute = flag.Int("maxClientSignsPerMinute", 0, "maximum number of sign requests per minute issued by any one client executable; zero for no limit")
+
+	idleThreshold = flag.Duration("idleThreshold", 0, "warn about sign requests issued after the user's session has been idle for this long (e.g. 30m); zero to disable")
+	idleConfirm   = flag.Bool("idleConfirm", false, "ask the user to approve sign requests issued while idle instead of just warning")
+
+	addLifetime = flag.Duration("addLifetime", 0, "default lifetime of the keys added by clients (e.g. 8h); zero for none")
+	addConfirm  = flag.Bool("addConfirm", false, "require the agent to confirm every use of the keys added by clients")
+
+	polkitAddKey = flag.Bool("polkitAddKey", false, "ask polkit to authorize every request that adds keys to the agent")
+
+	auditFile    = flag.String("auditFile", "", "path to a file in which to record all sign requests")
+	auditSyslog  = flag.Bool("auditSyslog", false, "send a record of all sign requests to syslog")
+	auditWebhook = flag.String("auditWebhook", "", "URL to which to post batches of records of all sign requests")
+
+	auditChainFlag  = flag.Bool("auditChain", false, "link each record in -auditFile to the previous one with a hash so that edits can be detected with verify-audit")
+	auditSigningKey = flag.String("auditSigningKey", "", "path to a PEM-encoded Ed25519 private key with which to sign the records in -auditChain")
+	auditAnchor     = flag.Duration("auditAnchorInterval", 15*time.Minute, "how often to report the hash of the last record in -auditChain to the log and to syslog if it changed; zero to disable")
+
+	statsFile = flag.String("statsFile", "", "path to a file in which to keep the key usage statistics shown by the stats subcommand across restarts; empty to only keep them in memory")
+
+	requireApproval  = flag.Bool("requireApproval", false, "deny all clients until approved via the control socket or, with -approvalPrompt, a desktop prompt")
+	approvalPrompt   = flag.Bool("approvalPrompt", false, "ask the user to approve new clients with the -confirmProgram")
+	approvalDuration = flag.Duration("approvalDuration", time.Hour, "how long client approvals last")
+
+	controlSocket = flag.String("controlSocket", "", "path to the socket on which to accept control commands; empty to disable")
+
+	notify  = flag.Bool("notify", false, "send desktop notifications when the selected agent changes or disappears")
+	useDBus = flag.Bool("dbus", false, "expose the daemon status on the D-Bus session bus")
+
+	eventCommand = flag.String("eventCommand", "", "program to run with the details of notable events, such as agent switches and rejected sign requests, as JSON on its stdin; empty for none")
+	eventWebhook = flag.String("eventWebhook", "", "URL to which to post the details of notable events, such as agent switches and rejected sign requests, as JSON; empty for none")
+
+	statsdAddress  = flag.String("statsdAddress", "", "host:port of a statsd server to which to push metrics; empty to disable")
+	statsdPrefix   = flag.String("statsdPrefix", "ssh_agent_switcher.", "prefix for the names of the metrics pushed to statsd")
+	statsdTags     = flag.String("statsdTags", "", "comma-separated dogstatsd tags, such as env:prod, to attach to the metrics pushed to statsd")
+	statsdInterval = flag.Duration("statsdInterval", 10*time.Second, "how often to push metrics to statsd")
+
+	captureDir    = flag.String("captureDir", "", "directory in which to record the messages exchanged with every client, one file per connection; empty to disable")
+	captureRedact = flag.Bool("captureRedact", true, "omit the payloads of the captured messages, which may contain private keys and signatures")
+
+	privacyMode = flag.Bool("privacy", false, "omit the key fingerprints and other message details from the debug logs, on top of -captureRedact")
+
+	churnThreshold = flag.Int("churnThreshold", 5, "warn when the selected agent changes this many times within -churnWindow; zero to never warn")
+	churnWindow    = flag.Duration("churnWindow", time.Minute, "period over which changes of the selected agent are counted for -churnThreshold")
+
+	selectionHistory = flag.Int("selectionHistory", 20, "number of recent agent selections to keep for the history control command; zero to disable")
+
+	startupSelfTest = flag.Bool("selfTest", false, "look for an agent once at startup and log what was found")
+	requireAgent    = flag.Bool("requireAgent", false, "like -selfTest but exit with an error if no usable agent was found, for provisioning scripts")
+
+	waitForAgent = flag.Duration("waitForAgent", 0, "how long to keep looking for an agent when a client connects and there is none, such as right after login; zero to serve an empty agent right away")
+	dialRetries  = flag.Int("dialRetries", 0, "how many more times to try the agent sockets that cannot be opened before giving up on them, for slow network file systems")
+	dialBackoff  = flag.Duration("dialBackoff", selection.DefaultDialBackoff, "how long to wait before the first of -dialRetries, which doubles with every retry")
+	agentTimeout = flag.Duration("agentTimeout", 0, "how long the agent has to answer a request, except for sign requests with security keys; zero to wait forever")
+
+	warmInterval    = flag.Duration("warmInterval", 0, "how often to select an agent in the background so that client connections can reuse it while the agents directory and the pin file do not change; zero to select an agent for every connection")
+	failureCooldown = flag.Duration("failureCooldown", 0, "how long to skip the agent sockets that could not be opened or failed to answer before trying them again; zero to try them on every connection")
+
+	quarantineAfter    = flag.Int("quarantineAfter", 3, "demote the agents that fail this many sign requests in a row below all others; zero to disable")
+	quarantineDuration = flag.Duration("quarantineDuration", 5*time.Minute, "how long to demote the agents quarantined by -quarantineAfter, unless they sign again first")
+
+	slowAgentThreshold = flag.Duration("slowAgentThreshold", 0, "demote the agents that consistently take longer than this to answer identities requests below all others; zero to disable")
+
+	identitiesCacheTTL = flag.Duration("identitiesCacheTTL", 0, "how long to reuse the answer of an agent to identities requests, which requests that add or remove keys through us invalidate; zero to always ask the agent")
+
+	maxConnections = flag.Int("maxConnections", 0, "maximum number of client connections to serve at once, after which new clients wait for a free slot; zero to derive it from the file descriptor limit")
+
+	maxConnectionLifetime = flag.Duration("maxConnectionLifetime", 0, "how long a client connection may last before it is closed, between requests, so that long-lived clients reconnect and get an agent selected again; zero for no limit")
+
+	failover = flag.Bool("failover", true, "when the agent goes away in the middle of a client connection, select another one and retry the pending request there instead of dropping the connection")
+
+	maxMessageSize = flag.Int("maxMessageSize", codec.DefaultMaxMessageSize, "largest agent message, in bytes, to accept from clients and agents")
+
+	chainSwitchers = flag.Bool("chainSwitchers", false, "proxy through other ssh-agent-switcher instances found in -agentsDir instead of skipping them")
+
+	upstreamSwitcher = flag.String("upstreamSwitcher", "", "path to the socket of another ssh-agent-switcher instance, such as the one of the host when running in a container, to proxy through before trying the agents in -agentsDir; empty to disable")
+
+	fallbackToInheritedAgent = flag.Bool("fallbackToInheritedAgent", false, "if SSH_AUTH_SOCK names an agent other than ourselves at startup, use it when no other agent is available")
+
+	slowThreshold = flag.Duration("slowThreshold", 0, "log a warning when selecting an agent or handling a request takes longer than this; zero to disable")
+
+	otlpEndpoint = flag.String("otlpEndpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "base URL of an OTLP/HTTP collector, such as http://localhost:4318, to which to export traces; empty to disable")
+
+	healthAddress = flag.String("healthAddress", "", "loopback host:port or Unix socket path on which to serve the /healthz and /readyz endpoints; empty to disable")
+
+	tlsAddress     = flag.String("tlsAddress", "", "host:port on which to accept remote clients over TLS with client certificates; empty to disable")
+	tlsCert        = flag.String("tlsCert", "", "path to the PEM certificate presented to -tlsAddress clients")
+	tlsKey         = flag.String("tlsKey", "", "path to the PEM private key of -tlsCert")
+	tlsClientCA    = flag.String("tlsClientCA", "", "path to the PEM certificates of the authorities that sign the certificates of -tlsAddress clients")
+	tlsAllowClient stringListFlag
+
+	gpgSocketPath = flag.String("gpgSocketPath", "", "path to the socket on which to proxy the gpg-agent selected among -gpgAgentsGlob; empty to disable")
+	gpgAgentsGlob = flag.String("gpgAgentsGlob", "", "glob matching the gpg-agent sockets forwarded with RemoteForward, such as /run/user/1000/gnupg/S.gpg-agent.*")
+
+	debugAddress = flag.String("debugAddress", "", "loopback host:port or Unix socket path on which to serve the pprof and expvar endpoints; empty to disable")
+
+	quiet     = flag.Bool("quiet", false, "only log warnings and errors; shorthand for -logLevel=warn")
+	logOutput = flag.String("logOutput", "stderr", "where to send log messages: stderr, syslog, or journal")
+	logFormat = flag.String("logFormat", "text", "format of the log messages written to stderr or -logFile: text, json, or console")
+
+	logRepeatInterval = flag.Duration("logRepeatInterval", 10*time.Minute, "how long to suppress repeated messages about skipped agents for; zero to never suppress them")
+
+	logFilePath    = flag.String("logFile", "", "path to a file in which to write log messages instead of stderr; reopened on SIGHUP")
+	logFileMaxSize = flag.Int("logFileMaxSize", 0, "size in MiB after which the -logFile is rotated; zero to never rotate")
+
+	showVersion = flag.Bool("version", false, "print the version and build information and exit")
+)
+
+func init() {
+	flag.Var(&socketPaths, "socketPath", "path to the socket to listen on (can be repeated to also listen on other paths, such as while migrating to a new one)")
+	flag.Var(&allowOwnerProcess, "allowOwnerProcess", "only select agents served by a process whose name matches this regular expression, such as ^sshd (can be repeated)")
+	flag.Var(&agentsGlob, "agentsGlob", "glob matching additional agent sockets to try after those in -agentsDir, such as those of tsh profiles (can be repeated)")
+	flag.Var(&agentAliases, "agentAlias", "name the agent sockets matching a glob in logs and status output, and make the name usable as a pin, with a value of the form NAME=PATTERN (can be repeated)")
+	flag.Var(&excludeGlob, "exclude", "glob matching agent sockets, or directories containing them, to never select, such as those of an automation account (can be repeated)")
+	flag.Var(&tlsAllowClient, "tlsAllowClient", "only accept -tlsAddress clients whose certificate name matches this glob (can be repeated)")
+	flag.Var(&allowClientExe, "allowClientExe", "only accept clients running this executable (exact path or glob; can be repeated)")
+	flag.Var(&allowClientCgroup, "allowClientCgroup", "only accept clients in this cgroup or its descendants (can be repeated)")
+	flag.Var(&allowMessages, "allowMessages", "comma-separated list of the only agent messages to forward, by name, number, or extension:NAME (can be repeated)")
+	flag.Var(&denyMessages, "denyMessages", "comma-separated list of agent messages to never forward, by name, number, or extension:NAME (can be repeated)")
+	flag.Var(&schedule.windows, "accessWindow", "only allow agent use during this recurring period of time, such as 'Mon-Fri 08:00-18:00' (can be repeated)")
+	flag.Var(&currentLogLevel, "logLevel", "most verbose level of the messages to log: error, warn, info, or debug")
+	flag.Var(&restrictedHideKey, "restrictedHideKey", "hide the key with this fingerprint or whose comment matches this glob from the clients of -restrictedSocketPath (can be repeated)")
+	flag.Var(&hideKey, "hideKey", "hide the key with this fingerprint or whose comment matches this glob from clients (can be repeated)")
+}
+
+// currentAgent tracks the agent that we are currently forwarding connections to.
+var currentAgent = &selectionTracker{}
+
+// nextConnectionID holds the identifier of the last accepted client connection.
+var nextConnectionID atomic.Uint64
+
+// signConfirmer asks the user to approve sign requests if enabled.
+var signConfirmer = &confirmer{}
+
+// addConstraints holds the constraints to add to the keys added by clients.
+var addConstraints keyConstraints
+
+// clientApprovals tracks the clients approved by the user in deny-by-default mode, if enabled.
+var clientApprovals *approvals
+
+// emergencyLock cuts off all access to the agents when engaged via the control socket.
+var emergencyLock = &accessLock{}
+
+// schedule restricts when the agent can be used.
+var schedule = &accessSchedule{}
+
+// limits restricts how often clients can issue sign requests, if enabled.
+var limits *signLimits
+
+// idleDetector scrutinizes sign requests issued while the user is away, if enabled.
+var idleDetector *idleCheck
+
+// audit records all sign requests if enabled.
+var audit auditSink
+
+// keyPolicies decides whether sign requests can be issued according to -policyFile and
+// -policyPlugin, if any.  Profiles may replace the former.
+var keyPolicies policy.Checker
+
+// pluginPolicy decides whether sign requests can be issued according to -policyPlugin, if any.
+var pluginPolicy policy.Checker
+
+// ownSockets tracks the sockets on which we serve clients so that we never select ourselves.
+var ownSockets = &discovery.SocketSet{}
+
+// decisions is the history of recent agent selections, or nil if not enabled.
+var decisions *selection.History
+
+// failedAgents remembers the agents that recently failed for -failureCooldown, or is nil if
+// not enabled.
+var failedAgents *selection.Cooldown
+
+// config holds the settings that the daemon shares with embedders of the switcher package.
+// main populates it from the flags before doing anything else.
+var config = switcher.NewConfig()
+
+// configFromFlags builds the settings stored in config from the flags.
+func configFromFlags() (switcher.Config, error) {
+	if *maxMessageSize < 1024 || *maxMessageSize > 1<<30 {
+		return switcher.Config{}, fmt.Errorf("invalid -maxMessageSize %d", *maxMessageSize)
+	}
+	if *agentTimeout < 0 {
+		return switcher.Config{}, fmt.Errorf("invalid -agentTimeout %v", *agentTimeout)
+	}
+	if *dialRetries < 0 {
+		return switcher.Config{}, fmt.Errorf("invalid -dialRetries %d", *dialRetries)
+	}
+	if *dialBackoff <= 0 {
+		return switcher.Config{}, fmt.Errorf("invalid -dialBackoff %v", *dialBackoff)
+	}
+	if *failureCooldown < 0 {
+		return switcher.Config{}, fmt.Errorf("invalid -failureCooldown %v", *failureCooldown)
+	}
+	for _, pattern := range agentsGlob {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return switcher.Config{}, fmt.Errorf("invalid -agentsGlob %q: %v", pattern, err)
+		}
+	}
+	for _, pattern := range excludeGlob {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return switcher.Config{}, fmt.Errorf("invalid -exclude %q: %v", pattern, err)
+		}
+	}
+	return switcher.NewConfig(
+		switcher.WithAgentsDir(*agentsDir),
+		switcher.WithChainSwitchers(*chainSwitchers),
+		switcher.WithDialRetries(*dialRetries, *dialBackoff),
+		switcher.WithFailureCooldown(*failureCooldown),
+		switcher.WithMaxMessageSize(uint32(*maxMessageSize)),
+		switcher.WithRequestTimeout(*agentTimeout),
+	), nil
+}
+
+// defaultSocketPath computes the name of the default value for the socketPath flag.
+func defaultSocketPath() string {
+	user := os.Getenv("USER")
+	if user == "" {
+		return ""
+	}
+	return fmt.Sprintf("/tmp/ssh-agent.%s", user)
+}
+
+// shortHostname returns the name of this host up to the first dot.
+func shortHostname() (string, error) {
+	host, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	host, _, _ = strings.Cut(host, ".")
+	if host == "" {
+		return "", errors.New("empty host name")
+	}
+	return host, nil
+}
+
+// logSkipped reports that a file in the agents directory was not considered a candidate.
+func logSkipped(skipped discovery.Skipped) {
+	level := levelDebug
+	if skipped.Suspicious {
+		level = levelWarn
+	}
+	logOncef(level, "Ignoring %s: %s", skipped.Path, skipped.Reason)
+}
+
+// findCandidates scans the contents of "dir", which should point to the directory where
+// sshd places the session directories for forwarded agents, and returns the paths to all
+// sockets that may be valid agents in the order in which they should be tried.  The files
+// that are not candidates are logged.
+func findCandidates(dir string) ([]string, error) {
+	candidates, skipped, err := scanDiscoverer(dir, []string{sessionsBackend, globBackend}).Discover()
+	for _, skip := range skipped {
+		logSkipped(skip)
+	}
+	var paths []string
+	for _, candidate := range candidates {
+		paths = append(paths, candidate.Path)
+	}
+	return paths, err
+}
+
+// scanDiscoverer creates a discoverer for the session directories under "dir" and the sockets
+// matching -agentsGlob, in the order of "backends", minus those matching -exclude, ranked by
+// their sessions if -preferActiveSessions, -demoteNottySessions, or -preferRecentTerminals, or
+// their overrides in the active profile, ask for it, and with the agents slower than
+// -slowAgentThreshold last.
+func scanDiscoverer(dir string, backends []string) discovery.Discoverer {
+	var chain discovery.Chain
+	for _, backend := range backends {
+		switch backend {
+		case sessionsBackend:
+			chain = append(chain, &missingDirDiscoverer{newSessionDirs(dir), dir})
+		case globBackend:
+			for _, pattern := range agentsGlob {
+				chain = append(chain, &discovery.Glob{Pattern: pattern})
+			}
+		}
+	}
+	var scan discovery.Discoverer = chain
+	if len(excludeGlob) > 0 {
+		scan = &discovery.Exclude{Discoverer: chain, Patterns: excludeGlob}
+	}
+	if s := currentSettings(); s.preferActiveSessions || s.demoteNottySessions || s.preferRecentTerminals {
+		scan = &sessionRanker{
+			Discoverer:      scan,
+			sessions:        s.preferActiveSessions,
+			demoteNotty:     s.demoteNottySessions,
+			recentTerminals: s.preferRecentTerminals,
+		}
+	}
+	if *slowAgentThreshold > 0 {
+		scan = &latencyRanker{scan, *slowAgentThreshold}
+	}
+	return scan
+}
+
+// newSessionDirs creates the discoverer of the session directories under "dir", bounded by
+// -scanMaxEntries and -scanMaxCandidates.
+func newSessionDirs(dir string) *discovery.SessionDirs {
+	return &discovery.SessionDirs{Dir: dir, MaxEntries: *scanMaxEntries, MaxCandidates: *scanMaxCandidates}
+}
+
+// agentsDirMissing is true while the agents directory does not exist.
+var agentsDirMissing atomic.Bool
+
+// missingDirDiscoverer wraps the discoverer of the session directories under "dir" so that a
+// "dir" that does not exist yet, such as a custom -agentsDir before the first forwarded login,
+// yields no candidates instead of failing every client connection.
+type missingDirDiscoverer struct {
+	discovery.Discoverer
+	dir string
+}
+
+// Discover runs the wrapped discoverer and ignores its failure if "dir" does not exist.
+func (d *missingDirDiscoverer) Discover() ([]discovery.Candidate, []discovery.Skipped, error) {
+	candidates, skipped, err := d.Discoverer.Discover()
+	if errors.Is(err, fs.ErrNotExist) {
+		if !agentsDirMissing.Swap(true) {
+			infof("Agents directory %s does not exist yet; waiting for it to appear", d.dir)
+		}
+		return candidates, skipped, nil
+	}
+	if agentsDirMissing.Swap(false) {
+		infof("Agents directory %s appeared; looking for agents in it", d.dir)
+	}
+	return candidates, skipped, err
+}
+
+// Origins of the candidates returned by preferredAgents, which become the reasons of the
+// selection decisions if they are selected.
+const (
+	lockedReason    = "locked by a client through this daemon"
+	pinnedReason    = "pinned with the choose subcommand"
+	inheritedReason = "inherited from SSH_AUTH_SOCK at startup"
+)
+
+// inheritedAgent is the agent that SSH_AUTH_SOCK named when we started, if
+// -fallbackToInheritedAgent is set, which is tried after all other candidates.
+var inheritedAgent string
+
+// inheritedAgentSocket returns the agent socket that SSH_AUTH_SOCK names, or an empty string
+// if the variable is unset or names one of the sockets we listen on.  Pointing at ourselves
+// is common when the environment comes from a previous login session that started us.
+func inheritedAgentSocket() string {
+	path := os.Getenv("SSH_AUTH_SOCK")
+	if path == "" {
+		return ""
+	}
+	ours := append(socketPaths.paths(), *restrictedSocketPath)
+	for _, own := range ours {
+		if own != "" && filepath.Clean(own) == filepath.Clean(path) {
+			debugf("Not falling back to SSH_AUTH_SOCK because it names our socket %s", own)
+			return ""
+		}
+	}
+	return path
+}
+
+// preferredAgents returns the agents to try before scanning for candidates: the agents that
+// clients locked through us, which must stay selected for as long as they exist because the
+// clients would otherwise be switched over to an unlocked agent behind their backs, and the
+// agent named by "pinFile".
+func preferredAgents(pinFile string) []discovery.Candidate {
+	var preferred []discovery.Candidate
+	for _, locked := range lockedAgents.list() {
+		preferred = append(preferred, discovery.Candidate{Path: locked, Origin: lockedReason, Explicit: true})
+	}
+	if pinned := resolvePin(readPin(pinFile)); pinned != "" {
+		preferred = append(preferred, discovery.Candidate{Path: pinned, Origin: pinnedReason, Explicit: true})
+	}
+	if *upstreamSwitcher != "" {
+		preferred = append(preferred, discovery.Candidate{Path: *upstreamSwitcher, Origin: upstreamReason, Explicit: true})
+	}
+	return preferred
+}
+
+// Names of the discovery backends accepted by -discoveryOrder.
+const (
+	sessionsBackend  = "sessions"
+	globBackend      = "glob"
+	pluginBackend    = "plugin"
+	inheritedBackend = "inherited"
+)
+
+// discoveryBackends lists the discovery backends in their default order.
+var discoveryBackends = []string{sessionsBackend, globBackend, pluginBackend, inheritedBackend}
+
+// isDiscoveryBackend returns true if "name" is one of discoveryBackends.
+func isDiscoveryBackend(name string) bool {
+	for _, backend := range discoveryBackends {
+		if backend == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseDiscoveryOrder parses the value of -discoveryOrder and returns every backend in the
+// order in which to try them, with the omitted ones at the end in their default order.
+func parseDiscoveryOrder(value string) ([]string, error) {
+	var order []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !isDiscoveryBackend(name) {
+			return nil, fmt.Errorf("invalid -discoveryOrder: unknown backend %q; must be one of %s", name, strings.Join(discoveryBackends, ", "))
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("invalid -discoveryOrder: backend %q given more than once", name)
+		}
+		seen[name] = true
+		order = append(order, name)
+	}
+	for _, name := range discoveryBackends {
+		if !seen[name] {
+			order = append(order, name)
+		}
+	}
+	return order, nil
+}
+
+// newDiscoverer creates a discoverer for "preferred" followed by the agents under "dir", those
+// found by -agentsGlob and -discoveryPlugin, and the inherited agent, if any, in the order given
+// by -discoveryOrder but with the quarantined agents last.
+func newDiscoverer(dir string, preferred []discovery.Candidate) discovery.Discoverer {
+	order, err := parseDiscoveryOrder(*discoveryOrder)
+	if err != nil {
+		// Already rejected by validateFlags.
+		order = discoveryBackends
+	}
+
+	var chain discovery.Chain
+	var scanned []string
+	scansSessions := false
+	flushScan := func() {
+		if len(scanned) == 0 {
+			return
+		}
+		scan := scanDiscoverer(dir, scanned)
+		if *scanTimeout > 0 {
+			// The key must differ between the two scans that exist when the plugin or the
+			// inherited agent are ordered between the session directories and the globs.
+			key := dir
+			if !scansSessions {
+				key = strings.Join(agentsGlob, " ")
+			}
+			scan = &timeoutDiscoverer{scan, key, *scanTimeout}
+		}
+		chain = append(chain, scan)
+		scanned = nil
+		scansSessions = false
+	}
+	for _, backend := range order {
+		switch backend {
+		case sessionsBackend, globBackend:
+			// Adjacent scans are kept together so that -preferActiveSessions and friends can
+			// rank their candidates as a whole.
+			scanned = append(scanned, backend)
+			scansSessions = scansSessions || backend == sessionsBackend
+
+		case pluginBackend:
+			flushScan()
+			p, err := startDiscoveryPlugin()
+			if err != nil {
+				logOncef(levelError, "Not using -discoveryPlugin: %v", err)
+			} else if p != nil {
+				chain = append(chain, &plugin.Discoverer{Plugin: p})
+			}
+
+		case inheritedBackend:
+			flushScan()
+			if inheritedAgent != "" {
+				// Not explicit so that the usual checks, such as the one that skips other
+				// switchers that could be proxying back to us, still apply.
+				chain = append(chain, discovery.Static([]discovery.Candidate{{Path: inheritedAgent, Origin: inheritedReason}}))
+			}
+		}
+	}
+	flushScan()
+	var found discovery.Discoverer = chain
+	if quarantinedAgents != nil {
+		found = &quarantineRanker{chain}
+	}
+	return discovery.Chain{discovery.Static(preferred), found}
+}
+
+// newSelector creates a selector configured from the flags.
+func newSelector() *selection.FirstReachable {
+	selector := &selection.FirstReachable{
+		OwnSockets:     ownSockets,
+		ChainSwitchers: config.ChainSwitchers,
+		DialRetries:    config.DialRetries,
+		DialBackoff:    config.DialBackoff,
+		Cooldown:       failedAgents,
+	}
+	var checks []func(path string, conn net.Conn) error
+	if len(allowOwnerProcess) > 0 {
+		checks = append(checks, checkAgentOwner)
+	}
+	if *skipOtherNamespaces {
+		checks = append(checks, checkAgentNamespaces)
+	}
+	if len(checks) > 0 {
+		selector.Check = func(path string, conn net.Conn) error {
+			for _, check := range checks {
+				if err := check(path, conn); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+	return selector
+}
+
+// loggingDiscoverer wraps a discoverer to log the files that it skips and, if "timer" is not
+// nil, to trace and time discovery as the "scan" step of "span".
+type loggingDiscoverer struct {
+	discovery.Discoverer
+	span  *span
+	timer *phaseTimer
+}
+
+// Discover runs the wrapped discoverer and logs the files that it skipped.
+func (d *loggingDiscoverer) Discover() ([]discovery.Candidate, []discovery.Skipped, error) {
+	child := d.span.child("scan")
+	defer child.end()
+
+	candidates, skipped, err := d.Discoverer.Discover()
+	if d.timer != nil {
+		d.timer.mark("scan")
+	}
+	if err != nil {
+		child.fail(err)
+	}
+	for _, skip := range skipped {
+		logSkipped(skip)
+	}
+	return candidates, skipped, err
+}
+
+// waitForAgentPoll is how often to look for agents during -waitForAgent.
+const waitForAgentPoll = 250 * time.Millisecond
+
+// findAgentSocket looks for a valid connection to an agent under "dir", opens the agent's
+// socket, and returns the connection to the agent.
+//
+// The locked agents, the agent named by "pinFile", and the -upstreamSwitcher are tried first.
+// The -upstreamSwitcher is only selected if it accepts a connection that already went through
+// the instances in "chain".  If "owner" is not nil, only the agents that belong to that user
+// are tried, starting with those locked through us.  The selected agent is reported via
+// "logger", the search is traced as a child of "trace", and the decision is recorded in the
+// selection history.
+//
+// This tries all possible candidates in search for a socket and only returns an error if
+// no valid and alive candidate can be found, after retrying for -waitForAgent if "logger" is
+// for a client connection.  Either way, the returned decision explains the outcome.
+func findAgentSocket(dir string, pinFile string, chain []string, owner *int, logger *connLogger, trace *span) (net.Conn, selection.Decision, error) {
+	span := trace.child("select_agent")
+	defer span.end()
+
+	timer := newPhaseTimer()
+	defer timer.warnIfSlow(logger, "agent selection")
+
+	if rescans.wait(rescanParkTimeout) {
+		timer.mark("rescan")
+		logger.debugf("Waited for the ongoing rescan to finish")
+	}
+
+	var preferred []discovery.Candidate
+	if owner == nil {
+		preferred = preferredAgents(pinFile)
+	} else {
+		preferred = userLockedAgents(*owner)
+	}
+	inputs := currentSelectionInputs(dir, pinFile)
+	// The -upstreamSwitcher is not tried again for this connection once it refuses it.
+	var upstreamRefused error
+	// The agent selected in the background is that of our own user.
+	if owner == nil {
+		if agent, decision, ok := warmAgent.dial(inputs); ok {
+			if upstreamRefused = chainUpstream(agent, &decision, chain); upstreamRefused == nil {
+				timer.mark("reuse " + decision.Winner)
+				logger.debugf("Reusing the agent selected in the background")
+				if logger != nil {
+					decision.Conn = logger.id
+				}
+				decisions.Record(decision)
+				span.set("agent.socket", decision.Winner)
+				logSelectedAgent(logger, preferred, decision)
+				return agent, decision, nil
+			}
+		}
+	}
+
+	var found discovery.Discoverer
+	if owner == nil {
+		found = newDiscoverer(dir, preferred)
+	} else {
+		found = userDiscoverer(dir, *owner, preferred)
+	}
+	discoverer := &loggingDiscoverer{found, span, timer}
+	var candidates discovery.Discoverer = discoverer
+	if upstreamRefused != nil {
+		candidates = otherAgent{discoverer, *upstreamSwitcher}
+	}
+	selector := newSelector()
+	selector.Observe = func(step string, path string) func(error) {
+		child := span.child(step)
+		child.set("agent.socket", path)
+		return func(err error) {
+			timer.mark(step + " " + path)
+			if err != nil {
+				child.fail(err)
+			}
+			child.end()
+		}
+	}
+	agent, decision, err := selection.Find(candidates, selector)
+	if wait := currentSettings().waitForAgent; err != nil && wait > 0 && logger != nil {
+		logger.infof("Waiting up to %v for an agent to appear: %v", wait, err)
+		deadline := time.Now().Add(wait)
+		for err != nil && time.Now().Before(deadline) {
+			time.Sleep(waitForAgentPoll)
+			agent, decision, err = selection.Find(candidates, selector)
+		}
+	}
+	if err == nil && upstreamRefused == nil {
+		if upstreamRefused = chainUpstream(agent, &decision, chain); upstreamRefused != nil {
+			agent, decision, err = selection.Find(otherAgent{discoverer, *upstreamSwitcher}, selector)
+		}
+	}
+	if upstreamRefused != nil {
+		decision.Rejected = append([]selection.Rejection{{Path: *upstreamSwitcher, Err: upstreamRefused}}, decision.Rejected...)
+	}
+	if logger != nil {
+		decision.Conn = logger.id
+	}
+	decisions.Record(decision)
+	if owner == nil {
+		warmAgent.store(inputs, decision)
+	}
+
+	for _, rejected := range decision.Rejected {
+		path, err := rejected.Path, rejected.Err
+		label := agentLabel(path)
+		var skipped *selection.SkippedError
+		switch {
+		case errors.As(err, &skipped):
+			// Already logged by the discoverer.
+		case isPreferred(preferred, path, lockedReason):
+			logger.warnf("Forgetting that %s was locked: %v; the agent selected instead may not be locked", label, err)
+			lockedAgents.set(path, false)
+		case isPreferred(preferred, path, pinnedReason):
+			logOncef(levelWarn, "Ignoring pinned %s: %v", label, err)
+		case isPreferred(preferred, path, upstreamReason):
+			logOncef(levelWarn, "Not chaining to -upstreamSwitcher %s: %v", label, err)
+		case err == discovery.ErrOwnSocket:
+			logOncef(levelWarn, "Ignoring %s: %v", label, err)
+		case err == selection.ErrOtherSwitcher:
+			logOncef(levelWarn, "Ignoring %s: %v; use -chainSwitchers to proxy through it", label, err)
+		default:
+			logOncef(levelDebug, "Ignoring %s: %v", label, err)
+		}
+	}
+
+	if err != nil {
+		span.fail(err)
+		return nil, decision, err
+	}
+	span.set("agent.socket", decision.Winner)
+	logSelectedAgent(logger, preferred, decision)
+	return agent, decision, nil
+}
+
+// logSelectedAgent logs that the agent in "decision" was opened for a client connection.
+func logSelectedAgent(logger *connLogger, preferred []discovery.Candidate, decision selection.Decision) {
+	switch {
+	case isPreferred(preferred, decision.Winner, lockedReason):
+		logger.infof("Successfully opened locked SSH agent at %s", agentLabel(decision.Winner))
+	case isPreferred(preferred, decision.Winner, pinnedReason):
+		logger.infof("Successfully opened pinned SSH agent at %s", agentLabel(decision.Winner))
+	case isPreferred(preferred, decision.Winner, upstreamReason):
+		logger.infof("Chaining to the upstream ssh-agent-switcher instance at %s", agentLabel(decision.Winner))
+	default:
+		if decision.Switcher {
+			logger.infof("Chaining through the ssh-agent-switcher instance at %s", agentLabel(decision.Winner))
+		}
+		logger.infof("Successfully opened SSH agent at %s", agentLabel(decision.Winner))
+	}
+}
+
+// isPreferred checks whether "path" is one of the agents in "preferred" for "reason".
+func isPreferred(preferred []discovery.Candidate, path string, reason string) bool {
+	for _, p := range preferred {
+		if p.Path == path && p.Origin == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyRequest handles the complete client request "msg", which includes the length prefix,
+// of the session "s" by forwarding it to the agent of "filter" via "next" and returning the
+// agent's response, or by returning a failure if "filter" rejects it.
+//
+// If the agent goes away before answering and -failover is enabled, the request is forwarded
+// to a newly selected agent instead, which "filter" keeps using for later requests.
+//
+// The round trip to the agent is traced as a child of "trace".
+func proxyRequest(s *switcher.Session, filter *messageFilter, msg []byte, trace *span, next switcher.Handler) ([]byte, error) {
+	timer := newPhaseTimer()
+	defer timer.warnIfSlow(filter.log, codec.MessageName(msg[4]))
+	filter.capture.record(captureRequest, msg)
+
+	if proxy.IsIdentifyRequest(msg) {
+		filter.log.debugf("Identifying as ssh-agent-switcher to the client")
+		filter.capture.record(captureResponse, proxy.IdentifyReply)
+		return proxy.IdentifyReply, nil
+	}
+
+	if isHopRequest(msg) {
+		filter.log.debugf("Answering hop request from the client")
+		reply := codec.Frame(replyHop(msg, filter.log))
+		filter.capture.record(captureResponse, reply)
+		return reply, nil
+	}
+
+	if isQueryRequest(msg) {
+		filter.log.debugf("Answering status query from the client")
+		var hops []string
+		if filter.decision.Switcher {
+			var err error
+			hops, err = upstreamHops(filter.agent)
+			if err != nil {
+				filter.log.warnf("Cannot query the hops after %s: %v", agentLabel(filter.agentPath), err)
+			}
+		}
+		reply := codec.Frame(encodeQueryReply(filter.decision, hops))
+		filter.capture.record(captureResponse, reply)
+		return reply, nil
+	}
+
+	err := filter.checkRequest(msg)
+	var request []byte
+	if err == nil {
+		request, err = filter.rewriteRequest(msg)
+	}
+	timer.mark("checks")
+	if err != nil {
+		filter.log.infof("Rejecting request: %v", err)
+		metricRequestsRejected.inc()
+		trace.set("rejected", err.Error())
+		filter.observeRejection(msg, err)
+		filter.capture.record(captureResponse, failureMessage)
+		return failureMessage, nil
+	}
+
+	if codec.IsSensitive(msg[4]) {
+		// The rewritten request may be a copy of "msg", which the switcher wipes on its own.
+		defer codec.Wipe(request)
+	}
+
+	avoidRestrictedAgent(filter, request, trace)
+	filter.observeRequest(request)
+	metricRequestsForwarded.inc()
+	if currentLogLevel >= levelDebug && len(request) >= 4 {
+		filter.log.debugf("Forwarding %s to the agent", describeMessage(request[4:]))
+	}
+
+	response, err := forwardRequest(s, filter, msg, request, timer, trace, next)
+	var lost *agentLostError
+	if !errors.As(err, &lost) || !currentSettings().failover {
+		return response, err
+	}
+	if filter.binding != nil {
+		// The new agent would not know about the session binding, which would lift the
+		// destination restrictions of the keys.
+		return nil, fmt.Errorf("%v; not failing over because the connection is bound to a session", err)
+	}
+	filter.log.warnf("Agent at %s went away: %v; retrying %s on a new agent", filter.agentPath, err, codec.MessageName(msg[4]))
+	if err := failOver(filter, trace); err != nil {
+		return nil, fmt.Errorf("%v; cannot fail over: %v", lost, err)
+	}
+	return forwardRequest(s, filter, msg, request, timer, trace, next)
+}
+
+// agentLostError indicates that the agent went away in the middle of a request, before any of
+// its response reached the client, so that the request can be retried on another agent.
+type agentLostError struct {
+	// op describes the operation that failed.
+	op string
+
+	// err is the reason why the operation failed.
+	err error
+}
+
+// Error returns the operation that failed and why.
+func (e *agentLostError) Error() string {
+	return fmt.Sprintf("%s agent failed: %v", e.op, e.err)
+}
+
+// newAgentError wraps the error "err" of the operation "op" with the agent.  Timeouts are not
+// wrapped in an agentLostError because a wedged agent may still act on the request.
+func newAgentError(op string, err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("%s agent failed: %v", op, err)
+	}
+	return &agentLostError{op: op, err: err}
+}
+
+// failOver replaces the agent of "filter", which went away, with a newly selected one.
+func failOver(filter *messageFilter, trace *span) error {
+	agent, decision, err := findAgentSocket(config.AgentsDir, *pinFile, filter.chain, filter.owner, filter.log, trace)
+	if err != nil {
+		currentAgent.noAgent()
+		return err
+	}
+	filter.agent.Close()
+	filter.agent = agent
+	filter.agentPath = agent.RemoteAddr().String()
+	filter.decision = decision
+	currentAgent.selected(filter.agentPath)
+	activeConnections.setAgent(filter.log.id, filter.agentPath)
+	return nil
+}
+
+// forwardRequest forwards "request", which is the client request "msg" after the rewrites of
+// "filter", to the agent of "filter" via "next", which is the default handler of the session
+// "s", and returns the agent's response after the rewrites of "filter".
+//
+// Failures of the agent are returned as agentLostError unless they are timeouts.
+func forwardRequest(s *switcher.Session, filter *messageFilter, msg []byte, request []byte, timer *phaseTimer, trace *span, next switcher.Handler) ([]byte, error) {
+	roundTrip := trace.child("agent")
+	defer roundTrip.end()
+
+	// The agent filters the identities of connections bound to a session by their destination
+	// constraints, so those must not share the answers of other connections.
+	cache := identitiesResponses
+	if filter.binding != nil {
+		cache = nil
+	}
+	rewrite := filter.rewritesResponse(msg)
+	response, generation := cache.lookup(filter.agentPath, request)
+	if response != nil {
+		filter.log.debugf("Answering %s from the identities cache", codec.MessageName(request[4]))
+		metricIdentitiesCacheHits.inc()
+		roundTrip.set("cached", "true")
+	} else {
+		defer identitiesResponses.invalidate(filter.agentPath, request)
+		// The filter may have switched to another agent since the previous request.
+		s.Agent = filter.agent
+		sent := time.Now()
+		var err error
+		response, err = next(s, request)
+		timer.mark("agent")
+		if err != nil {
+			roundTrip.fail(err)
+			var agentErr *switcher.AgentError
+			if errors.As(err, &agentErr) {
+				return nil, newAgentError(agentErr.Op, agentErr.Err)
+			}
+			return nil, err
+		}
+		agentLatencies.record(filter.agentPath, request, time.Since(sent))
+		if !rewrite {
+			quarantinedAgents.record(filter.agentPath, request, response)
+		}
+		cache.store(filter.agentPath, request, generation, response)
+	}
+	roundTrip.end()
+
+	if rewrite {
+		msg, err := filter.rewriteResponse(response[4:])
+		if err != nil {
+			return nil, err
+		}
+		if currentLogLevel >= levelDebug {
+			filter.log.debugf("Forwarding rewritten %s to the client", describeMessage(msg))
+		}
+		response = codec.Frame(msg)
+		if codec.IsSensitive(msg[0]) {
+			codec.Wipe(msg)
+		}
+		filter.capture.record(captureResponse, response)
+		return response, nil
+	}
+
+	filter.observeResponse(response)
+	if currentLogLevel >= levelDebug {
+		filter.log.debugf("Forwarding %s to the client", describeMessage(response[4:]))
+	}
+	filter.capture.record(captureResponse, response)
+	return response, nil
+}
+
+// errConnectionExpired indicates that a client connection was closed because it reached
+// -maxConnectionLifetime while waiting for the next request.
+var errConnectionExpired = errors.New("reached -maxConnectionLifetime")
+
+// answerEmptyAgent handles the client request "msg", which includes the length prefix, of the
+// session "s" for which there is no agent.  Hop requests and status queries are answered here,
+// the latter with the decision that explains why there is no agent, and the rest are left to
+// the empty agent of "next", which lets clients like ssh fall back to other authentication
+// methods cleanly instead of failing with a cryptic error when the connection is closed under
+// them.
+func answerEmptyAgent(s *switcher.Session, msg []byte, next switcher.Handler) ([]byte, error) {
+	switch {
+	case isHopRequest(msg):
+		return codec.Frame(replyHop(msg, nil)), nil
+	case isQueryRequest(msg):
+		return codec.Frame(encodeQueryReply(s.Decision, nil)), nil
+	default:
+		return next(s, msg)
+	}
+}
+
+// checkPeerSupported fails if -checkPeer is enabled on a platform where we cannot query the
+// user of clients, which would otherwise reject every client.
+func checkPeerSupported() error {
+	if *checkPeer && !peercred.Supported {
+		return fmt.Errorf("-checkPeer is not supported on %s, which cannot tell the user of clients; pass -checkPeer=false to accept all clients that can open the socket", runtime.GOOS)
+	}
+	return nil
+}
+
+// validateFlags checks the values of the flags that configure the daemon, other than those
+// checked by configFromFlags, and returns all problems found.
+func validateFlags() []error {
+	var errs []error
+	if *logRepeatInterval < 0 {
+		errs = append(errs, fmt.Errorf("invalid -logRepeatInterval %v", *logRepeatInterval))
+	}
+	if *logFileMaxSize < 0 {
+		errs = append(errs, fmt.Errorf("invalid -logFileMaxSize %d", *logFileMaxSize))
+	}
+	if err := checkLogOutput(*logOutput, *logFormat, *logFilePath); err != nil {
+		errs = append(errs, err)
+	}
+	if *churnThreshold < 0 || *churnWindow <= 0 {
+		errs = append(errs, fmt.Errorf("invalid -churnThreshold %d or -churnWindow %v", *churnThreshold, *churnWindow))
+	}
+
+	if *addLifetime != 0 && (*addLifetime < time.Second || *addLifetime > math.MaxUint32*time.Second) {
+		errs = append(errs, fmt.Errorf("invalid -addLifetime %v", *addLifetime))
+	}
+	if *maxSignsPerMinute < 0 || *maxClientSignsPerMinute < 0 {
+		errs = append(errs, errors.New("sign request limits cannot be negative"))
+	}
+	if *idleThreshold < 0 {
+		errs = append(errs, errors.New("-idleThreshold cannot be negative"))
+	}
+	if *requireApproval && *approvalDuration <= 0 {
+		errs = append(errs, errors.New("-approvalDuration must be positive"))
+	}
+
+	if _, err := parseDiscoveryOrder(*discoveryOrder); err != nil {
+		errs = append(errs, err)
+	}
+	if *quarantineAfter < 0 || *quarantineDuration <= 0 {
+		errs = append(errs, fmt.Errorf("invalid -quarantineAfter %d or -quarantineDuration %v", *quarantineAfter, *quarantineDuration))
+	}
+	if *slowAgentThreshold < 0 {
+		errs = append(errs, fmt.Errorf("invalid -slowAgentThreshold %v", *slowAgentThreshold))
+	}
+	if *identitiesCacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("invalid -identitiesCacheTTL %v", *identitiesCacheTTL))
+	}
+	if *maxConnections < 0 {
+		errs = append(errs, fmt.Errorf("invalid -maxConnections %d", *maxConnections))
+	}
+	if *selectionHistory < 0 {
+		errs = append(errs, fmt.Errorf("invalid -selectionHistory %d", *selectionHistory))
+	}
+	if *slowThreshold < 0 {
+		errs = append(errs, fmt.Errorf("invalid -slowThreshold %v", *slowThreshold))
+	}
+	if *cleanupInterval < 0 {
+		errs = append(errs, fmt.Errorf("invalid -cleanupInterval %v", *cleanupInterval))
+	}
+	if *waitForAgent < 0 {
+		errs = append(errs, fmt.Errorf("invalid -waitForAgent %v", *waitForAgent))
+	}
+	if *socketCheckInterval < 0 {
+		errs = append(errs, fmt.Errorf("invalid -socketCheckInterval %v", *socketCheckInterval))
+	}
+	if *policyCheckInterval < 0 {
+		errs = append(errs, fmt.Errorf("invalid -policyCheckInterval %v", *policyCheckInterval))
+	}
+	if *scanTimeout < 0 {
+		errs = append(errs, fmt.Errorf("invalid -scanTimeout %v", *scanTimeout))
+	}
+	if *scanMaxEntries < 0 {
+		errs = append(errs, fmt.Errorf("invalid -scanMaxEntries %d", *scanMaxEntries))
+	}
+	if *scanMaxCandidates < 0 {
+		errs = append(errs, fmt.Errorf("invalid -scanMaxCandidates %d", *scanMaxCandidates))
+	}
+	if *maxConnectionLifetime < 0 {
+		errs = append(errs, fmt.Errorf("invalid -maxConnectionLifetime %v", *maxConnectionLifetime))
+	}
+	if *warmInterval < 0 {
+		errs = append(errs, fmt.Errorf("invalid -warmInterval %v", *warmInterval))
+	}
+	if _, _, err := parseSocketPermissions(*socketMode, *socketGroup); err != nil {
+		errs = append(errs, err)
+	}
+	if *gpgSocketPath != "" && *gpgAgentsGlob == "" {
+		errs = append(errs, errors.New("-gpgSocketPath requires -gpgAgentsGlob"))
+	}
+	if *statsdAddress != "" && *statsdInterval <= 0 {
+		errs = append(errs, fmt.Errorf("invalid -statsdInterval %v", *statsdInterval))
+	}
+	if *auditChainFlag && *auditFile == "" {
+		errs = append(errs, errors.New("-auditChain requires -auditFile"))
+	}
+	if *auditAnchor < 0 {
+		errs = append(errs, fmt.Errorf("invalid -auditAnchorInterval %v", *auditAnchor))
+	}
+	if *auditSigningKey != "" && !*auditChainFlag {
+		errs = append(errs, errors.New("-auditSigningKey requires -auditChain"))
+	}
+	if err := checkPeerSupported(); err != nil {
+		errs = append(errs, err)
+	}
+	if (len(allowClientExe) > 0 || len(allowClientCgroup) > 0) && !peercred.ReportsPID {
+		errs = append(errs, fmt.Errorf("-allowClientExe and -allowClientCgroup are not supported on %s, which does not report the pid of clients", runtime.GOOS))
+	}
+	if *privacyMode && !*captureRedact {
+		errs = append(errs, errors.New("-privacy cannot be used with -captureRedact=false"))
+	}
+	if *upstreamSwitcher != "" && !filepath.IsAbs(*upstreamSwitcher) {
+		errs = append(errs, fmt.Errorf("invalid -upstreamSwitcher %s: must be an absolute path", *upstreamSwitcher))
+	}
+	return errs
+}
+
+// setupRequestHandling configures the global state used to filter and record client requests
+// based on the flags.
+func setupRequestHandling() error {
+	signConfirmer.program = *confirmProgram
+
+	if *addLifetime != 0 {
+		addConstraints.lifetime = uint32(*addLifetime / time.Second)
+	}
+	addConstraints.confirm = *addConfirm
+
+	limits = newSignLimits(*maxSignsPerMinute, *maxClientSignsPerMinute)
+
+	if *idleThreshold > 0 {
+		idleDetector = &idleCheck{threshold: *idleThreshold, confirm: *idleConfirm, tracker: currentAgent}
+	}
+
+	if *requireApproval {
+		var prompt *confirmer
+		if *approvalPrompt {
+			prompt = signConfirmer
+		}
+		clientApprovals = newApprovals(*approvalDuration, prompt)
+	}
+
+	sinks, err := openAuditSinks()
+	if err != nil {
+		return err
+	}
+	if len(sinks) > 0 {
+		audit = sinks
+	}
+
+	if *policyPluginPath != "" {
+		p, err := startPlugin("policyPlugin", *policyPluginPath, "checkSign")
+		if err != nil {
+			return err
+		}
+		pluginPolicy = &plugin.Policy{Plugin: p}
+	}
+	if keyPolicies, err = newKeyPolicies(*policyFile); err != nil {
+		return err
+	}
+
+	if _, err := startDiscoveryPlugin(); err != nil {
+		return err
+	}
+
+	return setupProfiles()
+}
+
+// newKeyPolicies combines the per-key rules in "policyFile", if not empty, with the
+// -policyPlugin.  Returns nil if there are neither.
+func newKeyPolicies(policyFile string) (policy.Checker, error) {
+	var checkers policy.Chain
+	if policyFile != "" {
+		rules, err := policy.Load(policyFile)
+		if err != nil {
+			return nil, err
+		}
+		rules.OnReload = func(path string, err error) {
+			if err != nil {
+				logOncef(levelWarn, "Keeping the previous contents of key list %s: %v", path, err)
+				return
+			}
+			infof("Reloaded key list %s", path)
+		}
+		checkers = append(checkers, rules)
+	}
+	if pluginPolicy != nil {
+		checkers = append(checkers, pluginPolicy)
+	}
+	if len(checkers) == 0 {
+		return nil, nil
+	}
+	return checkers, nil
+}
+
+// openAuditSinks opens the audit sinks requested by the flags.
+func openAuditSinks() (auditSinks, error) {
+	var sinks auditSinks
+	if *auditFile != "" {
+		var chain *auditChain
+		if *auditChainFlag {
+			var err error
+			chain, err = openAuditChain(*auditFile, *auditSigningKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+		sink, err := openFileAuditSink(*auditFile, chain)
+		if err != nil {
+			return nil, err
+		}
+		if chain != nil && *auditAnchor > 0 {
+			go sink.anchorAudit(*auditAnchor)
+		}
+		sinks = append(sinks, sink)
+	}
+	if *auditSyslog {
+		sink, err := openSyslogAuditSink()
+		if err != nil {
+			return nil, fmt.Errorf("cannot connect to syslog: %v", err)
+		}
+		sinks = append(sinks, sink)
+	}
+	if *auditWebhook != "" {
+		sink, err := newWebhookAuditSink(*auditWebhook)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// socketPolicy holds the restrictions that one of our sockets applies to its clients on top of
+// those that the global flags apply to all of them.
+type socketPolicy struct {
+	// restricted is true for the -restrictedSocketPath socket.
+	restricted bool
+
+	// readOnly rejects the requests that modify the agent.
+	readOnly bool
+
+	// confirmSign asks the user to approve every sign request.
+	confirmSign bool
+
+	// hidden lists the keys, by fingerprint or comment glob, that clients cannot see or use.
+	hidden []string
+
+	// owner, if not nil, is the ID of the only user whose clients are accepted, instead of
+	// those of our own user, and whose agents are served.
+	owner *int
+}
+
+// clientSession holds what the daemon knows about a client connection, which it keeps as the
+// Value of the switcher.Session of the connection.
+type clientSession struct {
+	// restrictions are those of the socket that the client connected to.
+	restrictions socketPolicy
+
+	// start is when the client connected.
+	start time.Time
+
+	// log receives the messages about the connection.
+	log *connLogger
+
+	// trace traces the connection.
+	trace *span
+
+	// info describes the client.
+	info clientInfo
+
+	// chain lists the instances that the connection went through before reaching us.
+	chain []string
+
+	// usage accounts for the traffic of the connection.
+	usage *connectionUsage
+
+	// accepted is true once the client passed all checks.
+	accepted bool
+
+	// filter handles the requests of the client, or is nil if there is no agent for it.
+	filter *messageFilter
+}
+
+// sessionConfig returns the configuration with which to serve the clients of a socket with
+// "restrictions": every client is checked, gets an agent selected for it, and has all of its
+// requests filtered and observed as the flags say.
+func sessionConfig(restrictions socketPolicy) switcher.Config {
+	cfg := config
+	cfg.Accept = func(s *switcher.Session) error {
+		return acceptSession(s, restrictions)
+	}
+	cfg.FindAgent = findSessionAgent
+	cfg.HandleRequest = handleSessionRequest
+	cfg.OnClose = closeSession
+	return cfg
+}
+
+// acceptSession checks whether the client of the session "s" may use the proxy and prepares
+// the session for it.  The rejection is logged by closeSession.
+func acceptSession(s *switcher.Session, restrictions socketPolicy) error {
+	state := &clientSession{
+		restrictions: restrictions,
+		start:        time.Now(),
+		log:          newConnLogger(nextConnectionID.Add(1)),
+		usage:        &connectionUsage{},
+	}
+	s.Value = state
+	logger := state.log
+	switch {
+	case restrictions.restricted:
+		logger.infof("Accepted restricted client connection")
+	case restrictions.owner != nil:
+		logger.infof("Accepted client connection for user %d", *restrictions.owner)
+	default:
+		logger.infof("Accepted client connection")
+	}
+	metricConnectionsAccepted.inc()
+
+	// Expire the connection only while it waits for the next request, which clients handle as
+	// the agent going away, so that they reconnect and get an agent selected again.
+	client := s.Client
+	if *maxConnectionLifetime > 0 {
+		client.SetReadDeadline(state.start.Add(*maxConnectionLifetime))
+	}
+
+	state.trace = tracing.start("connection", nil)
+
+	peers := clientPolicy{
+		checkUid:       *checkPeer && restrictions.owner == nil,
+		allowedExes:    allowClientExe,
+		allowedCgroups: allowClientCgroup,
+	}
+	if agentSocketGroup >= 0 {
+		peers.sharedGroup = strconv.Itoa(agentSocketGroup)
+	}
+	if err := peers.authorize(client); err != nil {
+		return err
+	}
+	if restrictions.owner != nil {
+		if err := authorizeUser(client, *restrictions.owner); err != nil {
+			return err
+		}
+	}
+	if err := emergencyLock.check(); err != nil {
+		return err
+	}
+
+	state.info = identifyClient(client)
+	state.trace.set("client", state.info.String())
+	if clientApprovals != nil {
+		if err := clientApprovals.authorize(state.info); err != nil {
+			return err
+		}
+	}
+
+	if *upstreamSwitcher != "" {
+		replay, hops, err := readHops(client, logger)
+		if err != nil {
+			return err
+		}
+		client, state.chain = replay, hops
+	}
+
+	state.accepted = true
+	s.Client = &countingConn{client, state.usage}
+	return nil
+}
+
+// findSessionAgent looks for an sshd serving an agent for the client of the session "s" and
+// prepares the filter of its requests.
+func findSessionAgent(s *switcher.Session) (net.Conn, selection.Decision, error) {
+	state := s.Value.(*clientSession)
+	logger := state.log
+	restrictions := state.restrictions
+
+	agent, decision, err := findAgentSocket(config.AgentsDir, *pinFile, state.chain, restrictions.owner, logger, state.trace)
+	if err != nil {
+		currentAgent.noAgent()
+		metricAgentNotFound.inc()
+		state.trace.fail(err)
+		logger.errorf("Acting as an empty agent: %v", err)
+		return nil, decision, err
+	}
+	currentAgent.selected(agent.RemoteAddr().String())
+
+	settings := currentSettings()
+	filter := &messageFilter{
+		lock:         emergencyLock,
+		schedule:     schedule,
+		readOnly:     settings.readOnly || restrictions.readOnly,
+		allowed:      &allowMessages,
+		denied:       &denyMessages,
+		policy:       settings.policies,
+		limits:       limits,
+		idle:         idleDetector,
+		client:       state.info,
+		confirmSign:  settings.confirmSign || restrictions.confirmSign,
+		confirmer:    signConfirmer,
+		hidden:       append(append([]string{}, settings.hidden...), restrictions.hidden...),
+		polkitAddKey: *polkitAddKey,
+		agent:        agent,
+		constraints:  &addConstraints,
+		audit:        audit,
+		agentPath:    agent.RemoteAddr().String(),
+		decision:     decision,
+		chain:        state.chain,
+		owner:        restrictions.owner,
+		locks:        lockedAgents,
+		log:          logger,
+	}
+	if *captureDir != "" {
+		capture, err := openCapture(*captureDir, logger, state.start, state.info, filter.agentPath, *captureRedact)
+		if err != nil {
+			logger.errorf("Not capturing traffic: %v", err)
+		} else {
+			filter.capture = capture
+		}
+	}
+	metricConnectionsActive.inc()
+	activeConnections.add(logger.id, activeConnection{client: state.info, agent: filter.agentPath, since: state.start, usage: state.usage})
+	state.filter = filter
+	return agent, decision, nil
+}
+
+// handleSessionRequest handles the complete client request "msg", which includes the length
+// prefix, of the session "s" with its filter, accounting for it in the usage of the session
+// and tracing it.  "next" is the default handler of the switcher.
+func handleSessionRequest(s *switcher.Session, msg []byte, next switcher.Handler) ([]byte, error) {
+	state := s.Value.(*clientSession)
+	if state.filter == nil {
+		return answerEmptyAgent(s, msg, next)
+	}
+
+	request := state.trace.child("request")
+	request.set("agent.message", codec.MessageName(msg[4]))
+	done := state.usage.startRequest()
+	response, err := proxyRequest(s, state.filter, msg, request, next)
+	done()
+	if err != nil {
+		request.fail(err)
+	}
+	request.end()
+	return response, err
+}
+
+// closeSession logs why the connection of the session "s" ended, which "err" explains, and
+// releases everything that the session held, including its slot in clientSlots.
+func closeSession(s *switcher.Session, err error) {
+	defer clientSlots.release()
+	state, ok := s.Value.(*clientSession)
+	if !ok {
+		// Rejected before acceptSession, such as by the checks of TLS clients.
+		return
+	}
+	defer state.trace.end()
+	logger := state.log
+
+	if !state.accepted {
+		if err == io.EOF {
+			logger.infof("Closing client connection")
+			return
+		}
+		logger.infof("Rejecting connection: %v", err)
+		metricConnectionsRejected.inc()
+		state.trace.fail(err)
+		return
+	}
+
+	if filter := state.filter; filter != nil {
+		if filter.capture != nil {
+			defer filter.capture.close()
+		}
+		defer metricConnectionsActive.dec()
+		defer activeConnections.remove(logger.id)
+	}
+
+	var invalid *codec.InvalidRequestError
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		logger.infof("Closing client connection: %v", errConnectionExpired)
+	case errors.As(err, &invalid):
+		logger.errorf("Dropping connection: invalid request from %s: %v", state.info, invalid)
+		state.trace.fail(err)
+	case err != nil:
+		logger.errorf("Dropping connection: %v", err)
+		state.trace.fail(err)
+	default:
+		logger.infof("Closing client connection")
+	}
+}
+
+// setupSignals installs signal handlers to clean up files, to dump our state on SIGUSR1 and
+// rescan the agents on SIGUSR2, and ignores signals that we don't want to cause us to exit.
+//
+// The sockets in "socketPaths", if any, are deleted on exit.
+func setupSignals(socketPaths ...string) {
+	// Prevent terminal disconnects from killing this process if started in the background.
+	// If we are logging to a file, use the signal to reopen it as log rotation tools expect.
+	if currentLogFile != nil {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := currentLogFile.reopen(); err != nil {
+					fmt.Fprintf(os.Stderr, "Cannot reopen log file: %v\n", err)
+					continue
+				}
+				infof("Reopened log file")
+			}
+		}()
+	} else {
+		signal.Ignore(syscall.SIGHUP)
+	}
+
+	// Offer cheap observability for when the control socket is not available.
+	usr := make(chan os.Signal, 1)
+	signal.Notify(usr, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range usr {
+			if sig == syscall.SIGUSR1 {
+				dumpState(config.AgentsDir)
+			} else {
+				rescan(config.AgentsDir, *pinFile)
+			}
+		}
+	}()
+
+	// Clean up the sockets we create on exit.
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		if len(socketPaths) == 0 {
+			infof("Shutting down due to signal")
+		} else {
+			infof("Shutting down due to signal and deleting %s", strings.Join(socketPaths, " and "))
+			for _, path := range socketPaths {
+				os.Remove(path)
+			}
+		}
+		if err := signStats.save(); err != nil {
+			errorf("Cannot save key usage statistics: %v", err)
+		}
+		os.Exit(1)
+	}()
+}
+
+// listenPrivate creates a socket at "path" that only the current user can access.
+func listenPrivate(path string) (net.Listener, error) {
+	// Ensure the socket is not group nor world readable so that we don't expose the
+	// real socket indirectly to other users.
+	oldUmask := syscall.Umask(0177)
+	defer syscall.Umask(oldUmask)
+	return net.Listen("unix", path)
+}
+
+// isUnixSocketAddress returns true if the -debugAddress or -healthAddress "address" names a
+// Unix socket.
+func isUnixSocketAddress(address string) bool {
+	return strings.HasPrefix(address, "/")
+}
+
+// Permissions and group of the -socketPath sockets, as parsed from -socketMode and
+// -socketGroup.  A negative group means to keep the one that the sockets get by default.
+var (
+	agentSocketMode  os.FileMode = 0600
+	agentSocketGroup             = -1
+)
+
+// parseSocketPermissions parses the values of -socketMode and -socketGroup.
+func parseSocketPermissions(mode string, group string) (os.FileMode, int, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm&^0777 != 0 {
+		return 0, 0, fmt.Errorf("invalid -socketMode %s", mode)
+	}
+	if perm&0007 != 0 {
+		return 0, 0, fmt.Errorf("invalid -socketMode %s: cannot grant access to other users", mode)
+	}
+	if perm&0600 != 0600 {
+		return 0, 0, fmt.Errorf("invalid -socketMode %s: must grant access to the current user", mode)
+	}
+
+	if group == "" {
+		return os.FileMode(perm), -1, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		g, err = user.LookupGroupId(group)
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid -socketGroup %s: %v", group, err)
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid -socketGroup %s: %v", group, err)
+	}
+	return os.FileMode(perm), gid, nil
+}
+
+// prepareSocketDir creates the parent directory of the socket at "path" with mode 0700 if it
+// does not exist yet, such as a subdirectory of $XDG_RUNTIME_DIR, or checks that other users
+// cannot replace the socket in it if it does.  World-writable directories with the sticky bit,
+// like /tmp, are fine because nobody else can remove our files from them.
+func prepareSocketDir(path string) error {
+	dir := filepath.Dir(path)
+	fi, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("cannot create the directory for %s: %v", path, err)
+		}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("cannot create %s: %s is not a directory", path, dir)
+	}
+	if fi.Mode().Perm()&0022 != 0 && fi.Mode()&os.ModeSticky == 0 {
+		return fmt.Errorf("cannot create %s: %s is writable by other users", path, dir)
+	}
+	return nil
+}
+
+// reclaimSocket deals with a file left at "path" where we want to create a socket.  Sockets
+// that nobody listens on anymore are leftovers of crashed instances and are removed.  Sockets
+// that something answers on are only removed with -force, because they usually mean that the
+// daemon is already running.
+func reclaimSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("cannot create %s: file exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		infof("Removing stale socket %s: %v", path, err)
+		return os.Remove(path)
+	}
+	isSwitcher, _ := proxy.Identify(conn, time.Second)
+	conn.Close()
+
+	owner := "another process"
+	if isSwitcher {
+		owner = "another ssh-agent-switcher instance"
+	}
+	if !*force {
+		return fmt.Errorf("cannot create %s: %s is listening on it; use -force to replace it", path, owner)
+	}
+	warnf("Replacing %s, on which %s is listening, because of -force", path, owner)
+	return os.Remove(path)
+}
+
+// listenAgent creates the agent socket at "path" with the -socketMode and -socketGroup
+// permissions, creating its parent directory and replacing stale sockets if necessary.
+func listenAgent(path string) (net.Listener, error) {
+	if err := prepareSocketDir(path); err != nil {
+		return nil, err
+	}
+	if err := reclaimSocket(path); err != nil {
+		return nil, err
+	}
+	listener, err := listenPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+	if agentSocketGroup >= 0 {
+		if err := os.Chown(path, -1, agentSocketGroup); err != nil {
+			listener.Close()
+			return nil, fmt.Errorf("cannot set the group of %s: %v", path, err)
+		}
+	}
+	if err := os.Chmod(path, agentSocketMode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("cannot set the permissions of %s: %v", path, err)
+	}
+	return listener, nil
+}
+
+// Exit codes of the subcommands other than healthcheck, which follows the conventions of
+// monitoring systems instead.  Errors for which there is no specific code exit with 1.
+const (
+	// exitNoAgent indicates that no agent could be selected.  This matches the code that
+	// healthcheck uses for the same condition.
+	exitNoAgent = 3
+
+	// exitKeyNotFound indicates that the selected agent does not hold the requested key.
+	exitKeyNotFound = 4
+
+	// exitUpstreamDial indicates that the agents could be found but that none could be
+	// opened.
+	exitUpstreamDial = 5
+
+	// exitProtocol indicates that a peer sent a message that violates the agent protocol.
+	exitProtocol = 6
+)
+
+// exitCode returns the exit code that describes "err".
+func exitCode(err error) int {
+	var dialErr *selection.UpstreamDialError
+	switch {
+	case errors.As(err, &dialErr):
+		return exitUpstreamDial
+	case errors.Is(err, selection.ErrNoAgentFound):
+		return exitNoAgent
+	case errors.Is(err, errKeyNotFound):
+		return exitKeyNotFound
+	case errors.Is(err, codec.ErrProtocol):
+		return exitProtocol
+	default:
+		return 1
+	}
+}
+
+// exitWithError logs "err", which made a subcommand fail, and exits with the code that
+// describes it.
+func exitWithError(err error) {
+	errorf("%v", err)
+	os.Exit(exitCode(err))
+}
+
+func main() {
+	flag.Parse()
+	if *showVersion {
+		printVersion(os.Stdout)
+		return
+	}
+	if *quiet {
+		currentLogLevel = levelWarn
+	}
+	if *socketPathPerHost {
+		host, err := shortHostname()
+		if err != nil {
+			fatalf("Cannot qualify -socketPath with the host name: %v", err)
+		}
+		socketPaths.qualify(host)
+	}
+	cfg, err := configFromFlags()
+	if err != nil {
+		fatalf("%v", err)
+	}
+	config = cfg
+	if *fallbackToInheritedAgent {
+		inheritedAgent = inheritedAgentSocket()
+	}
+	if config.FailureCooldown > 0 {
+		failedAgents = selection.NewCooldown(config.FailureCooldown)
+	}
+	stdio := false
+	system := false
+	if len(flag.Args()) != 0 {
+		switch flag.Arg(0) {
+		case "bridge":
+			if err := runBridge(flag.Args()[1:]); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		case "check-config":
+			if err := runCheckConfig(flag.Args()[1:]); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		case "choose":
+			if err := runChooser(flag.Args()[1:]); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		case "container":
+			if err := runContainer(flag.Args()[1:]); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		case "control":
+			if err := runControl(flag.Args()[1:]); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		case "lock", "unlock":
+			if err := runControl(flag.Args()); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		case "devcontainer":
+			if err := runDevcontainer(flag.Args()[1:]); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		case "healthcheck":
+			if err := runHealthcheck(flag.Args()[1:]); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		case "ping":
+			if err := runPing(flag.Args()[1:]); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		case "publish":
+			if err := runPublish(flag.Args()[1:]); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		case "query":
+			if err := runQuery(flag.Args()[1:]); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		case "replay":
+			if err := runReplay(flag.Args()[1:]); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		case "ssh-config":
+			if err := runSSHConfig(flag.Args()[1:]); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		case "stats":
+			if err := runStats(flag.Args()[1:]); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		case "select":
+			if err := runSelect(flag.Args()[1:]); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		case "system":
+			system = true
+
+		case "shell-init":
+			if err := runShellInit(flag.Args()[1:]); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		case "stdio":
+			if len(flag.Args()) != 1 {
+				fatalf("stdio takes no arguments")
+			}
+			stdio = true
+
+		case "verify":
+			if err := runVerify(flag.Args()[1:]); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		case "verify-audit":
+			if err := runVerifyAudit(flag.Args()[1:]); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		case "version":
+			if err := runVersion(flag.Args()[1:]); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		case "install-service":
+			if err := installService(flag.Args()[1:]); err != nil {
+				exitWithError(err)
+			}
+			return
+
+		default:
+			fatalf("Unknown subcommand %s", flag.Arg(0))
+		}
+	}
+
+	if errs := validateFlags(); len(errs) > 0 {
+		fatalf("%v", errs[0])
+	}
+
+	repeatedMessages.interval = *logRepeatInterval
+	if err := setupLogOutput(*logOutput, *logFormat, *logFilePath, int64(*logFileMaxSize)*1024*1024); err != nil {
+		fatalf("%v", err)
+	}
+
+	currentAgent.notify = *notify
+	if *eventCommand != "" || *eventWebhook != "" {
+		hooks, err := newEventHooks(*eventCommand, *eventWebhook)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		events = hooks
+	}
+	churn := &churnDetector{window: *churnWindow, threshold: *churnThreshold}
+	currentAgent.watch(churn.changed)
+	if err := setupRequestHandling(); err != nil {
+		fatalf("%v", err)
+	}
+
+	if *selectionHistory > 0 {
+		decisions = selection.NewHistory(*selectionHistory)
+	}
+
+	if *statsFile != "" {
+		stats, err := loadUsageStats(*statsFile)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		signStats = stats
+		go signStats.persist()
+	}
+
+	if agentSocketMode, agentSocketGroup, err = parseSocketPermissions(*socketMode, *socketGroup); err != nil {
+		fatalf("%v", err)
+	}
+
+	if *skipProcessChecks {
+		if len(allowOwnerProcess) > 0 || *skipOtherNamespaces {
+			warnf("Ignoring -allowOwnerProcess and -skipOtherNamespaces because of -skipProcessChecks")
+		}
+		allowOwnerProcess = nil
+		*skipOtherNamespaces = false
+	}
+
+	if *otlpEndpoint != "" {
+		t, err := newTracer(*otlpEndpoint)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		tracing = t
+	}
+
+	if *statsdAddress != "" {
+		pusher, err := newStatsdPusher(*statsdAddress, *statsdPrefix, *statsdTags)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		go pusher.run(*statsdInterval)
+	}
+
+	if stdio {
+		switcher.ServeConn(context.Background(), newStdioConn(), sessionConfig(socketPolicy{}))
+		return
+	}
+
+	if *startupSelfTest || *requireAgent {
+		if err := selfTest(config.AgentsDir, *pinFile, *requireAgent); err != nil {
+			fatalf("%v", err)
+		}
+	}
+
+	setupConnectionSlots(*maxConnections)
+	if *identitiesCacheTTL > 0 {
+		identitiesResponses = newIdentitiesCache(*identitiesCacheTTL)
+	}
+	if *quarantineAfter > 0 {
+		quarantinedAgents = newQuarantineTracker(*quarantineAfter, *quarantineDuration)
+	}
+
+	if system {
+		if err := runSystem(flag.Args()[1:]); err != nil {
+			exitWithError(err)
+		}
+		return
+	}
+
+	socket, err := systemdListener()
+	if err != nil {
+		fatalf("%v", err)
+	}
+
+	// Install signal handlers before we create the sockets so that we don't leave them
+	// behind in any case.  If systemd owns the socket, we must not delete it on exit.
+	var cleanup []string
+	if socket == nil {
+		cleanup = append(cleanup, *socketPath)
+	}
+	cleanup = append(cleanup, socketPaths.extra...)
+	if *restrictedSocketPath != "" {
+		cleanup = append(cleanup, *restrictedSocketPath)
+	}
+	if *controlSocket != "" {
+		cleanup = append(cleanup, *controlSocket)
+	}
+	if isUnixSocketAddress(*debugAddress) {
+		cleanup = append(cleanup, *debugAddress)
+	}
+	if isUnixSocketAddress(*healthAddress) {
+		cleanup = append(cleanup, *healthAddress)
+	}
+	if *gpgSocketPath != "" {
+		cleanup = append(cleanup, *gpgSocketPath)
+	}
+	setupSignals(cleanup...)
+
+	activated := socket != nil
+	if activated {
+		infof("Listening on %s (socket activated)", *socketPath)
+	} else {
+		socket, err = listenAgent(*socketPath)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		infof("Listening on %s", *socketPath)
+	}
+	if inheritedAgent != "" {
+		infof("Falling back to the inherited agent %s when no other agent is available", inheritedAgent)
+	}
+	if err := ownSockets.Add(*socketPath); err != nil {
+		warnf("Cannot identify our own socket %s: %v", *socketPath, err)
+	}
+	for _, path := range socketPaths.extra {
+		listener, err := listenAgent(path)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		if err := ownSockets.Add(path); err != nil {
+			warnf("Cannot identify our own socket %s: %v", path, err)
+		}
+		infof("Also listening on %s", path)
+		go serveAgentSocket(listener)
+	}
+
+	if *restrictedSocketPath != "" {
+		listener, err := listenAgent(*restrictedSocketPath)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		if err := ownSockets.Add(*restrictedSocketPath); err != nil {
+			warnf("Cannot identify our own socket %s: %v", *restrictedSocketPath, err)
+		}
+		infof("Serving restricted clients on %s", *restrictedSocketPath)
+		go serveRestrictedSocket(listener)
+	}
+
+	if *socketCheckInterval > 0 {
+		// systemd owns socket-activated sockets and would not know about a new one.
+		if !activated {
+			go watchSocket(*socketPath, *socketCheckInterval, serveAgentSocket)
+		}
+		for _, path := range socketPaths.extra {
+			go watchSocket(path, *socketCheckInterval, serveAgentSocket)
+		}
+		if *restrictedSocketPath != "" {
+			go watchSocket(*restrictedSocketPath, *socketCheckInterval, serveRestrictedSocket)
+		}
+	}
+	if *policyCheckInterval > 0 && len(policyFiles()) > 0 {
+		go watchPolicies(*policyCheckInterval)
+	}
+
+	if *controlSocket != "" {
+		control, err := listenPrivate(*controlSocket)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		infof("Accepting control commands on %s", *controlSocket)
+		go serveControl(control)
+	}
+
+	if *debugAddress != "" {
+		listener, err := listenLocal(*debugAddress)
+		if err != nil {
+			fatalf("Cannot serve debug endpoints: %v", err)
+		}
+		infof("Serving debug endpoints on %s", *debugAddress)
+		go serveDebug(listener)
+	}
+
+	if *healthAddress != "" {
+		listener, err := listenLocal(*healthAddress)
+		if err != nil {
+			fatalf("Cannot serve health endpoints: %v", err)
+		}
+		infof("Serving health endpoints on %s", *healthAddress)
+		go serveHealth(listener, config.AgentsDir)
+	}
+
+	if *gpgSocketPath != "" {
+		listener, err := listenPrivate(*gpgSocketPath)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		if err := ownSockets.Add(*gpgSocketPath); err != nil {
+			warnf("Cannot identify our own socket %s: %v", *gpgSocketPath, err)
+		}
+		infof("Proxying gpg-agent sockets matching %s on %s", *gpgAgentsGlob, *gpgSocketPath)
+		go serveGpg(listener, *gpgAgentsGlob)
+	}
+
+	if *tlsAddress != "" {
+		tlsConfig, err := loadTLSConfig(*tlsCert, *tlsKey, *tlsClientCA)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		listener, err := tls.Listen("tcp", *tlsAddress, tlsConfig)
+		if err != nil {
+			fatalf("%v", err)
+		}
+		infof("Accepting TLS clients on %s", listener.Addr())
+		go serveTLS(listener, tlsAllowClient)
+	}
+
+	if *cleanupStale {
+		go removeStaleSessions(config.AgentsDir, *cleanupInterval)
+	}
+
+	if *warmInterval > 0 {
+		warmAgent = &warmSelection{}
+		go warmAgent.keep(config.AgentsDir, *pinFile, *warmInterval)
+	}
+
+	exportEnvironment(*socketPath, *environmentFile, *systemdEnvironment)
+
+	if *useDBus {
+		if err := startDBusService(config.AgentsDir, currentAgent); err != nil {
+			errorf("Cannot expose status on D-Bus: %v", err)
+		}
+	}
+
+	if err := serveClients(context.Background(), socket, sessionConfig(socketPolicy{})); err != nil {
+		fatalf("%v", err)
+	}
+}
+
+// serveRestrictedSocket accepts agent clients on the -restrictedSocketPath "listener" until it
+// fails.
+func serveRestrictedSocket(listener net.Listener) {
+	restrictions := socketPolicy{
+		restricted:  true,
+		readOnly:    true,
+		confirmSign: *restrictedConfirmSign,
+		hidden:      restrictedHideKey,
+	}
+	err := serveClients(context.Background(), listener, sessionConfig(restrictions))
+	errorf("Cannot accept connections on %s: %v", listener.Addr(), err)
+}
+
+// serveAgentSocket accepts agent clients on the extra -socketPath "listener" until it fails.
+func serveAgentSocket(listener net.Listener) {
+	err := serveClients(context.Background(), listener, sessionConfig(socketPolicy{}))
+	errorf("Cannot accept connections on %s: %v", listener.Addr(), err)
+}
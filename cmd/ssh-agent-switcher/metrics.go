@@ -0,0 +1,90 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"sync/atomic"
+)
+
+// metric is a named value that describes the behavior of the daemon.
+type metric struct {
+	// name identifies the metric.  Must be a valid identifier in all the monitoring systems
+	// that we export metrics to, so it can only contain lowercase letters and underscores.
+	name string
+
+	// help describes what the metric counts.
+	help string
+
+	// gauge is true if the value can go up and down, or false if it only increases.
+	gauge bool
+
+	// value is the current value of the metric.
+	value atomic.Int64
+}
+
+// allMetrics lists all the metrics known to the daemon, in the order in which they are exported.
+var allMetrics []*metric
+
+// newCounter registers a metric whose value only increases.
+func newCounter(name string, help string) *metric {
+	m := &metric{name: name, help: help}
+	allMetrics = append(allMetrics, m)
+	return m
+}
+
+// newGauge registers a metric whose value can go up and down.
+func newGauge(name string, help string) *metric {
+	m := &metric{name: name, help: help, gauge: true}
+	allMetrics = append(allMetrics, m)
+	return m
+}
+
+// Metrics collected by the daemon.
+var (
+	metricConnectionsAccepted = newCounter("connections_accepted", "client connections accepted")
+	metricConnectionsRejected = newCounter("connections_rejected", "client connections rejected before reaching an agent")
+	metricConnectionsActive   = newGauge("connections_active", "client connections being proxied")
+	metricAgentNotFound       = newCounter("agent_not_found", "client connections dropped because no agent was available")
+	metricRequestsForwarded   = newCounter("requests_forwarded", "client requests forwarded to an agent")
+	metricRequestsRejected    = newCounter("requests_rejected", "client requests rejected by the configured restrictions")
+	metricSignsForwarded      = newCounter("signs_forwarded", "sign requests forwarded to an agent")
+	metricIdentitiesCacheHits = newCounter("identities_cache_hits", "identities requests answered from -identitiesCacheTTL")
+	metricAgentsQuarantined   = newCounter("agents_quarantined", "agents quarantined for failing every sign request")
+	metricSelectionChanges    = newCounter("selection_changes", "changes of the agent selected for new clients")
+)
+
+// inc increments the metric by one.
+func (m *metric) inc() {
+	m.value.Add(1)
+}
+
+// dec decrements the metric by one.  Only valid for gauges.
+func (m *metric) dec() {
+	m.value.Add(-1)
+}
+
+// get returns the current value of the metric.
+func (m *metric) get() int64 {
+	return m.value.Load()
+}
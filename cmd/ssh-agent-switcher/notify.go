@@ -0,0 +1,135 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// selectionTracker remembers which agent was last handed out to clients so that we can detect
+// when the upstream changes or disappears.
+type selectionTracker struct {
+	mu sync.Mutex
+
+	// current is the path to the last agent socket that was selected, or empty if none.
+	current string
+
+	// lost is true if the last attempt to find an agent failed.
+	lost bool
+
+	// notify causes desktop notifications to be emitted on state transitions.
+	notify bool
+
+	// watchers are invoked with the new selection every time it changes.
+	watchers []func(current string)
+}
+
+// watch registers "fn" to be called every time the selected agent changes.  The new selection
+// is passed as an argument and is empty if no agent is available.
+//
+// The callback runs synchronously in the goroutine that triggered the change, so it should
+// return quickly.
+func (t *selectionTracker) watch(fn func(current string)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.watchers = append(t.watchers, fn)
+}
+
+// getCurrent returns the path to the last selected agent, or empty if none.
+func (t *selectionTracker) getCurrent() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.current
+}
+
+// fire invokes all registered watchers to let them know that the selection is now "current".
+func (t *selectionTracker) fire(current string) {
+	t.mu.Lock()
+	watchers := t.watchers
+	t.mu.Unlock()
+
+	for _, fn := range watchers {
+		fn(current)
+	}
+}
+
+// selected records that the agent at "path" was chosen to serve a client.
+func (t *selectionTracker) selected(path string) {
+	t.mu.Lock()
+	previous, wasLost := t.current, t.lost
+	t.current = path
+	t.lost = false
+
+	if wasLost {
+		t.notifyf("SSH agent available", "Now forwarding to %s", path)
+	} else if previous != "" && previous != path {
+		t.notifyf("SSH agent switched", "Now forwarding to %s (was %s)", path, previous)
+	}
+	t.mu.Unlock()
+
+	if wasLost {
+		events.emit(event{Type: eventAgentAvailable, Agent: path})
+	} else if previous != "" && previous != path {
+		events.emit(event{Type: eventAgentSwitched, Agent: path, Previous: previous})
+	}
+	if previous != path {
+		t.fire(path)
+	}
+}
+
+// noAgent records that we could not find any agent to serve a client.
+func (t *selectionTracker) noAgent() {
+	t.mu.Lock()
+	if t.lost {
+		t.mu.Unlock()
+		return
+	}
+	t.current = ""
+	t.lost = true
+
+	t.notifyf("No SSH agent available", "Clients will not be able to use any forwarded keys")
+	t.mu.Unlock()
+
+	events.emit(event{Type: eventNoAgent})
+
+	t.fire("")
+}
+
+// notifyf emits a desktop notification if enabled.  Must be called with the mutex held.
+//
+// The notification is sent in the background: we don't want a slow or broken notification
+// daemon to delay the handling of client connections.
+func (t *selectionTracker) notifyf(summary string, format string, args ...any) {
+	if !t.notify {
+		return
+	}
+
+	body := fmt.Sprintf(format, args...)
+	go func() {
+		if err := sendDesktopNotification(summary, body); err != nil {
+			errorf("Failed to send desktop notification: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,145 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/jmmv/ssh-agent-switcher/internal/peercred"
+)
+
+// processName returns the name of the command run by the process "pid", as the kernel
+// reports it.
+func processName(pid int) (string, error) {
+	comm, err := os.ReadFile(procFile(pid, "comm"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(comm), "\n"), nil
+}
+
+// listeningSocketInode returns the inode of the listening Unix socket bound to "path".
+func listeningSocketInode(path string) (string, error) {
+	f, err := os.Open(filepath.Join(*procDir, "net", "unix"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// Each line has the fields: Num RefCount Protocol Flags Type St Inode Path.  Listening
+	// sockets have the __SO_ACCEPTCON flag set.
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 8 && fields[7] == path && fields[3] == "00010000" {
+			return fields[6], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("no listening socket at %s", path)
+}
+
+// socketListenerPID returns the PID of a process that holds the listening socket at "path".
+//
+// The credentials of the peer of a connection to a listening socket, which "conn" provides,
+// are those of the process that created the listener, which is what we want for the session
+// processes of SSH servers.  But agents that daemonize after creating the listener leave the
+// PID of a process that is gone, in which case we look for the processes that hold the socket
+// instead.  This only finds processes whose file descriptors we can inspect.
+func socketListenerPID(path string, conn net.Conn) (int, error) {
+	creds, err := peercred.Get(conn)
+	if err != nil {
+		return 0, err
+	}
+	if creds.PID != 0 {
+		if _, err := os.Stat(procFile(creds.PID, "comm")); err == nil {
+			return creds.PID, nil
+		}
+	}
+
+	inode, err := listeningSocketInode(path)
+	if err != nil {
+		return 0, err
+	}
+	target := "socket:[" + inode + "]"
+	fds, _ := filepath.Glob(filepath.Join(*procDir, "[0-9]*", "fd", "*"))
+	for _, fd := range fds {
+		if link, err := os.Readlink(fd); err == nil && link == target {
+			return strconv.Atoi(filepath.Base(filepath.Dir(filepath.Dir(fd))))
+		}
+	}
+	return 0, fmt.Errorf("no visible process holds the socket")
+}
+
+// checkAgentOwner rejects the candidate agent at "path", which is connected via "conn", unless
+// the process that listens on its socket matches -allowOwnerProcess.
+func checkAgentOwner(path string, conn net.Conn) error {
+	pid, err := socketListenerPID(path, conn)
+	if err != nil {
+		return fmt.Errorf("cannot determine the process serving the agent: %v", err)
+	}
+	name, err := processName(pid)
+	if err != nil {
+		return fmt.Errorf("cannot determine the name of pid %d serving the agent: %v", pid, err)
+	}
+	if !allowOwnerProcess.matchesAny(name) {
+		return fmt.Errorf("served by %s (pid %d), which does not match -allowOwnerProcess", name, pid)
+	}
+	return nil
+}
+
+// checkAgentNamespaces rejects the candidate agent at "path", which is connected via "conn",
+// unless the process that listens on its socket lives in our mount and PID namespaces.  A
+// socket that another container placed in a shared directory is reachable from ours too, but
+// the keys behind it belong to a different environment.
+func checkAgentNamespaces(path string, conn net.Conn) error {
+	// The kernel reports a PID of zero for peers in PID namespaces that we cannot see into,
+	// in which case we won't find the process by its file descriptors either.
+	pid, err := socketListenerPID(path, conn)
+	if err != nil {
+		return fmt.Errorf("cannot find the process serving the agent in our PID namespace: %v", err)
+	}
+	for _, ns := range []string{"mnt", "pid"} {
+		ours, err := os.Readlink(procFile(os.Getpid(), filepath.Join("ns", ns)))
+		if err != nil {
+			return fmt.Errorf("cannot determine our %s namespace: %v", ns, err)
+		}
+		theirs, err := os.Readlink(procFile(pid, filepath.Join("ns", ns)))
+		if err != nil {
+			return fmt.Errorf("cannot determine the %s namespace of pid %d serving the agent: %v", ns, pid, err)
+		}
+		if ours != theirs {
+			return fmt.Errorf("served by pid %d in %s namespace %s instead of ours", pid, ns, theirs)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// defaultPinFile computes the default value for the pinFile flag.
+func defaultPinFile() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "ssh-agent-switcher", "pinned")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "state", "ssh-agent-switcher", "pinned")
+	}
+	return ""
+}
+
+// readPin returns the path to the agent socket recorded in "pinFile", or empty if there is no
+// pinned agent.
+//
+// The file is ignored unless it is owned by us and only writable by us: otherwise, another
+// user could redirect our connections to an agent of their choosing.
+func readPin(pinFile string) string {
+	if pinFile == "" {
+		return ""
+	}
+
+	f, err := os.Open(pinFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logOncef(levelWarn, "Ignoring pin file %s: %v", pinFile, err)
+		}
+		return ""
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		logOncef(levelWarn, "Ignoring pin file %s: stat failed: %v", pinFile, err)
+		return ""
+	}
+	stat := fi.Sys().(*syscall.Stat_t)
+	if int(stat.Uid) != os.Getuid() {
+		logOncef(levelWarn, "Ignoring pin file %s: owner %d is not current user %d", pinFile, stat.Uid, os.Getuid())
+		return ""
+	}
+	if fi.Mode().Perm()&0022 != 0 {
+		logOncef(levelWarn, "Ignoring pin file %s: writable by others", pinFile)
+		return ""
+	}
+
+	var buf [4096]byte
+	n, err := f.Read(buf[:])
+	if err != nil {
+		logOncef(levelWarn, "Ignoring pin file %s: %v", pinFile, err)
+		return ""
+	}
+	return string(bytes.TrimSpace(buf[:n]))
+}
+
+// writePin records "path" as the pinned agent in "pinFile", or removes the pin if "path" is
+// empty.
+func writePin(pinFile string, path string) error {
+	if pinFile == "" {
+		return fmt.Errorf("no pin file configured")
+	}
+
+	if path == "" {
+		err := os.Remove(pinFile)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(pinFile), 0700); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(pinFile), ".pinned.*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := fmt.Fprintf(tmp, "%s\n", path); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), pinFile)
+}
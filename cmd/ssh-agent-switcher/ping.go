@@ -0,0 +1,109 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// timeRoundTrips issues "count" identities requests to the agent connected via "rw" and
+// returns how long each of them took.
+func timeRoundTrips(rw io.ReadWriter, count int) ([]time.Duration, error) {
+	var times []time.Duration
+	for i := 0; i < count; i++ {
+		start := time.Now()
+		if _, err := requestIdentities(rw); err != nil {
+			return nil, err
+		}
+		times = append(times, time.Since(start))
+	}
+	return times, nil
+}
+
+// summarizeTimes formats the minimum, average, and maximum of "times", which cannot be empty.
+func summarizeTimes(times []time.Duration) string {
+	min, max, total := times[0], times[0], time.Duration(0)
+	for _, t := range times {
+		if t < min {
+			min = t
+		}
+		if t > max {
+			max = t
+		}
+		total += t
+	}
+	avg := total / time.Duration(len(times))
+	return fmt.Sprintf("min/avg/max = %v/%v/%v", min.Round(time.Microsecond), avg.Round(time.Microsecond), max.Round(time.Microsecond))
+}
+
+// runPing implements the ping subcommand, which measures the latency of the selected agent
+// both directly and through the running daemon.
+func runPing(args []string) error {
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	count := fs.Int("count", 5, "number of identities requests to time on every path")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("ping takes no arguments")
+	}
+	if *count <= 0 {
+		return errors.New("-count must be positive")
+	}
+
+	// The diagnostics emitted during discovery are not interesting here: we report the
+	// selected agent, or the reason why none was found, ourselves.
+	defer silenceLogs()()
+
+	start := time.Now()
+	agent, _, err := findAgentSocket(config.AgentsDir, *pinFile, nil, nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("cannot select an agent: %w", err)
+	}
+	defer agent.Close()
+	fmt.Fprintf(os.Stdout, "selected %s in %v\n", agent.RemoteAddr(), time.Since(start).Round(time.Microsecond))
+
+	direct, err := timeRoundTrips(agent, *count)
+	if err != nil {
+		return fmt.Errorf("direct requests to %s failed: %w", agent.RemoteAddr(), err)
+	}
+	fmt.Fprintf(os.Stdout, "direct: %s\n", summarizeTimes(direct))
+
+	proxy, err := net.Dial("unix", *socketPath)
+	if err != nil {
+		return fmt.Errorf("cannot connect to the daemon: %v", err)
+	}
+	defer proxy.Close()
+	proxied, err := timeRoundTrips(proxy, *count)
+	if err != nil {
+		return fmt.Errorf("requests through %s failed: %w", *socketPath, err)
+	}
+	fmt.Fprintf(os.Stdout, "proxied: %s\n", summarizeTimes(proxied))
+
+	return nil
+}
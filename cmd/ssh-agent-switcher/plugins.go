@@ -0,0 +1,65 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jmmv/ssh-agent-switcher/plugin"
+)
+
+// discoveryPlugin holds the plugin given to -discoveryPlugin once started.
+var discoveryPlugin struct {
+	once   sync.Once
+	plugin *plugin.Plugin
+	err    error
+}
+
+// startPlugin starts the plugin at "path" and checks that it implements "method", which is
+// what "flagName" uses it for.
+func startPlugin(flagName string, path string, method string) (*plugin.Plugin, error) {
+	p, err := plugin.Start(path, *pluginTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if !p.Implements(method) {
+		p.Close()
+		return nil, fmt.Errorf("-%s %s does not implement %s", flagName, path, method)
+	}
+	return p, nil
+}
+
+// startDiscoveryPlugin starts the plugin given to -discoveryPlugin the first time it is called
+// and returns it, or nil if there is none.  The daemon calls this during startup so that a
+// broken plugin keeps it from starting, but subcommands only start the plugin if they need to
+// discover agents.
+func startDiscoveryPlugin() (*plugin.Plugin, error) {
+	discoveryPlugin.once.Do(func() {
+		if *discoveryPluginPath != "" {
+			discoveryPlugin.plugin, discoveryPlugin.err = startPlugin("discoveryPlugin", *discoveryPluginPath, "discover")
+		}
+	})
+	return discoveryPlugin.plugin, discoveryPlugin.err
+}
@@ -0,0 +1,119 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// settingsMu serializes the updates to keyPolicies and activeSettings, which happen when the
+// policy files change and when switching profiles.
+var settingsMu sync.Mutex
+
+// fileStamp identifies a version of a file by its modification time and size.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// statStamp returns the stamp of the file at "path", or the zero stamp if it does not exist.
+func statStamp(path string) fileStamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: fi.ModTime(), size: fi.Size()}
+}
+
+// policyFiles returns the policy files in use: the -policyFile and those of the profiles.
+func policyFiles() []string {
+	var files []string
+	if *policyFile != "" {
+		files = append(files, *policyFile)
+	}
+	for _, p := range profiles {
+		if p.PolicyFile != nil && *p.PolicyFile != "" {
+			files = append(files, *p.PolicyFile)
+		}
+	}
+	return files
+}
+
+// reloadPolicies loads the policy files again and applies them to new client connections.
+// Connections that are already open keep the rules that were in effect when they started.
+// On error, the previous rules remain in effect.
+func reloadPolicies() error {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+
+	policies, err := newKeyPolicies(*policyFile)
+	if err != nil {
+		return err
+	}
+	previous := keyPolicies
+	keyPolicies = policies
+	s, err := resolveProfile(currentSettings().profile)
+	if err != nil {
+		keyPolicies = previous
+		return err
+	}
+	activeSettings.Store(s)
+	return nil
+}
+
+// watchPolicies checks every "interval" whether any of the policy files changed and, if so,
+// reloads them.  This lets users rotate the keys allowed by a policy without restarting the
+// daemon and disrupting the shells that depend on it.
+func watchPolicies(interval time.Duration) {
+	stamps := make(map[string]fileStamp)
+	for _, path := range policyFiles() {
+		stamps[path] = statStamp(path)
+	}
+
+	for {
+		time.Sleep(interval)
+
+		var changed []string
+		for path, stamp := range stamps {
+			if current := statStamp(path); current != stamp {
+				stamps[path] = current
+				changed = append(changed, path)
+			}
+		}
+		if len(changed) == 0 {
+			continue
+		}
+		sort.Strings(changed)
+
+		if err := reloadPolicies(); err != nil {
+			warnf("Keeping the previous policies after %s changed: %v", strings.Join(changed, ", "), err)
+			continue
+		}
+		infof("Reloaded %s for new client connections", strings.Join(changed, ", "))
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !nodbus && !minimal
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// polkitAllowUserInteraction is the CheckAuthorization flag that lets polkit display the
+// desktop's authentication dialog.
+const polkitAllowUserInteraction = 0x1
+
+// checkPolkitAuthorization asks polkit whether "client" may perform "action", which makes polkit
+// authenticate the user through the desktop's authentication agent if the action requires it.
+//
+// "details" are passed to polkit so that its rules and its dialogs can refer to them.
+func checkPolkitAuthorization(action string, client clientInfo, details map[string]string) error {
+	if client.pid == 0 {
+		return errors.New("cannot identify the client to polkit")
+	}
+
+	conn, err := dialDBus(systemBusAddress())
+	if err != nil {
+		return fmt.Errorf("cannot connect to the system bus: %v", err)
+	}
+	defer conn.Close()
+	if err := conn.hello(); err != nil {
+		return fmt.Errorf("cannot connect to the system bus: %v", err)
+	}
+
+	var body dbusEncoder
+
+	// The subject is a unix-process: polkit looks up the start time of the process by itself
+	// when it's missing, and requires the uid to be present to avoid pid reuse attacks.
+	body.align(8)
+	body.putString("unix-process")
+	body.putArray(8, func() {
+		body.align(8)
+		body.putString("pid")
+		body.putSignature("u")
+		body.putUint32(uint32(client.pid))
+		body.align(8)
+		body.putString("uid")
+		body.putSignature("i")
+		body.putUint32(uint32(os.Getuid()))
+	})
+
+	body.putString(action)
+
+	keys := make([]string, 0, len(details))
+	for key := range details {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	body.putArray(8, func() {
+		for _, key := range keys {
+			body.align(8)
+			body.putString(key)
+			body.putString(details[key])
+		}
+	})
+
+	body.putUint32(polkitAllowUserInteraction)
+	body.putString("") // No cancellation identifier.
+
+	reply, err := conn.call(&dbusMessage{
+		destination: "org.freedesktop.PolicyKit1",
+		path:        "/org/freedesktop/PolicyKit1/Authority",
+		iface:       "org.freedesktop.PolicyKit1.Authority",
+		member:      "CheckAuthorization",
+		signature:   "(sa{sv})sa{ss}us",
+		body:        body.buf,
+	})
+	if err != nil {
+		return err
+	}
+
+	if reply.signature != "(bba{ss})" {
+		return fmt.Errorf("unexpected polkit reply signature %q", reply.signature)
+	}
+	d := dbusDecoder{buf: reply.body, order: reply.order}
+	authorized, err := d.getUint32()
+	if err != nil {
+		return err
+	}
+	if authorized == 0 {
+		return fmt.Errorf("%s not authorized by polkit", client)
+	}
+	return nil
+}
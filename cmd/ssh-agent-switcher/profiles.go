@@ -0,0 +1,270 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/policy"
+)
+
+// defaultProfile is the name of the profile that uses the settings given via flags.
+const defaultProfile = "default"
+
+// profile is a named set of settings from the -profilesFile that can be switched to at
+// runtime.  Settings that are not set keep the values given via flags.
+type profile struct {
+	// ConfirmSign overrides -confirmSign.
+	ConfirmSign *bool `json:"confirmSign"`
+
+	// ReadOnly overrides -readOnly.
+	ReadOnly *bool `json:"readOnly"`
+
+	// PolicyFile overrides -policyFile.  An empty string disables the per-key rules.
+	PolicyFile *string `json:"policyFile"`
+
+	// HideKey replaces the values of -hideKey.
+	HideKey []string `json:"hideKey"`
+
+	// PreferActiveSessions overrides -preferActiveSessions.
+	PreferActiveSessions *bool `json:"preferActiveSessions"`
+
+	// DemoteNottySessions overrides -demoteNottySessions.
+	DemoteNottySessions *bool `json:"demoteNottySessions"`
+
+	// PreferRecentTerminals overrides -preferRecentTerminals.
+	PreferRecentTerminals *bool `json:"preferRecentTerminals"`
+
+	// WaitForAgent overrides -waitForAgent, as a duration such as "30s".
+	WaitForAgent *string `json:"waitForAgent"`
+
+	// Failover overrides -failover.
+	Failover *bool `json:"failover"`
+}
+
+// profilesFileContents is the format of the -profilesFile.
+type profilesFileContents struct {
+	Profiles map[string]*profile `json:"profiles"`
+}
+
+// loadProfiles reads the profiles defined in the file at "path" and checks the settings that
+// do not depend on other files.
+func loadProfiles(path string) (map[string]*profile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var contents profilesFileContents
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&contents); err != nil {
+		return nil, fmt.Errorf("invalid profiles file %s: %v", path, err)
+	}
+
+	for name, p := range contents.Profiles {
+		if name == defaultProfile {
+			return nil, fmt.Errorf("invalid profiles file %s: %s is reserved for the settings given via flags", path, name)
+		}
+		if p == nil {
+			return nil, fmt.Errorf("invalid profiles file %s: profile %s is empty", path, name)
+		}
+		if p.WaitForAgent != nil {
+			if d, err := time.ParseDuration(*p.WaitForAgent); err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid profiles file %s: invalid waitForAgent %q in profile %s", path, *p.WaitForAgent, name)
+			}
+		}
+		for _, pattern := range p.HideKey {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid profiles file %s: invalid hideKey %q in profile %s: %v", path, pattern, name, err)
+			}
+		}
+	}
+	return contents.Profiles, nil
+}
+
+// runtimeSettings holds the settings in effect for new client connections, which come from
+// the flags and from the active profile, if any.
+type runtimeSettings struct {
+	// profile is the name of the active profile.
+	profile string
+
+	confirmSign           bool
+	readOnly              bool
+	policies              policy.Checker
+	hidden                []string
+	preferActiveSessions  bool
+	demoteNottySessions   bool
+	preferRecentTerminals bool
+	waitForAgent          time.Duration
+	failover              bool
+}
+
+var (
+	// profiles holds the profiles defined in the -profilesFile, if any.
+	profiles map[string]*profile
+
+	// activeSettings holds the settings of the active profile.  Nil until
+	// setupRequestHandling runs, in which case the settings given via flags apply.
+	activeSettings atomic.Pointer[runtimeSettings]
+)
+
+// currentSettings returns the settings in effect for new client connections.
+func currentSettings() *runtimeSettings {
+	if s := activeSettings.Load(); s != nil {
+		return s
+	}
+	s, _ := resolveProfile(defaultProfile)
+	return s
+}
+
+// profileNames returns the names of all profiles, including the default one, sorted.
+func profileNames() []string {
+	names := []string{defaultProfile}
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolveProfile computes the settings of the profile "name" on top of the flags.  Files
+// referenced by the profile are loaded again so that switching to a profile picks up any
+// changes to them.
+func resolveProfile(name string) (*runtimeSettings, error) {
+	s := &runtimeSettings{
+		profile:               name,
+		confirmSign:           *confirmSign,
+		readOnly:              *readOnly,
+		policies:              keyPolicies,
+		hidden:                hideKey,
+		preferActiveSessions:  *preferActiveSessions,
+		demoteNottySessions:   *demoteNottySessions,
+		preferRecentTerminals: *preferRecentTerminals,
+		waitForAgent:          *waitForAgent,
+		failover:              *failover,
+	}
+	if name == defaultProfile {
+		return s, nil
+	}
+
+	p, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q; valid profiles are: %s", name, strings.Join(profileNames(), ", "))
+	}
+	if p.ConfirmSign != nil {
+		s.confirmSign = *p.ConfirmSign
+	}
+	if p.ReadOnly != nil {
+		s.readOnly = *p.ReadOnly
+	}
+	if p.PolicyFile != nil {
+		policies, err := newKeyPolicies(*p.PolicyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot use profile %s: %v", name, err)
+		}
+		s.policies = policies
+	}
+	if p.HideKey != nil {
+		s.hidden = p.HideKey
+	}
+	if p.PreferActiveSessions != nil {
+		s.preferActiveSessions = *p.PreferActiveSessions
+	}
+	if p.DemoteNottySessions != nil {
+		s.demoteNottySessions = *p.DemoteNottySessions
+	}
+	if p.PreferRecentTerminals != nil {
+		s.preferRecentTerminals = *p.PreferRecentTerminals
+	}
+	if p.WaitForAgent != nil {
+		// Already validated by loadProfiles.
+		s.waitForAgent, _ = time.ParseDuration(*p.WaitForAgent)
+	}
+	if p.Failover != nil {
+		s.failover = *p.Failover
+	}
+	return s, nil
+}
+
+// setupProfiles loads the -profilesFile, if any, and activates the -profile.
+func setupProfiles() error {
+	if *profilesFile != "" {
+		loaded, err := loadProfiles(*profilesFile)
+		if err != nil {
+			return err
+		}
+		profiles = loaded
+	}
+
+	// Catch mistakes in the files referenced by the profiles now instead of when the user
+	// tries to switch to them.
+	for _, name := range profileNames() {
+		if _, err := resolveProfile(name); err != nil {
+			return err
+		}
+	}
+
+	s, err := resolveProfile(*initialProfile)
+	if err != nil {
+		return fmt.Errorf("invalid -profile: %v", err)
+	}
+	activeSettings.Store(s)
+	if s.profile != defaultProfile {
+		infof("Using profile %s", s.profile)
+	}
+	return nil
+}
+
+// profileCommand implements the "profile [NAME]" control command.
+func profileCommand(args []string) (string, error) {
+	switch len(args) {
+	case 0:
+		return fmt.Sprintf("active profile: %s; available profiles: %s", currentSettings().profile,
+			strings.Join(profileNames(), ", ")), nil
+
+	case 1:
+		settingsMu.Lock()
+		defer settingsMu.Unlock()
+		s, err := resolveProfile(args[0])
+		if err != nil {
+			return "", err
+		}
+		activeSettings.Store(s)
+		infof("Switched to profile %s via the control socket", s.profile)
+		return "switched to profile " + s.profile, nil
+
+	default:
+		return "", errors.New("usage: profile [NAME]")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+// This file adapts the codec package to the limits in config.
+
+import (
+	"io"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+)
+
+// failureMessage is a complete SSH_AGENT_FAILURE message, including its length prefix.
+var failureMessage = []byte{0, 0, 0, 1, codec.AgentFailure}
+
+// readAgentFrame reads a single length-prefixed message from "r" and returns it, including
+// the length prefix.  The message is stored in "buf" if it fits.
+func readAgentFrame(r io.Reader, buf []byte) ([]byte, error) {
+	return codec.ReadFrame(r, buf, config.MaxMessageSize)
+}
+
+// describeMessage returns a description of the message "body", which excludes the length
+// prefix, for the debug logs.  The description omits the keys and other details of the
+// message with -privacy.
+func describeMessage(body []byte) string {
+	if *privacyMode {
+		return codec.Summarize(body)
+	}
+	return codec.Describe(body)
+}
+
+// readAgentMessage reads a single length-prefixed message from "r" and returns its contents,
+// including the message type in the first byte.
+func readAgentMessage(r io.Reader) ([]byte, error) {
+	frame, err := readAgentFrame(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	return frame[4:], nil
+}
+
+// requestIdentities asks the agent connected via "rw" for the list of keys it holds.
+func requestIdentities(rw io.ReadWriter) ([]codec.Identity, error) {
+	return codec.RequestIdentities(rw, config.MaxMessageSize)
+}
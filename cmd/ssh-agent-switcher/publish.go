@@ -0,0 +1,116 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// removeRemoteSocket deletes the socket at "path" on "host", if any, using the ssh binary at
+// "sshProgram".  sshd refuses to forward to a path that already exists and does not clean up
+// after itself, so the socket of a previous forwarding that died would block us.
+func removeRemoteSocket(sshProgram string, host string, path string) error {
+	quoted := shellQuote(path)
+	cmd := exec.Command(sshProgram, "-T", host, "test ! -S "+quoted+" || rm -f "+quoted)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// runPublish implements the publish subcommand, which forwards the daemon's socket to a fixed
+// path on a remote host for as long as it runs, reconnecting if the forwarding dies.
+func runPublish(args []string) error {
+	fs := flag.NewFlagSet("publish", flag.ExitOnError)
+	remoteSocket := fs.String("remoteSocket", defaultSocketPath(), "path on the remote host at which to publish the socket")
+	sshProgram := fs.String("sshProgram", "ssh", "ssh binary to use to connect to the remote host")
+	retryInterval := fs.Duration("retryInterval", 10*time.Second, "how long to wait before reconnecting after the forwarding dies")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: publish [-remoteSocket PATH] [-sshProgram PATH] [-retryInterval DURATION] HOST")
+	}
+	host := fs.Arg(0)
+	if strings.HasPrefix(host, "-") {
+		return fmt.Errorf("invalid host %q", host)
+	}
+	if *remoteSocket == "" {
+		return errors.New("-remoteSocket is required")
+	}
+	if *retryInterval <= 0 {
+		return fmt.Errorf("invalid -retryInterval %v", *retryInterval)
+	}
+
+	socket, err := daemonSocket()
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer func() {
+		if err := removeRemoteSocket(*sshProgram, host, *remoteSocket); err != nil {
+			warnf("Cannot remove %s on %s: %v", *remoteSocket, host, err)
+		}
+	}()
+
+	for {
+		if err := removeRemoteSocket(*sshProgram, host, *remoteSocket); err != nil {
+			warnf("Cannot remove stale %s on %s: %v", *remoteSocket, host, err)
+		}
+
+		cmd := exec.Command(*sshProgram, "-N", "-o", "ExitOnForwardFailure=yes", "-o", "ServerAliveInterval=30",
+			"-R", *remoteSocket+":"+socket, host)
+		cmd.Stderr = os.Stderr
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+		infof("Publishing %s at %s on %s", socket, *remoteSocket, host)
+
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case <-stop:
+			cmd.Process.Kill()
+			<-done
+			infof("Stopped publishing to %s", host)
+			return nil
+		case err := <-done:
+			warnf("Forwarding to %s ended: %v; retrying in %v", host, err, *retryInterval)
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(*retryInterval):
+		}
+	}
+}
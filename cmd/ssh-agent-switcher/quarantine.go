@@ -0,0 +1,150 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+	"github.com/jmmv/ssh-agent-switcher/discovery"
+)
+
+// signFailures holds the recent outcomes of the sign requests forwarded to one agent.
+type signFailures struct {
+	// consecutive is how many sign requests in a row the agent failed.
+	consecutive int
+
+	// until is when the quarantine of the agent ends, or zero if it is not quarantined.
+	until time.Time
+}
+
+// quarantineTracker quarantines the agents that fail every sign request, such as a locked
+// agent or one whose smartcard broke, which would otherwise keep winning the selection while
+// all authentications silently fail.
+type quarantineTracker struct {
+	// after is how many sign requests in a row an agent must fail to be quarantined.
+	after int
+
+	// duration is how long the agents stay quarantined.
+	duration time.Duration
+
+	// mu protects agents.
+	mu sync.Mutex
+
+	// agents maps the paths to the agent sockets to their failures.
+	agents map[string]*signFailures
+}
+
+// quarantinedAgents tracks the failing agents.  Nil if -quarantineAfter is zero.
+var quarantinedAgents *quarantineTracker
+
+// newQuarantineTracker creates a tracker that quarantines the agents that fail "after" sign
+// requests in a row for "duration".
+func newQuarantineTracker(after int, duration time.Duration) *quarantineTracker {
+	return &quarantineTracker{after: after, duration: duration, agents: make(map[string]*signFailures)}
+}
+
+// record accounts for "response", which includes the length prefix, as the answer of the agent
+// at "path" to "request".  Only the answers to sign requests count: a signature lifts the
+// quarantine of the agent right away and a failure brings it closer to one.
+func (t *quarantineTracker) record(path string, request []byte, response []byte) {
+	if t == nil || len(request) < 5 || request[4] != codec.AgentcSignRequest || len(response) < 5 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if response[4] != codec.AgentFailure {
+		if failures, ok := t.agents[path]; ok {
+			if !failures.until.IsZero() {
+				infof("Lifting the quarantine of %s: it answered a sign request", path)
+			}
+			delete(t.agents, path)
+		}
+		return
+	}
+
+	failures, ok := t.agents[path]
+	if !ok {
+		failures = &signFailures{}
+		t.agents[path] = failures
+	}
+	failures.consecutive++
+	if failures.consecutive >= t.after {
+		if failures.until.IsZero() || time.Now().After(failures.until) {
+			warnf("Quarantining %s for %v: it failed the last %d sign requests; is it locked or is its key broken?", path, t.duration, failures.consecutive)
+			metricAgentsQuarantined.inc()
+		}
+		failures.until = time.Now().Add(t.duration)
+	}
+}
+
+// quarantined returns true if the agent at "path" is quarantined.
+func (t *quarantineTracker) quarantined(path string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	failures, ok := t.agents[path]
+	if !ok || failures.until.IsZero() {
+		return false
+	}
+	if time.Now().After(failures.until) {
+		// Give the agent another chance, which a single failure takes away again.
+		failures.until = time.Time{}
+		failures.consecutive = t.after - 1
+		return false
+	}
+	return true
+}
+
+// quarantineRanker is a discovery.Discoverer that moves the candidates of another discoverer
+// whose agents are quarantined behind all others.  The relative order of the candidates is
+// otherwise preserved, so a quarantined agent is still selected if there is no other.
+type quarantineRanker struct {
+	discovery.Discoverer
+}
+
+// Discover returns the candidates of the wrapped discoverer with the quarantined ones last.
+func (r *quarantineRanker) Discover() ([]discovery.Candidate, []discovery.Skipped, error) {
+	candidates, skipped, err := r.Discoverer.Discover()
+	if len(candidates) < 2 {
+		return candidates, skipped, err
+	}
+
+	quarantined := make(map[string]bool, len(candidates))
+	for _, candidate := range candidates {
+		if quarantinedAgents.quarantined(candidate.Path) {
+			logOncef(levelInfo, "Demoting %s: it is quarantined because it failed every recent sign request", candidate.Path)
+			quarantined[candidate.Path] = true
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return !quarantined[candidates[i].Path] && quarantined[candidates[j].Path]
+	})
+	return candidates, skipped, err
+}
@@ -0,0 +1,128 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+	"github.com/jmmv/ssh-agent-switcher/selection"
+)
+
+// queryExtension is the agent extension that ssh-agent-switcher answers by itself, without
+// forwarding it, with a description of the agent selected for the connection.
+//
+// The reply is an SSH_AGENT_SUCCESS message followed by a string with one "key: value" line
+// per property so that tools like shell prompts can show the status without needing access
+// to the control socket.
+const queryExtension = "query@ssh-agent-switcher"
+
+// isQueryRequest checks whether the client request "msg", which includes the length prefix,
+// asks for the status of the connection.
+func isQueryRequest(msg []byte) bool {
+	return codec.ExtensionName(msg) == queryExtension
+}
+
+// encodeQueryReply builds the reply to a status query for a connection whose agent was
+// selected by "decision" and that goes through the other ssh-agent-switcher instances in
+// "hops", as returned by upstreamHops.  The reply includes the message type in the first byte.
+func encodeQueryReply(decision selection.Decision, hops []string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "instance: %s\n", instanceID)
+	if decision.Err != nil {
+		fmt.Fprintf(&b, "upstream: none\n")
+		fmt.Fprintf(&b, "reason: %v\n", decision.Err)
+	} else {
+		fmt.Fprintf(&b, "upstream: %s\n", decision.Winner)
+		if name := agentAliases.nameOf(decision.Winner); name != "" {
+			fmt.Fprintf(&b, "upstream-name: %s\n", name)
+		}
+		fmt.Fprintf(&b, "reason: %s\n", decision.Reason)
+	}
+	fmt.Fprintf(&b, "selected-at: %s\n", decision.Time.Format(time.RFC3339))
+	fmt.Fprintf(&b, "candidates: %d\n", len(decision.Candidates))
+	for _, rejected := range decision.Rejected {
+		fmt.Fprintf(&b, "rejected: %s\n", rejected)
+	}
+	for _, hop := range hops {
+		fmt.Fprintf(&b, "hop: %s\n", hop)
+	}
+	return codec.AppendString([]byte{codec.AgentSuccess}, []byte(b.String()))
+}
+
+// queryStatus sends a status query to the ssh-agent-switcher instance at the other end of
+// "conn" and returns the description of the selected agent.
+func queryStatus(conn net.Conn) (string, error) {
+	request := codec.AppendString([]byte{codec.AgentcExtension}, []byte(queryExtension))
+	if err := codec.WriteMessage(conn, request); err != nil {
+		return "", err
+	}
+	reply, err := readAgentMessage(conn)
+	if err != nil {
+		return "", err
+	}
+	if reply[0] != codec.AgentSuccess {
+		return "", fmt.Errorf("%s is not supported; is this an ssh-agent-switcher instance?", queryExtension)
+	}
+
+	r := codec.NewReader(reply[1:])
+	status, err := r.ReadString()
+	if err != nil {
+		return "", fmt.Errorf("invalid reply: %w", err)
+	}
+	return string(status), nil
+}
+
+// runQuery implements the query subcommand, which asks a running daemon over the agent socket
+// which agent it selected and why.
+func runQuery(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	socket := fs.String("socket", os.Getenv("SSH_AUTH_SOCK"), "path to the socket of the ssh-agent-switcher instance to query")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("usage: query [-socket PATH]")
+	}
+	if *socket == "" {
+		return errors.New("cannot determine the socket to query; use -socket")
+	}
+
+	conn, err := net.Dial("unix", *socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	status, err := queryStatus(conn)
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(os.Stdout, status)
+	return nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/policy"
+)
+
+// signLimits enforces the limits on sign requests that apply regardless of the key in use.
+type signLimits struct {
+	// global is the maximum number of sign requests per minute across all clients, or zero
+	// for no limit.
+	global int
+
+	// perClient is the maximum number of sign requests per minute issued by any single
+	// client executable, or zero for no limit.
+	perClient int
+
+	// limiter counts the recent sign requests.
+	limiter *policy.RateLimiter
+}
+
+// newSignLimits creates the limits on sign requests given the per-minute maximums "global" and
+// "perClient", either of which can be zero to disable it.  Returns nil if no limits apply.
+func newSignLimits(global int, perClient int) *signLimits {
+	if global == 0 && perClient == 0 {
+		return nil
+	}
+	return &signLimits{
+		global:    global,
+		perClient: perClient,
+		limiter:   policy.NewRateLimiter(time.Minute),
+	}
+}
+
+// clientKey returns the key under which the sign requests of "client" are counted.
+func clientKey(client clientInfo) string {
+	// Clients are grouped by executable, not by process, because a compromised program can
+	// trivially spawn new processes.
+	switch {
+	case client.remote != "":
+		return "tls:" + client.remote
+	case client.exe == "":
+		return fmt.Sprintf("pid:%d", client.pid)
+	default:
+		return "client:" + client.exe
+	}
+}
+
+// perClientExceeded logs and returns the error for sign requests of "client" over the limit.
+func (l *signLimits) perClientExceeded(client clientInfo) error {
+	warnf("%s exceeded the limit of %d signs per minute; the agent may be under abuse", client, l.perClient)
+	return fmt.Errorf("%s exceeded the limit of %d signs per minute", client, l.perClient)
+}
+
+// globalExceeded logs and returns the error for sign requests over the global limit.
+func (l *signLimits) globalExceeded() error {
+	warnf("clients exceeded the global limit of %d signs per minute; the agent may be under abuse", l.global)
+	return fmt.Errorf("global limit of %d signs per minute exceeded", l.global)
+}
+
+// precheck returns an error if a sign request issued by "client" would exceed any of the
+// limits, without recording it.  This is for rejecting requests before asking the user to
+// confirm them, which check must still do afterwards.
+func (l *signLimits) precheck(client clientInfo) error {
+	now := time.Now()
+	if l.perClient > 0 && l.limiter.Full(clientKey(client), l.perClient, now) {
+		return l.perClientExceeded(client)
+	}
+	if l.global > 0 && l.limiter.Full("global", l.global, now) {
+		return l.globalExceeded()
+	}
+	return nil
+}
+
+// check records a sign request issued by "client" and returns an error if it exceeds any of
+// the limits.  Rejected requests do not count against any of the limits.
+func (l *signLimits) check(client clientInfo) error {
+	now := time.Now()
+	key := clientKey(client)
+
+	if l.perClient > 0 && !l.limiter.Allow(key, l.perClient, now) {
+		return l.perClientExceeded(client)
+	}
+
+	if l.global > 0 && !l.limiter.Allow("global", l.global, now) {
+		if l.perClient > 0 {
+			l.limiter.Undo(key, now)
+		}
+		return l.globalExceeded()
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+)
+
+// replayCapture sends the requests recorded in "messages" to "agent" and compares the agent's
+// responses to the recorded ones, reporting the outcome of every exchange to "out".
+func replayCapture(agent io.ReadWriter, messages []capturedMessage, out io.Writer) error {
+	responses := 0
+	differences := 0
+	for _, m := range messages {
+		switch m.direction {
+		case captureRequest:
+			if m.redacted {
+				return fmt.Errorf("line %d: cannot replay redacted %s; capture with -captureRedact=false", m.line, m)
+			}
+			fmt.Fprintf(out, "> %s\n", m)
+			if _, err := agent.Write(m.data); err != nil {
+				return fmt.Errorf("line %d: write to agent failed: %v", m.line, err)
+			}
+
+		case captureResponse:
+			body, err := readAgentMessage(agent)
+			if err != nil {
+				return fmt.Errorf("line %d: read from agent failed: %v", m.line, err)
+			}
+			got := codec.Frame(body)
+
+			responses++
+			if m.matches(got) {
+				fmt.Fprintf(out, "< %s: same\n", m)
+				continue
+			}
+			differences++
+			fmt.Fprintf(out, "< %s: differs\n", m)
+			fmt.Fprintf(out, "    expected: %s\n", hex.EncodeToString(m.data))
+			fmt.Fprintf(out, "    got:      %s (%s)\n", hex.EncodeToString(got), codec.Describe(body))
+		}
+	}
+
+	if differences > 0 {
+		return fmt.Errorf("%d of %d responses differ", differences, responses)
+	}
+	fmt.Fprintf(out, "All %d responses match\n", responses)
+	return nil
+}
+
+// runReplay implements the replay subcommand, which feeds a capture recorded with -captureDir
+// to an agent to reproduce the conversation offline.
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	agentPath := fs.String("agent", os.Getenv("SSH_AUTH_SOCK"), "path to the socket of the agent to replay the capture against")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: replay [-agent PATH] CAPTURE")
+	}
+	if *agentPath == "" {
+		return errors.New("cannot determine the agent to use; use -agent")
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	messages, err := readCapture(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(0), err)
+	}
+
+	agent, err := net.Dial("unix", *agentPath)
+	if err != nil {
+		return err
+	}
+	defer agent.Close()
+
+	return replayCapture(agent, messages, os.Stdout)
+}
@@ -0,0 +1,109 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/discovery"
+)
+
+// scanOutcome holds what a discoverer returned.
+type scanOutcome struct {
+	candidates []discovery.Candidate
+	skipped    []discovery.Skipped
+	err        error
+}
+
+// scanFlight is a scan that is running in the background.
+type scanFlight struct {
+	// done is closed when the scan finishes and "outcome" is set.
+	done chan struct{}
+
+	// outcome is what the scan returned.
+	outcome scanOutcome
+}
+
+// scanFlights tracks the scans that are running in the background, keyed by directory, so that
+// the connections that arrive while a scan is slow share it instead of piling up more of them.
+type scanFlights struct {
+	// mu protects flights.
+	mu sync.Mutex
+
+	// flights maps the directories being scanned to their scans.
+	flights map[string]*scanFlight
+}
+
+// pendingScans tracks the scans of the agents directory that are running in the background.
+var pendingScans = &scanFlights{flights: make(map[string]*scanFlight)}
+
+// start returns the scan of "key" that is running in the background, starting it with "d" if
+// there is none.
+func (f *scanFlights) start(key string, d discovery.Discoverer) *scanFlight {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if flight, ok := f.flights[key]; ok {
+		return flight
+	}
+
+	flight := &scanFlight{done: make(chan struct{})}
+	f.flights[key] = flight
+	go func() {
+		candidates, skipped, err := d.Discover()
+		flight.outcome = scanOutcome{candidates, skipped, err}
+
+		f.mu.Lock()
+		delete(f.flights, key)
+		f.mu.Unlock()
+		close(flight.done)
+	}()
+	return flight
+}
+
+// timeoutDiscoverer wraps the discoverer that scans "dir" so that a scan that hangs, such as
+// one of a hung network file system, fails client connections after "timeout" instead of
+// hanging them forever.  The scan keeps running in the background and later connections wait
+// for it to finish instead of starting another one.
+type timeoutDiscoverer struct {
+	discovery.Discoverer
+	dir     string
+	timeout time.Duration
+}
+
+// Discover runs the wrapped discoverer for up to "timeout".
+func (d *timeoutDiscoverer) Discover() ([]discovery.Candidate, []discovery.Skipped, error) {
+	flight := pendingScans.start(d.dir, d.Discoverer)
+
+	timer := time.NewTimer(d.timeout)
+	defer timer.Stop()
+	select {
+	case <-flight.done:
+		return flight.outcome.candidates, flight.outcome.skipped, flight.outcome.err
+	case <-timer.C:
+		logOncef(levelWarn, "Scanning %s is taking longer than -scanTimeout %v; is it on a hung file system?", d.dir, d.timeout)
+		return nil, nil, fmt.Errorf("scan of %s did not finish within %v", d.dir, d.timeout)
+	}
+}
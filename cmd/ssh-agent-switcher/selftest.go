@@ -0,0 +1,53 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/jmmv/ssh-agent-switcher/selection"
+)
+
+// selfTest looks for an agent under "dir" once and logs what it finds, for -selfTest.  Returns
+// an error if there is no usable agent and "require" is true.
+func selfTest(dir string, pinFile string, require bool) error {
+	discoverer := newDiscoverer(dir, preferredAgents(pinFile))
+	conn, decision, err := selection.Find(discoverer, newSelector())
+	for _, path := range decision.Candidates {
+		infof("Self-test: candidate %s", path)
+	}
+	for _, rejected := range decision.Rejected {
+		infof("Self-test: rejected %s", rejected)
+	}
+	if err != nil {
+		if require {
+			return fmt.Errorf("no usable agent found, as required by -requireAgent: %v", err)
+		}
+		warnf("Self-test found no usable agent: %v", err)
+		return nil
+	}
+	conn.Close()
+	infof("Self-test found agent at %s: %s", decision.Winner, decision.Reason)
+	return nil
+}
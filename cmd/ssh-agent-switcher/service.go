@@ -0,0 +1,293 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// serviceName is the base name of the systemd units that we generate.
+const serviceName = "ssh-agent-switcher"
+
+// systemdListener returns the listening socket passed to us by systemd via socket activation,
+// if any.
+//
+// Returns a nil listener and no error if we were not started via socket activation.
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds == 0 {
+		return nil, nil
+	}
+	if nfds != 1 {
+		return nil, fmt.Errorf("expected 1 socket from systemd but got %d", nfds)
+	}
+
+	// File descriptors passed by systemd start at 3.
+	f := os.NewFile(3, "systemd-socket")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+// systemdQuote quotes "arg" so that it is interpreted as a single word in an ExecStart line.
+func systemdQuote(arg string) string {
+	arg = strings.ReplaceAll(arg, "%", "%%")
+	if arg != "" && !strings.ContainsAny(arg, " \t\n\"'\\$;") {
+		return arg
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range arg {
+		switch r {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case '\n':
+			b.WriteString(`\n`)
+		case '$':
+			b.WriteString("$$")
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// serviceCommandLine computes the ExecStart line for the service unit based on the path to our
+// own binary and the flags given to the current invocation.
+//
+// The listening socket and agents directory are always recorded explicitly so that the service
+// does not depend on the environment of the systemd user instance.
+func serviceCommandLine() (string, error) {
+	return daemonCommandLine(systemdQuote)
+}
+
+// daemonCommandLine computes the command line that runs the daemon with the flags given to the
+// current invocation, always including the listening socket and agents directory, and quotes
+// every argument with "quote".
+//
+// The sockets are recorded as given, without the host name that -socketPathPerHost appends,
+// so that the command line works on every host that shares it.
+func daemonCommandLine(quote func(string) string) (string, error) {
+	binary, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{quote(binary)}
+	add := func(f *flag.Flag) {
+		if values, ok := f.Value.(*stringListFlag); ok {
+			for _, value := range *values {
+				args = append(args, quote(fmt.Sprintf("-%s=%s", f.Name, value)))
+			}
+			return
+		}
+		if paths, ok := f.Value.(*socketPathFlag); ok {
+			for _, path := range paths.paths() {
+				args = append(args, quote(fmt.Sprintf("-%s=%s", f.Name, paths.unqualified(path))))
+			}
+			return
+		}
+		args = append(args, quote(fmt.Sprintf("-%s=%s", f.Name, f.Value.String())))
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		switch f.Name {
+		case "socketPath", "agentsDir":
+			add(f)
+		}
+	})
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "socketPath", "agentsDir":
+		default:
+			add(f)
+		}
+	})
+
+	return strings.Join(args, " "), nil
+}
+
+// serviceAddressFamilies returns the socket address families that the daemon needs to be able
+// to use given its configuration.
+func serviceAddressFamilies() string {
+	return "AF_UNIX"
+}
+
+// serviceUnit returns the contents of the service unit.
+func serviceUnit(execStart string) string {
+	return fmt.Sprintf(`# Generated by ssh-agent-switcher install-service.
+
+[Unit]
+Description=SSH agent switcher
+Documentation=https://github.com/jmmv/ssh-agent-switcher
+
+[Service]
+ExecStart=%s
+Restart=on-failure
+RestartSec=1s
+
+LockPersonality=yes
+MemoryDenyWriteExecute=yes
+NoNewPrivileges=yes
+RestrictAddressFamilies=%s
+RestrictRealtime=yes
+SystemCallArchitectures=native
+
+[Install]
+WantedBy=default.target
+`, execStart, serviceAddressFamilies())
+}
+
+// socketUnit returns the contents of the socket unit that listens on "socketPath".
+func socketUnit(socketPath string) string {
+	return fmt.Sprintf(`# Generated by ssh-agent-switcher install-service.
+
+[Unit]
+Description=SSH agent switcher socket
+Documentation=https://github.com/jmmv/ssh-agent-switcher
+
+[Socket]
+ListenStream=%s
+SocketMode=0600
+RemoveOnStop=yes
+
+[Install]
+WantedBy=sockets.target
+`, socketPath)
+}
+
+// defaultUnitDir returns the directory where systemd looks for user-provided units.
+func defaultUnitDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "systemd", "user")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".config", "systemd", "user")
+	}
+	return ""
+}
+
+// runSystemctl invokes systemctl on the user instance with the given arguments.
+func runSystemctl(args ...string) error {
+	cmd := exec.Command("systemctl", append([]string{"--user"}, args...)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("systemctl %s failed: %v", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// makeSocketPathsAbsolute resolves all -socketPath values against the current directory so
+// that they can be recorded for processes that run elsewhere.
+func makeSocketPathsAbsolute() error {
+	if *socketPath == "" {
+		return errors.New("cannot determine the socket path; use -socketPath")
+	}
+	var err error
+	if *socketPath, err = filepath.Abs(*socketPath); err != nil {
+		return err
+	}
+	for i, path := range socketPaths.extra {
+		if socketPaths.extra[i], err = filepath.Abs(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installService implements the install-service subcommand, which writes systemd user units
+// to run the daemon with the current flags and optionally enables them.
+func installService(args []string) error {
+	fs := flag.NewFlagSet("install-service", flag.ExitOnError)
+	unitDir := fs.String("unitDir", defaultUnitDir(), "directory in which to write the units")
+	withSocket := fs.Bool("socket", false, "also install a socket unit to start the daemon on demand")
+	enable := fs.Bool("enable", true, "enable and start the units after writing them")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("install-service takes no arguments")
+	}
+	if *unitDir == "" {
+		return errors.New("cannot determine where to install the units; use -unitDir")
+	}
+
+	if err := makeSocketPathsAbsolute(); err != nil {
+		return err
+	}
+	absSocketPath := *socketPath
+
+	execStart, err := serviceCommandLine()
+	if err != nil {
+		return err
+	}
+
+	units := map[string]string{
+		serviceName + ".service": serviceUnit(execStart),
+	}
+	if *withSocket {
+		listenPath := absSocketPath
+		if *socketPathPerHost {
+			// Let systemd append the short host name on every host that shares the unit.
+			listenPath = socketPaths.unqualified(absSocketPath) + ".%l"
+		}
+		units[serviceName+".socket"] = socketUnit(listenPath)
+	}
+
+	if err := os.MkdirAll(*unitDir, 0755); err != nil {
+		return err
+	}
+	for name, contents := range units {
+		path := filepath.Join(*unitDir, name)
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			return err
+		}
+		infof("Wrote %s", path)
+	}
+
+	if !*enable {
+		return nil
+	}
+
+	if err := runSystemctl("daemon-reload"); err != nil {
+		return err
+	}
+	unit := serviceName + ".service"
+	if *withSocket {
+		unit = serviceName + ".socket"
+	}
+	return runSystemctl("enable", "--now", unit)
+}
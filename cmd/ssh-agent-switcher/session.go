@@ -0,0 +1,170 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+	"github.com/jmmv/ssh-agent-switcher/policy"
+)
+
+// sessionBindExtension is the name of the extension that OpenSSH clients use to tell the agent
+// which host they are authenticating to.
+const sessionBindExtension = "session-bind@openssh.com"
+
+// sessionBinding describes the SSH session that a client bound its agent connection to.
+type sessionBinding struct {
+	// hostKey is the public key blob of the server.
+	hostKey []byte
+
+	// hostName is the name of the server as recorded in the known hosts files, or empty if
+	// unknown.
+	hostName string
+
+	// forwarding is true if the connection is being forwarded to the server instead of
+	// being used to authenticate to it.
+	forwarding bool
+}
+
+// parseSessionBind decodes the session-bind@openssh.com extension message "msg", which
+// includes the length prefix.
+func parseSessionBind(msg []byte) (*sessionBinding, error) {
+	r := codec.NewReader(msg[5:])
+	if _, err := r.ReadString(); err != nil { // Extension name.
+		return nil, err
+	}
+	hostKey, err := r.ReadString()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.ReadString(); err != nil { // Session identifier.
+		return nil, err
+	}
+	if _, err := r.ReadString(); err != nil { // Signature.
+		return nil, err
+	}
+	forwarding, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	return &sessionBinding{
+		// The message buffer is reused for subsequent messages so we must make a copy.
+		hostKey:    bytes.Clone(hostKey),
+		hostName:   knownHostName(hostKey),
+		forwarding: forwarding != 0,
+	}, nil
+}
+
+// String returns a human-readable description of the bound host.
+func (b *sessionBinding) String() string {
+	key := codec.Identity{Blob: b.hostKey}
+	description := fmt.Sprintf("host key %s %s", key.KeyType(), key.Fingerprint())
+	if b.hostName != "" {
+		description = fmt.Sprintf("%s (%s)", b.hostName, description)
+	}
+	return description
+}
+
+// host describes the server for the purposes of checking policy rules.
+//
+// A nil binding, which means that the client did not say which host it is connecting to,
+// yields a nil host.
+func (b *sessionBinding) host() *policy.Host {
+	if b == nil {
+		return nil
+	}
+	return &policy.Host{
+		KeyFingerprint: codec.Fingerprint(b.hostKey),
+		Name:           b.hostName,
+		Forwarding:     b.forwarding,
+		Description:    b.String(),
+	}
+}
+
+// knownHostsFiles returns the paths to the files in which OpenSSH records host keys.
+func knownHostsFiles() []string {
+	var files []string
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".ssh", "known_hosts"))
+	}
+	return append(files, "/etc/ssh/ssh_known_hosts")
+}
+
+// knownHostName looks for "hostKey" in the known hosts files and returns the first name that
+// it is recorded under, or empty if not found.  Hashed host names cannot be recovered.
+func knownHostName(hostKey []byte) string {
+	for _, file := range knownHostsFiles() {
+		name, err := findKnownHost(file, hostKey)
+		if err == nil {
+			return name
+		}
+	}
+	return ""
+}
+
+// errHostNotFound indicates that a host key does not appear in a known hosts file.
+var errHostNotFound = errors.New("host not found")
+
+// findKnownHost looks for "hostKey" in the known hosts file "path" and returns the first name
+// that it is recorded under.
+func findKnownHost(path string, hostKey []byte) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "@") {
+			continue
+		}
+
+		key, err := base64.StdEncoding.DecodeString(fields[2])
+		if err != nil || !bytes.Equal(key, hostKey) {
+			continue
+		}
+
+		for _, name := range strings.Split(fields[0], ",") {
+			if strings.HasPrefix(name, "|") || strings.HasPrefix(name, "!") {
+				continue // Hashed or negated.
+			}
+			return name, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errHostNotFound
+}
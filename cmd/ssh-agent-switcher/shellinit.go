@@ -0,0 +1,57 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+)
+
+// runShellInit implements the shell-init subcommand, which prints the commands for a login
+// script to start the daemon with the flags given before the subcommand, unless it is already
+// running, and to point SSH_AUTH_SOCK at its socket.  The socket path is computed exactly like
+// the daemon does, including the host name appended by -socketPathPerHost.
+func runShellInit(args []string) error {
+	fs := flag.NewFlagSet("shell-init", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("shell-init takes no arguments")
+	}
+
+	if err := makeSocketPathsAbsolute(); err != nil {
+		return err
+	}
+	command, err := daemonCommandLine(shellQuote)
+	if err != nil {
+		return err
+	}
+
+	socket := shellQuote(*socketPath)
+	fmt.Printf("if [ ! -S %s ]; then\n", socket)
+	fmt.Printf("    (%s </dev/null >/dev/null 2>&1 &)\n", command)
+	fmt.Printf("fi\n")
+	fmt.Printf("SSH_AUTH_SOCK=%s; export SSH_AUTH_SOCK\n", socket)
+	return nil
+}
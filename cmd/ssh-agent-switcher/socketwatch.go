@@ -0,0 +1,61 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"net"
+	"os"
+	"time"
+)
+
+// watchSocket checks every "interval" that our socket at "path" still exists and, if somebody
+// deleted it, such as an overzealous /tmp cleaner, creates it again and serves it with "serve".
+// Without this, the daemon would keep running uselessly while every client fails to connect.
+//
+// The listener of the deleted socket stays open because its accept loop never ends, but
+// nobody can reach it anymore.  Files that replaced the socket are left alone.
+func watchSocket(path string, interval time.Duration, serve func(net.Listener)) {
+	for {
+		time.Sleep(interval)
+
+		if ownSockets.Contains(path) {
+			continue
+		}
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			logOncef(levelWarn, "Not recreating %s: it was replaced by another file", path)
+			continue
+		}
+
+		listener, err := listenAgent(path)
+		if err != nil {
+			logOncef(levelError, "Cannot recreate deleted socket %s: %v", path, err)
+			continue
+		}
+		if err := ownSockets.Add(path); err != nil {
+			warnf("Cannot identify our own socket %s: %v", path, err)
+		}
+		warnf("Recreated socket %s after it was deleted", path)
+		go serve(listener)
+	}
+}
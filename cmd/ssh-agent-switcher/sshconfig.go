@@ -0,0 +1,202 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sshConfigHeader is the first line of the ssh_config fragments that we manage, which tells
+// us that we can overwrite them.
+const sshConfigHeader = "# Managed by ssh-agent-switcher; remove with: ssh-agent-switcher ssh-config remove"
+
+// defaultSSHDir returns the directory that holds the configuration of the user's ssh client,
+// or empty if the home directory is unknown.
+func defaultSSHDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".ssh")
+}
+
+// quoteSSHConfig quotes "value" for an ssh_config file if it contains spaces.
+func quoteSSHConfig(value string) string {
+	if strings.ContainsAny(value, " \t") {
+		return `"` + value + `"`
+	}
+	return value
+}
+
+// writeFileAtomically replaces the contents of "path" with "data", giving the file "mode"
+// if it is created.  Readers see either the old or the new contents.
+func writeFileAtomically(path string, data []byte, mode os.FileMode) error {
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// includeLine returns the Include directive that loads the fragment at "fragment".
+func includeLine(fragment string) string {
+	return "Include " + quoteSSHConfig(fragment)
+}
+
+// installSSHConfig writes the fragment at "fragment" that points IdentityAgent at "socket" and
+// makes the ssh_config file at "config" include it if it does not already.
+func installSSHConfig(config string, fragment string, socket string) error {
+	existing, err := os.ReadFile(fragment)
+	if err == nil && !strings.HasPrefix(string(existing), sshConfigHeader+"\n") {
+		return fmt.Errorf("refusing to overwrite %s, which was not created by ssh-agent-switcher", fragment)
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fragment), 0700); err != nil {
+		return err
+	}
+	contents := fmt.Sprintf("%s\nHost *\n    IdentityAgent %s\n", sshConfigHeader, quoteSSHConfig(socket))
+	if err := writeFileAtomically(fragment, []byte(contents), 0600); err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(config)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	include := includeLine(fragment)
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == include {
+			return nil
+		}
+	}
+	// Directives before the first Host or Match block apply to all hosts, and the first
+	// value that ssh obtains for each option wins, so the Include must come first.
+	if err := os.MkdirAll(filepath.Dir(config), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomically(config, append([]byte(include+"\n"), data...), 0600)
+}
+
+// removeSSHConfig deletes the fragment at "fragment" and its Include directive from the
+// ssh_config file at "config".
+func removeSSHConfig(config string, fragment string) error {
+	data, err := os.ReadFile(config)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err == nil {
+		include := includeLine(fragment)
+		lines := strings.SplitAfter(string(data), "\n")
+		kept := make([]string, 0, len(lines))
+		for _, line := range lines {
+			if strings.TrimSpace(line) != include {
+				kept = append(kept, line)
+			}
+		}
+		if len(kept) != len(lines) {
+			if err := writeFileAtomically(config, []byte(strings.Join(kept, "")), 0600); err != nil {
+				return err
+			}
+		}
+	}
+
+	existing, err := os.ReadFile(fragment)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(string(existing), sshConfigHeader+"\n") {
+		return fmt.Errorf("refusing to remove %s, which was not created by ssh-agent-switcher", fragment)
+	}
+	return os.Remove(fragment)
+}
+
+// runSSHConfig implements the ssh-config subcommand, which points the IdentityAgent of the
+// user's ssh client at our socket via an included fragment, or removes the fragment.  This
+// reaches programs that do not inherit SSH_AUTH_SOCK, such as graphical Git clients.
+func runSSHConfig(args []string) error {
+	fs := flag.NewFlagSet("ssh-config", flag.ExitOnError)
+	var defaultConfig, defaultFragment string
+	if dir := defaultSSHDir(); dir != "" {
+		defaultConfig = filepath.Join(dir, "config")
+		defaultFragment = filepath.Join(dir, "ssh-agent-switcher.conf")
+	}
+	config := fs.String("config", defaultConfig, "path to the ssh_config file that includes the fragment")
+	fragment := fs.String("fragment", defaultFragment, "path to the fragment that sets IdentityAgent")
+	fs.Parse(args)
+	if fs.NArg() != 1 || (fs.Arg(0) != "install" && fs.Arg(0) != "remove") {
+		return errors.New("usage: ssh-config [-config PATH] [-fragment PATH] install|remove")
+	}
+	if *config == "" || *fragment == "" {
+		return errors.New("cannot determine the home directory; use -config and -fragment")
+	}
+
+	absFragment, err := filepath.Abs(*fragment)
+	if err != nil {
+		return err
+	}
+
+	if fs.Arg(0) == "remove" {
+		if err := removeSSHConfig(*config, absFragment); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s and its Include from %s\n", absFragment, *config)
+		return nil
+	}
+
+	if err := makeSocketPathsAbsolute(); err != nil {
+		return err
+	}
+	if err := installSSHConfig(*config, absFragment, *socketPath); err != nil {
+		return err
+	}
+	fmt.Printf("ssh now uses the agent at %s via %s\n", *socketPath, absFragment)
+	return nil
+}
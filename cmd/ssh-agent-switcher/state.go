@@ -0,0 +1,286 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/selection"
+)
+
+// activeConnection describes a client connection that is being proxied.
+type activeConnection struct {
+	// client describes the process on the other end of the connection.
+	client clientInfo
+
+	// agent is the path to the socket of the agent that serves the connection.
+	agent string
+
+	// since is when the connection was accepted.
+	since time.Time
+
+	// usage accumulates the traffic of the connection.
+	usage *connectionUsage
+}
+
+// describe describes the connection "id" for the status output.
+func (c activeConnection) describe(id uint64) string {
+	desc := fmt.Sprintf("[conn %d] %s using %s for %v", id, c.client, agentLabel(c.agent), time.Since(c.since).Round(time.Second))
+	if c.usage != nil {
+		desc += "; " + c.usage.String()
+	}
+	return desc
+}
+
+// connectionUsage accumulates the traffic of a client connection.  It is updated by the
+// goroutine that serves the connection and read by those that report on it.
+type connectionUsage struct {
+	// requests is the number of requests that the client sent.
+	requests atomic.Uint64
+
+	// bytesIn and bytesOut are the number of bytes read from and written to the client.
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+
+	// busy is the time spent handling requests, in nanoseconds.
+	busy atomic.Int64
+
+	// last is when the client sent its latest request, in nanoseconds since the Unix epoch,
+	// or zero if it did not send any yet.
+	last atomic.Int64
+}
+
+// startRequest records that the client sent a request and returns the function to call once
+// the request has been handled.
+func (u *connectionUsage) startRequest() func() {
+	start := time.Now()
+	u.requests.Add(1)
+	u.last.Store(start.UnixNano())
+	return func() {
+		u.busy.Add(int64(time.Since(start)))
+	}
+}
+
+// String returns a human-readable summary of the traffic.
+func (u *connectionUsage) String() string {
+	desc := fmt.Sprintf("%d requests, %d bytes in, %d bytes out, %v busy", u.requests.Load(), u.bytesIn.Load(), u.bytesOut.Load(), time.Duration(u.busy.Load()).Round(time.Millisecond))
+	if last := u.last.Load(); last != 0 {
+		desc += fmt.Sprintf(", last request %v ago", time.Since(time.Unix(0, last)).Round(time.Second))
+	}
+	return desc
+}
+
+// countingConn wraps a client connection to account for the bytes exchanged over it.
+type countingConn struct {
+	net.Conn
+	usage *connectionUsage
+}
+
+// Read reads from the wrapped connection and accounts for the bytes read.
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.usage.bytesIn.Add(uint64(n))
+	return n, err
+}
+
+// Write writes to the wrapped connection and accounts for the bytes written.
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.usage.bytesOut.Add(uint64(n))
+	return n, err
+}
+
+// connectionRegistry tracks the client connections that are being proxied.
+type connectionRegistry struct {
+	// mu protects conns.
+	mu sync.Mutex
+
+	// conns maps connection identifiers to their details.
+	conns map[uint64]activeConnection
+}
+
+// activeConnections tracks the client connections that are being proxied.
+var activeConnections = &connectionRegistry{conns: make(map[uint64]activeConnection)}
+
+// add registers the connection "id".
+func (r *connectionRegistry) add(id uint64, conn activeConnection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns[id] = conn
+}
+
+// setAgent records that the connection "id" is now proxied to the agent at "path".
+func (r *connectionRegistry) setAgent(id uint64, path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if conn, ok := r.conns[id]; ok {
+		conn.agent = path
+		r.conns[id] = conn
+	}
+}
+
+// remove forgets the connection "id".
+func (r *connectionRegistry) remove(id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, id)
+}
+
+// list returns the identifiers of the active connections, in ascending order, and their
+// details.
+func (r *connectionRegistry) list() ([]uint64, map[uint64]activeConnection) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids := make([]uint64, 0, len(r.conns))
+	conns := make(map[uint64]activeConnection, len(r.conns))
+	for id, conn := range r.conns {
+		ids = append(ids, id)
+		conns[id] = conn
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, conns
+}
+
+// dumpState logs the internal state of the daemon: the selected agent, the candidate agents
+// currently under "dir", and the active connections.
+func dumpState(dir string) {
+	current := currentAgent.getCurrent()
+	if current == "" {
+		current = "none"
+	}
+	infof("State: selected agent: %s", current)
+
+	candidates, err := findCandidates(dir)
+	if err != nil {
+		infof("State: cannot scan candidates: %v", err)
+	} else {
+		infof("State: %d candidate agents", len(candidates))
+		for _, path := range candidates {
+			infof("State: candidate %s", path)
+		}
+	}
+
+	ids, conns := activeConnections.list()
+	infof("State: %d active connections", len(ids))
+	for _, id := range ids {
+		infof("State: %s", conns[id].describe(id))
+	}
+}
+
+// connectionsCommand implements the "connections" control command.
+func connectionsCommand(args []string) (string, error) {
+	if len(args) != 0 {
+		return "", errors.New("usage: connections")
+	}
+	ids, conns := activeConnections.list()
+	if len(ids) == 0 {
+		return "no active connections", nil
+	}
+	lines := make([]string, len(ids))
+	for i, id := range ids {
+		lines[i] = conns[id].describe(id)
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// rescanParkTimeout is how long client connections wait for an ongoing rescan to finish before
+// looking for an agent on their own.
+const rescanParkTimeout = 5 * time.Second
+
+// rescanGate lets client connections wait for an ongoing rescan to finish instead of racing
+// with it, so that they see its outcome.
+type rescanGate struct {
+	// mu protects done.
+	mu sync.Mutex
+
+	// done is closed when the ongoing rescan finishes, or is nil if there is none.
+	done chan struct{}
+}
+
+// rescans tracks the ongoing rescan, if any.
+var rescans = &rescanGate{}
+
+// begin records that a rescan started and returns the function to call when it finishes.
+func (g *rescanGate) begin() func() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	done := make(chan struct{})
+	g.done = done
+	return func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.done == done {
+			g.done = nil
+		}
+		close(done)
+	}
+}
+
+// wait blocks until the ongoing rescan, if any, finishes or "timeout" expires.  Returns false
+// right away if there is no ongoing rescan.
+func (g *rescanGate) wait(timeout time.Duration) bool {
+	g.mu.Lock()
+	done := g.done
+	g.mu.Unlock()
+	if done == nil {
+		return false
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+	}
+	return true
+}
+
+// rescan forgets the messages suppressed by logOncef, so that the reasons for skipping agents
+// are logged again, and looks for an agent under "dir" right away to refresh the selection.
+// Client connections that arrive in the meantime wait for it to finish.
+func rescan(dir string, pinFile string) {
+	defer rescans.begin()()
+	repeatedMessages.reset()
+
+	inputs := currentSelectionInputs(dir, pinFile)
+	discoverer := &loggingDiscoverer{Discoverer: newDiscoverer(dir, preferredAgents(pinFile))}
+	conn, decision, err := selection.Find(discoverer, newSelector())
+	warmAgent.store(inputs, decision)
+	if err != nil {
+		infof("Rescan found no agent: %v", err)
+		currentAgent.noAgent()
+		return
+	}
+	conn.Close()
+	infof("Rescan found agent at %s", agentLabel(decision.Winner))
+	currentAgent.selected(decision.Winner)
+}
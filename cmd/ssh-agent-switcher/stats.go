@@ -0,0 +1,228 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyUsage describes how a key was used to sign on behalf of clients authenticating to a
+// single server.
+type keyUsage struct {
+	// Key is the fingerprint of the key.
+	Key string `json:"key"`
+
+	// Host describes the server that clients were authenticating to, or empty if they did not
+	// bind their connections to a session.
+	Host string `json:"host,omitempty"`
+
+	// Signs is the number of signatures made by the agent.
+	Signs uint64 `json:"signs"`
+
+	// LastUsed is when the agent last made a signature.
+	LastUsed time.Time `json:"last_used"`
+}
+
+// String formats the usage as a line of the report printed by the stats subcommand.
+func (u *keyUsage) String() string {
+	host := u.Host
+	if host == "" {
+		host = "unknown hosts"
+	}
+	return fmt.Sprintf("%s for %s: %d signatures, last at %s", u.Key, host, u.Signs,
+		u.LastUsed.Format(time.RFC3339))
+}
+
+// usageStats counts the signatures made with every key.
+type usageStats struct {
+	// path is the file in which the statistics are kept across restarts, or empty to only
+	// keep them in memory.
+	path string
+
+	// dirty receives a value whenever the statistics change and have yet to be saved.
+	dirty chan struct{}
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// usage maps the key and host of every entry, separated by a space, to the entry.
+	usage map[string]*keyUsage
+}
+
+// signStats counts the signatures made on behalf of our clients.  loadUsageStats replaces it
+// if -statsFile is set.
+var signStats = &usageStats{usage: make(map[string]*keyUsage)}
+
+// loadUsageStats reads the statistics kept in "path", if the file exists, and keeps them
+// there as they change.
+func loadUsageStats(path string) (*usageStats, error) {
+	s := &usageStats{path: path, dirty: make(chan struct{}, 1), usage: make(map[string]*keyUsage)}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("cannot read -statsFile: %v", err)
+	}
+
+	var entries []keyUsage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("invalid -statsFile %s: %v", path, err)
+	}
+	for i := range entries {
+		s.usage[entries[i].Key+" "+entries[i].Host] = &entries[i]
+	}
+	return s, nil
+}
+
+// record counts a signature made with the key "fingerprint" at "now" for a client
+// authenticating to "host".
+func (s *usageStats) record(fingerprint string, host string, now time.Time) {
+	s.mu.Lock()
+	id := fingerprint + " " + host
+	entry, ok := s.usage[id]
+	if !ok {
+		entry = &keyUsage{Key: fingerprint, Host: host}
+		s.usage[id] = entry
+	}
+	entry.Signs++
+	entry.LastUsed = now
+	s.mu.Unlock()
+
+	if s.dirty != nil {
+		select {
+		case s.dirty <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// list returns a copy of all entries sorted by key and host.
+func (s *usageStats) list() []keyUsage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]keyUsage, 0, len(s.usage))
+	for _, entry := range s.usage {
+		entries = append(entries, *entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Key != entries[j].Key {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].Host < entries[j].Host
+	})
+	return entries
+}
+
+// save writes the statistics to the file they are kept in, if any.
+func (s *usageStats) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".stats.*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// persist saves the statistics every time they change.  Never returns.
+func (s *usageStats) persist() {
+	for range s.dirty {
+		if err := s.save(); err != nil {
+			logOncef(levelWarn, "Cannot save key usage statistics to %s: %v", s.path, err)
+		}
+	}
+}
+
+// formatUsage renders "entries" as the report printed by the stats subcommand.
+func formatUsage(entries []keyUsage) string {
+	if len(entries) == 0 {
+		return "no signatures yet"
+	}
+	lines := make([]string, len(entries))
+	for i := range entries {
+		lines[i] = entries[i].String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// statsCommand implements the "stats" control command.
+func statsCommand(args []string) (string, error) {
+	if len(args) != 0 {
+		return "", errors.New("usage: stats")
+	}
+	return formatUsage(signStats.list()), nil
+}
+
+// runStats implements the stats subcommand, which prints how many signatures every key made
+// for every server.  The statistics come from the running daemon if -controlSocket is set, or
+// from -statsFile otherwise.
+func runStats(args []string) error {
+	if len(args) != 0 {
+		return errors.New("stats takes no arguments")
+	}
+
+	if *controlSocket != "" {
+		return runControl([]string{"stats"})
+	}
+	if *statsFile == "" {
+		return errors.New("-controlSocket or -statsFile must be set to find the statistics")
+	}
+
+	stats, err := loadUsageStats(*statsFile)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stdout, formatUsage(stats.list()))
+	return nil
+}
@@ -0,0 +1,127 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build !nometrics && !minimal
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// maxStatsdPacketSize is the largest UDP payload that we send to statsd, which is safe to send
+// over most networks without fragmentation.
+const maxStatsdPacketSize = 1432
+
+// statsdPusher periodically sends the value of all metrics to a statsd server.
+type statsdPusher struct {
+	// conn is the UDP socket connected to the server.
+	conn net.Conn
+
+	// prefix is prepended to the name of every metric.
+	prefix string
+
+	// tags is the encoded list of dogstatsd tags to attach to every metric, or empty.
+	tags string
+
+	// sent holds the value of each counter as of the last push so that we can send deltas.
+	sent map[*metric]int64
+}
+
+// newStatsdPusher creates a pusher that sends metrics to the statsd server at "address" with
+// the names prefixed by "prefix" and with the dogstatsd "tags", if any, which is a list of
+// comma-separated name:value pairs.
+func newStatsdPusher(address string, prefix string, tags string) (*statsdPusher, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid statsd address %s: %v", address, err)
+	}
+	for _, tag := range strings.Split(tags, ",") {
+		if strings.ContainsAny(tag, "|#\n") {
+			return nil, fmt.Errorf("invalid statsd tag %q", tag)
+		}
+	}
+	return &statsdPusher{conn: conn, prefix: prefix, tags: tags, sent: make(map[*metric]int64)}, nil
+}
+
+// format returns the statsd line that reports the current value of "m", or empty if there is
+// nothing to report.
+func (p *statsdPusher) format(m *metric) string {
+	var line string
+	value := m.get()
+	if m.gauge {
+		line = fmt.Sprintf("%s%s:%d|g", p.prefix, m.name, value)
+	} else {
+		delta := value - p.sent[m]
+		if delta == 0 {
+			return ""
+		}
+		p.sent[m] = value
+		line = fmt.Sprintf("%s%s:%d|c", p.prefix, m.name, delta)
+	}
+	if p.tags != "" {
+		line += "|#" + p.tags
+	}
+	return line
+}
+
+// push sends the current value of all metrics, batching as many as fit in each packet.
+func (p *statsdPusher) push() {
+	var packet []byte
+	flush := func() {
+		if len(packet) == 0 {
+			return
+		}
+		if _, err := p.conn.Write(packet); err != nil {
+			debugf("Cannot send metrics to statsd: %v", err)
+		}
+		packet = packet[:0]
+	}
+
+	for _, m := range allMetrics {
+		line := p.format(m)
+		if line == "" {
+			continue
+		}
+		if len(packet) > 0 && len(packet)+1+len(line) > maxStatsdPacketSize {
+			flush()
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	flush()
+}
+
+// run pushes the metrics every "interval" forever.
+func (p *statsdPusher) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		p.push()
+	}
+}
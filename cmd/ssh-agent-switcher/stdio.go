@@ -0,0 +1,96 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"net"
+	"os"
+	"time"
+)
+
+// stdioAddr is the address of both ends of a stdioConn.
+type stdioAddr struct{}
+
+// Network returns the name of the pseudo-network of stdio connections.
+func (stdioAddr) Network() string { return "stdio" }
+
+// String returns a human-readable representation of the address.
+func (stdioAddr) String() string { return "stdio" }
+
+// stdioConn adapts the standard input and output of the process to a net.Conn so that the
+// client that started us can be served like any other.
+type stdioConn struct {
+	in  *os.File
+	out *os.File
+}
+
+// newStdioConn creates a connection over the standard input and output of the process.
+func newStdioConn() *stdioConn {
+	return &stdioConn{in: os.Stdin, out: os.Stdout}
+}
+
+// Read reads from the standard input.
+func (c *stdioConn) Read(b []byte) (int, error) {
+	return c.in.Read(b)
+}
+
+// Write writes to the standard output.
+func (c *stdioConn) Write(b []byte) (int, error) {
+	return c.out.Write(b)
+}
+
+// Close closes both the standard input and output.
+func (c *stdioConn) Close() error {
+	err := c.in.Close()
+	if err2 := c.out.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// LocalAddr returns the address of our end of the connection.
+func (c *stdioConn) LocalAddr() net.Addr { return stdioAddr{} }
+
+// RemoteAddr returns the address of the client's end of the connection.
+func (c *stdioConn) RemoteAddr() net.Addr { return stdioAddr{} }
+
+// SetDeadline sets both the read and write deadlines.  Deadlines are not supported when the
+// standard input or output are regular files.
+func (c *stdioConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err2 := c.SetWriteDeadline(t); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// SetReadDeadline sets the deadline for reads from the standard input.
+func (c *stdioConn) SetReadDeadline(t time.Time) error {
+	return c.in.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for writes to the standard output.
+func (c *stdioConn) SetWriteDeadline(t time.Time) error {
+	return c.out.SetWriteDeadline(t)
+}
@@ -0,0 +1,246 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/discovery"
+	"github.com/jmmv/ssh-agent-switcher/internal/peercred"
+)
+
+// defaultUsersDir is the default directory in which the system subcommand creates the
+// sockets of every user.
+const defaultUsersDir = "/run/ssh-agent-switcher"
+
+// systemDaemon serves a socket for every user that has forwarded agents.
+type systemDaemon struct {
+	// usersDir is the directory in which to create the sockets of the users.
+	usersDir string
+
+	// minUid is the lowest user ID to serve, which keeps system accounts out.
+	minUid int
+
+	// ctx stops serving all sockets once done.
+	ctx context.Context
+
+	// sockets maps the IDs of the served users to the paths of their sockets.
+	sockets map[int]string
+}
+
+// sessionOwners returns the IDs of the users, starting at "minUid", that own session
+// directories under "dir".
+func sessionOwners(dir string, minUid int) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[int]bool)
+	var uids []int
+	for _, entry := range entries {
+		if !entry.IsDir() || !isSessionDir(entry.Name()) {
+			continue
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		uid := int(fi.Sys().(*syscall.Stat_t).Uid)
+		if uid >= minUid && !seen[uid] {
+			seen[uid] = true
+			uids = append(uids, uid)
+		}
+	}
+	sort.Ints(uids)
+	return uids, nil
+}
+
+// isSessionDir returns true if "name" is named like the session directories of any of the
+// SSH servers that we know about.
+func isSessionDir(name string) bool {
+	for _, c := range discovery.DefaultConventions {
+		if strings.HasPrefix(name, c.DirPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorizeUser rejects "client" unless it runs as the user "uid".
+func authorizeUser(client net.Conn, uid int) error {
+	creds, err := peercred.Get(client)
+	if err != nil {
+		return err
+	}
+	if creds.UID != uid {
+		return fmt.Errorf("peer uid %d (pid %d) is not user %d", creds.UID, creds.PID, uid)
+	}
+	return nil
+}
+
+// userLockedAgents returns the agents that clients locked through us whose sockets belong to
+// the user "uid", which are tried before the other agents of that user.  The locks of other
+// users must never be tried because explicit candidates skip the checks of the discoverers.
+func userLockedAgents(uid int) []discovery.Candidate {
+	var locked []discovery.Candidate
+	for _, path := range lockedAgents.list() {
+		fi, err := os.Lstat(path)
+		if err == nil && int(fi.Sys().(*syscall.Stat_t).Uid) == uid {
+			locked = append(locked, discovery.Candidate{Path: path, Origin: lockedReason, Explicit: true})
+		}
+	}
+	return locked
+}
+
+// userDiscoverer creates a discoverer for "preferred" followed by the agents that sshd forwards
+// to the user "uid" under "dir", minus those matching -exclude.  Other sources of agents, like
+// -agentsGlob and -discoveryPlugin, cannot tell which user the agents belong to.
+func userDiscoverer(dir string, uid int, preferred []discovery.Candidate) discovery.Discoverer {
+	sessions := newSessionDirs(dir)
+	sessions.Owner = &uid
+	var found discovery.Discoverer = &missingDirDiscoverer{sessions, dir}
+	if len(excludeGlob) > 0 {
+		found = &discovery.Exclude{Discoverer: found, Patterns: excludeGlob}
+	}
+	return discovery.Chain{discovery.Static(preferred), found}
+}
+
+// serveUser creates the socket of the user "uid" and proxies the clients that connect to it,
+// which must run as that user, to the agents forwarded to that user only.
+func (d *systemDaemon) serveUser(uid int) error {
+	u, err := user.LookupId(strconv.Itoa(uid))
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(d.usersDir, u.Username)
+
+	// Sockets left behind by a previous run would make listening fail.  Nobody else can
+	// write to usersDir, so whatever socket is there is ours.
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	listener, err := listenPrivate(path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chown(path, uid, -1); err != nil {
+		listener.Close()
+		return fmt.Errorf("cannot give %s to %s: %v", path, u.Username, err)
+	}
+	d.sockets[uid] = path
+
+	infof("Serving the agents of %s on %s", u.Username, path)
+	go func() {
+		if err := serveClients(d.ctx, listener, sessionConfig(socketPolicy{owner: &uid})); err != nil {
+			errorf("Stopped serving the agents of %s: %v", u.Username, err)
+		}
+	}()
+	return nil
+}
+
+// scan creates the sockets of the users that got their first session directories since the
+// previous scan.
+func (d *systemDaemon) scan() {
+	uids, err := sessionOwners(config.AgentsDir, d.minUid)
+	if err != nil {
+		warnf("Cannot find the users with sessions in %s: %v", config.AgentsDir, err)
+		return
+	}
+	for _, uid := range uids {
+		if _, ok := d.sockets[uid]; ok {
+			continue
+		}
+		if err := d.serveUser(uid); err != nil {
+			logOncef(levelWarn, "Cannot serve the agents of user %d: %v", uid, err)
+		}
+	}
+}
+
+// runSystem implements the system subcommand, which runs as root and serves a socket in
+// -usersDir for every user with forwarded agents so that shared servers need a single daemon
+// instead of one per user.  Every socket belongs to its user and only proxies that user's
+// clients to that user's agents, with the same checks and filters as the socket of the daemon.
+func runSystem(args []string) error {
+	fs := flag.NewFlagSet("system", flag.ExitOnError)
+	usersDir := fs.String("usersDir", defaultUsersDir, "directory in which to create the socket of every user, named after the user")
+	minUid := fs.Int("minUid", 1000, "lowest user ID to serve")
+	scanInterval := fs.Duration("scanInterval", 10*time.Second, "how often to look for users with new sessions")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("usage: system [-usersDir DIR] [-minUid UID] [-scanInterval DURATION]")
+	}
+	if *scanInterval <= 0 {
+		return fmt.Errorf("invalid -scanInterval %v", *scanInterval)
+	}
+	if os.Geteuid() != 0 {
+		return errors.New("system must run as root")
+	}
+	if *upstreamSwitcher != "" {
+		// The hops of the clients would be chained to the same instance for all users.
+		return errors.New("-upstreamSwitcher cannot be used with system")
+	}
+
+	if err := os.MkdirAll(*usersDir, 0755); err != nil {
+		return err
+	}
+	if err := os.Chmod(*usersDir, 0755); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	d := &systemDaemon{usersDir: *usersDir, minUid: *minUid, ctx: ctx, sockets: make(map[int]string)}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	infof("Serving the agents of every user in %s", *usersDir)
+	ticker := time.NewTicker(*scanInterval)
+	defer ticker.Stop()
+	for {
+		d.scan()
+		select {
+		case <-ticker.C:
+		case <-signals:
+			infof("Shutting down and deleting the sockets in %s", *usersDir)
+			for _, path := range d.sockets {
+				os.Remove(path)
+			}
+			return nil
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// tlsHandshakeTimeout is how long remote clients have to complete the TLS handshake.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// loadTLSConfig builds the configuration of the -tlsAddress listener, which presents the
+// certificate in "certFile" with the private key in "keyFile" and only accepts clients that
+// present a certificate signed by one of the authorities in "clientCAFile".
+func loadTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" || clientCAFile == "" {
+		return nil, errors.New("-tlsAddress requires -tlsCert, -tlsKey, and -tlsClientCA")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load TLS certificate: %v", err)
+	}
+
+	pem, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load client CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("cannot load client CA: no certificates in %s", clientCAFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// tlsClientName returns the name with which the client of "conn", which completed the
+// handshake, identifies itself: the common name of its certificate, or its first DNS name if
+// it has no common name.
+func tlsClientName(conn *tls.Conn) string {
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	if name := certs[0].Subject.CommonName; name != "" {
+		return name
+	}
+	if len(certs[0].DNSNames) > 0 {
+		return certs[0].DNSNames[0]
+	}
+	return ""
+}
+
+// tlsClientAllowed returns true if "name" matches any of the glob patterns in "allowed", or
+// if there are no patterns.
+func tlsClientAllowed(name string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, pattern := range allowed {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptTLSClient completes the handshake with the remote client "conn" and checks whether the
+// client is allowed to use the proxy.
+func acceptTLSClient(conn *tls.Conn, allowed []string) error {
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		infof("Rejecting TLS connection from %s: %v", conn.RemoteAddr(), err)
+		metricConnectionsRejected.inc()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+
+	name := tlsClientName(conn)
+	if !tlsClientAllowed(name, allowed) {
+		infof("Rejecting TLS connection from %s: client %q is not allowed by -tlsAllowClient", conn.RemoteAddr(), name)
+		metricConnectionsRejected.inc()
+		return fmt.Errorf("client %q is not allowed by -tlsAllowClient", name)
+	}
+	infof("Accepted TLS client %q from %s", name, conn.RemoteAddr())
+	return nil
+}
+
+// serveTLS accepts remote clients on "listener", which must be a TLS listener, until it fails.
+func serveTLS(listener net.Listener, allowed []string) {
+	cfg := sessionConfig(socketPolicy{})
+	cfg.Authorize = func(conn net.Conn) error {
+		return acceptTLSClient(conn.(*tls.Conn), allowed)
+	}
+	err := serveClients(context.Background(), listener, cfg)
+	errorf("Cannot accept TLS connections: %v", err)
+}
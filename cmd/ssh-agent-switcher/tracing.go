@@ -0,0 +1,184 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+// This file implements a minimal OpenTelemetry tracer.  otlp.go exports its spans using the
+// JSON encoding of OTLP over HTTP.  See https://opentelemetry.io/docs/specs/otlp/ for details.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+	"time"
+)
+
+// Kinds of spans as defined by OTLP.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// spanStatusError is the OTLP status code for spans that describe failed operations.
+const spanStatusError = 2
+
+// span describes a timed operation within a trace.
+//
+// All methods can be called on a nil span, which does nothing.  This is what the tracer hands
+// out when tracing is disabled.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	kind     int
+	name     string
+	start    time.Time
+	attrs    map[string]string
+	err      error
+	ended    bool
+}
+
+// tracer creates spans and exports them in the background once they finish.
+type tracer struct {
+	// url is the OTLP/HTTP endpoint that receives the spans.
+	url string
+
+	// spans queues the finished spans that have yet to be exported.
+	spans chan otlpSpan
+}
+
+// tracing is the tracer for the whole daemon, or nil if tracing is disabled.
+var tracing *tracer
+
+// start begins a new span called "name" as a child of "parent", or as the root of a new trace
+// if "parent" is nil.
+func (t *tracer) start(name string, parent *span) *span {
+	if t == nil {
+		return nil
+	}
+
+	s := &span{tracer: t, kind: spanKindInternal, name: name, start: time.Now()}
+	if parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+		s.kind = spanKindServer
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// child begins a new span called "name" as a child of "s".
+func (s *span) child(name string) *span {
+	if s == nil {
+		return nil
+	}
+	return s.tracer.start(name, s)
+}
+
+// set attaches the attribute "key" with "value" to the span.
+func (s *span) set(key string, value string) {
+	if s == nil {
+		return
+	}
+	if s.attrs == nil {
+		s.attrs = make(map[string]string)
+	}
+	s.attrs[key] = value
+}
+
+// fail marks the span as describing an operation that failed due to "err".
+func (s *span) fail(err error) {
+	if s == nil {
+		return
+	}
+	s.err = err
+}
+
+// end finishes the span and queues it for export.  Calling end more than once has no effect
+// so that an early end can be paired with a deferred one.
+func (s *span) end() {
+	if s == nil || s.ended {
+		return
+	}
+	s.ended = true
+
+	exported := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		exported.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for key, value := range s.attrs {
+		exported.Attributes = append(exported.Attributes, otlpAttribute{
+			Key:   key,
+			Value: otlpValue{StringValue: value},
+		})
+	}
+	if s.err != nil {
+		exported.Status = &otlpStatus{Code: spanStatusError, Message: s.err.Error()}
+	}
+
+	select {
+	case s.tracer.spans <- exported:
+	default:
+		debugf("Dropping span %s: trace queue is full", s.name)
+	}
+}
+
+// otlpSpan is a finished span in the OTLP JSON encoding.
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+// otlpAttribute is a key/value pair attached to a resource or a span.
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue is the value of an attribute.  We only produce string values.
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// otlpStatus describes the outcome of a span.
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
@@ -0,0 +1,265 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+	"github.com/jmmv/ssh-agent-switcher/proxy"
+	"github.com/jmmv/ssh-agent-switcher/selection"
+)
+
+// hopExtension is the agent extension that an ssh-agent-switcher instance sends to its
+// -upstreamSwitcher right after opening it to tell it which instances the connection already
+// went through, so that chains that loop back are detected instead of opening connections
+// forever.
+//
+// The request carries a string with the identifiers of those instances, one per line and the
+// nearest to the client first.  The reply is SSH_AGENT_SUCCESS if the upstream instance accepts
+// the connection and SSH_AGENT_FAILURE otherwise.
+const hopExtension = "hop@ssh-agent-switcher"
+
+// maxHops is the maximum number of instances that a connection can go through before reaching
+// a real agent.
+const maxHops = 8
+
+// hopTimeout is how long the upstream instance has to answer the hop request.
+const hopTimeout = 5 * time.Second
+
+// upstreamReason is the origin of the -upstreamSwitcher candidate returned by preferredAgents.
+const upstreamReason = "named by -upstreamSwitcher"
+
+// instanceID identifies this instance in the chains of ssh-agent-switcher instances.  It
+// includes the host name and the pid so that the hops reported to clients are recognizable.
+var instanceID = newInstanceID()
+
+// newInstanceID generates an identifier for this instance that is unique across hosts and
+// containers even if they share the host name and the pid.
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "unknown"
+	}
+	var suffix [4]byte
+	rand.Read(suffix[:])
+	return fmt.Sprintf("%s:%d:%s", host, os.Getpid(), hex.EncodeToString(suffix[:]))
+}
+
+// isHopRequest checks whether the client request "msg", which includes the length prefix,
+// carries the instances that the connection went through.
+func isHopRequest(msg []byte) bool {
+	return codec.ExtensionName(msg) == hopExtension
+}
+
+// acceptHop parses the hop request "msg", which includes the length prefix, and returns the
+// instances that the connection went through, or an error if we should not serve it because it
+// already went through us or through too many instances.
+func acceptHop(msg []byte) ([]string, error) {
+	r := codec.NewReader(msg[5:])
+	if _, err := r.ReadString(); err != nil {
+		return nil, fmt.Errorf("invalid %s request: %v", hopExtension, err)
+	}
+	data, err := r.ReadString()
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s request: %v", hopExtension, err)
+	}
+
+	var chain []string
+	for _, id := range strings.Split(string(data), "\n") {
+		if id == "" {
+			continue
+		}
+		if id == instanceID {
+			return nil, fmt.Errorf("loop detected: connection already went through this instance via %s", strings.Join(chain, ", "))
+		}
+		chain = append(chain, id)
+	}
+	if len(chain) >= maxHops {
+		return nil, fmt.Errorf("connection went through %d instances; the limit is %d", len(chain), maxHops)
+	}
+	return chain, nil
+}
+
+// replyHop returns the reply to the hop request "msg", which includes the length prefix, for
+// instances that do not chain to an upstream instance themselves.  Such instances cannot cause
+// a loop but still enforce the limit on the number of hops.
+func replyHop(msg []byte, logger *connLogger) []byte {
+	if _, err := acceptHop(msg); err != nil {
+		logger.warnf("Refusing chained connection: %v", err)
+		return []byte{codec.AgentFailure}
+	}
+	return []byte{codec.AgentSuccess}
+}
+
+// replayConn is a connection that returns "pending" before reading from the wrapped connection,
+// which lets us look at the first request of a client before proxying it.
+type replayConn struct {
+	net.Conn
+	pending []byte
+}
+
+// Read returns the pending data first and then reads from the wrapped connection.
+func (c *replayConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// readHops looks at the first requests of "client" for the instances that the connection went
+// through, which downstream instances send before anything else, answering the identification
+// requests that come before it.  Returns the connection to keep serving the client with, which
+// replays the first other request, and the instances, if any.
+//
+// This must happen before selecting an agent when chaining to an -upstreamSwitcher because the
+// selection opens a connection to the upstream instance, which would be a loop if the client is
+// that instance.
+func readHops(client net.Conn, logger *connLogger) (net.Conn, []string, error) {
+	for {
+		msg, err := readAgentFrame(client, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch {
+		case proxy.IsIdentifyRequest(msg):
+			if err := codec.WriteMessage(client, []byte{codec.AgentSuccess}); err != nil {
+				return nil, nil, fmt.Errorf("write to client failed: %v", err)
+			}
+
+		case isHopRequest(msg):
+			chain, err := acceptHop(msg)
+			if err != nil {
+				codec.WriteMessage(client, []byte{codec.AgentFailure})
+				return nil, nil, err
+			}
+			if err := codec.WriteMessage(client, []byte{codec.AgentSuccess}); err != nil {
+				return nil, nil, fmt.Errorf("write to client failed: %v", err)
+			}
+			logger.debugf("Client connection went through %s", strings.Join(chain, ", "))
+			return client, chain, nil
+
+		default:
+			return &replayConn{client, msg}, nil, nil
+		}
+	}
+}
+
+// errNotSwitcher indicates that the -upstreamSwitcher is not an ssh-agent-switcher instance.
+var errNotSwitcher = errors.New("not an ssh-agent-switcher instance")
+
+// chainTo tells the upstream instance at the other end of "conn" that the connection went
+// through the instances in "chain" and then through us, and returns an error if the upstream
+// instance refuses to serve it.
+func chainTo(conn net.Conn, chain []string) error {
+	switcher, err := proxy.Identify(conn, selection.DefaultIdentifyTimeout)
+	if err != nil {
+		return err
+	}
+	if !switcher {
+		return errNotSwitcher
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(hopTimeout)); err != nil {
+		return err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	hops := strings.Join(append(append([]string{}, chain...), instanceID), "\n")
+	request := codec.AppendString([]byte{codec.AgentcExtension}, []byte(hopExtension))
+	request = codec.AppendString(request, []byte(hops))
+	if err := codec.WriteMessage(conn, request); err != nil {
+		return fmt.Errorf("cannot send hops: %v", err)
+	}
+	reply, err := readAgentMessage(conn)
+	if err != nil {
+		return fmt.Errorf("cannot send hops: %v", err)
+	}
+	if reply[0] != codec.AgentSuccess {
+		return errors.New("refused the connection; its log says why, usually because it chains back to us")
+	}
+	return nil
+}
+
+// chainUpstream tells the -upstreamSwitcher that the connection went through the instances in
+// "chain" if "agent", selected per "decision", is that instance.  Returns an error after
+// closing "agent" if the upstream instance refuses the connection, in which case another agent
+// has to be selected.
+func chainUpstream(agent net.Conn, decision *selection.Decision, chain []string) error {
+	if *upstreamSwitcher == "" || decision.Winner != *upstreamSwitcher {
+		return nil
+	}
+	if err := chainTo(agent, chain); err != nil {
+		agent.Close()
+		return err
+	}
+	decision.Switcher = true
+	return nil
+}
+
+// upstreamHops asks the upstream instance at the other end of "conn" for its status and returns
+// the "hop:" lines that describe the chain from that instance onwards: one line with the
+// identifier of every instance and the socket that it selected, the nearest first.
+func upstreamHops(conn net.Conn) ([]string, error) {
+	if err := conn.SetDeadline(time.Now().Add(hopTimeout)); err != nil {
+		return nil, err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	status, err := queryStatus(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var instance, upstream string
+	var rest []string
+	for _, line := range strings.Split(status, "\n") {
+		key, value, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "instance":
+			instance = value
+		case "upstream":
+			upstream = value
+		case "hop":
+			rest = append(rest, value)
+		}
+	}
+	if instance == "" {
+		return nil, errors.New("upstream instance did not report its identifier")
+	}
+	return append([]string{instance + " " + upstream}, rest...), nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+)
+
+// agentRSASHA256 is the SSH_AGENT_RSA_SHA2_256 flag of sign requests, which asks for an
+// rsa-sha2-256 signature instead of a deprecated ssh-rsa one.
+const agentRSASHA256 = 2
+
+// errKeyNotFound indicates that the selected agent does not hold the key to verify.
+var errKeyNotFound = errors.New("key not found")
+
+// verifyResult is the outcome of the verify subcommand, as printed by -json.
+type verifyResult struct {
+	Fingerprint string `json:"fingerprint"`
+	Found       bool   `json:"found"`
+	Type        string `json:"type,omitempty"`
+	Comment     string `json:"comment,omitempty"`
+	Upstream    string `json:"upstream,omitempty"`
+	Signed      *bool  `json:"signed,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// upstreamOf returns the agent that the ssh-agent-switcher instance at the other end of
+// "conn" selected for it, or an empty string if it cannot tell, such as when "conn" goes to a
+// plain agent.
+func upstreamOf(conn net.Conn) string {
+	status, err := queryStatus(conn)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(status, "\n") {
+		if upstream, ok := strings.CutPrefix(line, "upstream: "); ok && upstream != "none" {
+			return upstream
+		}
+	}
+	return ""
+}
+
+// testSign asks the agent connected via "conn" to sign random data with the key "id".
+func testSign(conn net.Conn, id codec.Identity) error {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return err
+	}
+	request := codec.SignRequest{KeyBlob: id.Blob, Data: data}
+	if id.KeyType() == "ssh-rsa" {
+		request.Flags = agentRSASHA256
+	}
+	if err := codec.WriteMessage(conn, codec.EncodeSignRequest(request)); err != nil {
+		return err
+	}
+	reply, err := readAgentMessage(conn)
+	if err != nil {
+		return err
+	}
+	switch reply[0] {
+	case codec.AgentSignResponse:
+		return nil
+	case codec.AgentFailure:
+		return errors.New("the agent refused to sign")
+	default:
+		return fmt.Errorf("%w: unexpected reply type %d to sign request", codec.ErrProtocol, reply[0])
+	}
+}
+
+// verifyKey checks that the agent at the other end of "conn" holds the key "fingerprint" and,
+// if "sign" is true, that it can sign with it.  The outcome is recorded in "result".
+func verifyKey(conn net.Conn, fingerprint string, sign bool, result *verifyResult) error {
+	result.Upstream = upstreamOf(conn)
+
+	ids, err := requestIdentities(conn)
+	if err != nil {
+		return fmt.Errorf("cannot list the keys: %w", err)
+	}
+	var key *codec.Identity
+	for i := range ids {
+		if ids[i].Fingerprint() == fingerprint {
+			key = &ids[i]
+			break
+		}
+	}
+	if key == nil {
+		return fmt.Errorf("%w: %s is not held by the selected agent", errKeyNotFound, fingerprint)
+	}
+	result.Found = true
+	result.Type = key.KeyType()
+	result.Comment = key.Comment
+
+	if sign {
+		err := testSign(conn, *key)
+		signed := err == nil
+		result.Signed = &signed
+		if err != nil {
+			return fmt.Errorf("test signature with %s failed: %w", fingerprint, err)
+		}
+	}
+	return nil
+}
+
+// runVerify implements the verify subcommand, which checks that a key is reachable through the
+// running daemon so that scripts can fail early if it is not.
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	socket := fs.String("socket", os.Getenv("SSH_AUTH_SOCK"), "path to the socket of the ssh-agent-switcher instance through which to reach the key")
+	sign := fs.Bool("sign", false, "also check that the key can sign some random data")
+	jsonOutput := fs.Bool("json", false, "print the outcome as a JSON object")
+	fs.Parse(args)
+	if fs.NArg() != 1 || !strings.HasPrefix(fs.Arg(0), "SHA256:") {
+		return errors.New("usage: verify [-json] [-sign] [-socket PATH] SHA256:FINGERPRINT")
+	}
+	if *socket == "" {
+		return errors.New("cannot determine the socket to use; use -socket")
+	}
+	result := verifyResult{Fingerprint: fs.Arg(0)}
+
+	conn, err := net.Dial("unix", *socket)
+	if err == nil {
+		err = verifyKey(conn, result.Fingerprint, *sign, &result)
+		conn.Close()
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	if *jsonOutput {
+		if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+			return err
+		}
+	} else if err == nil {
+		fmt.Fprintf(os.Stdout, "%s %s %s is reachable", result.Fingerprint, result.Type, result.Comment)
+		if result.Upstream != "" {
+			fmt.Fprintf(os.Stdout, " through %s", result.Upstream)
+		}
+		if result.Signed != nil {
+			fmt.Fprintf(os.Stdout, " and signs")
+		}
+		fmt.Fprintln(os.Stdout)
+	}
+	return err
+}
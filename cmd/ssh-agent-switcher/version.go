@@ -0,0 +1,116 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information that release builds set at link time with flags such as -ldflags
+// "-X main.version=1.2.0 -X main.commit=0123abc -X main.buildDate=2026-01-31T12:00:00Z".
+// Empty values are taken from the information that the Go toolchain embeds, if any.
+var (
+	version   = ""
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo describes the build of this binary.
+type buildInfo struct {
+	version    string
+	commit     string
+	commitTime string
+	modified   bool
+	buildDate  string
+	goVersion  string
+}
+
+// currentBuildInfo returns the build information set at link time, completed with the
+// information embedded by the Go toolchain.
+func currentBuildInfo() buildInfo {
+	info := buildInfo{
+		version:   version,
+		commit:    commit,
+		buildDate: buildDate,
+		goVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.version == "" && bi.Main.Version != "(devel)" {
+			info.version = bi.Main.Version
+		}
+		for _, setting := range bi.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.commit == "" {
+					info.commit = setting.Value
+				}
+			case "vcs.time":
+				info.commitTime = setting.Value
+			case "vcs.modified":
+				info.modified = setting.Value == "true"
+			}
+		}
+	}
+	if info.version == "" {
+		info.version = "unknown"
+	}
+	return info
+}
+
+// printVersion writes the build information to "w" in a format suitable for bug reports.
+func printVersion(w io.Writer) {
+	info := currentBuildInfo()
+	fmt.Fprintf(w, "ssh-agent-switcher %s\n", info.version)
+	if info.commit != "" {
+		line := "commit: " + info.commit
+		if info.commitTime != "" {
+			line += " from " + info.commitTime
+		}
+		if info.modified {
+			line += " with local modifications"
+		}
+		fmt.Fprintln(w, line)
+	}
+	if info.buildDate != "" {
+		fmt.Fprintf(w, "built: %s\n", info.buildDate)
+	}
+	fmt.Fprintf(w, "go: %s %s/%s\n", info.goVersion, runtime.GOOS, runtime.GOARCH)
+}
+
+// runVersion implements the version subcommand.
+func runVersion(args []string) error {
+	fs := flag.NewFlagSet("version", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		return errors.New("version takes no arguments")
+	}
+	printVersion(os.Stdout)
+	return nil
+}
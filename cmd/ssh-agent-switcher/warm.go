@@ -0,0 +1,154 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package main
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/discovery"
+	"github.com/jmmv/ssh-agent-switcher/selection"
+)
+
+// selectionInputs captures the state that agent selection depends on and that is cheap to
+// inspect, so that a previous selection can be reused for as long as it does not change.
+type selectionInputs struct {
+	// dirTime is the modification time of the agents directory, which changes whenever a
+	// session directory comes or goes.
+	dirTime time.Time
+
+	// pinTime is the modification time of the pin file, or zero if there is none.
+	pinTime time.Time
+
+	// locked lists the locked agents.
+	locked string
+
+	// profile is the name of the active profile, which may rank agents differently.
+	profile string
+}
+
+// currentSelectionInputs captures the inputs of the selection of agents under "dir" given
+// the pin file "pinFile".
+func currentSelectionInputs(dir string, pinFile string) selectionInputs {
+	var inputs selectionInputs
+	if info, err := os.Stat(dir); err == nil {
+		inputs.dirTime = info.ModTime()
+	}
+	if info, err := os.Stat(pinFile); err == nil {
+		inputs.pinTime = info.ModTime()
+	}
+	inputs.locked = strings.Join(lockedAgents.list(), "\n")
+	inputs.profile = currentSettings().profile
+	return inputs
+}
+
+// warmSelection keeps the last agent selection so that client connections can reuse it with a
+// single connect instead of scanning for agents again.
+type warmSelection struct {
+	// mu protects all the fields below.
+	mu sync.Mutex
+
+	// inputs are the inputs of the selection when it was made.
+	inputs selectionInputs
+
+	// decision is the last successful selection, or the zero value if there is none.
+	decision selection.Decision
+}
+
+// warmAgent keeps the agent selected in the background for -warmInterval, or is nil if not
+// enabled.
+var warmAgent *warmSelection
+
+// store records the outcome of a selection made for "inputs".  Failed selections forget the
+// previous one.
+//
+// A nil selection records nothing.
+func (w *warmSelection) store(inputs selectionInputs, decision selection.Decision) {
+	if w == nil {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if decision.Err != nil || decision.Winner == "" {
+		decision = selection.Decision{}
+	}
+	w.inputs = inputs
+	w.decision = decision
+}
+
+// dial opens the agent of the last selection if its inputs are still "inputs".  Returns false
+// if there is no usable selection, in which case the caller must select an agent from scratch.
+//
+// A nil selection is never usable.
+func (w *warmSelection) dial(inputs selectionInputs) (net.Conn, selection.Decision, bool) {
+	if w == nil {
+		return nil, selection.Decision{}, false
+	}
+	w.mu.Lock()
+	decision, ok := w.decision, w.decision.Winner != "" && w.inputs == inputs
+	w.mu.Unlock()
+	if !ok {
+		return nil, selection.Decision{}, false
+	}
+
+	conn, err := discovery.Dial(decision.Winner, ownSockets)
+	if err != nil {
+		debugf("Cannot reuse the agent at %s selected in the background: %v", decision.Winner, err)
+		w.store(inputs, selection.Decision{})
+		return nil, selection.Decision{}, false
+	}
+	decision.Candidates = []string{decision.Winner}
+	decision.Rejected = nil
+	decision.Time = time.Now()
+	return conn, decision, true
+}
+
+// keep selects an agent under "dir" every "interval" so that client connections do not have to.
+func (w *warmSelection) keep(dir string, pinFile string, interval time.Duration) {
+	for {
+		inputs := currentSelectionInputs(dir, pinFile)
+		discoverer := newDiscoverer(dir, preferredAgents(pinFile))
+		conn, decision, err := selection.Find(discoverer, newSelector())
+		if err == nil {
+			conn.Close()
+		}
+
+		w.mu.Lock()
+		changed := w.decision.Winner != decision.Winner
+		w.mu.Unlock()
+		if changed {
+			if err != nil {
+				debugf("No agent to keep warm: %v", err)
+			} else {
+				debugf("Keeping the agent at %s warm", decision.Winner)
+			}
+		}
+		w.store(inputs, decision)
+
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build nowebhooks || minimal
+
+package main
+
+import (
+	"errors"
+)
+
+// errNoWebhooks indicates that the binary was built without support for webhooks.
+var errNoWebhooks = errors.New("built without webhook support")
+
+// checkWebhookURL fails because webhook support was left out of the build.
+func checkWebhookURL(endpoint string) error {
+	return errNoWebhooks
+}
+
+// webhookAuditSink is never instantiated because webhook support was left out of the build.
+type webhookAuditSink struct{}
+
+// newWebhookAuditSink fails because webhook support was left out of the build.
+func newWebhookAuditSink(endpoint string) (*webhookAuditSink, error) {
+	return nil, errNoWebhooks
+}
+
+// record does nothing.
+func (s *webhookAuditSink) record(event auditEvent) {}
+
+// postEvent fails because webhook support was left out of the build.
+func postEvent(webhook string, body []byte) error {
+	return errNoWebhooks
+}
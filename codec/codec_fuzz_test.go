@@ -0,0 +1,126 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// These are native Go fuzz targets for the parsers in this package.  "go test" runs them with
+// their seed corpora only; to fuzz one of them, run:
+//
+//	go test ./codec -run '^$' -fuzz FuzzRequestReader
+
+// signRequestBody builds the body of an SSH_AGENTC_SIGN_REQUEST message, excluding the message
+// type, that asks the key "blob" to sign "data" with "flags".
+func signRequestBody(blob []byte, data []byte, flags uint32) []byte {
+	body := AppendString(nil, blob)
+	body = AppendString(body, data)
+	return binary.BigEndian.AppendUint32(body, flags)
+}
+
+// testKeyBlob is the public key blob of an Ed25519 key, which is all the parsers care about.
+var testKeyBlob = AppendString(AppendString(nil, []byte("ssh-ed25519")), bytes.Repeat([]byte{7}, 32))
+
+func FuzzRequestReader(f *testing.F) {
+	identities := Frame([]byte{AgentcRequestIdentities})
+	sign := Frame(append([]byte{AgentcSignRequest}, signRequestBody(testKeyBlob, []byte("data"), 0)...))
+	f.Add(identities)
+	f.Add(append(append([]byte{}, identities...), sign...))
+	f.Add(sign[:7])
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add([]byte{0, 0, 4, 1, AgentcRequestIdentities})
+	f.Add(Frame([]byte{AgentSuccess}))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		requests := NewRequestReader(bytes.NewReader(data), 1024)
+		for {
+			frame, err := requests.Next()
+			if err != nil {
+				return
+			}
+			if length := binary.BigEndian.Uint32(frame); int(length) != len(frame)-4 || length > 1024 {
+				t.Fatalf("Frame of %d bytes has length prefix %d", len(frame), length)
+			}
+			if !IsRequest(frame[4]) {
+				t.Fatalf("Returned message %d is not a request", frame[4])
+			}
+			Describe(frame[4:])
+			ExtensionName(frame)
+			ParseSignRequest(frame)
+		}
+	})
+}
+
+func FuzzIdentitiesAnswer(f *testing.F) {
+	f.Add(EncodeIdentitiesAnswer(nil)[1:])
+	f.Add(EncodeIdentitiesAnswer([]Identity{{Blob: testKeyBlob, Comment: "user@host"}})[1:])
+	f.Add(EncodeIdentitiesAnswer([]Identity{{Blob: testKeyBlob}, {Blob: []byte("garbage"), Comment: "other"}})[1:])
+	f.Add([]byte{0, 0, 0, 1})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ids, err := ParseIdentitiesAnswer(data)
+		if err != nil {
+			return
+		}
+
+		encoded := EncodeIdentitiesAnswer(ids)
+		again, err := ParseIdentitiesAnswer(encoded[1:])
+		if err != nil {
+			t.Fatalf("Cannot parse encoded identities: %v", err)
+		}
+		if len(again) != len(ids) {
+			t.Fatalf("Got %d identities after encoding %d", len(again), len(ids))
+		}
+		for i := range ids {
+			if !bytes.Equal(ids[i].Blob, again[i].Blob) || ids[i].Comment != again[i].Comment {
+				t.Fatalf("Identity %d changed after encoding", i)
+			}
+			ids[i].KeyType()
+			ids[i].Fingerprint()
+		}
+	})
+}
+
+func FuzzSignRequest(f *testing.F) {
+	f.Add(signRequestBody(testKeyBlob, []byte("data"), 0))
+	f.Add(signRequestBody(testKeyBlob, nil, 4))
+	f.Add(signRequestBody(AppendString(nil, []byte("sk-ssh-ed25519@openssh.com")), []byte("data"), 0))
+	f.Add(signRequestBody(nil, nil, 0)[:6])
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg := Frame(append([]byte{AgentcSignRequest}, data...))
+		request, err := ParseSignRequest(msg)
+		if err != nil {
+			return
+		}
+		if len(request.KeyBlob)+len(request.Data)+8+4 > len(data) {
+			t.Fatalf("Sign request fields of %d and %d bytes do not fit in a message of %d bytes", len(request.KeyBlob), len(request.Data), len(data))
+		}
+		IsSecurityKey(request.KeyBlob)
+	})
+}
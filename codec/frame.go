@@ -0,0 +1,92 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package codec parses and serializes the messages of the SSH agent protocol.  See
+// draft-miller-ssh-agent for details on the format.
+//
+// All the protocol parsing done by ssh-agent-switcher goes through this package so that the
+// security-critical code that handles untrusted input lives in one place and can be fuzzed:
+// see codec_fuzz_test.go.
+//
+// Both clients and agents can split messages across multiple writes and clients can pipeline
+// requests, so the functions in this package always reassemble complete messages from the
+// byte streams instead of assuming that one read returns one message.
+package codec
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// DefaultMaxMessageSize is the default limit on the size of the messages, excluding the length
+// prefix, that we are willing to handle in either direction.  This matches the limit used by
+// OpenSSH.
+const DefaultMaxMessageSize = 256 * 1024
+
+// ReadFrame reads a single length-prefixed message from "r" and returns it, including the
+// length prefix.  The message is stored in "buf" if it fits.  Messages larger than "maxSize"
+// are rejected before reading their contents.
+func ReadFrame(r io.Reader, buf []byte, maxSize uint32) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:])
+	if length == 0 {
+		return nil, newProtocolError("empty agent message")
+	}
+	if length > maxSize {
+		return nil, newProtocolError("agent message too large (%d bytes)", length)
+	}
+
+	frame := buf
+	if int(length)+4 > len(buf) {
+		frame = make([]byte, int(length)+4)
+	}
+	frame = frame[:int(length)+4]
+	copy(frame, header[:])
+	if _, err := io.ReadFull(r, frame[4:]); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+// WriteMessage writes "msg", which must include the message type in the first byte, to "w"
+// with its length prefix.
+func WriteMessage(w io.Writer, msg []byte) error {
+	_, err := w.Write(Frame(msg))
+	return err
+}
+
+// Frame returns "msg", which must include the message type in the first byte, with its length
+// prefix.
+func Frame(msg []byte) []byte {
+	return append(binary.BigEndian.AppendUint32(nil, uint32(len(msg))), msg...)
+}
+
+// AppendString appends "s" to "buf" as a length-prefixed string.
+func AppendString(buf []byte, s []byte) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s)))
+	return append(buf, s...)
+}
@@ -0,0 +1,126 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package codec
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"strings"
+)
+
+// Identity represents a key held by an agent.
+type Identity struct {
+	// Blob is the public key in the SSH wire format.
+	Blob []byte
+
+	// Comment is the comment that the agent reports for the key.
+	Comment string
+}
+
+// KeyType returns the algorithm name embedded in the key blob.
+func (id Identity) KeyType() string {
+	return KeyType(id.Blob)
+}
+
+// Fingerprint returns the SHA256 fingerprint of the key in the same format used by OpenSSH.
+func (id Identity) Fingerprint() string {
+	return Fingerprint(id.Blob)
+}
+
+// KeyType returns the algorithm name embedded in the key "blob", or "unknown" if malformed.
+func KeyType(blob []byte) string {
+	name, err := NewReader(blob).ReadString()
+	if err != nil {
+		return "unknown"
+	}
+	return string(name)
+}
+
+// IsSecurityKey returns true if the key "blob" lives in a FIDO security key, which cannot sign
+// until the user touches it.
+func IsSecurityKey(blob []byte) bool {
+	return strings.HasPrefix(KeyType(blob), "sk-")
+}
+
+// Fingerprint returns the SHA256 fingerprint of the key "blob" in the same format used by
+// OpenSSH.
+func Fingerprint(blob []byte) string {
+	sum := sha256.Sum256(blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// ParseIdentitiesAnswer decodes the body of an SSH_AGENT_IDENTITIES_ANSWER message, excluding
+// the message type.
+func ParseIdentitiesAnswer(body []byte) ([]Identity, error) {
+	r := NewReader(body)
+	n, err := r.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []Identity
+	for i := uint32(0); i < n; i++ {
+		blob, err := r.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		comment, err := r.ReadString()
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, Identity{Blob: blob, Comment: string(comment)})
+	}
+	return ids, nil
+}
+
+// EncodeIdentitiesAnswer builds an SSH_AGENT_IDENTITIES_ANSWER message, including the message
+// type, that lists "ids".
+func EncodeIdentitiesAnswer(ids []Identity) []byte {
+	msg := []byte{AgentIdentitiesAnswer}
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(ids)))
+	for _, id := range ids {
+		msg = AppendString(msg, id.Blob)
+		msg = AppendString(msg, []byte(id.Comment))
+	}
+	return msg
+}
+
+// RequestIdentities asks the agent connected via "rw" for the list of keys it holds, rejecting
+// replies larger than "maxSize".
+func RequestIdentities(rw io.ReadWriter, maxSize uint32) ([]Identity, error) {
+	if err := WriteMessage(rw, []byte{AgentcRequestIdentities}); err != nil {
+		return nil, err
+	}
+
+	reply, err := ReadFrame(rw, nil, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	if reply[4] != AgentIdentitiesAnswer {
+		return nil, newProtocolError("unexpected reply type %d to identities request", reply[4])
+	}
+	return ParseIdentitiesAnswer(reply[5:])
+}
@@ -0,0 +1,162 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package codec
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Message numbers defined by the SSH agent protocol.
+const (
+	AgentFailure                     = 5
+	AgentSuccess                     = 6
+	AgentcRequestIdentities          = 11
+	AgentIdentitiesAnswer            = 12
+	AgentcSignRequest                = 13
+	AgentSignResponse                = 14
+	AgentcAddIdentity                = 17
+	AgentcRemoveIdentity             = 18
+	AgentcRemoveAllIdentities        = 19
+	AgentcAddSmartcardKey            = 20
+	AgentcRemoveSmartcardKey         = 21
+	AgentcLock                       = 22
+	AgentcUnlock                     = 23
+	AgentcAddIDConstrained           = 25
+	AgentcAddSmartcardKeyConstrained = 26
+	AgentcExtension                  = 27
+	AgentExtensionFailure            = 28
+	AgentExtensionResponse           = 29
+)
+
+// Message numbers of the SSH protocol 1 agent requests that modify the agent.  Their keys are
+// long gone, but OpenSSH's agent still honors SSH_AGENTC_REMOVE_ALL_RSA_IDENTITIES by removing
+// all keys, and ssh-add -D sends it after SSH_AGENTC_REMOVE_ALL_IDENTITIES.
+const (
+	AgentcAddRSAIdentity         = 7
+	AgentcRemoveRSAIdentity      = 8
+	AgentcRemoveAllRSAIdentities = 9
+	AgentcAddRSAIDConstrained    = 24
+)
+
+// Key constraint identifiers defined by the SSH agent protocol.
+const (
+	ConstrainLifetime  = 1
+	ConstrainConfirm   = 2
+	ConstrainMaxsign   = 3
+	ConstrainExtension = 255
+)
+
+// messageNames maps message numbers to their names as given in the protocol specification.
+var messageNames = map[byte]string{
+	AgentFailure:                     "SSH_AGENT_FAILURE",
+	AgentSuccess:                     "SSH_AGENT_SUCCESS",
+	AgentcAddRSAIdentity:             "SSH_AGENTC_ADD_RSA_IDENTITY",
+	AgentcRemoveRSAIdentity:          "SSH_AGENTC_REMOVE_RSA_IDENTITY",
+	AgentcRemoveAllRSAIdentities:     "SSH_AGENTC_REMOVE_ALL_RSA_IDENTITIES",
+	AgentcRequestIdentities:          "SSH_AGENTC_REQUEST_IDENTITIES",
+	AgentIdentitiesAnswer:            "SSH_AGENT_IDENTITIES_ANSWER",
+	AgentcSignRequest:                "SSH_AGENTC_SIGN_REQUEST",
+	AgentSignResponse:                "SSH_AGENT_SIGN_RESPONSE",
+	AgentcAddIdentity:                "SSH_AGENTC_ADD_IDENTITY",
+	AgentcRemoveIdentity:             "SSH_AGENTC_REMOVE_IDENTITY",
+	AgentcRemoveAllIdentities:        "SSH_AGENTC_REMOVE_ALL_IDENTITIES",
+	AgentcAddSmartcardKey:            "SSH_AGENTC_ADD_SMARTCARD_KEY",
+	AgentcRemoveSmartcardKey:         "SSH_AGENTC_REMOVE_SMARTCARD_KEY",
+	AgentcLock:                       "SSH_AGENTC_LOCK",
+	AgentcUnlock:                     "SSH_AGENTC_UNLOCK",
+	AgentcAddRSAIDConstrained:        "SSH_AGENTC_ADD_RSA_ID_CONSTRAINED",
+	AgentcAddIDConstrained:           "SSH_AGENTC_ADD_ID_CONSTRAINED",
+	AgentcAddSmartcardKeyConstrained: "SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED",
+	AgentcExtension:                  "SSH_AGENTC_EXTENSION",
+	AgentExtensionFailure:            "SSH_AGENT_EXTENSION_FAILURE",
+	AgentExtensionResponse:           "SSH_AGENT_EXTENSION_RESPONSE",
+}
+
+// MessageName returns the name of the message number "msgType".
+func MessageName(msgType byte) string {
+	if name, ok := messageNames[msgType]; ok {
+		return name
+	}
+	return fmt.Sprintf("message %d", msgType)
+}
+
+// MessageType returns the number of the message called "name", which is matched against the
+// names in the protocol specification without regard to case and with the SSH_AGENT_ and
+// SSH_AGENTC_ prefixes being optional.  Returns false if there is no such message.
+func MessageType(name string) (byte, bool) {
+	upper := strings.ToUpper(name)
+	for msgType, fullName := range messageNames {
+		if upper == fullName || upper == strings.TrimPrefix(strings.TrimPrefix(fullName, "SSH_AGENTC_"), "SSH_AGENT_") {
+			return msgType, true
+		}
+	}
+	return 0, false
+}
+
+// Describe returns a human-readable description of the message "body", which excludes the
+// length prefix, for use in debug logs.  The description includes the details that help
+// diagnose incompatibilities between clients and agents, but never any secrets.
+func Describe(body []byte) string {
+	if len(body) == 0 {
+		return "empty message"
+	}
+	msgType := body[0]
+	r := NewReader(body[1:])
+
+	description := MessageName(msgType)
+	switch msgType {
+	case AgentcSignRequest, AgentcRemoveIdentity:
+		if blob, err := r.ReadString(); err == nil {
+			description += " with key " + Fingerprint(blob)
+		}
+	case AgentcAddIdentity, AgentcAddIDConstrained:
+		if keyType, err := r.ReadString(); err == nil {
+			description += fmt.Sprintf(" of type %q", keyType)
+		}
+	case AgentcExtension:
+		if name, err := r.ReadString(); err == nil {
+			description += fmt.Sprintf(" %q", name)
+		}
+	case AgentIdentitiesAnswer:
+		if n, err := r.ReadUint32(); err == nil {
+			description += fmt.Sprintf(" with %d keys", n)
+		}
+	}
+	return fmt.Sprintf("%s (%d bytes)", description, len(body))
+}
+
+// ExtensionName returns the name of the extension requested by the SSH_AGENTC_EXTENSION
+// message "msg", which includes the length prefix, or empty if malformed or if "msg" is not an
+// extension request.
+func ExtensionName(msg []byte) string {
+	if len(msg) < 5 || msg[4] != AgentcExtension {
+		return ""
+	}
+	name, err := NewReader(msg[5:]).ReadString()
+	if err != nil {
+		return ""
+	}
+	return string(name)
+}
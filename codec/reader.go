@@ -0,0 +1,86 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package codec
+
+import (
+	"encoding/binary"
+)
+
+// ErrTruncated indicates that an agent message is shorter than what its contents claim.
+var ErrTruncated = newProtocolError("truncated agent message")
+
+// Reader decodes the fields of an agent message in order.
+type Reader struct {
+	// buf holds the fields that have not been read yet.
+	buf []byte
+}
+
+// NewReader creates a reader for the fields in "buf", which the returned strings point into.
+func NewReader(buf []byte) *Reader {
+	return &Reader{buf: buf}
+}
+
+// Len returns the number of bytes that have not been read yet.
+func (r *Reader) Len() int {
+	return len(r.buf)
+}
+
+// Rest returns the bytes that have not been read yet.
+func (r *Reader) Rest() []byte {
+	return r.buf
+}
+
+// ReadByte reads a single byte, such as a boolean.
+func (r *Reader) ReadByte() (byte, error) {
+	if len(r.buf) < 1 {
+		return 0, ErrTruncated
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b, nil
+}
+
+// ReadUint32 reads a uint32.
+func (r *Reader) ReadUint32() (uint32, error) {
+	if len(r.buf) < 4 {
+		return 0, ErrTruncated
+	}
+	v := binary.BigEndian.Uint32(r.buf)
+	r.buf = r.buf[4:]
+	return v, nil
+}
+
+// ReadString reads a length-prefixed string.
+func (r *Reader) ReadString() ([]byte, error) {
+	n, err := r.ReadUint32()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(n) > uint64(len(r.buf)) {
+		return nil, ErrTruncated
+	}
+	s := r.buf[:n]
+	r.buf = r.buf[n:]
+	return s, nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package codec
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// requestTypes lists the message types that clients can send.  This includes the requests of
+// the long-gone SSH1 protocol, which modern agents reject but old clients still probe for.
+var requestTypes = map[byte]bool{
+	1:  true, // SSH_AGENTC_REQUEST_RSA_IDENTITIES
+	3:  true, // SSH_AGENTC_RSA_CHALLENGE
+	7:  true, // SSH_AGENTC_ADD_RSA_IDENTITY
+	8:  true, // SSH_AGENTC_REMOVE_RSA_IDENTITY
+	9:  true, // SSH_AGENTC_REMOVE_ALL_RSA_IDENTITIES
+	11: true, // SSH_AGENTC_REQUEST_IDENTITIES
+	13: true, // SSH_AGENTC_SIGN_REQUEST
+	17: true, // SSH_AGENTC_ADD_IDENTITY
+	18: true, // SSH_AGENTC_REMOVE_IDENTITY
+	19: true, // SSH_AGENTC_REMOVE_ALL_IDENTITIES
+	20: true, // SSH_AGENTC_ADD_SMARTCARD_KEY
+	21: true, // SSH_AGENTC_REMOVE_SMARTCARD_KEY
+	22: true, // SSH_AGENTC_LOCK
+	23: true, // SSH_AGENTC_UNLOCK
+	24: true, // SSH_AGENTC_ADD_RSA_ID_CONSTRAINED
+	25: true, // SSH_AGENTC_ADD_ID_CONSTRAINED
+	26: true, // SSH_AGENTC_ADD_SMARTCARD_KEY_CONSTRAINED
+	27: true, // SSH_AGENTC_EXTENSION
+}
+
+// IsRequest returns true if "msgType" is a message that clients can send.
+func IsRequest(msgType byte) bool {
+	return requestTypes[msgType]
+}
+
+// InvalidRequestError indicates that a client sent something that cannot be an agent request.
+type InvalidRequestError struct {
+	// Reason explains what is wrong with the request.
+	Reason string
+}
+
+// Error returns the reason why the request is invalid.
+func (e *InvalidRequestError) Error() string {
+	return e.Reason
+}
+
+// Is returns true if "target" is ErrProtocol.
+func (e *InvalidRequestError) Is(target error) bool {
+	return target == ErrProtocol
+}
+
+// readBuffer buffers the reads from "r" like bufio.Reader does but lets us wipe the bytes that
+// were already consumed, which bufio.Reader would keep around until they are overwritten.
+type readBuffer struct {
+	r io.Reader
+
+	// buf holds the bytes read from "r" and yet to be consumed between start and end.
+	buf        []byte
+	start, end int
+
+	// err is the error returned by "r" along with the last bytes that it returned, if any.
+	err error
+}
+
+// newReadBuffer creates a buffer of "size" bytes for the reads from "r".
+func newReadBuffer(r io.Reader, size int) *readBuffer {
+	return &readBuffer{r: r, buf: make([]byte, size)}
+}
+
+// Read returns the buffered bytes, refilling the buffer from "r" when it is empty.  Reads
+// larger than the buffer go to "r" directly.
+func (b *readBuffer) Read(p []byte) (int, error) {
+	if b.start == b.end {
+		if b.err != nil {
+			err := b.err
+			b.err = nil
+			return 0, err
+		}
+		if len(p) >= len(b.buf) {
+			return b.r.Read(p)
+		}
+		n, err := b.r.Read(b.buf)
+		b.start, b.end = 0, n
+		if n == 0 {
+			return 0, err
+		}
+		b.err = err
+	}
+	n := copy(p, b.buf[b.start:b.end])
+	b.start += n
+	return n, nil
+}
+
+// wipeConsumed overwrites the bytes that were already returned by Read with zeros while
+// keeping those that were not.  This includes the stale bytes past the end of the last refill,
+// which belong to earlier refills.
+func (b *readBuffer) wipeConsumed() {
+	Wipe(b.buf[:b.start])
+	Wipe(b.buf[b.end:])
+}
+
+// RequestReader reads the requests sent by a client one complete message at a time.
+type RequestReader struct {
+	// in buffers the client stream so that pipelined requests do not cost a read each.
+	in *readBuffer
+
+	// buf holds the requests that fit in it.  Larger ones get buffers of their own.
+	buf []byte
+
+	// maxSize is the largest request, excluding the length prefix, that we accept.
+	maxSize uint32
+
+	// last is the request last returned by Next.
+	last []byte
+}
+
+// NewRequestReader creates a reader for the requests sent by the client on "r" that rejects
+// any request larger than "maxSize".
+func NewRequestReader(r io.Reader, maxSize uint32) *RequestReader {
+	return &RequestReader{
+		in:      newReadBuffer(r, 4096),
+		buf:     make([]byte, 4096),
+		maxSize: maxSize,
+	}
+}
+
+// Next returns the next complete request, including its length prefix.  The request is only
+// valid until the next call.
+//
+// Returns io.EOF if the client closed the connection between requests and an
+// *InvalidRequestError if the client sent garbage, after which the stream is unusable.
+func (r *RequestReader) Next() ([]byte, error) {
+	if _, err := io.ReadFull(r.in, r.buf[:4]); err != nil {
+		return nil, err
+	}
+
+	// Check the length before reading the rest so that we never wait for, or allocate
+	// memory for, a message that cannot possibly be valid.
+	length := binary.BigEndian.Uint32(r.buf)
+	if length == 0 {
+		return nil, &InvalidRequestError{Reason: "empty message"}
+	}
+	if length > r.maxSize {
+		return nil, &InvalidRequestError{Reason: fmt.Sprintf("message too large (%d bytes)", length)}
+	}
+
+	frame := r.buf
+	if int(length)+4 > len(r.buf) {
+		frame = make([]byte, int(length)+4)
+		copy(frame, r.buf[:4])
+	}
+	frame = frame[:int(length)+4]
+	if _, err := io.ReadFull(r.in, frame[4:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	if !IsRequest(frame[4]) {
+		return nil, &InvalidRequestError{Reason: fmt.Sprintf("message %d is not a request", frame[4])}
+	}
+	r.last = frame
+	return frame, nil
+}
+
+// Wipe overwrites the request last returned by Next with zeros, along with the copy of its
+// bytes that was buffered while reading it.  Callers should do this once they are done with
+// requests that carry secrets, as told by IsSensitive.
+func (r *RequestReader) Wipe() {
+	Wipe(r.last)
+	r.in.wipeConsumed()
+}
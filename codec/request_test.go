@@ -0,0 +1,100 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package codec
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// request returns a framed request of type "msgType" whose body, after the type, has "size"
+// bytes.
+func request(msgType byte, size int) []byte {
+	return Frame(append([]byte{msgType}, bytes.Repeat([]byte{'x'}, size)...))
+}
+
+func TestRequestReaderNext(t *testing.T) {
+	identities := request(AgentcRequestIdentities, 0)
+	sign := request(AgentcSignRequest, 100)
+	large := request(AgentcAddIdentity, 10000)
+
+	for name, test := range map[string]struct {
+		input   []byte
+		maxSize uint32
+		split   bool
+
+		want    [][]byte
+		wantErr error
+	}{
+		"no requests":                {input: nil, maxSize: 1024, wantErr: io.EOF},
+		"one request":                {input: identities, maxSize: 1024, want: [][]byte{identities}},
+		"pipelined requests":         {input: concat(identities, sign, identities), maxSize: 1024, want: [][]byte{identities, sign, identities}},
+		"split requests":             {input: concat(sign, identities), maxSize: 1024, split: true, want: [][]byte{sign, identities}},
+		"larger than buffer":         {input: concat(large, identities), maxSize: 20000, want: [][]byte{large, identities}},
+		"split larger than buffer":   {input: large, maxSize: 20000, split: true, want: [][]byte{large}},
+		"exactly max size":           {input: sign, maxSize: 101, want: [][]byte{sign}},
+		"over max size":              {input: sign, maxSize: 100, wantErr: ErrProtocol},
+		"over max size without body": {input: sign[:4], maxSize: 100, wantErr: ErrProtocol},
+		"after valid request":        {input: concat(identities, sign), maxSize: 100, want: [][]byte{identities}, wantErr: ErrProtocol},
+		"empty message":              {input: []byte{0, 0, 0, 0}, maxSize: 1024, wantErr: ErrProtocol},
+		"not a request":              {input: Frame([]byte{AgentSuccess}), maxSize: 1024, wantErr: ErrProtocol},
+		"truncated length":           {input: sign[:2], maxSize: 1024, wantErr: io.ErrUnexpectedEOF},
+		"truncated body":             {input: sign[:50], maxSize: 1024, wantErr: io.ErrUnexpectedEOF},
+		"truncated large body":       {input: large[:5000], maxSize: 20000, wantErr: io.ErrUnexpectedEOF},
+	} {
+		t.Run(name, func(t *testing.T) {
+			var input io.Reader = bytes.NewReader(test.input)
+			if test.split {
+				input = iotest.OneByteReader(input)
+			}
+			requests := NewRequestReader(input, test.maxSize)
+
+			for i, want := range test.want {
+				got, err := requests.Next()
+				if err != nil {
+					t.Fatalf("Next failed on request %d: %v", i, err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("Next returned %x for request %d; want %x", got, i, want)
+				}
+			}
+
+			wantErr := test.wantErr
+			if wantErr == nil {
+				wantErr = io.EOF
+			}
+			if _, err := requests.Next(); !errors.Is(err, wantErr) {
+				t.Errorf("Next returned %v after %d requests; want %v", err, len(test.want), wantErr)
+			}
+		})
+	}
+}
+
+// concat returns the concatenation of "parts".
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
@@ -0,0 +1,66 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package codec
+
+import (
+	"fmt"
+)
+
+// sensitiveTypes lists the message types that can carry secrets: private keys, the PINs of
+// smartcards, the passphrases that lock and unlock the agent, and signatures, which are not
+// secret but prove that the key was used.  The SSH1 requests that add keys carry private keys
+// too.
+var sensitiveTypes = map[byte]bool{
+	AgentSignResponse:                true,
+	AgentcAddRSAIdentity:             true,
+	AgentcAddIdentity:                true,
+	AgentcAddSmartcardKey:            true,
+	AgentcLock:                       true,
+	AgentcUnlock:                     true,
+	AgentcAddRSAIDConstrained:        true,
+	AgentcAddIDConstrained:           true,
+	AgentcAddSmartcardKeyConstrained: true,
+}
+
+// IsSensitive returns true if messages of type "msgType" can carry secrets, which callers
+// should wipe from their buffers once the messages have been handled.
+func IsSensitive(msgType byte) bool {
+	return sensitiveTypes[msgType]
+}
+
+// Wipe overwrites "buf" with zeros.
+func Wipe(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+}
+
+// Summarize is like Describe but only returns the name and the size of the message "body",
+// which excludes the length prefix, for logs that must not reveal which keys are in use.
+func Summarize(body []byte) string {
+	if len(body) == 0 {
+		return "empty message"
+	}
+	return fmt.Sprintf("%s (%d bytes)", MessageName(body[0]), len(body))
+}
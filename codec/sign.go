@@ -0,0 +1,71 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package codec
+
+import (
+	"encoding/binary"
+)
+
+// SignRequest holds the fields of an SSH_AGENTC_SIGN_REQUEST message.
+type SignRequest struct {
+	// KeyBlob is the public key with which to sign, in the SSH wire format.
+	KeyBlob []byte
+
+	// Data is the data to sign.
+	Data []byte
+
+	// Flags holds the SSH_AGENT_RSA_SHA2_* flags.
+	Flags uint32
+}
+
+// ParseSignRequest decodes the SSH_AGENTC_SIGN_REQUEST message "msg", which includes the length
+// prefix.  The returned fields point into "msg".
+func ParseSignRequest(msg []byte) (SignRequest, error) {
+	if len(msg) < 5 || msg[4] != AgentcSignRequest {
+		return SignRequest{}, newProtocolError("not a sign request")
+	}
+	r := NewReader(msg[5:])
+	blob, err := r.ReadString()
+	if err != nil {
+		return SignRequest{}, err
+	}
+	data, err := r.ReadString()
+	if err != nil {
+		return SignRequest{}, err
+	}
+	flags, err := r.ReadUint32()
+	if err != nil {
+		return SignRequest{}, err
+	}
+	return SignRequest{KeyBlob: blob, Data: data, Flags: flags}, nil
+}
+
+// EncodeSignRequest builds an SSH_AGENTC_SIGN_REQUEST message, including the message type, that
+// asks for a signature of "req".
+func EncodeSignRequest(req SignRequest) []byte {
+	msg := []byte{AgentcSignRequest}
+	msg = AppendString(msg, req.KeyBlob)
+	msg = AppendString(msg, req.Data)
+	return binary.BigEndian.AppendUint32(msg, req.Flags)
+}
@@ -0,0 +1,219 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package discovery
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Candidate is an agent socket that a Discoverer produced and that may be selected.
+type Candidate struct {
+	// Path is the path to the agent socket.
+	Path string
+
+	// Origin explains where the candidate comes from, such as "in /tmp" for the sockets that
+	// sshd created under /tmp or "pinned with the choose subcommand".
+	Origin string
+
+	// Explicit is true if the user asked for this agent in particular instead of it being
+	// found by a heuristic.  Explicit candidates are trusted to be what the user wants and are
+	// exempt from the checks that selectors apply to the candidates they find on their own.
+	Explicit bool
+}
+
+// Discoverer produces the candidate agent sockets among which to select an agent.
+type Discoverer interface {
+	// Discover returns the candidates in the order in which they should be tried and the
+	// files that were found but were not considered candidates.
+	//
+	// An error means that discovery failed as a whole.  Discoverers can still return the
+	// candidates they found before failing.
+	Discover() ([]Candidate, []Skipped, error)
+}
+
+// SessionDirs discovers the agents that sshd forwards into session directories under Dir.
+// This is the discoverer that ssh-agent-switcher uses by default.
+type SessionDirs struct {
+	// Dir is the directory where sshd places the session directories, usually /tmp.
+	Dir string
+
+	// Conventions lists the SSH servers whose session directories to recognize.  Nil means
+	// DefaultConventions.
+	Conventions []Convention
+
+	// Owner, if not nil, is the user ID that must own the session directories and sockets
+	// instead of the current user.  This lets a daemon that runs as root find the agents of
+	// other users.
+	Owner *int
+
+	// MaxEntries, if positive, is the maximum number of entries of Dir to look at, which
+	// keeps scanning cheap when Dir is a busy shared /tmp.  Bounded scans do not sort the
+	// entries of Dir, so the candidates come in the order in which the file system returns
+	// them.
+	MaxEntries int
+
+	// MaxCandidates, if positive, stops the scan once this many candidates were found.  Like
+	// MaxEntries, it makes the scan unsorted.
+	MaxCandidates int
+}
+
+// Discover scans Dir with ScanConventions, stopping at MaxEntries or MaxCandidates.
+func (d *SessionDirs) Discover() ([]Candidate, []Skipped, error) {
+	conventions := d.Conventions
+	if conventions == nil {
+		conventions = DefaultConventions
+	}
+	uid := os.Getuid()
+	if d.Owner != nil {
+		uid = *d.Owner
+	}
+	limits := scanLimits{maxEntries: d.MaxEntries, maxCandidates: d.MaxCandidates}
+	paths, skipped, err := scanConventions(d.Dir, conventions, uid, limits)
+	candidates := make([]Candidate, 0, len(paths))
+	for _, path := range paths {
+		candidates = append(candidates, Candidate{Path: path, Origin: "in " + d.Dir})
+	}
+	return candidates, skipped, err
+}
+
+// Glob discovers the sockets whose paths match Pattern, as interpreted by filepath.Glob, that
+// are owned by the current user.  This is meant for agents that are forwarded to paths chosen
+// in the ssh configuration instead of to session directories, such as gpg-agent sockets
+// forwarded with RemoteForward.
+//
+// The most recently created sockets come first because they belong to the newest sessions,
+// which are the most likely to be alive.
+type Glob struct {
+	// Pattern is the glob that the paths to the sockets must match.
+	Pattern string
+}
+
+// Discover returns the sockets matching Pattern, newest first.
+func (g *Glob) Discover() ([]Candidate, []Skipped, error) {
+	paths, err := filepath.Glob(g.Pattern)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	type socket struct {
+		path  string
+		mtime time.Time
+	}
+	var sockets []socket
+	var skipped []Skipped
+	uid := os.Getuid()
+	for _, path := range paths {
+		// Use Lstat so that symlinks to sockets elsewhere are not followed.
+		fi, err := os.Lstat(path)
+		if err != nil {
+			skipped = append(skipped, Skipped{Path: path, Reason: "stat failed: " + err.Error()})
+			continue
+		}
+		if reason, suspicious := checkSocket(fi, uid); reason != "" {
+			skipped = append(skipped, Skipped{Path: path, Reason: reason, Suspicious: suspicious})
+			continue
+		}
+		sockets = append(sockets, socket{path: path, mtime: fi.ModTime()})
+	}
+	sort.SliceStable(sockets, func(i, j int) bool {
+		return sockets[i].mtime.After(sockets[j].mtime)
+	})
+
+	candidates := make([]Candidate, 0, len(sockets))
+	for _, socket := range sockets {
+		candidates = append(candidates, Candidate{Path: socket.path, Origin: "matching " + g.Pattern})
+	}
+	return candidates, skipped, nil
+}
+
+// Exclude is a Discoverer that drops the candidates of another discoverer whose paths, or the
+// paths of any of their parent directories, match any of Patterns, as interpreted by
+// filepath.Match.  The dropped candidates are reported as skipped.
+type Exclude struct {
+	// Discoverer produces the candidates to filter.
+	Discoverer Discoverer
+
+	// Patterns are the globs that the paths to exclude match.
+	Patterns []string
+}
+
+// excludedBy returns the pattern in "patterns" that matches "path" or any of its parent
+// directories, or empty if none does.
+func excludedBy(patterns []string, path string) string {
+	for dir := path; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, dir); matched {
+				return pattern
+			}
+		}
+	}
+	return ""
+}
+
+// Discover returns the candidates of the wrapped discoverer that do not match Patterns.
+func (e *Exclude) Discover() ([]Candidate, []Skipped, error) {
+	candidates, skipped, err := e.Discoverer.Discover()
+	kept := candidates[:0]
+	for _, candidate := range candidates {
+		if pattern := excludedBy(e.Patterns, candidate.Path); pattern != "" {
+			skipped = append(skipped, Skipped{Path: candidate.Path, Reason: "excluded by " + pattern})
+			continue
+		}
+		kept = append(kept, candidate)
+	}
+	return kept, skipped, err
+}
+
+// Static is a Discoverer that always produces the same candidates.
+type Static []Candidate
+
+// Discover returns the candidates in "s".
+func (s Static) Discover() ([]Candidate, []Skipped, error) {
+	return s, nil, nil
+}
+
+// Chain is a Discoverer that produces the candidates of all of its discoverers in order, so
+// that the candidates of the later ones act as fallbacks of the earlier ones.
+type Chain []Discoverer
+
+// Discover runs all discoverers in "c" even if some of them fail and returns the candidates
+// and skipped files of all of them.  The returned error is the first one that any discoverer
+// returned, if any.
+func (c Chain) Discover() ([]Candidate, []Skipped, error) {
+	var allCandidates []Candidate
+	var allSkipped []Skipped
+	var firstErr error
+	for _, d := range c {
+		candidates, skipped, err := d.Discover()
+		allCandidates = append(allCandidates, candidates...)
+		allSkipped = append(allSkipped, skipped...)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return allCandidates, allSkipped, firstErr
+}
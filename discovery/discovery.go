@@ -0,0 +1,465 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package discovery finds the sockets of the agents that sshd forwards for SSH sessions.
+//
+// sshd places every forwarded agent in a session directory of the form ssh-XXXXXXXX, usually
+// under /tmp, that contains a socket of the form agent.NNNN.  Other SSH servers follow similar
+// conventions, which are described by Convention.  Candidates are validated based on their file
+// system metadata and, if their names say so, on whether the session process that created them
+// still exists: there is no guarantee that any of them is alive.
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Convention describes how an SSH server names the session directories and sockets of the
+// agents that it forwards.
+type Convention struct {
+	// Server is the name of the SSH server that follows this convention.
+	Server string
+
+	// DirPrefix is the prefix of the names of the session directories.
+	DirPrefix string
+
+	// SocketPrefix is the prefix of the names of the agent sockets within the session
+	// directories.
+	SocketPrefix string
+
+	// SocketSuffix is the suffix of the names of the agent sockets, if any.
+	SocketSuffix string
+
+	// PIDInName is true if the names of the agent sockets contain the PID of the session
+	// process that serves them between SocketPrefix and SocketSuffix.
+	PIDInName bool
+}
+
+// DefaultConventions lists the conventions of the SSH servers known to Scan.
+var DefaultConventions = []Convention{
+	// OpenSSH creates ssh-XXXXXXXXXX/agent.PID.
+	{Server: "OpenSSH", DirPrefix: "ssh-", SocketPrefix: "agent.", PIDInName: true},
+
+	// Dropbear creates dropbear-XXXXXX/auth-XXXXXXXX-N.
+	{Server: "Dropbear", DirPrefix: "dropbear-", SocketPrefix: "auth-"},
+
+	// Teleport nodes create teleport-XXXXXXXX/teleport-PID.socket.
+	{Server: "Teleport", DirPrefix: "teleport-", SocketPrefix: "teleport-", SocketSuffix: ".socket", PIDInName: true},
+}
+
+// conventionFor returns the convention in "conventions" whose session directories are named
+// like "name", if any.
+func conventionFor(conventions []Convention, name string) (Convention, bool) {
+	for _, c := range conventions {
+		if strings.HasPrefix(name, c.DirPrefix) {
+			return c, true
+		}
+	}
+	return Convention{}, false
+}
+
+// sessionPID extracts the PID of the session process from the socket "name" if the convention
+// records it.
+func (c Convention) sessionPID(name string) (int, bool) {
+	if !c.PIDInName || !strings.HasSuffix(name, c.SocketSuffix) {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, c.SocketPrefix), c.SocketSuffix))
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	return pid, true
+}
+
+// describePrefixes lists the session directory prefixes of "conventions" for humans.
+func describePrefixes(conventions []Convention) string {
+	var prefixes []string
+	for _, c := range conventions {
+		prefixes = append(prefixes, "'"+c.DirPrefix+"'")
+	}
+	return strings.Join(prefixes, " nor ")
+}
+
+// Skipped describes a file that Scan found but did not consider a candidate.
+type Skipped struct {
+	// Path is the path to the skipped file.
+	Path string
+
+	// Reason explains why the file was skipped.
+	Reason string
+
+	// Suspicious is true if the file looks like an agent but fails the ownership or
+	// permission checks, which could mean that another user planted it.  Callers should
+	// report these more prominently than the garbage that usually lives next to agents.
+	Suspicious bool
+}
+
+// scanner accumulates the results of a scan.
+type scanner struct {
+	// ourUid is the user identifier that candidates must be owned by.
+	ourUid int
+
+	// candidates lists the sockets that may be valid agents.
+	candidates []string
+
+	// skipped lists the files that were not considered candidates.
+	skipped []Skipped
+}
+
+// skip records that "path" was not considered for "reason".
+func (s *scanner) skip(path string, reason string, suspicious bool) {
+	s.skipped = append(s.skipped, Skipped{Path: path, Reason: reason, Suspicious: suspicious})
+}
+
+// checkSocket verifies that "fi", which must come from Lstat, describes a socket owned by
+// "uid" without unusual mode bits.  Returns why the socket is not acceptable, and whether
+// that is suspicious, or an empty reason if it is.
+func checkSocket(fi fs.FileInfo, uid int) (string, bool) {
+	stat := fi.Sys().(*syscall.Stat_t)
+	if (stat.Mode & syscall.S_IFMT) != syscall.S_IFSOCK {
+		return "not a socket", false
+	}
+	if int(stat.Uid) != uid {
+		return fmt.Sprintf("owner %d is not current user %d", stat.Uid, uid), true
+	}
+	if stat.Mode&(syscall.S_ISUID|syscall.S_ISGID|syscall.S_ISVTX) != 0 {
+		return fmt.Sprintf("has unexpected mode %#o", stat.Mode&07777), true
+	}
+	return "", false
+}
+
+// checkSessionProcess verifies that the session process "pid" that created an agent socket
+// still exists and runs as us, which we know because we can signal it.  Returns why the socket
+// is stale, or an empty reason if it may not be.
+//
+// Stale sockets are not only useless: on some systems they accept connections that then hang,
+// so skipping them here saves every client from waiting on them.
+func checkSessionProcess(pid int) string {
+	switch err := syscall.Kill(pid, 0); err {
+	case syscall.ESRCH:
+		return fmt.Sprintf("session process %d is gone", pid)
+	case syscall.EPERM:
+		return fmt.Sprintf("session process %d belongs to another user", pid)
+	default:
+		return ""
+	}
+}
+
+// scanSubdir scans the contents of "dir", which should point to a session directory created
+// by an SSH server that follows "convention", and records the paths to all the sockets that
+// look valid.
+//
+// This only returns an error if no candidate can be found.
+func (s *scanner) scanSubdir(dir string, convention Convention) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+
+		if !strings.HasPrefix(entry.Name(), convention.SocketPrefix) {
+			s.skip(path, "does not start with '"+convention.SocketPrefix+"'", false)
+			continue
+		}
+
+		// Use Lstat so that symlinks to sockets elsewhere are not followed.
+		fi, err := os.Lstat(path)
+		if err != nil {
+			s.skip(path, "stat failed: "+err.Error(), false)
+			continue
+		}
+
+		// The session directory is already known to be ours but it could be a stale one in
+		// which somebody else managed to place a socket, so check the socket too.
+		if reason, suspicious := checkSocket(fi, s.ourUid); reason != "" {
+			s.skip(path, reason, suspicious)
+			continue
+		}
+
+		if pid, ok := convention.sessionPID(entry.Name()); ok {
+			if reason := checkSessionProcess(pid); reason != "" {
+				s.skip(path, reason, false)
+				continue
+			}
+		}
+
+		s.candidates = append(s.candidates, path)
+		found = true
+	}
+
+	if !found {
+		return errors.New("no socket in directory")
+	}
+	return nil
+}
+
+// Scan scans the contents of "dir", which should point to the directory where sshd places
+// the session directories for forwarded agents, and returns the paths to all sockets that may
+// be valid agents in the order in which they should be tried.  The files that were found but
+// were not considered candidates are returned too, along with the reasons why.
+//
+// The session directories of all the servers in DefaultConventions are recognized.
+func Scan(dir string) ([]string, []Skipped, error) {
+	return ScanConventions(dir, DefaultConventions)
+}
+
+// ScanConventions is like Scan but only recognizes the session directories of the SSH servers
+// that follow "conventions".
+func ScanConventions(dir string, conventions []Convention) ([]string, []Skipped, error) {
+	return scanConventions(dir, conventions, os.Getuid(), scanLimits{})
+}
+
+// scanBatchSize is how many entries of the directory that holds the session directories are
+// read at once by bounded scans.
+const scanBatchSize = 256
+
+// scanLimits bounds how much of the directory that holds the session directories is scanned.
+type scanLimits struct {
+	// maxEntries is the maximum number of entries to look at, or zero for no limit.
+	maxEntries int
+
+	// maxCandidates is the number of candidates after which to stop, or zero for no limit.
+	maxCandidates int
+}
+
+// bounded returns true if any of the limits is set.
+func (l scanLimits) bounded() bool {
+	return l.maxEntries > 0 || l.maxCandidates > 0
+}
+
+// scanConventions is like ScanConventions but looks for the agents of the user "uid" instead
+// of those of the current user and stops scanning at "limits".
+func scanConventions(dir string, conventions []Convention, uid int, limits scanLimits) ([]string, []Skipped, error) {
+	// It is tempting to use the *at family of system calls to avoid races when checking for
+	// file metadata before opening the socket... but there is no guarantee that the sshd
+	// instance will be present at all even after we open the socket, so the races don't
+	// matter.  Most of these checks are merely to keep things speedy and nice, but the ones
+	// on the ownership and permissions of the session directories also keep us away from
+	// sockets that other users could have planted or replaced.
+
+	s := scanner{ourUid: uid}
+	if !limits.bounded() {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		// The sorting is unnecessary but it helps with testing certain conditions.
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Name() < entries[j].Name()
+		})
+
+		for _, entry := range entries {
+			s.scanEntry(dir, entry, conventions)
+		}
+		return s.candidates, s.skipped, nil
+	}
+
+	// Reading and sorting the whole directory is expensive when it is a busy /tmp with tens
+	// of thousands of entries, so bounded scans read it in batches, look at the entries in
+	// the order in which the file system returns them, and stop as soon as they can.
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	seen := 0
+	for {
+		entries, err := f.ReadDir(scanBatchSize)
+		for _, entry := range entries {
+			if limits.maxEntries > 0 && seen == limits.maxEntries {
+				s.skip(dir, fmt.Sprintf("stopped scanning after %d entries", seen), false)
+				return s.candidates, s.skipped, nil
+			}
+			seen++
+
+			s.scanEntry(dir, entry, conventions)
+			if limits.maxCandidates > 0 && len(s.candidates) >= limits.maxCandidates {
+				return s.candidates, s.skipped, nil
+			}
+		}
+		if err == io.EOF {
+			return s.candidates, s.skipped, nil
+		} else if err != nil {
+			return s.candidates, s.skipped, err
+		}
+	}
+}
+
+// scanEntry checks whether "entry" of "dir" is a session directory created by an SSH server
+// that follows one of "conventions" and records the sockets in it that look valid.
+func (s *scanner) scanEntry(dir string, entry fs.DirEntry, conventions []Convention) {
+	path := filepath.Join(dir, entry.Name())
+
+	convention, known := conventionFor(conventions, entry.Name())
+
+	if entry.Type()&fs.ModeSymlink != 0 && known {
+		s.skip(path, "is a symlink", true)
+		return
+	}
+
+	if !entry.IsDir() {
+		s.skip(path, "not a directory", false)
+		return
+	}
+
+	if !known {
+		s.skip(path, "does not start with "+describePrefixes(conventions), false)
+		return
+	}
+
+	// Use Lstat so that a directory replaced by a symlink after we read the directory is not
+	// followed.
+	fi, err := os.Lstat(path)
+	if err != nil {
+		s.skip(path, "stat failed: "+err.Error(), false)
+		return
+	}
+	if !fi.IsDir() {
+		s.skip(path, "not a directory", true)
+		return
+	}
+
+	// This check is not strictly necessary to find valid agents: if we found sshd sockets
+	// owned by other users, we would simply fail to open them later anyway.
+	uid := fi.Sys().(*syscall.Stat_t).Uid
+	if int(uid) != s.ourUid {
+		s.skip(path, fmt.Sprintf("owner %d is not current user %d", uid, s.ourUid), false)
+		return
+	}
+
+	// All known servers create the session directories with mode 0700.  Anything more
+	// permissive would let other users plant their own sockets in them.
+	if perm := fi.Mode().Perm(); perm != 0700 {
+		s.skip(path, fmt.Sprintf("mode %#o is not 0700", perm), true)
+		return
+	}
+
+	if err := s.scanSubdir(path, convention); err != nil {
+		s.skip(path, err.Error(), false)
+	}
+}
+
+// staleSessionDir returns the paths to the entries of the session directory "dir", which
+// follows "convention", if all of them are sockets owned by "uid" whose session process is
+// gone.  Returns nil if the directory is empty or contains anything else.
+func staleSessionDir(dir string, convention Convention, uid int) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var paths []string
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), convention.SocketPrefix) {
+			return nil, nil
+		}
+		pid, ok := convention.sessionPID(entry.Name())
+		if !ok {
+			return nil, nil
+		}
+		path := filepath.Join(dir, entry.Name())
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return nil, err
+		}
+		if reason, _ := checkSocket(fi, uid); reason != "" {
+			return nil, nil
+		}
+		if checkSessionProcess(pid) == "" {
+			return nil, nil
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// removeSessionDir removes the session directory "dir" after removing the "sockets" in it.
+// This fails if anything else appeared in the directory in the meantime.
+func removeSessionDir(dir string, sockets []string) error {
+	for _, socket := range sockets {
+		if err := os.Remove(socket); err != nil {
+			return err
+		}
+	}
+	return os.Remove(dir)
+}
+
+// RemoveStale removes the session directories under "dir" that SSH servers following
+// "conventions" left behind for sessions that are gone, such as when they crash or when the
+// machine reboots without cleaning /tmp, and returns the paths to the removed directories.
+//
+// Only the session directories that pass the same checks as ScanConventions are considered, and
+// only if they exclusively contain sockets whose names record the PID of their session process
+// and that process is gone.  Empty session directories are left alone because they may belong
+// to sessions that are still being set up.
+func RemoveStale(dir string, conventions []Convention) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	uid := os.Getuid()
+	var removed []string
+	var firstErr error
+	for _, entry := range entries {
+		convention, known := conventionFor(conventions, entry.Name())
+		if !known || !convention.PIDInName || !entry.IsDir() {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		fi, err := os.Lstat(path)
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+		if int(fi.Sys().(*syscall.Stat_t).Uid) != uid || fi.Mode().Perm() != 0700 {
+			continue
+		}
+
+		sockets, err := staleSessionDir(path, convention, uid)
+		if err == nil && len(sockets) > 0 {
+			err = removeSessionDir(path, sockets)
+			if err == nil {
+				removed = append(removed, path)
+			}
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return removed, firstErr
+}
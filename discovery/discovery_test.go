@@ -0,0 +1,129 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package discovery_test
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+	"github.com/jmmv/ssh-agent-switcher/discovery"
+	"github.com/jmmv/ssh-agent-switcher/testutil"
+)
+
+// gonePID returns the identifier of a process that already exited.
+func gonePID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("Cannot run true: %v", err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestSessionDirsDiscover(t *testing.T) {
+	tree := testutil.NewSSHDTree(t)
+	live := tree.AddAgent("live", os.Getpid(), testutil.NewAgent(t, "live key"))
+	stale := tree.AddStaleSocket("gone", gonePID(t))
+	garbage := tree.AddFile("ssh-live/garbage", 0600)
+	notSocket := tree.AddFile("ssh-file/agent.1", 0600)
+	tree.AddFile("unrelated", 0644)
+
+	candidates, skipped, err := (&discovery.SessionDirs{Dir: tree.Dir}).Discover()
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+	if len(candidates) != 1 || candidates[0].Path != live {
+		t.Errorf("Discover returned candidates %v; want only %s", candidates, live)
+	}
+
+	reasons := make(map[string]string)
+	for _, skip := range skipped {
+		reasons[skip.Path] = skip.Reason
+	}
+	for path, want := range map[string]string{
+		stale:     "is gone",
+		garbage:   "does not start with 'agent.'",
+		notSocket: "not a socket",
+	} {
+		if !strings.Contains(reasons[path], want) {
+			t.Errorf("Discover skipped %s with reason %q; want %q", path, reasons[path], want)
+		}
+	}
+}
+
+func TestSessionDirsDiscoverOtherOwner(t *testing.T) {
+	tree := testutil.NewSSHDTree(t)
+	tree.AddAgent("live", os.Getpid(), testutil.NewAgent(t))
+
+	other := os.Getuid() + 1
+	candidates, skipped, _ := (&discovery.SessionDirs{Dir: tree.Dir, Owner: &other}).Discover()
+	if len(candidates) != 0 {
+		t.Errorf("Discover returned candidates %v of another user", candidates)
+	}
+	dir := filepath.Join(tree.Dir, "ssh-live")
+	for _, skip := range skipped {
+		if skip.Path == dir {
+			if !strings.Contains(skip.Reason, "is not current user") {
+				t.Errorf("Discover skipped %s with reason %q; want the owner mismatch", dir, skip.Reason)
+			}
+			return
+		}
+	}
+	t.Errorf("Discover did not report skipping %s", dir)
+}
+
+func TestDial(t *testing.T) {
+	tree := testutil.NewSSHDTree(t)
+	path := tree.AddAgent("live", os.Getpid(), testutil.NewAgent(t, "first", "second"))
+
+	if _, err := discovery.Dial(path, nil); !errors.Is(err, discovery.ErrOwnSocket) {
+		t.Fatalf("Dial to a socket served by this process returned %v; want %v", err, discovery.ErrOwnSocket)
+	}
+
+	own := &discovery.SocketSet{SharedProcess: true}
+	conn, err := discovery.Dial(path, own)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	ids, err := codec.RequestIdentities(conn, codec.DefaultMaxMessageSize)
+	if err != nil {
+		t.Fatalf("RequestIdentities failed: %v", err)
+	}
+	if len(ids) != 2 || ids[0].Comment != "first" || ids[1].Comment != "second" {
+		t.Errorf("Agent returned identities %v; want the keys first and second", ids)
+	}
+
+	if err := own.Add(path); err != nil {
+		t.Fatalf("Add failed: %v", err)
+	}
+	if _, err := discovery.Dial(path, own); !errors.Is(err, discovery.ErrOwnSocket) {
+		t.Errorf("Dial to a socket in the set returned %v; want %v", err, discovery.ErrOwnSocket)
+	}
+}
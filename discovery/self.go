@@ -0,0 +1,125 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package discovery
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/jmmv/ssh-agent-switcher/internal/peercred"
+)
+
+// fileID identifies a file regardless of the path used to reach it.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// statFileID returns the identifier of the file at "path", following symlinks.
+func statFileID(path string) (fileID, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileID{}, err
+	}
+	stat := fi.Sys().(*syscall.Stat_t)
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, nil
+}
+
+// SocketSet tracks the sockets on which a proxy serves clients so that it never selects
+// itself as the upstream agent.  Doing so would make every connection recurse into a new one.
+//
+// The zero value is an empty set ready to use.
+type SocketSet struct {
+	// SharedProcess indicates that the calling process serves agents besides being a proxy,
+	// as happens in tests that run an in-memory agent.  Dial then refuses the sockets in the
+	// set only instead of any socket served by the calling process.
+	SharedProcess bool
+
+	// mu protects ids.
+	mu sync.Mutex
+
+	// ids is the set of identifiers of the sockets.
+	ids map[fileID]bool
+}
+
+// Add records the socket at "path" as one of ours.
+func (s *SocketSet) Add(path string) error {
+	id, err := statFileID(path)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ids == nil {
+		s.ids = make(map[fileID]bool)
+	}
+	s.ids[id] = true
+	return nil
+}
+
+// Contains checks whether "path" refers to one of our sockets, possibly via symlinks.
+//
+// A nil set contains nothing.
+func (s *SocketSet) Contains(path string) bool {
+	if s == nil {
+		return false
+	}
+	id, err := statFileID(path)
+	if err != nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ids[id]
+}
+
+// ErrOwnSocket indicates that a candidate agent socket is served by the calling process.
+var ErrOwnSocket = errors.New("is our own socket")
+
+// Dial opens the agent socket at "path", refusing to connect to any of the sockets in "own",
+// which may be nil, or to any socket served by the calling process unless own.SharedProcess.
+//
+// The socket is first compared against "own" by device and inode, which catches overlapping
+// directories and symlinks.  Sockets we cannot recognize that way, such as those reached via
+// bind mounts in other namespaces, are refused after connecting if their peer is our process.
+func Dial(path string, own *SocketSet) (net.Conn, error) {
+	if own.Contains(path) {
+		return nil, ErrOwnSocket
+	}
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := peercred.Get(conn)
+	if err == nil && creds.PID == os.Getpid() && (own == nil || !own.SharedProcess) {
+		conn.Close()
+		return nil, ErrOwnSocket
+	}
+	return conn, nil
+}
@@ -1,3 +1,3 @@
-module ssh-agent-switcher
+module github.com/jmmv/ssh-agent-switcher
 
-go 1.20
+go 1.21
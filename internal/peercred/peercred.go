@@ -0,0 +1,67 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package peercred queries the credentials of the process on the other end of a Unix socket.
+package peercred
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ErrUnsupported indicates that we don't know how to query the credentials of the peer of a
+// Unix socket on this platform, which Supported tells in advance.
+var ErrUnsupported = errors.New("peer credentials not supported on this platform")
+
+// Credentials describes the process on the other end of a Unix socket connection.
+type Credentials struct {
+	// UID is the user identifier of the peer.
+	UID int
+
+	// PID is the process identifier of the peer, or 0 if the platform does not report it,
+	// which ReportsPID tells in advance.
+	PID int
+}
+
+// Get queries the credentials of the process on the other end of "conn".
+func Get(conn net.Conn) (Credentials, error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return Credentials{}, fmt.Errorf("not a Unix socket connection")
+	}
+
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	var creds Credentials
+	var credsErr error
+	if err := raw.Control(func(fd uintptr) {
+		creds, credsErr = getsockopt(int(fd))
+	}); err != nil {
+		return Credentials{}, err
+	}
+	return creds, credsErr
+}
@@ -0,0 +1,69 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+//go:build darwin || freebsd
+
+package peercred
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// Values from <sys/un.h> and <sys/ucred.h>, which are identical in macOS and FreeBSD.
+const (
+	solLocal      = 0
+	localPeercred = 1
+	xucredVersion = 0
+)
+
+// xucred mirrors the C struct of the same name.  FreeBSD has an extra trailing field that we
+// don't care about, so we leave room for it.
+type xucred struct {
+	version uint32
+	uid     uint32
+	ngroups int16
+	groups  [16]uint32
+	_       [16]byte
+}
+
+// Supported is true because LOCAL_PEERCRED tells us who the peer is.
+const Supported = true
+
+// ReportsPID is false because LOCAL_PEERCRED only describes the user of the peer.
+const ReportsPID = false
+
+// getsockopt queries the peer credentials of the socket "fd" via LOCAL_PEERCRED.
+func getsockopt(fd int) (Credentials, error) {
+	var cred xucred
+	size := uint32(unsafe.Sizeof(cred))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), solLocal, localPeercred,
+		uintptr(unsafe.Pointer(&cred)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return Credentials{}, errno
+	}
+	if cred.version != xucredVersion {
+		return Credentials{}, syscall.EINVAL
+	}
+	return Credentials{UID: int(cred.uid)}, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package peercred_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/jmmv/ssh-agent-switcher/internal/peercred"
+)
+
+// socketPair returns the two ends of a connected pair of Unix sockets.
+func socketPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("Cannot create socket pair: %v", err)
+	}
+
+	var conns [2]net.Conn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "socketpair")
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Cannot create socket pair: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conns[i] = conn
+	}
+	return conns[0], conns[1]
+}
+
+func TestGet(t *testing.T) {
+	conn, _ := socketPair(t)
+
+	creds, err := peercred.Get(conn)
+	if !peercred.Supported {
+		if !errors.Is(err, peercred.ErrUnsupported) {
+			t.Errorf("Get returned %v on an unsupported platform; want %v", err, peercred.ErrUnsupported)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+
+	if creds.UID != os.Getuid() {
+		t.Errorf("Get returned uid %d; want %d", creds.UID, os.Getuid())
+	}
+	wantPID := 0
+	if peercred.ReportsPID {
+		wantPID = os.Getpid()
+	}
+	if creds.PID != wantPID {
+		t.Errorf("Get returned pid %d; want %d", creds.PID, wantPID)
+	}
+}
+
+func TestGetNotUnixSocket(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	if _, err := peercred.Get(client); err == nil {
+		t.Errorf("Get succeeded on a connection that is not a Unix socket")
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package plugin
+
+import (
+	"github.com/jmmv/ssh-agent-switcher/discovery"
+)
+
+// discoverResult holds the result of the discover request.
+type discoverResult struct {
+	Candidates []struct {
+		Path     string `json:"path"`
+		Origin   string `json:"origin"`
+		Explicit bool   `json:"explicit"`
+	} `json:"candidates"`
+	Skipped []struct {
+		Path   string `json:"path"`
+		Reason string `json:"reason"`
+	} `json:"skipped"`
+}
+
+// Discoverer is a discovery.Discoverer backed by a plugin that implements the "discover"
+// method.  The request has no params and its result lists the candidate agent sockets in order
+// of preference, along with the files that were skipped and why (lines wrapped for
+// readability):
+//
+//	{"method": "discover"}
+//	{"result": {"candidates": [{"path": "/run/agent.sock", "origin": "from the vault",
+//	    "explicit": false}], "skipped": [{"path": "/run/old.sock", "reason": "expired"}]}}
+//
+// Only "path" is required.  Candidates without an "origin" are described as coming from the
+// plugin, and "explicit" candidates are selected as soon as they can be opened, without checking
+// whether they are other ssh-agent-switcher instances.
+type Discoverer struct {
+	// Plugin is the plugin to ask for candidates.
+	Plugin *Plugin
+}
+
+// Discover asks the plugin for candidates.
+func (d *Discoverer) Discover() ([]discovery.Candidate, []discovery.Skipped, error) {
+	var result discoverResult
+	if err := d.Plugin.call("discover", nil, &result); err != nil {
+		return nil, nil, err
+	}
+
+	var candidates []discovery.Candidate
+	for _, c := range result.Candidates {
+		if c.Path == "" {
+			continue
+		}
+		origin := c.Origin
+		if origin == "" {
+			origin = "from plugin " + d.Plugin.Path()
+		}
+		candidates = append(candidates, discovery.Candidate{Path: c.Path, Origin: origin, Explicit: c.Explicit})
+	}
+	var skipped []discovery.Skipped
+	for _, s := range result.Skipped {
+		skipped = append(skipped, discovery.Skipped{Path: s.Path, Reason: s.Reason})
+	}
+	return candidates, skipped, nil
+}
@@ -0,0 +1,317 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package plugin runs discovery backends and policy engines shipped as separate executables so
+// that sites can integrate ssh-agent-switcher with their own infrastructure without forking it.
+//
+// A plugin is a long-running process that receives requests on its stdin and writes responses
+// to its stdout, one JSON object per line, answering each request before reading the next one.
+// Requests have the form:
+//
+//	{"method": "NAME", "params": {...}}
+//
+// and responses have the form:
+//
+//	{"result": {...}}
+//
+// on success or:
+//
+//	{"error": "MESSAGE"}
+//
+// on failure.  The first request is always "hello", whose params hold the "version" of the
+// protocol spoken by ssh-agent-switcher, which is currently 1, and whose result must hold the
+// version spoken by the plugin and the "methods" that it implements:
+//
+//	{"method": "hello", "params": {"version": 1}}
+//	{"result": {"version": 1, "methods": ["discover", "checkSign"]}}
+//
+// The other methods are described by the types that call them: Discoverer for "discover" and
+// Policy for "checkSign".
+//
+// Anything that the plugin writes to its stderr is passed through to the stderr of the caller.
+// Plugins must exit when their stdin is closed.  A plugin that fails to answer a request is
+// killed and restarted on the next request.
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// ProtocolVersion is the version of the plugin protocol implemented by this package.
+const ProtocolVersion = 1
+
+// DefaultTimeout is how long a plugin has to answer a request if Start is not given a timeout.
+const DefaultTimeout = 5 * time.Second
+
+// maxResponseSize is the size of the longest response line accepted from a plugin.
+const maxResponseSize = 1 << 20
+
+// request is the format of the lines sent to plugins.
+type request struct {
+	Method string `json:"method"`
+	Params any    `json:"params,omitempty"`
+}
+
+// response is the format of the lines received from plugins.
+type response struct {
+	Result json.RawMessage `json:"result"`
+	Error  string          `json:"error"`
+}
+
+// helloParams holds the params of the hello request.
+type helloParams struct {
+	Version int `json:"version"`
+}
+
+// helloResult holds the result of the hello request.
+type helloResult struct {
+	Version int      `json:"version"`
+	Methods []string `json:"methods"`
+}
+
+// Error indicates that a plugin answered a request with an error.
+type Error struct {
+	// Path is the path to the plugin executable.
+	Path string
+
+	// Method is the name of the failed request.
+	Method string
+
+	// Message is the error returned by the plugin.
+	Message string
+}
+
+// Error returns the error returned by the plugin along with the identity of the plugin.
+func (e *Error) Error() string {
+	return fmt.Sprintf("plugin %s failed %s: %s", e.Path, e.Method, e.Message)
+}
+
+// process is a running instance of a plugin.
+type process struct {
+	// cmd is the running plugin.
+	cmd *exec.Cmd
+
+	// stdin is the write end of the stdin of the plugin.
+	stdin io.WriteCloser
+
+	// lines receives the lines written by the plugin to its stdout and is closed when the
+	// plugin closes its stdout.
+	lines chan []byte
+
+	// killed is closed once the plugin is killed so that nothing waits on "lines" anymore.
+	killed chan struct{}
+}
+
+// kill terminates the plugin without waiting for it to exit cleanly.
+func (p *process) kill() {
+	close(p.killed)
+	p.stdin.Close()
+	p.cmd.Process.Kill()
+}
+
+// Plugin is a connection to a plugin executable, which is started on demand.  It is safe for
+// concurrent use: requests are serialized.
+type Plugin struct {
+	// path is the path to the plugin executable.
+	path string
+
+	// timeout is how long the plugin has to answer a request.
+	timeout time.Duration
+
+	// mu protects the fields below and serializes requests.
+	mu sync.Mutex
+
+	// proc is the running instance of the plugin, or nil if it has to be started.
+	proc *process
+
+	// methods is the set of methods that the plugin implements.
+	methods map[string]bool
+}
+
+// Start launches the plugin at "path" and checks that it speaks our protocol.  The plugin has
+// "timeout" to answer every request, or DefaultTimeout if zero.
+func Start(path string, timeout time.Duration) (*Plugin, error) {
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	p := &Plugin{path: path, timeout: timeout}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Path returns the path to the plugin executable.
+func (p *Plugin) Path() string {
+	return p.path
+}
+
+// Implements returns true if the plugin announced that it implements "method".
+func (p *Plugin) Implements(method string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.methods[method]
+}
+
+// Close terminates the plugin.
+func (p *Plugin) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stop()
+}
+
+// stop kills the running plugin, if any, so that the next request starts it again.  Must be
+// called with "mu" held.
+func (p *Plugin) stop() {
+	if p.proc != nil {
+		p.proc.kill()
+		p.proc = nil
+	}
+}
+
+// start launches the plugin and greets it.  Must be called with "mu" held.
+func (p *Plugin) start() error {
+	cmd := exec.Command(p.path)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("cannot start plugin %s: %v", p.path, err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("cannot start plugin %s: %v", p.path, err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cannot start plugin %s: %v", p.path, err)
+	}
+
+	proc := &process{cmd: cmd, stdin: stdin, lines: make(chan []byte), killed: make(chan struct{})}
+	go func() {
+		defer cmd.Wait()
+		defer close(proc.lines)
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(nil, maxResponseSize)
+		for scanner.Scan() {
+			select {
+			case proc.lines <- append([]byte{}, scanner.Bytes()...):
+			case <-proc.killed:
+				return
+			}
+		}
+	}()
+	p.proc = proc
+
+	var hello helloResult
+	if err := p.roundTrip("hello", helloParams{Version: ProtocolVersion}, &hello); err != nil {
+		p.stop()
+		return err
+	}
+	if hello.Version != ProtocolVersion {
+		p.stop()
+		return fmt.Errorf("plugin %s speaks protocol version %d but we only support %d", p.path, hello.Version, ProtocolVersion)
+	}
+	p.methods = make(map[string]bool)
+	for _, method := range hello.Methods {
+		p.methods[method] = true
+	}
+	return nil
+}
+
+// roundTrip sends the request "method" with "params" to the running plugin and decodes its
+// result into "result".  If the plugin misbehaves, it is killed so that the next request
+// starts it again.  Must be called with "mu" held.
+func (p *Plugin) roundTrip(method string, params any, result any) error {
+	line, err := json.Marshal(request{Method: method, Params: params})
+	if err != nil {
+		return fmt.Errorf("cannot encode %s request for plugin %s: %v", method, p.path, err)
+	}
+
+	reply, err := p.exchange(append(line, '\n'))
+	if err != nil {
+		p.stop()
+		return fmt.Errorf("plugin %s failed %s: %v", p.path, method, err)
+	}
+
+	var resp response
+	if err := json.Unmarshal(reply, &resp); err != nil {
+		p.stop()
+		return fmt.Errorf("plugin %s sent an invalid response to %s: %v", p.path, method, err)
+	}
+	if resp.Error != "" {
+		return &Error{Path: p.path, Method: method, Message: resp.Error}
+	}
+	if result != nil {
+		if err := json.Unmarshal(resp.Result, result); err != nil {
+			return fmt.Errorf("plugin %s sent an invalid result for %s: %v", p.path, method, err)
+		}
+	}
+	return nil
+}
+
+// exchange writes "line" to the running plugin and waits for the line it answers with.  Must
+// be called with "mu" held.
+func (p *Plugin) exchange(line []byte) ([]byte, error) {
+	if _, err := p.proc.stdin.Write(line); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case reply, ok := <-p.proc.lines:
+		if !ok {
+			return nil, errors.New("plugin exited")
+		}
+		return reply, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("no answer within %v", p.timeout)
+	}
+}
+
+// call sends the request "method" with "params" to the plugin, starting it if necessary, and
+// decodes its result into "result".
+func (p *Plugin) call(method string, params any, result any) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.proc == nil {
+		if err := p.start(); err != nil {
+			return err
+		}
+	}
+	if !p.methods[method] {
+		return fmt.Errorf("plugin %s does not implement %s", p.path, method)
+	}
+	return p.roundTrip(method, params, result)
+}
@@ -0,0 +1,319 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/policy"
+)
+
+// pluginModeEnv is the environment variable that makes the test binary act as a plugin.  Its
+// value selects how the plugin behaves: see runPlugin.
+const pluginModeEnv = "SSH_AGENT_SWITCHER_TEST_PLUGIN"
+
+// pluginMarkerEnv is the environment variable that holds the path to the file that the
+// "crash-once" plugin creates the first time it crashes.
+const pluginMarkerEnv = "SSH_AGENT_SWITCHER_TEST_PLUGIN_MARKER"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(pluginModeEnv); mode != "" {
+		os.Exit(runPlugin(mode))
+	}
+	os.Exit(m.Run())
+}
+
+// runPlugin serves the plugin protocol on stdin and stdout in the way "mode" says and returns
+// the exit code of the plugin.
+func runPlugin(mode string) int {
+	stdin := bufio.NewScanner(os.Stdin)
+	reply := func(v any) {
+		line, _ := json.Marshal(v)
+		fmt.Printf("%s\n", line)
+	}
+
+	switch mode {
+	case "exit":
+		return 1
+	case "old-version":
+		reply(map[string]any{"result": map[string]any{"version": ProtocolVersion + 1}})
+		return 0
+	}
+
+	for stdin.Scan() {
+		var req struct {
+			Method string          `json:"method"`
+			Params json.RawMessage `json:"params"`
+		}
+		if err := json.Unmarshal(stdin.Bytes(), &req); err != nil {
+			return 2
+		}
+		if req.Method == "hello" {
+			methods := []string{"discover", "checkSign"}
+			if mode == "discover-only" {
+				methods = methods[:1]
+			}
+			reply(map[string]any{"result": map[string]any{"version": ProtocolVersion, "methods": methods}})
+			continue
+		}
+
+		switch mode {
+		case "crash":
+			return 1
+		case "crash-once":
+			marker := os.Getenv(pluginMarkerEnv)
+			if _, err := os.Stat(marker); err != nil {
+				os.WriteFile(marker, nil, 0600)
+				return 1
+			}
+		case "hang":
+			for stdin.Scan() {
+			}
+			return 0
+		case "garbage":
+			fmt.Println("this is not json")
+			continue
+		case "oversized":
+			fmt.Printf(`{"result": {"reason": "%s"}}`+"\n", strings.Repeat("x", maxResponseSize))
+			continue
+		case "bad-result":
+			reply(map[string]any{"result": map[string]any{"allow": "yes", "candidates": "none"}})
+			continue
+		}
+
+		switch req.Method {
+		case "discover":
+			reply(map[string]any{"result": map[string]any{
+				"candidates": []map[string]any{
+					{"path": "/run/vault.sock", "origin": "from the vault", "explicit": true},
+					{"path": ""},
+					{"path": "/run/other.sock"},
+				},
+				"skipped": []map[string]any{
+					{"path": "/run/old.sock", "reason": "expired"},
+				},
+			}})
+
+		case "checkSign":
+			var params checkSignParams
+			if err := json.Unmarshal(req.Params, &params); err != nil {
+				return 2
+			}
+			switch {
+			case params.Fingerprint == "SHA256:revoked":
+				reply(map[string]any{"result": map[string]any{"allow": false, "reason": "key revoked"}})
+			case params.Fingerprint == "SHA256:unexplained":
+				reply(map[string]any{"result": map[string]any{"allow": false}})
+			case params.Fingerprint == "SHA256:broken":
+				reply(map[string]any{"error": "backend unavailable"})
+			case params.Fingerprint == "SHA256:confirm":
+				reply(map[string]any{"result": map[string]any{"allow": true, "confirm": true}})
+			case params.Host != nil && params.Host.Forwarding:
+				reply(map[string]any{"result": map[string]any{"allow": false, "reason": "forwarded to " + params.Host.Name}})
+			default:
+				reply(map[string]any{"result": map[string]any{"allow": true}})
+			}
+
+		default:
+			reply(map[string]any{"error": "unknown method " + req.Method})
+		}
+	}
+	return 0
+}
+
+// startPlugin starts the test binary as a plugin that behaves as "mode" says and stops it when
+// the test finishes.
+func startPlugin(t *testing.T, mode string, timeout time.Duration) *Plugin {
+	t.Helper()
+	t.Setenv(pluginModeEnv, mode)
+	t.Setenv(pluginMarkerEnv, filepath.Join(t.TempDir(), "crashed"))
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Cannot find test binary: %v", err)
+	}
+	p, err := Start(exe, timeout)
+	if err != nil {
+		t.Fatalf("Start failed: %v", err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+func TestStartErrors(t *testing.T) {
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatalf("Cannot find test binary: %v", err)
+	}
+
+	for name, test := range map[string]struct {
+		path    string
+		mode    string
+		wantErr string
+	}{
+		"missing executable": {path: filepath.Join(t.TempDir(), "missing"), wantErr: "cannot start plugin"},
+		"exits right away":   {path: exe, mode: "exit", wantErr: "failed hello: plugin exited"},
+		"other version":      {path: exe, mode: "old-version", wantErr: "speaks protocol version 2"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(pluginModeEnv, test.mode)
+			p, err := Start(test.path, time.Second)
+			if err == nil {
+				p.Close()
+				t.Fatalf("Start succeeded; want error %q", test.wantErr)
+			}
+			if !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Start returned %q; want %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestImplements(t *testing.T) {
+	p := startPlugin(t, "discover-only", time.Second)
+	if !p.Implements("discover") || p.Implements("checkSign") {
+		t.Errorf("Plugin does not implement the methods that it announced")
+	}
+}
+
+func TestDiscoverer(t *testing.T) {
+	p := startPlugin(t, "good", time.Second)
+	candidates, skipped, err := (&Discoverer{Plugin: p}).Discover()
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+
+	if len(candidates) != 2 {
+		t.Fatalf("Discover returned candidates %v; want 2", candidates)
+	}
+	if c := candidates[0]; c.Path != "/run/vault.sock" || c.Origin != "from the vault" || !c.Explicit {
+		t.Errorf("Discover returned first candidate %+v; want the one from the vault", c)
+	}
+	if c := candidates[1]; c.Path != "/run/other.sock" || c.Origin != "from plugin "+p.Path() || c.Explicit {
+		t.Errorf("Discover returned second candidate %+v; want one from the plugin", c)
+	}
+	if len(skipped) != 1 || skipped[0].Path != "/run/old.sock" || skipped[0].Reason != "expired" {
+		t.Errorf("Discover returned skipped %v; want /run/old.sock", skipped)
+	}
+}
+
+func TestPolicyCheckSign(t *testing.T) {
+	p := &Policy{Plugin: startPlugin(t, "good", time.Second)}
+
+	for name, test := range map[string]struct {
+		sign policy.Sign
+
+		wantErr     string
+		wantConfirm bool
+	}{
+		"allowed": {
+			sign: policy.Sign{Fingerprint: "SHA256:good", Client: "ssh"},
+		},
+		"confirm": {
+			sign:        policy.Sign{Fingerprint: "SHA256:confirm", Client: "ssh"},
+			wantConfirm: true,
+		},
+		"denied": {
+			sign:    policy.Sign{Fingerprint: "SHA256:revoked", Client: "ssh"},
+			wantErr: "use of key SHA256:revoked denied by plugin " + p.Plugin.Path() + ": key revoked",
+		},
+		"denied without reason": {
+			sign:    policy.Sign{Fingerprint: "SHA256:unexplained", Client: "ssh"},
+			wantErr: "no reason given",
+		},
+		"denied by host": {
+			sign: policy.Sign{Fingerprint: "SHA256:good", Client: "ssh", Host: &policy.Host{
+				KeyFingerprint: "SHA256:host", Name: "example.com", Forwarding: true,
+			}},
+			wantErr: "forwarded to example.com",
+		},
+		"plugin error": {
+			sign:    policy.Sign{Fingerprint: "SHA256:broken", Client: "ssh"},
+			wantErr: "use of key SHA256:broken denied: plugin " + p.Plugin.Path() + " failed checkSign: backend unavailable",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rule, err := p.CheckSign(test.sign)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("CheckSign returned %v; want error %q", err, test.wantErr)
+				}
+				if rule != nil {
+					t.Errorf("CheckSign returned rule %+v with an error", rule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CheckSign failed: %v", err)
+			}
+			if confirm := rule != nil && rule.Confirm; confirm != test.wantConfirm {
+				t.Errorf("CheckSign returned rule %+v; want confirm %v", rule, test.wantConfirm)
+			}
+		})
+	}
+}
+
+func TestPolicyFailsClosed(t *testing.T) {
+	for mode, wantErr := range map[string]string{
+		"crash":         "failed checkSign: plugin exited",
+		"hang":          "failed checkSign: no answer within 100ms",
+		"garbage":       "sent an invalid response to checkSign",
+		"oversized":     "failed checkSign: plugin exited",
+		"bad-result":    "sent an invalid result for checkSign",
+		"discover-only": "does not implement checkSign",
+	} {
+		t.Run(mode, func(t *testing.T) {
+			p := &Policy{Plugin: startPlugin(t, mode, 100*time.Millisecond)}
+			rule, err := p.CheckSign(policy.Sign{Fingerprint: "SHA256:good", Client: "ssh"})
+			if err == nil || !strings.Contains(err.Error(), wantErr) {
+				t.Fatalf("CheckSign returned %v; want error %q", err, wantErr)
+			}
+			if !strings.HasPrefix(err.Error(), "use of key SHA256:good denied: ") {
+				t.Errorf("CheckSign returned %q; want the key to be denied", err)
+			}
+			if rule != nil {
+				t.Errorf("CheckSign returned rule %+v with an error", rule)
+			}
+		})
+	}
+}
+
+func TestRestartAfterCrash(t *testing.T) {
+	p := &Policy{Plugin: startPlugin(t, "crash-once", time.Second)}
+	sign := policy.Sign{Fingerprint: "SHA256:good", Client: "ssh"}
+
+	if _, err := p.CheckSign(sign); err == nil || !strings.Contains(err.Error(), "plugin exited") {
+		t.Fatalf("CheckSign returned %v; want the crash of the plugin", err)
+	}
+	if _, err := p.CheckSign(sign); err != nil {
+		t.Errorf("CheckSign failed after restarting the plugin: %v", err)
+	}
+}
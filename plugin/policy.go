@@ -0,0 +1,102 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/jmmv/ssh-agent-switcher/policy"
+)
+
+// checkSignHost describes the server in the params of the checkSign request.
+type checkSignHost struct {
+	KeyFingerprint string `json:"keyFingerprint"`
+	Name           string `json:"name,omitempty"`
+	Forwarding     bool   `json:"forwarding"`
+}
+
+// checkSignParams holds the params of the checkSign request.
+type checkSignParams struct {
+	Fingerprint string         `json:"fingerprint"`
+	ClientExe   string         `json:"clientExe,omitempty"`
+	Client      string         `json:"client"`
+	Host        *checkSignHost `json:"host,omitempty"`
+}
+
+// checkSignResult holds the result of the checkSign request.
+type checkSignResult struct {
+	Allow   bool   `json:"allow"`
+	Reason  string `json:"reason"`
+	Confirm bool   `json:"confirm"`
+	Polkit  bool   `json:"polkit"`
+}
+
+// Policy is a policy.Checker backed by a plugin that implements the "checkSign" method.  The
+// params of the request describe the sign request as in policy.Sign, and its result says
+// whether it is allowed and, if so, whether the user must approve it via a confirmation prompt
+// or via polkit (lines wrapped for readability):
+//
+//	{"method": "checkSign", "params": {"fingerprint": "SHA256:...", "clientExe": "/usr/bin/ssh",
+//	    "client": "/usr/bin/ssh (pid 1234)", "host": {"keyFingerprint": "SHA256:...",
+//	    "name": "example.com", "forwarding": false}}}
+//	{"result": {"allow": false, "reason": "key revoked"}}
+//
+// "clientExe" and "host" are omitted when unknown.  Sign requests are denied if the plugin
+// fails.
+type Policy struct {
+	// Plugin is the plugin to ask about sign requests.
+	Plugin *Plugin
+}
+
+// CheckSign asks the plugin whether "sign" can be issued.
+func (p *Policy) CheckSign(sign policy.Sign) (*policy.Rule, error) {
+	params := checkSignParams{
+		Fingerprint: sign.Fingerprint,
+		ClientExe:   sign.ClientExe,
+		Client:      sign.Client,
+	}
+	if sign.Host != nil {
+		params.Host = &checkSignHost{
+			KeyFingerprint: sign.Host.KeyFingerprint,
+			Name:           sign.Host.Name,
+			Forwarding:     sign.Host.Forwarding,
+		}
+	}
+
+	var result checkSignResult
+	if err := p.Plugin.call("checkSign", params, &result); err != nil {
+		return nil, fmt.Errorf("use of key %s denied: %v", sign.Fingerprint, err)
+	}
+	if !result.Allow {
+		reason := result.Reason
+		if reason == "" {
+			reason = "no reason given"
+		}
+		return nil, fmt.Errorf("use of key %s denied by plugin %s: %s", sign.Fingerprint, p.Plugin.Path(), reason)
+	}
+	if !result.Confirm && !result.Polkit {
+		return nil, nil
+	}
+	return &policy.Rule{Fingerprint: sign.Fingerprint, Confirm: result.Confirm, Polkit: result.Polkit}, nil
+}
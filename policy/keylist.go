@@ -0,0 +1,146 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package policy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+)
+
+// keyListCheckInterval is how often we check whether a key list file changed.
+const keyListCheckInterval = time.Second
+
+// keyList is a set of key fingerprints loaded from a file that is maintained elsewhere, such
+// as by a security team, and that is reloaded when it changes.
+type keyList struct {
+	path string
+
+	mu           sync.Mutex
+	fingerprints map[string]bool
+	modTime      time.Time
+	size         int64
+	checked      time.Time
+}
+
+// parseKeyList extracts the fingerprints of the keys listed in "data", which holds one key per
+// line as a fingerprint, as printed by ssh-add -l, or as an authorized_keys entry.  Empty lines
+// and lines starting with # are ignored.
+func parseKeyList(data []byte) (map[string]bool, error) {
+	fingerprints := make(map[string]bool)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fingerprint, ok := lineFingerprint(strings.Fields(line))
+		if !ok {
+			return nil, fmt.Errorf("line %d: no key fingerprint nor public key found", lineno)
+		}
+		fingerprints[fingerprint] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return fingerprints, nil
+}
+
+// lineFingerprint returns the fingerprint of the key described by the "fields" of a line of a
+// key list file.
+//
+// authorized_keys entries are recognized by a key type followed by a base64 blob that embeds
+// the same type, which skips over the options that may precede them.  Any other line must
+// contain a fingerprint, like the lines printed by ssh-add -l do.
+func lineFingerprint(fields []string) (string, bool) {
+	for i := 0; i+1 < len(fields); i++ {
+		blob, err := base64.StdEncoding.DecodeString(fields[i+1])
+		if err == nil && codec.KeyType(blob) == fields[i] {
+			return codec.Fingerprint(blob), true
+		}
+	}
+	for _, field := range fields {
+		if isFingerprint(field) {
+			return field, true
+		}
+	}
+	return "", false
+}
+
+// loadKeyList reads the key list file at "path".
+func loadKeyList(path string) (*keyList, error) {
+	l := &keyList{path: path}
+	if _, err := l.refresh(time.Now()); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// refresh reloads the key list if its file changed since we last read it, checking at most
+// once every keyListCheckInterval.  Returns true if the list was reloaded.  On error, the
+// previous contents of the list remain in effect.
+func (l *keyList) refresh(now time.Time) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.checked.IsZero() && now.Sub(l.checked) < keyListCheckInterval {
+		return false, nil
+	}
+	l.checked = now
+
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		return false, err
+	}
+	if l.fingerprints != nil && fi.ModTime().Equal(l.modTime) && fi.Size() == l.size {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return false, err
+	}
+	fingerprints, err := parseKeyList(data)
+	if err != nil {
+		return false, fmt.Errorf("invalid key list %s: %v", l.path, err)
+	}
+	l.fingerprints = fingerprints
+	l.modTime = fi.ModTime()
+	l.size = fi.Size()
+	return true, nil
+}
+
+// contains returns true if the key with "fingerprint" is in the list.
+func (l *keyList) contains(fingerprint string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.fingerprints[fingerprint]
+}
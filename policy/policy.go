@@ -0,0 +1,390 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package policy implements the per-key usage rules that decide which clients can use which
+// keys, to authenticate to which hosts, and how often.
+package policy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Rule describes how a single key may be used.
+type Rule struct {
+	// Fingerprint identifies the key in the format printed by ssh-add -l.
+	Fingerprint string `json:"fingerprint"`
+
+	// AllowClientExe lists the executables, as exact paths or glob patterns, that can use
+	// the key.  If empty, any client can use it.
+	AllowClientExe []string `json:"allowClientExe"`
+
+	// Confirm asks the user to approve every use of the key.
+	Confirm bool `json:"confirm"`
+
+	// Polkit asks polkit to authorize every use of the key, which lets the desktop's standard
+	// authentication dialog approve it.
+	Polkit bool `json:"polkit"`
+
+	// Deny rejects all uses of the key.
+	Deny bool `json:"deny"`
+
+	// AllowHosts lists the hosts, as glob patterns that match their names in the known hosts
+	// files or as host key fingerprints, to which the key can authenticate.  If empty, the
+	// key can be used with any host, including unknown ones.
+	AllowHosts []string `json:"allowHosts"`
+
+	// MaxSignsPerMinute caps how many sign requests can be issued with the key in any
+	// one-minute window across all clients.  Zero means no limit.
+	MaxSignsPerMinute int `json:"maxSignsPerMinute"`
+}
+
+// Policy holds the per-key rules loaded from a policy file.
+type Policy struct {
+	// rules maps key fingerprints to their rules.
+	rules map[string]*Rule
+
+	// signs counts the recent sign requests issued with each rate-limited key.
+	signs *RateLimiter
+
+	// allowLists and denyLists are the key lists that the policy file references.  If there
+	// are allow lists, only the keys in any of them can be used.
+	allowLists []*keyList
+	denyLists  []*keyList
+
+	// OnReload is called, if not nil, when a key list is reloaded after a change and when
+	// reloading it fails, in which case its previous contents remain in effect.
+	OnReload func(path string, err error)
+}
+
+// fileContents is the format of policy files.
+type fileContents struct {
+	Keys []*Rule `json:"keys"`
+
+	// AllowKeysFiles and DenyKeysFiles are paths to key list files, relative to the directory
+	// of the policy file unless absolute.
+	AllowKeysFiles []string `json:"allowKeysFiles"`
+	DenyKeysFiles  []string `json:"denyKeysFiles"`
+}
+
+// loadKeyLists loads the key list files in "paths", relative to the directory of the policy
+// file at "policyPath".
+func loadKeyLists(policyPath string, paths []string) ([]*keyList, error) {
+	var lists []*keyList
+	for _, path := range paths {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(policyPath), path)
+		}
+		list, err := loadKeyList(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy file %s: %v", policyPath, err)
+		}
+		lists = append(lists, list)
+	}
+	return lists, nil
+}
+
+// isFingerprint returns true if "s" is a SHA256 key fingerprint in the format printed by
+// ssh-add -l.
+func isFingerprint(s string) bool {
+	digest, ok := strings.CutPrefix(s, "SHA256:")
+	if !ok {
+		return false
+	}
+	raw, err := base64.RawStdEncoding.DecodeString(digest)
+	return err == nil && len(raw) == sha256.Size
+}
+
+// Load reads the per-key rules from the JSON file at "path".
+func Load(path string) (*Policy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var contents fileContents
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&contents); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %v", path, err)
+	}
+
+	policy := &Policy{
+		rules: make(map[string]*Rule),
+		signs: NewRateLimiter(time.Minute),
+	}
+	for _, rule := range contents.Keys {
+		if !isFingerprint(rule.Fingerprint) {
+			return nil, fmt.Errorf("invalid policy file %s: fingerprint %q is not a SHA256 fingerprint", path, rule.Fingerprint)
+		}
+		for _, pattern := range rule.AllowClientExe {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid policy file %s: invalid allowClientExe pattern %q for %s: %v", path, pattern, rule.Fingerprint, err)
+			}
+		}
+		for _, pattern := range rule.AllowHosts {
+			if strings.HasPrefix(pattern, "SHA256:") && !isFingerprint(pattern) {
+				return nil, fmt.Errorf("invalid policy file %s: allowHosts entry %q for %s is not a SHA256 fingerprint", path, pattern, rule.Fingerprint)
+			}
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid policy file %s: invalid allowHosts pattern %q for %s: %v", path, pattern, rule.Fingerprint, err)
+			}
+		}
+		if _, ok := policy.rules[rule.Fingerprint]; ok {
+			return nil, fmt.Errorf("invalid policy file %s: duplicate rules for %s", path, rule.Fingerprint)
+		}
+		if rule.MaxSignsPerMinute < 0 {
+			return nil, fmt.Errorf("invalid policy file %s: negative maxSignsPerMinute for %s", path, rule.Fingerprint)
+		}
+		policy.rules[rule.Fingerprint] = rule
+	}
+
+	if policy.allowLists, err = loadKeyLists(path, contents.AllowKeysFiles); err != nil {
+		return nil, err
+	}
+	if policy.denyLists, err = loadKeyLists(path, contents.DenyKeysFiles); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// refreshKeyLists reloads the key lists that changed and reports the outcome via OnReload.
+func (p *Policy) refreshKeyLists(now time.Time) {
+	for _, lists := range [][]*keyList{p.allowLists, p.denyLists} {
+		for _, list := range lists {
+			reloaded, err := list.refresh(now)
+			if (reloaded || err != nil) && p.OnReload != nil {
+				p.OnReload(list.path, err)
+			}
+		}
+	}
+}
+
+// checkKeyLists returns an error if the key with "fingerprint" is in a deny list or, if there
+// are allow lists, in none of them.
+func (p *Policy) checkKeyLists(fingerprint string) error {
+	for _, list := range p.denyLists {
+		if list.contains(fingerprint) {
+			return fmt.Errorf("use of key %s denied by key list %s", fingerprint, list.path)
+		}
+	}
+	if len(p.allowLists) == 0 {
+		return nil
+	}
+	for _, list := range p.allowLists {
+		if list.contains(fingerprint) {
+			return nil
+		}
+	}
+	return fmt.Errorf("use of key %s denied: not in any allowed key list", fingerprint)
+}
+
+// Rule returns the rule for the key with "fingerprint", or nil if there is none.
+//
+// A nil policy has no rules.
+func (p *Policy) Rule(fingerprint string) *Rule {
+	if p == nil {
+		return nil
+	}
+	return p.rules[fingerprint]
+}
+
+// signsExceeded returns the error for sign requests with the key "rule" applies to that exceed
+// its rate limit.
+func signsExceeded(rule *Rule) error {
+	return fmt.Errorf("key %s exceeded its limit of %d signs per minute", rule.Fingerprint, rule.MaxSignsPerMinute)
+}
+
+// Host describes the server that a client is authenticating to.
+type Host struct {
+	// KeyFingerprint is the fingerprint of the host key of the server.
+	KeyFingerprint string
+
+	// Name is the name of the server as recorded in the known hosts files, or empty if
+	// unknown.
+	Name string
+
+	// Forwarding is true if the connection is being forwarded to the server instead of
+	// being used to authenticate to it.
+	Forwarding bool
+
+	// Description is a human-readable description of the server for error messages.
+	Description string
+}
+
+// hostAllowed returns an error if "host", which may be nil, is not one of the hosts allowed by
+// "rule".
+func (rule *Rule) hostAllowed(host *Host) error {
+	if len(rule.AllowHosts) == 0 {
+		return nil
+	}
+
+	if host == nil {
+		return fmt.Errorf("key %s is restricted to some hosts but the client did not say which host it is connecting to", rule.Fingerprint)
+	}
+	if host.Forwarding {
+		return fmt.Errorf("key %s is restricted to some hosts but is being used via an agent forwarded to %s", rule.Fingerprint, host.Description)
+	}
+
+	for _, pattern := range rule.AllowHosts {
+		if pattern == host.KeyFingerprint {
+			return nil
+		}
+		if host.Name != "" {
+			if matched, _ := filepath.Match(pattern, host.Name); matched {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("use of key %s for %s not allowed by policy", rule.Fingerprint, host.Description)
+}
+
+// Sign describes a sign request to be checked against a policy.
+type Sign struct {
+	// Fingerprint identifies the key to sign with.
+	Fingerprint string
+
+	// ClientExe is the path to the executable of the client, or empty if unknown.
+	ClientExe string
+
+	// Client is a human-readable description of the client for error messages.
+	Client string
+
+	// Host is the server the client is authenticating to, or nil if unknown.
+	Host *Host
+}
+
+// Checker decides whether sign requests can be issued.  Policy implements it for the rules of
+// a policy file, and other implementations can consult external policy engines.
+type Checker interface {
+	// CheckSign returns an error if the sign request "sign" must not be issued.  The
+	// returned rule, which may be nil, tells whether the request also needs to be approved
+	// by the user.
+	CheckSign(sign Sign) (*Rule, error)
+}
+
+// Recorder is implemented by the Checkers that limit how often keys can be used.  CheckSign
+// only rejects the requests that would exceed the limits, so that requests that the user
+// declines later on do not count against them, and the requests that go ahead must be
+// reported to RecordSign.
+type Recorder interface {
+	// RecordSign accounts for the sign request "sign", which CheckSign allowed and the user
+	// approved if needed, and returns an error if it exceeds any of the limits.
+	RecordSign(sign Sign) error
+}
+
+// Chain is a Checker that only allows sign requests that all of its checkers allow, in order.
+// The request needs to be approved by the user if any of the checkers says so.
+type Chain []Checker
+
+// CheckSign asks all checkers about "sign" and merges the approvals that they require.
+func (c Chain) CheckSign(sign Sign) (*Rule, error) {
+	var merged *Rule
+	for _, checker := range c {
+		rule, err := checker.CheckSign(sign)
+		if err != nil {
+			return nil, err
+		}
+		if rule == nil {
+			continue
+		}
+		if merged == nil {
+			merged = &Rule{Fingerprint: sign.Fingerprint}
+		}
+		merged.Confirm = merged.Confirm || rule.Confirm
+		merged.Polkit = merged.Polkit || rule.Polkit
+	}
+	return merged, nil
+}
+
+// RecordSign reports "sign" to all checkers that are Recorders, in order, and stops at the
+// first one that rejects it.
+func (c Chain) RecordSign(sign Sign) error {
+	for _, checker := range c {
+		if recorder, ok := checker.(Recorder); ok {
+			if err := recorder.RecordSign(sign); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CheckSign returns an error if the sign request "sign" must not be issued according to the
+// policy.  The returned rule, which is nil if the key has none, tells whether the request also
+// needs to be approved by the user.
+func (p *Policy) CheckSign(sign Sign) (*Rule, error) {
+	p.refreshKeyLists(time.Now())
+	if err := p.checkKeyLists(sign.Fingerprint); err != nil {
+		return nil, err
+	}
+
+	rule := p.Rule(sign.Fingerprint)
+	if rule == nil {
+		return nil, nil
+	}
+
+	if rule.Deny {
+		return nil, fmt.Errorf("use of key %s denied by policy", rule.Fingerprint)
+	}
+	if len(rule.AllowClientExe) > 0 && !MatchExe(rule.AllowClientExe, sign.ClientExe) {
+		return nil, fmt.Errorf("use of key %s by %s not allowed by policy", rule.Fingerprint, sign.Client)
+	}
+	if err := rule.hostAllowed(sign.Host); err != nil {
+		return nil, err
+	}
+	if rule.MaxSignsPerMinute > 0 && p.signs.Full(rule.Fingerprint, rule.MaxSignsPerMinute, time.Now()) {
+		return nil, signsExceeded(rule)
+	}
+	return rule, nil
+}
+
+// RecordSign accounts for "sign" and returns an error if the key has exceeded its rate limit.
+func (p *Policy) RecordSign(sign Sign) error {
+	rule := p.Rule(sign.Fingerprint)
+	if rule == nil || rule.MaxSignsPerMinute == 0 {
+		return nil
+	}
+	if !p.signs.Allow(rule.Fingerprint, rule.MaxSignsPerMinute, time.Now()) {
+		return signsExceeded(rule)
+	}
+	return nil
+}
+
+// MatchExe returns true if the executable "exe" matches any of the paths or glob patterns in
+// "patterns".
+func MatchExe(patterns []string, exe string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, exe); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,447 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package policy_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+	"github.com/jmmv/ssh-agent-switcher/policy"
+)
+
+// keyBlob returns the public key blob of a fake Ed25519 key derived from "seed".
+func keyBlob(seed byte) []byte {
+	blob := codec.AppendString(nil, []byte("ssh-ed25519"))
+	return codec.AppendString(blob, bytes.Repeat([]byte{seed}, 32))
+}
+
+// authorizedKey returns the authorized_keys entry for the fake key derived from "seed".
+func authorizedKey(seed byte) string {
+	return "ssh-ed25519 " + base64.StdEncoding.EncodeToString(keyBlob(seed)) + " user@host"
+}
+
+var (
+	// fp1 and fp2 are the fingerprints of two different keys.
+	fp1 = codec.Fingerprint(keyBlob(1))
+	fp2 = codec.Fingerprint(keyBlob(2))
+)
+
+// writeFiles creates the "files", which map names to contents, in a new directory and
+// returns the path to the directory.
+func writeFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatalf("Cannot create %s: %v", name, err)
+		}
+	}
+	return dir
+}
+
+// load writes the policy file "contents" along with the "files" that it references and loads
+// the policy.
+func load(t *testing.T, contents string, files map[string]string) (*policy.Policy, error) {
+	t.Helper()
+	all := map[string]string{"policy.json": contents}
+	for name, data := range files {
+		all[name] = data
+	}
+	return policy.Load(filepath.Join(writeFiles(t, all), "policy.json"))
+}
+
+func TestLoadMissingFile(t *testing.T) {
+	_, err := policy.Load(filepath.Join(t.TempDir(), "missing.json"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Load returned %v; want a not found error", err)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for name, test := range map[string]struct {
+		contents string
+		files    map[string]string
+		wantErr  string
+	}{
+		"malformed json": {
+			contents: `{"keys": [`,
+			wantErr:  "unexpected EOF",
+		},
+		"not an object": {
+			contents: `["keys"]`,
+			wantErr:  "cannot unmarshal array",
+		},
+		"unknown top-level key": {
+			contents: `{"rules": []}`,
+			wantErr:  `unknown field "rules"`,
+		},
+		"unknown rule key": {
+			contents: fmt.Sprintf(`{"keys": [{"fingerprint": %q, "allowClient": ["/bin/ssh"]}]}`, fp1),
+			wantErr:  `unknown field "allowClient"`,
+		},
+		"wrong value type": {
+			contents: fmt.Sprintf(`{"keys": [{"fingerprint": %q, "deny": "yes"}]}`, fp1),
+			wantErr:  "cannot unmarshal string",
+		},
+		"missing fingerprint": {
+			contents: `{"keys": [{"deny": true}]}`,
+			wantErr:  `fingerprint "" is not a SHA256 fingerprint`,
+		},
+		"md5 fingerprint": {
+			contents: `{"keys": [{"fingerprint": "MD5:00:11:22:33:44:55:66:77:88:99:aa:bb:cc:dd:ee:ff"}]}`,
+			wantErr:  "is not a SHA256 fingerprint",
+		},
+		"truncated fingerprint": {
+			contents: `{"keys": [{"fingerprint": "SHA256:abcd"}]}`,
+			wantErr:  "is not a SHA256 fingerprint",
+		},
+		"duplicate rules": {
+			contents: fmt.Sprintf(`{"keys": [{"fingerprint": %q}, {"fingerprint": %q, "deny": true}]}`, fp1, fp1),
+			wantErr:  "duplicate rules for " + fp1,
+		},
+		"bad exe pattern": {
+			contents: fmt.Sprintf(`{"keys": [{"fingerprint": %q, "allowClientExe": ["/usr/bin/["]}]}`, fp1),
+			wantErr:  "invalid allowClientExe pattern",
+		},
+		"bad host pattern": {
+			contents: fmt.Sprintf(`{"keys": [{"fingerprint": %q, "allowHosts": ["[host"]}]}`, fp1),
+			wantErr:  "invalid allowHosts pattern",
+		},
+		"bad host fingerprint": {
+			contents: fmt.Sprintf(`{"keys": [{"fingerprint": %q, "allowHosts": ["SHA256:short"]}]}`, fp1),
+			wantErr:  "is not a SHA256 fingerprint",
+		},
+		"negative rate limit": {
+			contents: fmt.Sprintf(`{"keys": [{"fingerprint": %q, "maxSignsPerMinute": -1}]}`, fp1),
+			wantErr:  "negative maxSignsPerMinute",
+		},
+		"missing allow list": {
+			contents: `{"allowKeysFiles": ["allowed.txt"]}`,
+			wantErr:  "allowed.txt: no such file",
+		},
+		"missing deny list": {
+			contents: `{"denyKeysFiles": ["denied.txt"]}`,
+			wantErr:  "denied.txt: no such file",
+		},
+		"malformed key list": {
+			contents: `{"denyKeysFiles": ["denied.txt"]}`,
+			files:    map[string]string{"denied.txt": "# Revoked keys.\n" + fp1 + "\nnot a key\n"},
+			wantErr:  "line 3: no key fingerprint nor public key found",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := load(t, test.contents, test.files)
+			if err == nil {
+				t.Fatalf("Load succeeded; want error %q", test.wantErr)
+			}
+			if !strings.HasPrefix(err.Error(), "invalid policy file ") || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Load returned %q; want an invalid policy file error with %q", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckSign(t *testing.T) {
+	knownHost := &policy.Host{KeyFingerprint: fp2, Name: "build.example.com", Description: "build.example.com"}
+
+	for name, test := range map[string]struct {
+		contents string
+		files    map[string]string
+		sign     policy.Sign
+
+		wantErr     string
+		wantConfirm bool
+	}{
+		"empty policy": {
+			contents: `{}`,
+			sign:     policy.Sign{Fingerprint: fp1},
+		},
+		"key without rule": {
+			contents: fmt.Sprintf(`{"keys": [{"fingerprint": %q, "deny": true}]}`, fp2),
+			sign:     policy.Sign{Fingerprint: fp1},
+		},
+		"denied key": {
+			contents: fmt.Sprintf(`{"keys": [{"fingerprint": %q, "deny": true}]}`, fp1),
+			sign:     policy.Sign{Fingerprint: fp1},
+			wantErr:  "use of key " + fp1 + " denied by policy",
+		},
+		"confirmed key": {
+			contents:    fmt.Sprintf(`{"keys": [{"fingerprint": %q, "confirm": true}]}`, fp1),
+			sign:        policy.Sign{Fingerprint: fp1},
+			wantConfirm: true,
+		},
+		"allowed client": {
+			contents: fmt.Sprintf(`{"keys": [{"fingerprint": %q, "allowClientExe": ["/usr/bin/*"]}]}`, fp1),
+			sign:     policy.Sign{Fingerprint: fp1, ClientExe: "/usr/bin/ssh"},
+		},
+		"other client": {
+			contents: fmt.Sprintf(`{"keys": [{"fingerprint": %q, "allowClientExe": ["/usr/bin/*"]}]}`, fp1),
+			sign:     policy.Sign{Fingerprint: fp1, ClientExe: "/tmp/ssh", Client: "pid 1"},
+			wantErr:  "by pid 1 not allowed by policy",
+		},
+		"unknown client": {
+			contents: fmt.Sprintf(`{"keys": [{"fingerprint": %q, "allowClientExe": ["/usr/bin/*"]}]}`, fp1),
+			sign:     policy.Sign{Fingerprint: fp1, Client: "unknown client"},
+			wantErr:  "not allowed by policy",
+		},
+		"host by name": {
+			contents: fmt.Sprintf(`{"keys": [{"fingerprint": %q, "allowHosts": ["*.example.com"]}]}`, fp1),
+			sign:     policy.Sign{Fingerprint: fp1, Host: knownHost},
+		},
+		"host by fingerprint": {
+			contents: fmt.Sprintf(`{"keys": [{"fingerprint": %q, "allowHosts": [%q]}]}`, fp1, fp2),
+			sign:     policy.Sign{Fingerprint: fp1, Host: &policy.Host{KeyFingerprint: fp2, Description: "unknown host"}},
+		},
+		"other host": {
+			contents: fmt.Sprintf(`{"keys": [{"fingerprint": %q, "allowHosts": ["*.example.org"]}]}`, fp1),
+			sign:     policy.Sign{Fingerprint: fp1, Host: knownHost},
+			wantErr:  "for build.example.com not allowed by policy",
+		},
+		"no host": {
+			contents: fmt.Sprintf(`{"keys": [{"fingerprint": %q, "allowHosts": ["*.example.com"]}]}`, fp1),
+			sign:     policy.Sign{Fingerprint: fp1},
+			wantErr:  "did not say which host",
+		},
+		"forwarded to host": {
+			contents: fmt.Sprintf(`{"keys": [{"fingerprint": %q, "allowHosts": ["*.example.com"]}]}`, fp1),
+			sign: policy.Sign{Fingerprint: fp1, Host: &policy.Host{
+				KeyFingerprint: fp2, Name: "build.example.com", Forwarding: true, Description: "build.example.com",
+			}},
+			wantErr: "via an agent forwarded to build.example.com",
+		},
+		"in allow list": {
+			contents: `{"allowKeysFiles": ["allowed.txt"]}`,
+			files:    map[string]string{"allowed.txt": fp1 + "\n"},
+			sign:     policy.Sign{Fingerprint: fp1},
+		},
+		"in allow list as authorized key": {
+			contents: `{"allowKeysFiles": ["allowed.txt"]}`,
+			files:    map[string]string{"allowed.txt": `restrict,command="true" ` + authorizedKey(1) + "\n"},
+			sign:     policy.Sign{Fingerprint: fp1},
+		},
+		"in second allow list": {
+			contents: `{"allowKeysFiles": ["first.txt", "second.txt"]}`,
+			files:    map[string]string{"first.txt": fp2 + "\n", "second.txt": fp1 + "\n"},
+			sign:     policy.Sign{Fingerprint: fp1},
+		},
+		"not in allow list": {
+			contents: `{"allowKeysFiles": ["allowed.txt"]}`,
+			files:    map[string]string{"allowed.txt": fp2 + "\n"},
+			sign:     policy.Sign{Fingerprint: fp1},
+			wantErr:  "not in any allowed key list",
+		},
+		"empty allow list": {
+			contents: `{"allowKeysFiles": ["allowed.txt"]}`,
+			files:    map[string]string{"allowed.txt": "# Nobody yet.\n\n"},
+			sign:     policy.Sign{Fingerprint: fp1},
+			wantErr:  "not in any allowed key list",
+		},
+		"in deny list": {
+			contents: `{"denyKeysFiles": ["denied.txt"]}`,
+			files:    map[string]string{"denied.txt": "256 " + fp1 + " user@host (ED25519)\n"},
+			sign:     policy.Sign{Fingerprint: fp1},
+			wantErr:  "denied by key list",
+		},
+		"not in deny list": {
+			contents: `{"denyKeysFiles": ["denied.txt"]}`,
+			files:    map[string]string{"denied.txt": authorizedKey(2) + "\n"},
+			sign:     policy.Sign{Fingerprint: fp1},
+		},
+		"empty deny list": {
+			contents: `{"denyKeysFiles": ["denied.txt"]}`,
+			files:    map[string]string{"denied.txt": ""},
+			sign:     policy.Sign{Fingerprint: fp1},
+		},
+		"deny list wins over allow list": {
+			contents: `{"allowKeysFiles": ["allowed.txt"], "denyKeysFiles": ["denied.txt"]}`,
+			files:    map[string]string{"allowed.txt": fp1 + "\n", "denied.txt": authorizedKey(1) + "\n"},
+			sign:     policy.Sign{Fingerprint: fp1},
+			wantErr:  "denied by key list",
+		},
+		"deny rule wins over allow list": {
+			contents: fmt.Sprintf(`{"keys": [{"fingerprint": %q, "deny": true}], "allowKeysFiles": ["allowed.txt"]}`, fp1),
+			files:    map[string]string{"allowed.txt": fp1 + "\n"},
+			sign:     policy.Sign{Fingerprint: fp1},
+			wantErr:  "denied by policy",
+		},
+		"allow list wins over rule": {
+			contents: fmt.Sprintf(`{"keys": [{"fingerprint": %q, "confirm": true}], "allowKeysFiles": ["allowed.txt"]}`, fp1),
+			files:    map[string]string{"allowed.txt": fp2 + "\n"},
+			sign:     policy.Sign{Fingerprint: fp1},
+			wantErr:  "not in any allowed key list",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p, err := load(t, test.contents, test.files)
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+
+			rule, err := p.CheckSign(test.sign)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("CheckSign returned %v; want error %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CheckSign failed: %v", err)
+			}
+			if confirm := rule != nil && rule.Confirm; confirm != test.wantConfirm {
+				t.Errorf("CheckSign returned rule %+v; want confirm %v", rule, test.wantConfirm)
+			}
+		})
+	}
+}
+
+func TestKeyListReload(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"policy.json": `{"denyKeysFiles": ["denied.txt"]}`,
+		"denied.txt":  "",
+	})
+	p, err := policy.Load(filepath.Join(dir, "policy.json"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	var reloads []error
+	p.OnReload = func(path string, err error) { reloads = append(reloads, err) }
+
+	sign := policy.Sign{Fingerprint: fp1}
+	if _, err := p.CheckSign(sign); err != nil {
+		t.Fatalf("CheckSign failed before denying the key: %v", err)
+	}
+
+	// replace rewrites the deny list and waits for the policy to check it again, which it
+	// does at most once per second.
+	denied := filepath.Join(dir, "denied.txt")
+	replace := func(contents string, mtime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(denied, []byte(contents), 0600); err != nil {
+			t.Fatalf("Cannot update deny list: %v", err)
+		}
+		if err := os.Chtimes(denied, mtime, mtime); err != nil {
+			t.Fatalf("Cannot update deny list: %v", err)
+		}
+		time.Sleep(1100 * time.Millisecond)
+	}
+
+	replace(fp1+"\n", time.Now().Add(time.Hour))
+	if _, err := p.CheckSign(sign); err == nil || !strings.Contains(err.Error(), "denied by key list") {
+		t.Errorf("CheckSign returned %v after denying the key; want the deny list error", err)
+	}
+	if len(reloads) != 1 || reloads[0] != nil {
+		t.Fatalf("OnReload got %v; want one successful reload", reloads)
+	}
+
+	replace("not a key\n", time.Now().Add(2*time.Hour))
+	if _, err := p.CheckSign(sign); err == nil || !strings.Contains(err.Error(), "denied by key list") {
+		t.Errorf("CheckSign returned %v after a bad reload; want the previous deny list to apply", err)
+	}
+	if len(reloads) != 2 || reloads[1] == nil || !strings.Contains(reloads[1].Error(), "line 1") {
+		t.Errorf("OnReload got %v; want the error of the bad reload", reloads)
+	}
+}
+
+func TestRecordSignRateLimit(t *testing.T) {
+	p, err := load(t, fmt.Sprintf(`{"keys": [{"fingerprint": %q, "maxSignsPerMinute": 2}]}`, fp1), nil)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+
+	sign := policy.Sign{Fingerprint: fp1}
+	for i := 0; i < 2; i++ {
+		if _, err := p.CheckSign(sign); err != nil {
+			t.Fatalf("CheckSign failed on sign %d: %v", i, err)
+		}
+		if err := p.RecordSign(sign); err != nil {
+			t.Fatalf("RecordSign failed on sign %d: %v", i, err)
+		}
+	}
+	if _, err := p.CheckSign(sign); err == nil || !strings.Contains(err.Error(), "exceeded its limit of 2 signs per minute") {
+		t.Errorf("CheckSign returned %v over the limit; want the rate limit error", err)
+	}
+	if err := p.RecordSign(sign); err == nil {
+		t.Errorf("RecordSign succeeded over the limit")
+	}
+
+	other := policy.Sign{Fingerprint: fp2}
+	if _, err := p.CheckSign(other); err != nil {
+		t.Errorf("CheckSign failed for a key without limit: %v", err)
+	}
+	if err := p.RecordSign(other); err != nil {
+		t.Errorf("RecordSign failed for a key without limit: %v", err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	for name, test := range map[string]struct {
+		events []time.Duration
+		undo   []time.Duration
+		at     time.Duration
+
+		wantFull bool
+	}{
+		"no events":           {at: 0, wantFull: false},
+		"under limit":         {events: []time.Duration{0}, at: time.Second, wantFull: false},
+		"at limit":            {events: []time.Duration{0, time.Second}, at: 2 * time.Second, wantFull: true},
+		"rejected over limit": {events: []time.Duration{0, time.Second, 2 * time.Second}, at: 30 * time.Second, wantFull: true},
+		"oldest expired":      {events: []time.Duration{0, time.Second}, at: time.Minute, wantFull: false},
+		"all expired":         {events: []time.Duration{0, time.Second}, at: time.Hour, wantFull: false},
+		"undone event":        {events: []time.Duration{0, time.Second}, undo: []time.Duration{time.Second}, at: 2 * time.Second, wantFull: false},
+		"undone unknown":      {events: []time.Duration{0, time.Second}, undo: []time.Duration{3 * time.Second}, at: 2 * time.Second, wantFull: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			const limit = 2
+			limiter := policy.NewRateLimiter(time.Minute)
+			for i, event := range test.events {
+				allowed := limiter.Allow("key", limit, start.Add(event))
+				if want := i < limit; allowed != want {
+					t.Errorf("Allow returned %v for event %d; want %v", allowed, i, want)
+				}
+			}
+			for _, event := range test.undo {
+				limiter.Undo("key", start.Add(event))
+			}
+
+			if full := limiter.Full("key", limit, start.Add(test.at)); full != test.wantFull {
+				t.Errorf("Full returned %v; want %v", full, test.wantFull)
+			}
+			if limiter.Full("other", limit, start.Add(test.at)) {
+				t.Errorf("Full returned true for a key without events")
+			}
+			if allowed := limiter.Allow("key", limit, start.Add(test.at)); allowed == test.wantFull {
+				t.Errorf("Allow returned %v after Full returned %v", allowed, test.wantFull)
+			}
+		})
+	}
+}
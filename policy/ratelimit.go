@@ -0,0 +1,99 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package policy
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter counts events per key over a sliding window of time.
+type RateLimiter struct {
+	// window is the period of time over which events are counted.
+	window time.Duration
+
+	// mu protects events.
+	mu sync.Mutex
+
+	// events records the times of the recent events for each key.
+	events map[string][]time.Time
+}
+
+// NewRateLimiter creates a rate limiter that counts events over "window".
+func NewRateLimiter(window time.Duration) *RateLimiter {
+	return &RateLimiter{
+		window: window,
+		events: make(map[string][]time.Time),
+	}
+}
+
+// Allow records an event for "key" at "now" and returns true unless "key" already had "limit"
+// events within the window, in which case the event is not recorded.
+func (l *RateLimiter) Allow(key string, limit int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := now.Add(-l.window)
+	recent := l.events[key]
+	for len(recent) > 0 && !recent[0].After(cutoff) {
+		recent = recent[1:]
+	}
+	if len(recent) >= limit {
+		l.events[key] = recent
+		return false
+	}
+	l.events[key] = append(recent, now)
+	return true
+}
+
+// Full returns true if "key" already had "limit" events within the window at "now", in which
+// case Allow would reject the next one.  Does not record any event.
+func (l *RateLimiter) Full(key string, limit int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := now.Add(-l.window)
+	count := 0
+	for _, t := range l.events[key] {
+		if t.After(cutoff) {
+			count++
+		}
+	}
+	return count >= limit
+}
+
+// Undo forgets the event recorded for "key" at "at" by a previous call to Allow, such as when
+// the event was rejected for other reasons and should not count against the limit.
+func (l *RateLimiter) Undo(key string, at time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	recent := l.events[key]
+	for i := len(recent) - 1; i >= 0; i-- {
+		if recent[i].Equal(at) {
+			l.events[key] = append(recent[:i], recent[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package proxy implements the agent protocol extensions that ssh-agent-switcher answers by
+// itself instead of forwarding them, such as the one through which instances recognize each
+// other when one proxies to another.
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+)
+
+// IdentifyExtension is the agent extension that ssh-agent-switcher answers by itself, without
+// forwarding it, so that other instances can tell it apart from real agents.
+const IdentifyExtension = "identify@ssh-agent-switcher"
+
+// IdentifyReply is the complete answer, including the length prefix, to an IdentifyExtension
+// request.
+var IdentifyReply = []byte{0, 0, 0, 1, codec.AgentSuccess}
+
+// IsIdentifyRequest checks whether the client request "msg", which includes the length prefix,
+// asks whether we are an ssh-agent-switcher instance.
+func IsIdentifyRequest(msg []byte) bool {
+	return codec.ExtensionName(msg) == IdentifyExtension
+}
+
+// Identify checks whether the agent at the other end of "conn" is an instance of
+// ssh-agent-switcher, waiting at most "timeout" for its answer.  Real agents reject the unknown
+// extension, which leaves "conn" usable.
+func Identify(conn net.Conn, timeout time.Duration) (bool, error) {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return false, err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	request := codec.AppendString([]byte{codec.AgentcExtension}, []byte(IdentifyExtension))
+	if err := codec.WriteMessage(conn, request); err != nil {
+		return false, fmt.Errorf("identification failed: %v", err)
+	}
+	reply, err := codec.ReadFrame(conn, nil, codec.DefaultMaxMessageSize)
+	if err != nil {
+		return false, fmt.Errorf("identification failed: %v", err)
+	}
+	return reply[4] == codec.AgentSuccess, nil
+}
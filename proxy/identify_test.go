@@ -0,0 +1,105 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package proxy_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+	"github.com/jmmv/ssh-agent-switcher/proxy"
+	"github.com/jmmv/ssh-agent-switcher/testutil"
+)
+
+// identifyRequest is the complete request, including the length prefix, that Identify sends.
+var identifyRequest = codec.Frame(codec.AppendString([]byte{codec.AgentcExtension}, []byte(proxy.IdentifyExtension)))
+
+func TestIsIdentifyRequest(t *testing.T) {
+	for name, test := range map[string]struct {
+		msg  []byte
+		want bool
+	}{
+		"identify":           {msg: identifyRequest, want: true},
+		"trailing data":      {msg: codec.Frame(append(codec.AppendString([]byte{codec.AgentcExtension}, []byte(proxy.IdentifyExtension)), 0)), want: true},
+		"truncated name":     {msg: identifyRequest[:len(identifyRequest)-1], want: false},
+		"truncated length":   {msg: identifyRequest[:7], want: false},
+		"only type":          {msg: identifyRequest[:5], want: false},
+		"only prefix":        {msg: identifyRequest[:4], want: false},
+		"empty":              {msg: nil, want: false},
+		"other extension":    {msg: codec.Frame(codec.AppendString([]byte{codec.AgentcExtension}, []byte("session-bind@openssh.com"))), want: false},
+		"extension prefix":   {msg: codec.Frame(codec.AppendString([]byte{codec.AgentcExtension}, []byte("identify@ssh-agent"))), want: false},
+		"other message type": {msg: codec.Frame(codec.AppendString([]byte{codec.AgentcRemoveIdentity}, []byte(proxy.IdentifyExtension))), want: false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got := proxy.IsIdentifyRequest(test.msg); got != test.want {
+				t.Errorf("IsIdentifyRequest(%x) = %v; want %v", test.msg, got, test.want)
+			}
+		})
+	}
+}
+
+func TestIdentify(t *testing.T) {
+	t.Run("switcher", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		go func() {
+			defer server.Close()
+			request, err := codec.NewRequestReader(server, codec.DefaultMaxMessageSize).Next()
+			if err == nil && proxy.IsIdentifyRequest(request) {
+				server.Write(proxy.IdentifyReply)
+			}
+		}()
+
+		switcher, err := proxy.Identify(client, time.Second)
+		if err != nil || !switcher {
+			t.Errorf("Identify returned %v, %v; want a switcher", switcher, err)
+		}
+	})
+
+	t.Run("agent", func(t *testing.T) {
+		agent := testutil.NewAgent(t, "key")
+		conn := agent.Pipe()
+		defer conn.Close()
+
+		switcher, err := proxy.Identify(conn, time.Second)
+		if err != nil || switcher {
+			t.Errorf("Identify returned %v, %v; want a real agent", switcher, err)
+		}
+		if ids, err := codec.RequestIdentities(conn, codec.DefaultMaxMessageSize); err != nil || len(ids) != 1 {
+			t.Errorf("Connection is unusable after Identify: %v, %v", ids, err)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		go codec.NewRequestReader(server, codec.DefaultMaxMessageSize).Next()
+
+		if _, err := proxy.Identify(client, 10*time.Millisecond); err == nil {
+			t.Errorf("Identify succeeded without an answer")
+		}
+	})
+}
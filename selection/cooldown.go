@@ -0,0 +1,95 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package selection
+
+import (
+	"sync"
+	"time"
+)
+
+// Cooldown remembers the candidate agents that recently failed so that selectors can skip them
+// for a while instead of paying for the same failure on every client connection.  It is safe
+// for concurrent use.
+type Cooldown struct {
+	// period is how long a failed candidate is skipped for.
+	period time.Duration
+
+	// mu protects all the fields below.
+	mu sync.Mutex
+
+	// failed maps the agent sockets that failed to when they can be tried again.
+	failed map[string]time.Time
+}
+
+// NewCooldown creates a cooldown that skips failed candidates for "period".
+func NewCooldown(period time.Duration) *Cooldown {
+	return &Cooldown{period: period, failed: make(map[string]time.Time)}
+}
+
+// Until returns when the agent socket at "path" can be tried again, if it is cooling down.
+//
+// A nil cooldown never skips any candidate.
+func (c *Cooldown) Until(path string) (time.Time, bool) {
+	if c == nil {
+		return time.Time{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	until, ok := c.failed[path]
+	if ok && !time.Now().Before(until) {
+		delete(c.failed, path)
+		return time.Time{}, false
+	}
+	return until, ok
+}
+
+// Fail records that the agent socket at "path" failed just now.
+//
+// A nil cooldown records nothing.
+func (c *Cooldown) Fail(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for p, until := range c.failed {
+		if !now.Before(until) {
+			delete(c.failed, p)
+		}
+	}
+	c.failed[path] = now.Add(c.period)
+}
+
+// Succeed records that the agent socket at "path" worked, so it is not skipped anymore.
+//
+// A nil cooldown records nothing.
+func (c *Cooldown) Succeed(path string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.failed, path)
+}
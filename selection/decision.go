@@ -0,0 +1,152 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package selection
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Decision records how an agent was selected for a client connection.
+type Decision struct {
+	// Time is when the selection finished.
+	Time time.Time
+
+	// Conn is the identifier of the client connection the selection was for.  Selectors do
+	// not know about connections so this is for the callers to fill in.
+	Conn uint64
+
+	// Candidates lists the agent sockets that were considered, in the order they were tried.
+	Candidates []string
+
+	// Rejected explains why each of the candidates that was not selected was rejected,
+	// followed by why Find skipped the files that were not candidates at all.
+	Rejected []Rejection
+
+	// Winner is the selected agent socket, or empty if no agent was found.
+	Winner string
+
+	// Reason explains why the winner was selected over the other candidates.
+	Reason string
+
+	// Switcher is true if the winner is another ssh-agent-switcher instance.
+	Switcher bool
+
+	// Err is the reason why selection failed, if any.
+	Err error
+}
+
+// Rejection explains why a candidate agent socket was not selected.
+type Rejection struct {
+	// Path is the path to the rejected agent socket.
+	Path string
+
+	// Err is the reason why the candidate was rejected.
+	Err error
+}
+
+// String formats the rejection for display.
+func (r Rejection) String() string {
+	return fmt.Sprintf("%s: %v", r.Path, r.Err)
+}
+
+// reject records that "path" was considered but rejected for "reason".
+func (d *Decision) reject(path string, reason error) {
+	d.Rejected = append(d.Rejected, Rejection{Path: path, Err: reason})
+}
+
+// String formats the decision as a single line for status output.
+func (d Decision) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s [conn %d] ", d.Time.Format(time.RFC3339), d.Conn)
+	if d.Err != nil {
+		fmt.Fprintf(&b, "failed: %v", d.Err)
+	} else {
+		fmt.Fprintf(&b, "selected %s", d.Winner)
+	}
+	fmt.Fprintf(&b, "; candidates: %d", len(d.Candidates))
+	if len(d.Candidates) > 0 {
+		fmt.Fprintf(&b, " (%s)", strings.Join(d.Candidates, ", "))
+	}
+	if len(d.Rejected) > 0 {
+		rejected := make([]string, len(d.Rejected))
+		for i, r := range d.Rejected {
+			rejected[i] = r.String()
+		}
+		fmt.Fprintf(&b, "; rejected: %s", strings.Join(rejected, "; "))
+	}
+	return b.String()
+}
+
+// History keeps the most recent decisions so that they can be inspected after the fact.
+type History struct {
+	// mu protects all the fields below.
+	mu sync.Mutex
+
+	// entries is a ring buffer of decisions, of which next is the oldest once it is full.
+	entries []Decision
+
+	// next is the position in entries where the next decision will be stored.
+	next int
+
+	// full is true once entries has wrapped around.
+	full bool
+}
+
+// NewHistory creates a history that keeps the last "size" decisions.
+func NewHistory(size int) *History {
+	return &History{entries: make([]Decision, size)}
+}
+
+// Record adds "d" to the history, evicting the oldest entry if the history is full.
+//
+// A nil history records nothing.
+func (h *History) Record(d Decision) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.entries[h.next] = d
+	h.next++
+	if h.next == len(h.entries) {
+		h.next = 0
+		h.full = true
+	}
+}
+
+// List returns the recorded decisions from oldest to newest.
+func (h *History) List() []Decision {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.full {
+		return append([]Decision(nil), h.entries[:h.next]...)
+	}
+	return append(append([]Decision(nil), h.entries[h.next:]...), h.entries[:h.next]...)
+}
@@ -0,0 +1,115 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package selection
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNoAgentFound indicates that no candidate agent could be selected.  Selectors return it
+// as is when there are no candidates and return a CandidateRejectedError, which matches it
+// with errors.Is, when all candidates were rejected.
+var ErrNoAgentFound = errors.New("agent not found")
+
+// ErrOtherSwitcher indicates that a candidate agent socket is served by another instance of
+// ssh-agent-switcher.
+var ErrOtherSwitcher = errors.New("is another ssh-agent-switcher instance")
+
+// CandidateRejectedError indicates that there were candidate agents but that all of them were
+// rejected.  The full list of rejections is in the decision of the selection.
+type CandidateRejectedError struct {
+	// Path is the path to the socket of the first rejected candidate, which is the most
+	// preferred one.
+	Path string
+
+	// Reason is why the first candidate was rejected.
+	Reason error
+}
+
+// Error returns the reason why the first candidate was rejected.
+func (e *CandidateRejectedError) Error() string {
+	return fmt.Sprintf("%v; rejected %s: %v", ErrNoAgentFound, e.Path, e.Reason)
+}
+
+// Unwrap returns the reason why the first candidate was rejected.
+func (e *CandidateRejectedError) Unwrap() error {
+	return e.Reason
+}
+
+// Is returns true if "target" is ErrNoAgentFound.
+func (e *CandidateRejectedError) Is(target error) bool {
+	return target == ErrNoAgentFound
+}
+
+// UpstreamDialError indicates that the socket of a candidate agent could not be opened.
+type UpstreamDialError struct {
+	// Path is the path to the socket of the candidate.
+	Path string
+
+	// Err is the reason why the socket could not be opened.
+	Err error
+}
+
+// Error returns the reason why the socket could not be opened.
+func (e *UpstreamDialError) Error() string {
+	return fmt.Sprintf("open failed: %v", e.Err)
+}
+
+// Unwrap returns the reason why the socket could not be opened.
+func (e *UpstreamDialError) Unwrap() error {
+	return e.Err
+}
+
+// CoolingDownError indicates that a candidate agent failed recently and is being skipped until
+// its cooldown expires.
+type CoolingDownError struct {
+	// Path is the path to the socket of the candidate.
+	Path string
+
+	// Until is when the candidate will be tried again.
+	Until time.Time
+}
+
+// Error returns when the candidate will be tried again.
+func (e *CoolingDownError) Error() string {
+	return fmt.Sprintf("failed recently; not trying again until %s", e.Until.Format(time.TimeOnly))
+}
+
+// SkippedError indicates that the discoverer did not produce a file as a candidate at all,
+// such as because it is not a socket or because it belongs to another user.
+type SkippedError struct {
+	// Reason explains why the file was skipped.
+	Reason string
+
+	// Suspicious is true if the file looks like an agent but failed the ownership or
+	// permission checks.  See discovery.Skipped.
+	Suspicious bool
+}
+
+// Error returns why the file was skipped.
+func (e *SkippedError) Error() string {
+	return "not a candidate: " + e.Reason
+}
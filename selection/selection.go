@@ -0,0 +1,310 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package selection picks the agent to which to proxy a client connection among the candidates
+// produced by a discovery.Discoverer.
+package selection
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/discovery"
+	"github.com/jmmv/ssh-agent-switcher/proxy"
+)
+
+// DefaultIdentifyTimeout is the default value of FirstReachable.IdentifyTimeout.
+const DefaultIdentifyTimeout = time.Second
+
+// DefaultDialBackoff is the default value of FirstReachable.DialBackoff.
+const DefaultDialBackoff = 100 * time.Millisecond
+
+// maxDialBackoff bounds the wait between retries, however many are allowed.
+const maxDialBackoff = 5 * time.Second
+
+// Selector chooses the agent to which to proxy a client connection among candidates.
+type Selector interface {
+	// Select opens the socket of the chosen candidate and returns the connection to it.
+	//
+	// Either way, the returned decision explains the outcome and lists the candidates that
+	// were rejected.  An error means that no candidate was acceptable, in which case it
+	// matches ErrNoAgentFound with errors.Is.
+	Select(candidates []discovery.Candidate) (net.Conn, Decision, error)
+}
+
+// Find produces candidates with "discoverer" and lets "selector" choose among them.
+//
+// A failure of the discoverer does not prevent selecting among the candidates it did produce,
+// but if none is selected, the failure of the discoverer is returned instead of the failure of
+// the selector.  The files that the discoverer skipped are appended to the rejections of the
+// decision with a SkippedError.
+func Find(discoverer discovery.Discoverer, selector Selector) (net.Conn, Decision, error) {
+	candidates, skipped, discoverErr := discoverer.Discover()
+	conn, decision, err := selector.Select(candidates)
+	for _, skip := range skipped {
+		decision.reject(skip.Path, &SkippedError{Reason: skip.Reason, Suspicious: skip.Suspicious})
+	}
+	if err != nil && discoverErr != nil {
+		decision.Err = discoverErr
+		return nil, decision, discoverErr
+	}
+	return conn, decision, err
+}
+
+// FirstReachable is the Selector that ssh-agent-switcher uses by default: it selects the first
+// candidate that can be opened and that is not another ssh-agent-switcher instance.
+//
+// The zero value is ready to use.
+type FirstReachable struct {
+	// OwnSockets lists the sockets on which the caller serves clients, which are never
+	// selected.  May be nil.
+	OwnSockets *discovery.SocketSet
+
+	// ChainSwitchers allows selecting other ssh-agent-switcher instances, which are rejected
+	// with ErrOtherSwitcher otherwise.  Explicit candidates are never checked.
+	ChainSwitchers bool
+
+	// Check, if not nil, is called with every candidate that is not explicit once it has
+	// been opened, and rejects the candidate if it returns an error.  Callers can use this to
+	// apply their own policies, such as verifying which process serves the agent.
+	Check func(path string, conn net.Conn) error
+
+	// SkipIdentify disables checking whether candidates are other ssh-agent-switcher
+	// instances, which is necessary to select agents that do not speak the SSH agent
+	// protocol, such as gpg-agent.
+	SkipIdentify bool
+
+	// IdentifyTimeout is how long a candidate has to answer whether it is another
+	// ssh-agent-switcher instance.  Zero means DefaultIdentifyTimeout.
+	IdentifyTimeout time.Duration
+
+	// DialRetries is how many more times to try the candidates whose sockets could not be
+	// opened, once every candidate has been tried and none was selected.  Zero tries every
+	// candidate once, which is right for local file systems, where a socket that cannot be
+	// opened belongs to a dead agent.  Slow network file systems can need a few retries.
+	DialRetries int
+
+	// DialBackoff is how long to wait before the first retry, which doubles with every
+	// retry up to 5 seconds.  Each wait is shortened by a random amount of up to half its
+	// length so that many clients don't retry in lockstep.  Zero means DefaultDialBackoff.
+	DialBackoff time.Duration
+
+	// Cooldown, if not nil, makes the selector skip the candidates that recently could not be
+	// opened or failed to identify themselves, and records new failures.  Explicit candidates
+	// are always tried but their failures are recorded all the same.
+	Cooldown *Cooldown
+
+	// Observe, if not nil, is called before every step of the selection with the name of
+	// the step ("probe", "check", or "identify") and the agent socket it is about.  The returned
+	// function, if not nil, is called with the outcome of the step.  Callers can use this to
+	// trace and time the selection.
+	Observe func(step string, path string) func(error)
+}
+
+// observe runs "f" as the step "step" about "path", reporting it to the observer if any.
+func (s *FirstReachable) observe(step string, path string, f func() error) error {
+	var done func(error)
+	if s.Observe != nil {
+		done = s.Observe(step, path)
+	}
+	err := f()
+	if done != nil {
+		done(err)
+	}
+	return err
+}
+
+// isResourceError returns true if "err" says that we or the agent ran out of a resource, such
+// as file descriptors or room in the listen backlog of the agent, which is common under load
+// and says nothing about the health of the agent.
+func isResourceError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.EAGAIN} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// probe opens the agent socket at "path".
+func (s *FirstReachable) probe(path string) (net.Conn, error) {
+	var conn net.Conn
+	err := s.observe("probe", path, func() error {
+		var err error
+		conn, err = discovery.Dial(path, s.OwnSockets)
+		return err
+	})
+	if err == discovery.ErrOwnSocket {
+		return nil, err
+	} else if err != nil {
+		return nil, &UpstreamDialError{Path: path, Err: err}
+	}
+	return conn, nil
+}
+
+// identify checks whether the agent at the other end of "conn", which lives in "path", is
+// another ssh-agent-switcher instance and whether that is acceptable.
+func (s *FirstReachable) identify(path string, conn net.Conn) (bool, error) {
+	timeout := s.IdentifyTimeout
+	if timeout == 0 {
+		timeout = DefaultIdentifyTimeout
+	}
+
+	var switcher bool
+	err := s.observe("identify", path, func() error {
+		var err error
+		switcher, err = proxy.Identify(conn, timeout)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if switcher && !s.ChainSwitchers {
+		return true, ErrOtherSwitcher
+	}
+	return switcher, nil
+}
+
+// backoff returns how long to wait before the retry number "retry", starting at 1.
+func (s *FirstReachable) backoff(retry int) time.Duration {
+	wait := s.DialBackoff
+	if wait == 0 {
+		wait = DefaultDialBackoff
+	}
+	for i := 1; i < retry && wait < maxDialBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxDialBackoff {
+		wait = maxDialBackoff
+	}
+	return wait - time.Duration(rand.Int63n(int64(wait/2)+1))
+}
+
+// Select tries the candidates in order and returns the connection to the first valid one.  If
+// none is valid, the candidates whose sockets could not be opened are tried again up to
+// DialRetries times.
+//
+// The reason of the decision is the origin of the selected candidate if it is explicit, and
+// says that it was the first reachable candidate from its origin otherwise.
+func (s *FirstReachable) Select(candidates []discovery.Candidate) (net.Conn, Decision, error) {
+	var decision Decision
+	for _, candidate := range candidates {
+		decision.Candidates = append(decision.Candidates, candidate.Path)
+	}
+
+	pending := candidates
+	for retry := 0; ; retry++ {
+		if retry > 0 {
+			time.Sleep(s.backoff(retry))
+		}
+		conn, unreachable := s.selectFrom(pending, &decision, retry >= s.DialRetries)
+		if conn != nil {
+			return conn, decision, nil
+		}
+		if len(unreachable) == 0 || retry >= s.DialRetries {
+			break
+		}
+		pending = unreachable
+	}
+
+	var err error = ErrNoAgentFound
+	if len(decision.Rejected) > 0 {
+		first := decision.Rejected[0]
+		err = &CandidateRejectedError{Path: first.Path, Reason: first.Err}
+	}
+	decision.Err = err
+	decision.Time = time.Now()
+	return nil, decision, err
+}
+
+// selectFrom tries "candidates" in order, records the outcome in "decision", and returns the
+// connection to the first valid one.  Otherwise, returns the candidates whose sockets could not
+// be opened, which are only recorded as rejected if this is the "last" attempt.
+func (s *FirstReachable) selectFrom(candidates []discovery.Candidate, decision *Decision, last bool) (net.Conn, []discovery.Candidate) {
+	var unreachable []discovery.Candidate
+	for _, candidate := range candidates {
+		path := candidate.Path
+		if until, ok := s.Cooldown.Until(path); ok && !candidate.Explicit {
+			decision.reject(path, &CoolingDownError{Path: path, Until: until})
+			continue
+		}
+
+		conn, err := s.probe(path)
+		if err != nil {
+			var dialErr *UpstreamDialError
+			if errors.As(err, &dialErr) && !last {
+				unreachable = append(unreachable, candidate)
+			} else {
+				if dialErr != nil && !isResourceError(dialErr.Err) {
+					s.Cooldown.Fail(path)
+				}
+				decision.reject(path, err)
+			}
+			continue
+		}
+
+		if candidate.Explicit {
+			s.Cooldown.Succeed(path)
+			decision.Winner = path
+			decision.Reason = candidate.Origin
+			decision.Time = time.Now()
+			return conn, nil
+		}
+
+		if s.Check != nil {
+			err := s.observe("check", path, func() error { return s.Check(path, conn) })
+			if err != nil {
+				conn.Close()
+				decision.reject(path, err)
+				continue
+			}
+		}
+
+		switcher := false
+		if !s.SkipIdentify {
+			switcher, err = s.identify(path, conn)
+			if err != nil {
+				if err != ErrOtherSwitcher {
+					s.Cooldown.Fail(path)
+				}
+				conn.Close()
+				decision.reject(path, err)
+				continue
+			}
+		}
+
+		s.Cooldown.Succeed(path)
+		decision.Winner = path
+		decision.Reason = "first reachable candidate " + candidate.Origin
+		decision.Switcher = switcher
+		if switcher {
+			decision.Reason += ", which is another ssh-agent-switcher instance"
+		}
+		decision.Time = time.Now()
+		return conn, nil
+	}
+	return nil, unreachable
+}
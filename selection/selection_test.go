@@ -0,0 +1,332 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package selection_test
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/discovery"
+	"github.com/jmmv/ssh-agent-switcher/selection"
+	"github.com/jmmv/ssh-agent-switcher/testutil"
+)
+
+// errCheck is the error with which the Check hook of some tests rejects candidates.
+var errCheck = errors.New("rejected by check")
+
+// wantRejection describes a candidate that a selection is expected to reject.
+type wantRejection struct {
+	// path is the path to the socket of the candidate.
+	path string
+
+	// is returns true if the error of the rejection is the expected one.
+	is func(error) bool
+}
+
+// isDialError returns true if "err" is an UpstreamDialError.
+func isDialError(err error) bool {
+	var dialErr *selection.UpstreamDialError
+	return errors.As(err, &dialErr)
+}
+
+// isCoolingDown returns true if "err" is a CoolingDownError.
+func isCoolingDown(err error) bool {
+	var coolingErr *selection.CoolingDownError
+	return errors.As(err, &coolingErr)
+}
+
+// isCheckError returns true if "err" is errCheck.
+func isCheckError(err error) bool {
+	return errors.Is(err, errCheck)
+}
+
+func TestFirstReachableSelect(t *testing.T) {
+	// selectTest describes the candidates and the selector of a test case and what the
+	// selection should return.
+	type selectTest struct {
+		candidates []discovery.Candidate
+		selector   *selection.FirstReachable
+
+		wantWinner   string
+		wantReason   string
+		wantRejected []wantRejection
+		wantErr      error
+
+		// wantCooling lists the sockets that must be cooling down after the selection.
+		wantCooling []string
+	}
+
+	for name, setup := range map[string]func(t *testing.T, tree *testutil.SSHDTree) selectTest{
+		"no candidates": func(t *testing.T, tree *testutil.SSHDTree) selectTest {
+			return selectTest{
+				selector: &selection.FirstReachable{},
+				wantErr:  selection.ErrNoAgentFound,
+			}
+		},
+
+		"first reachable": func(t *testing.T, tree *testutil.SSHDTree) selectTest {
+			stale := tree.AddStaleSocket("stale", os.Getpid())
+			live := tree.AddAgent("live", os.Getpid(), testutil.NewAgent(t))
+			other := tree.AddAgent("other", os.Getpid(), testutil.NewAgent(t))
+			return selectTest{
+				candidates: []discovery.Candidate{
+					{Path: stale, Origin: "in test"},
+					{Path: live, Origin: "in test"},
+					{Path: other, Origin: "in test"},
+				},
+				selector:     &selection.FirstReachable{},
+				wantWinner:   live,
+				wantReason:   "first reachable candidate in test",
+				wantRejected: []wantRejection{{stale, isDialError}},
+			}
+		},
+
+		"all rejected": func(t *testing.T, tree *testutil.SSHDTree) selectTest {
+			stale := tree.AddStaleSocket("stale", os.Getpid())
+			live := tree.AddAgent("live", os.Getpid(), testutil.NewAgent(t))
+			return selectTest{
+				candidates: []discovery.Candidate{
+					{Path: stale, Origin: "in test"},
+					{Path: live, Origin: "in test"},
+				},
+				selector: &selection.FirstReachable{
+					Check: func(path string, conn net.Conn) error { return errCheck },
+				},
+				wantRejected: []wantRejection{{stale, isDialError}, {live, isCheckError}},
+				wantErr:      &selection.CandidateRejectedError{Path: stale},
+			}
+		},
+
+		"explicit candidate skips check": func(t *testing.T, tree *testutil.SSHDTree) selectTest {
+			live := tree.AddAgent("live", os.Getpid(), testutil.NewAgent(t))
+			pinned := tree.AddAgent("pinned", os.Getpid(), testutil.NewAgent(t))
+			return selectTest{
+				candidates: []discovery.Candidate{
+					{Path: live, Origin: "in test"},
+					{Path: pinned, Origin: "pinned in test", Explicit: true},
+				},
+				selector: &selection.FirstReachable{
+					Check: func(path string, conn net.Conn) error { return errCheck },
+				},
+				wantWinner:   pinned,
+				wantReason:   "pinned in test",
+				wantRejected: []wantRejection{{live, isCheckError}},
+			}
+		},
+
+		"failure starts cooldown": func(t *testing.T, tree *testutil.SSHDTree) selectTest {
+			stale := tree.AddStaleSocket("stale", os.Getpid())
+			live := tree.AddAgent("live", os.Getpid(), testutil.NewAgent(t))
+			return selectTest{
+				candidates: []discovery.Candidate{
+					{Path: stale, Origin: "in test"},
+					{Path: live, Origin: "in test"},
+				},
+				selector:     &selection.FirstReachable{Cooldown: selection.NewCooldown(time.Hour)},
+				wantWinner:   live,
+				wantReason:   "first reachable candidate in test",
+				wantRejected: []wantRejection{{stale, isDialError}},
+				wantCooling:  []string{stale},
+			}
+		},
+
+		"cooldown skips candidate": func(t *testing.T, tree *testutil.SSHDTree) selectTest {
+			cooling := tree.AddAgent("cooling", os.Getpid(), testutil.NewAgent(t))
+			live := tree.AddAgent("live", os.Getpid(), testutil.NewAgent(t))
+			cooldown := selection.NewCooldown(time.Hour)
+			cooldown.Fail(cooling)
+			return selectTest{
+				candidates: []discovery.Candidate{
+					{Path: cooling, Origin: "in test"},
+					{Path: live, Origin: "in test"},
+				},
+				selector:     &selection.FirstReachable{Cooldown: cooldown},
+				wantWinner:   live,
+				wantReason:   "first reachable candidate in test",
+				wantRejected: []wantRejection{{cooling, isCoolingDown}},
+				wantCooling:  []string{cooling},
+			}
+		},
+
+		"cooldown does not skip explicit candidate": func(t *testing.T, tree *testutil.SSHDTree) selectTest {
+			pinned := tree.AddAgent("pinned", os.Getpid(), testutil.NewAgent(t))
+			cooldown := selection.NewCooldown(time.Hour)
+			cooldown.Fail(pinned)
+			return selectTest{
+				candidates: []discovery.Candidate{
+					{Path: pinned, Origin: "pinned in test", Explicit: true},
+				},
+				selector:   &selection.FirstReachable{Cooldown: cooldown},
+				wantWinner: pinned,
+				wantReason: "pinned in test",
+			}
+		},
+
+		"retry finds late agent": func(t *testing.T, tree *testutil.SSHDTree) selectTest {
+			late := missingSocket(t, tree, "late")
+			return selectTest{
+				candidates: []discovery.Candidate{{Path: late, Origin: "in test"}},
+				selector: &selection.FirstReachable{
+					DialRetries: 2,
+					DialBackoff: time.Millisecond,
+					Observe:     startAgentAfterFailedProbe(t, tree, "late"),
+				},
+				wantWinner: late,
+				wantReason: "first reachable candidate in test",
+			}
+		},
+
+		"no retries": func(t *testing.T, tree *testutil.SSHDTree) selectTest {
+			late := missingSocket(t, tree, "late")
+			return selectTest{
+				candidates: []discovery.Candidate{{Path: late, Origin: "in test"}},
+				selector: &selection.FirstReachable{
+					DialBackoff: time.Millisecond,
+					Observe:     startAgentAfterFailedProbe(t, tree, "late"),
+				},
+				wantRejected: []wantRejection{{late, isDialError}},
+				wantErr:      &selection.CandidateRejectedError{Path: late},
+			}
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			test := setup(t, testutil.NewSSHDTree(t))
+			test.selector.OwnSockets = &discovery.SocketSet{SharedProcess: true}
+
+			conn, decision, err := test.selector.Select(test.candidates)
+			if conn != nil {
+				conn.Close()
+			}
+
+			if test.wantErr == nil {
+				if err != nil {
+					t.Fatalf("Select failed: %v", err)
+				}
+			} else {
+				if conn != nil {
+					t.Errorf("Select returned a connection and error %v", err)
+				}
+				if !errors.Is(err, selection.ErrNoAgentFound) {
+					t.Errorf("Select returned error %v; want one that matches %v", err, selection.ErrNoAgentFound)
+				}
+				var rejectedErr *selection.CandidateRejectedError
+				if want, ok := test.wantErr.(*selection.CandidateRejectedError); ok {
+					if !errors.As(err, &rejectedErr) || rejectedErr.Path != want.Path {
+						t.Errorf("Select returned error %v; want the rejection of %s", err, want.Path)
+					}
+				} else if errors.As(err, &rejectedErr) {
+					t.Errorf("Select returned error %v; want %v", err, test.wantErr)
+				}
+				if decision.Err != err {
+					t.Errorf("Decision has error %v; want %v", decision.Err, err)
+				}
+			}
+
+			if decision.Winner != test.wantWinner {
+				t.Errorf("Select chose %q; want %q", decision.Winner, test.wantWinner)
+			}
+			if decision.Reason != test.wantReason {
+				t.Errorf("Decision has reason %q; want %q", decision.Reason, test.wantReason)
+			}
+			if len(decision.Candidates) != len(test.candidates) {
+				t.Errorf("Decision lists candidates %v; want %d", decision.Candidates, len(test.candidates))
+			}
+			if len(decision.Rejected) != len(test.wantRejected) {
+				t.Fatalf("Decision has rejections %v; want %d", decision.Rejected, len(test.wantRejected))
+			}
+			for i, want := range test.wantRejected {
+				got := decision.Rejected[i]
+				if got.Path != want.path || !want.is(got.Err) {
+					t.Errorf("Rejection %d is %v; want a different one for %s", i, got, want.path)
+				}
+			}
+
+			for _, path := range test.wantCooling {
+				if _, ok := test.selector.Cooldown.Until(path); !ok {
+					t.Errorf("%s is not cooling down", path)
+				}
+			}
+			if test.wantWinner != "" {
+				if _, ok := test.selector.Cooldown.Until(test.wantWinner); ok {
+					t.Errorf("Selected %s is still cooling down", test.wantWinner)
+				}
+			}
+		})
+	}
+}
+
+// missingSocket returns the path to the socket agent.PID in the session directory ssh-SESSION
+// of "tree", which does not exist until an agent is added to the session.
+func missingSocket(t *testing.T, tree *testutil.SSHDTree, session string) string {
+	t.Helper()
+	path := tree.AddStaleSocket(session, os.Getpid())
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("Cannot remove socket: %v", err)
+	}
+	return path
+}
+
+// startAgentAfterFailedProbe returns an observer for FirstReachable that starts an agent in the
+// session directory ssh-SESSION of "tree" once a probe fails, so that retries can find it.
+func startAgentAfterFailedProbe(t *testing.T, tree *testutil.SSHDTree, session string) func(string, string) func(error) {
+	started := false
+	return func(step string, path string) func(error) {
+		if step != "probe" {
+			return nil
+		}
+		return func(err error) {
+			if err != nil && !started {
+				tree.AddAgent(session, os.Getpid(), testutil.NewAgent(t))
+				started = true
+			}
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	tree := testutil.NewSSHDTree(t)
+	live := tree.AddAgent("live", os.Getpid(), testutil.NewAgent(t))
+	garbage := tree.AddFile("ssh-live/garbage", 0600)
+
+	selector := &selection.FirstReachable{OwnSockets: &discovery.SocketSet{SharedProcess: true}}
+	conn, decision, err := selection.Find(&discovery.SessionDirs{Dir: tree.Dir}, selector)
+	if err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+	conn.Close()
+	if decision.Winner != live {
+		t.Errorf("Find chose %q; want %q", decision.Winner, live)
+	}
+	if len(decision.Rejected) != 1 || decision.Rejected[0].Path != garbage {
+		t.Fatalf("Decision has rejections %v; want only %s", decision.Rejected, garbage)
+	}
+	var skipErr *selection.SkippedError
+	if !errors.As(decision.Rejected[0].Err, &skipErr) || !strings.Contains(skipErr.Reason, "agent.") {
+		t.Errorf("Rejection of %s is %v; want a SkippedError", garbage, decision.Rejected[0].Err)
+	}
+}
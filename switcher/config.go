@@ -0,0 +1,281 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package switcher
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+	"github.com/jmmv/ssh-agent-switcher/discovery"
+	"github.com/jmmv/ssh-agent-switcher/selection"
+)
+
+// DefaultAgentsDir is the default value of Config.AgentsDir.
+const DefaultAgentsDir = "/tmp"
+
+// Config configures Serve.  The zero value proxies to the agents that sshd forwards into
+// DefaultAgentsDir.
+//
+// Programs can fill in the fields directly or build the configuration with NewConfig and the
+// options that this package provides.
+type Config struct {
+	// AgentsDir is the directory where sshd places the session directories of forwarded
+	// agents, which the default discoverer scans.  Empty means DefaultAgentsDir.
+	AgentsDir string
+
+	// Discoverer produces the candidate agents for every client connection.  Nil means the
+	// agents that sshd forwards into AgentsDir.
+	Discoverer discovery.Discoverer
+
+	// Selector chooses the agent for every client connection among the candidates.  Nil
+	// means a selection.FirstReachable that never selects the socket of the listener.
+	Selector selection.Selector
+
+	// ChainSwitchers allows the default selector to proxy through other ssh-agent-switcher
+	// instances instead of skipping them.
+	ChainSwitchers bool
+
+	// DialRetries and DialBackoff configure how the default selector retries the sockets of
+	// candidate agents that cannot be opened.  See selection.FirstReachable.
+	DialRetries int
+	DialBackoff time.Duration
+
+	// FailureCooldown is how long the default selector skips the candidate agents that could
+	// not be opened or failed to answer before trying them again.  Zero tries them every time.
+	FailureCooldown time.Duration
+
+	// MaxMessageSize is the largest message, excluding the length prefix, that is proxied
+	// in either direction.  Zero means codec.DefaultMaxMessageSize.
+	MaxMessageSize uint32
+
+	// RequestTimeout is how long the agent has to answer a request, except for sign requests
+	// with security keys, which wait for the user to touch the key.  Zero waits forever.
+	RequestTimeout time.Duration
+
+	// Logger receives messages about client connections, each with the "conn" attribute
+	// that identifies the connection.  Nil discards all messages.
+	Logger *slog.Logger
+
+	// Authorize, if not nil, is called for every client connection before selecting an
+	// agent for it.  Clients for which it returns an error are disconnected right away.  Nil
+	// accepts all clients that can reach the listener.
+	Authorize func(client net.Conn) error
+
+	// OnAgentSelected, if not nil, is called every time an agent is selected for a client
+	// connection, before proxying any request to it.
+	OnAgentSelected func(decision selection.Decision)
+
+	// OnAgentLost, if not nil, is called when no agent can be selected for a client
+	// connection after an agent was selected for the previous one.  It is not called again
+	// until an agent is selected and lost once more.
+	OnAgentLost func(decision selection.Decision)
+
+	// OnClientDenied, if not nil, is called with the error returned by Authorize for every
+	// client connection that it rejects.  The connection is closed afterwards.
+	OnClientDenied func(client net.Conn, err error)
+
+	// Accept, if not nil, is called for every authorized client connection before selecting
+	// an agent for it, and can prepare the session, for example by wrapping its Client or by
+	// keeping state in its Value.  Clients for which it returns an error are disconnected
+	// right away.
+	Accept func(s *Session) error
+
+	// FindAgent, if not nil, selects the agent for every client connection instead of
+	// Discoverer and Selector.  Clients for which it returns an error are served by an empty
+	// agent.
+	FindAgent func(s *Session) (net.Conn, selection.Decision, error)
+
+	// HandleRequest, if not nil, handles every client request, which includes the length
+	// prefix, instead of the default handler, which is given as "next" so that HandleRequest
+	// can delegate to it.  The default handler answers the requests to identify
+	// ssh-agent-switcher instances, forwards the rest to the Agent of the session, or
+	// answers them like an agent without keys would if there is none, and returns the
+	// response, including the length prefix, which is then written to the client.
+	//
+	// Returning a response without forwarding the request to the agent filters it.
+	// HandleRequest may also replace the Agent of the session, in which case it must close
+	// the previous one.  Returning an error drops the connection, and so does returning a
+	// response that is not a complete message: one of at least 5 bytes whose length prefix
+	// matches the rest of the response.
+	HandleRequest func(s *Session, request []byte, next Handler) ([]byte, error)
+
+	// OnClose, if not nil, is called for every client connection once it is done, even if
+	// it was rejected, with the error that ended it or nil if the client closed it.  Both
+	// the client and agent connections are closed afterwards.
+	OnClose func(s *Session, err error)
+}
+
+// Session describes a client connection to the hooks of Config.
+type Session struct {
+	// Client is the connection to the client.  Accept may replace it with a wrapper of the
+	// original connection, which is the one that is closed at the end.
+	Client net.Conn
+
+	// Agent is the connection to the agent selected for the client, or nil while the client
+	// is served by an empty agent.
+	Agent net.Conn
+
+	// Decision explains how the Agent was selected or why there is none.
+	Decision selection.Decision
+
+	// Logger receives messages about the session, with the "conn" attribute that identifies
+	// it and, once selected, the "agent" attribute.
+	Logger *slog.Logger
+
+	// Value is state that the hooks keep for the session.
+	Value any
+
+	// buf holds the responses from the agent that fit in it.
+	buf []byte
+}
+
+// Handler handles the client request "request" of the session "s", which includes the length
+// prefix, and returns the response to send to the client, including the length prefix.
+type Handler func(s *Session, request []byte) ([]byte, error)
+
+// setDefaults fills in the fields of "c" whose zero values stand for a default.
+func (c *Config) setDefaults() {
+	if c.AgentsDir == "" {
+		c.AgentsDir = DefaultAgentsDir
+	}
+	if c.MaxMessageSize == 0 {
+		c.MaxMessageSize = codec.DefaultMaxMessageSize
+	}
+	if c.Logger == nil {
+		c.Logger = slog.New(discardHandler{})
+	}
+}
+
+// discardHandler is a slog.Handler that drops all messages.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// Option modifies a Config built by NewConfig.
+type Option func(*Config)
+
+// NewConfig returns the default configuration modified by "opts", in order, with all defaults
+// filled in.
+func NewConfig(opts ...Option) Config {
+	var c Config
+	for _, opt := range opts {
+		opt(&c)
+	}
+	c.setDefaults()
+	return c
+}
+
+// WithAgentsDir sets Config.AgentsDir.
+func WithAgentsDir(dir string) Option {
+	return func(c *Config) { c.AgentsDir = dir }
+}
+
+// WithDiscoverer sets Config.Discoverer.
+func WithDiscoverer(d discovery.Discoverer) Option {
+	return func(c *Config) { c.Discoverer = d }
+}
+
+// WithSelector sets Config.Selector.
+func WithSelector(s selection.Selector) Option {
+	return func(c *Config) { c.Selector = s }
+}
+
+// WithChainSwitchers sets Config.ChainSwitchers.
+func WithChainSwitchers(chain bool) Option {
+	return func(c *Config) { c.ChainSwitchers = chain }
+}
+
+// WithDialRetries sets Config.DialRetries and Config.DialBackoff.
+func WithDialRetries(retries int, backoff time.Duration) Option {
+	return func(c *Config) {
+		c.DialRetries = retries
+		c.DialBackoff = backoff
+	}
+}
+
+// WithFailureCooldown sets Config.FailureCooldown.
+func WithFailureCooldown(period time.Duration) Option {
+	return func(c *Config) { c.FailureCooldown = period }
+}
+
+// WithMaxMessageSize sets Config.MaxMessageSize.
+func WithMaxMessageSize(size uint32) Option {
+	return func(c *Config) { c.MaxMessageSize = size }
+}
+
+// WithRequestTimeout sets Config.RequestTimeout.
+func WithRequestTimeout(timeout time.Duration) Option {
+	return func(c *Config) { c.RequestTimeout = timeout }
+}
+
+// WithLogger sets Config.Logger.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Config) { c.Logger = logger }
+}
+
+// WithAuthorize sets Config.Authorize.
+func WithAuthorize(authorize func(client net.Conn) error) Option {
+	return func(c *Config) { c.Authorize = authorize }
+}
+
+// WithOnAgentSelected sets Config.OnAgentSelected.
+func WithOnAgentSelected(f func(decision selection.Decision)) Option {
+	return func(c *Config) { c.OnAgentSelected = f }
+}
+
+// WithOnAgentLost sets Config.OnAgentLost.
+func WithOnAgentLost(f func(decision selection.Decision)) Option {
+	return func(c *Config) { c.OnAgentLost = f }
+}
+
+// WithOnClientDenied sets Config.OnClientDenied.
+func WithOnClientDenied(f func(client net.Conn, err error)) Option {
+	return func(c *Config) { c.OnClientDenied = f }
+}
+
+// WithAccept sets Config.Accept.
+func WithAccept(f func(s *Session) error) Option {
+	return func(c *Config) { c.Accept = f }
+}
+
+// WithFindAgent sets Config.FindAgent.
+func WithFindAgent(f func(s *Session) (net.Conn, selection.Decision, error)) Option {
+	return func(c *Config) { c.FindAgent = f }
+}
+
+// WithHandleRequest sets Config.HandleRequest.
+func WithHandleRequest(f func(s *Session, request []byte, next Handler) ([]byte, error)) Option {
+	return func(c *Config) { c.HandleRequest = f }
+}
+
+// WithOnClose sets Config.OnClose.
+func WithOnClose(f func(s *Session, err error)) Option {
+	return func(c *Config) { c.OnClose = f }
+}
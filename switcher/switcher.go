@@ -0,0 +1,434 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package switcher runs the ssh-agent-switcher proxy in-process so that other programs can
+// embed it: Serve accepts agent clients on a listener and proxies every connection to the
+// agent selected for it until the caller cancels the context.
+package switcher
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+	"github.com/jmmv/ssh-agent-switcher/discovery"
+	"github.com/jmmv/ssh-agent-switcher/proxy"
+	"github.com/jmmv/ssh-agent-switcher/selection"
+)
+
+// server holds the state of a running Serve or ServeConn call.
+type server struct {
+	// cfg is the configuration with all defaults filled in.
+	cfg Config
+
+	// l is the listener on which clients are accepted, or nil for ServeConn.
+	l net.Listener
+
+	// wg tracks the goroutines that handle client connections.
+	wg sync.WaitGroup
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// conns holds the open client and agent connections, which are closed on shutdown.
+	conns map[net.Conn]struct{}
+
+	// closing is true once Serve has started shutting down.
+	closing bool
+
+	// lastConn is the identifier of the last accepted client connection.
+	lastConn uint64
+
+	// haveAgent is true if an agent was selected for the last client connection.
+	haveAgent bool
+}
+
+// AgentError indicates that forwarding a request failed because of the agent, which may
+// have gone away, as opposed to the client.
+type AgentError struct {
+	// Op describes the operation that failed, such as "write to" or "read from".
+	Op string
+
+	// Err is the reason why the operation failed.
+	Err error
+}
+
+// Error returns the operation that failed and why.
+func (e *AgentError) Error() string {
+	return fmt.Sprintf("%s agent failed: %v", e.Op, e.Err)
+}
+
+// Unwrap returns the reason why the operation failed.
+func (e *AgentError) Unwrap() error {
+	return e.Err
+}
+
+// errClosing indicates that a client connection was dropped because the server is shutting
+// down.
+var errClosing = errors.New("shutting down")
+
+// newServer prepares to serve clients with "cfg" on "l", which may be nil.
+func newServer(l net.Listener, cfg Config) (*server, error) {
+	cfg.setDefaults()
+	if cfg.Discoverer == nil && cfg.FindAgent == nil {
+		cfg.Discoverer = &discovery.SessionDirs{Dir: cfg.AgentsDir}
+	}
+	if cfg.Selector == nil && cfg.FindAgent == nil {
+		own := &discovery.SocketSet{}
+		if l != nil {
+			if addr, ok := l.Addr().(*net.UnixAddr); ok {
+				if err := own.Add(addr.Name); err != nil {
+					return nil, fmt.Errorf("cannot identify our own socket %s: %v", addr.Name, err)
+				}
+			}
+		}
+		selector := &selection.FirstReachable{
+			OwnSockets:     own,
+			ChainSwitchers: cfg.ChainSwitchers,
+			DialRetries:    cfg.DialRetries,
+			DialBackoff:    cfg.DialBackoff,
+		}
+		if cfg.FailureCooldown > 0 {
+			selector.Cooldown = selection.NewCooldown(cfg.FailureCooldown)
+		}
+		cfg.Selector = selector
+	}
+	return &server{cfg: cfg, l: l, conns: make(map[net.Conn]struct{})}, nil
+}
+
+// Serve accepts agent clients on "l" and proxies every connection to the agent that the
+// selector of "cfg" chooses for it.  Clients for which there is no agent are served by an empty
+// agent so that they can fall back to other authentication methods cleanly.
+//
+// The callbacks in "cfg" are called from the goroutines that handle client connections, so
+// they may run concurrently with each other and must not block for long.
+//
+// Serve runs until "ctx" is done, in which case it closes "l" and all client and agent
+// connections, waits for their handlers to finish, and returns nil.  If accepting a connection
+// fails, Serve shuts down the same way and returns the error.
+func Serve(ctx context.Context, l net.Listener, cfg Config) error {
+	s, err := newServer(l, cfg)
+	if err != nil {
+		l.Close()
+		return err
+	}
+	defer s.stopOnDone(ctx)()
+
+	for {
+		client, err := l.Accept()
+		if err != nil {
+			s.shutdown()
+			s.wg.Wait()
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		s.wg.Add(1)
+		go s.handle(client)
+	}
+}
+
+// ServeConn serves the single client connection "client" like Serve serves every connection
+// that it accepts, and returns once the connection is done.  If "ctx" is done earlier, the
+// client and agent connections are closed.
+func ServeConn(ctx context.Context, client net.Conn, cfg Config) error {
+	s, err := newServer(nil, cfg)
+	if err != nil {
+		client.Close()
+		return err
+	}
+	defer s.stopOnDone(ctx)()
+
+	s.wg.Add(1)
+	s.handle(client)
+	return nil
+}
+
+// stopOnDone shuts the server down once "ctx" is done until the returned function is called.
+func (s *server) stopOnDone(ctx context.Context) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.shutdown()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// shutdown stops accepting connections and closes all open connections.
+func (s *server) shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return
+	}
+	s.closing = true
+	if s.l != nil {
+		s.l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// track records "conn" so that it is closed on shutdown.  Returns false if the server is
+// already shutting down, in which case the caller must drop the connection.
+func (s *server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+// untrack forgets about "conn", which the caller closes.
+func (s *server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// newConnLogger assigns an identifier to a new client connection and returns the logger for
+// the messages about it.
+func (s *server) newConnLogger() *slog.Logger {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastConn++
+	return s.cfg.Logger.With("conn", s.lastConn)
+}
+
+// logError logs a failure via "logger" unless the server is shutting down, in which case
+// failures are expected.
+func (s *server) logError(logger *slog.Logger, msg string, args ...any) {
+	s.mu.Lock()
+	closing := s.closing
+	s.mu.Unlock()
+	if !closing {
+		logger.Warn(msg, args...)
+	}
+}
+
+// handle serves the client connection "client" until either end closes it.
+func (s *server) handle(client net.Conn) {
+	defer s.wg.Done()
+	defer client.Close()
+
+	session := &Session{Client: client, Logger: s.newConnLogger()}
+	var err error
+	if s.cfg.OnClose != nil {
+		defer func() { s.cfg.OnClose(session, err) }()
+	}
+	if !s.track(client) {
+		err = errClosing
+		return
+	}
+	defer s.untrack(client)
+
+	err = s.serve(session)
+}
+
+// serve authorizes the client of "session", selects an agent for it, and proxies its requests
+// until either end closes the connection.
+func (s *server) serve(session *Session) error {
+	logger := session.Logger
+	logger.Debug("Accepted client connection")
+	if s.cfg.Authorize != nil {
+		if err := s.cfg.Authorize(session.Client); err != nil {
+			logger.Warn("Rejecting client", "err", err)
+			if s.cfg.OnClientDenied != nil {
+				s.cfg.OnClientDenied(session.Client, err)
+			}
+			return err
+		}
+	}
+	if s.cfg.Accept != nil {
+		if err := s.cfg.Accept(session); err != nil {
+			logger.Warn("Rejecting client", "err", err)
+			return err
+		}
+	}
+
+	start := time.Now()
+	agent, decision, err := s.findAgent(session)
+	session.Decision = decision
+	s.notifySelection(decision, err == nil)
+	if err != nil {
+		s.logError(logger, "Acting as an empty agent", "err", err)
+	} else {
+		logger = logger.With("agent", decision.Winner)
+		logger.Debug("Selected agent", "reason", decision.Reason)
+		session.Logger = logger
+		session.Agent = agent
+	}
+
+	if err := s.proxyConnection(session); err != nil {
+		s.logError(logger, "Dropping connection", "elapsed", time.Since(start).Round(time.Millisecond), "err", err)
+		return err
+	}
+	logger.Debug("Closing client connection", "elapsed", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// findAgent selects the agent for the client of "session".
+func (s *server) findAgent(session *Session) (net.Conn, selection.Decision, error) {
+	if s.cfg.FindAgent != nil {
+		return s.cfg.FindAgent(session)
+	}
+	return selection.Find(s.cfg.Discoverer, s.cfg.Selector)
+}
+
+// notifySelection reports the outcome of selecting an agent for a client connection to the
+// callbacks of the configuration.  "found" is true if an agent was selected.
+func (s *server) notifySelection(decision selection.Decision, found bool) {
+	s.mu.Lock()
+	lost := s.haveAgent && !found
+	s.haveAgent = found
+	s.mu.Unlock()
+
+	if found && s.cfg.OnAgentSelected != nil {
+		s.cfg.OnAgentSelected(decision)
+	} else if lost && s.cfg.OnAgentLost != nil {
+		s.cfg.OnAgentLost(decision)
+	}
+}
+
+// proxyConnection handles all requests from the client of "session" and sends the responses
+// back to it until the client closes the connection.  The agent of the session, which may be
+// replaced along the way, is closed at the end.
+func (s *server) proxyConnection(session *Session) error {
+	agent := session.Agent
+	defer func() {
+		if agent != nil {
+			s.untrack(agent)
+		}
+		if session.Agent != nil {
+			session.Agent.Close()
+		}
+	}()
+	if agent != nil && !s.track(agent) {
+		agent = nil
+		return errClosing
+	}
+
+	handle := s.handleRequest
+	if s.cfg.HandleRequest != nil {
+		handle = func(session *Session, request []byte) ([]byte, error) {
+			return s.cfg.HandleRequest(session, request, s.handleRequest)
+		}
+	}
+
+	requests := codec.NewRequestReader(session.Client, s.cfg.MaxMessageSize)
+	session.buf = make([]byte, 4096)
+	for {
+		request, err := requests.Next()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if _, ok := err.(*codec.InvalidRequestError); ok {
+				return fmt.Errorf("invalid request: %w", err)
+			}
+			return fmt.Errorf("read from client failed: %w", err)
+		}
+
+		response, err := handle(session, request)
+		if codec.IsSensitive(request[4]) {
+			requests.Wipe()
+		}
+		if session.Agent != agent {
+			if agent != nil {
+				s.untrack(agent)
+			}
+			agent = session.Agent
+			if agent != nil && !s.track(agent) {
+				agent = nil
+				return errClosing
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if len(response) < 5 || binary.BigEndian.Uint32(response) != uint32(len(response)-4) {
+			return fmt.Errorf("request handler returned an invalid response of %d bytes", len(response))
+		}
+
+		_, err = session.Client.Write(response)
+		if codec.IsSensitive(response[4]) {
+			codec.Wipe(response)
+		}
+		if err != nil {
+			return fmt.Errorf("write to client failed: %w", err)
+		}
+	}
+}
+
+// handleRequest is the default Handler: it answers the requests to identify ssh-agent-switcher
+// instances and forwards all other requests to the agent of "session", or answers them like
+// an agent without keys would if there is none.
+func (s *server) handleRequest(session *Session, request []byte) ([]byte, error) {
+	if proxy.IsIdentifyRequest(request) {
+		return proxy.IdentifyReply, nil
+	}
+
+	agent := session.Agent
+	if agent == nil {
+		reply := []byte{codec.AgentFailure}
+		if request[4] == codec.AgentcRequestIdentities {
+			reply = codec.EncodeIdentitiesAnswer(nil)
+		}
+		return codec.Frame(reply), nil
+	}
+
+	// Sign requests for security keys block until the user touches the key, which can take
+	// arbitrarily long, so they are exempt from the timeout.
+	timeout := s.cfg.RequestTimeout
+	if sign, err := codec.ParseSignRequest(request); err == nil && codec.IsSecurityKey(sign.KeyBlob) {
+		timeout = 0
+	}
+	if timeout > 0 {
+		agent.SetDeadline(time.Now().Add(timeout))
+		defer agent.SetDeadline(time.Time{})
+	}
+
+	if _, err := agent.Write(request); err != nil {
+		return nil, &AgentError{Op: "write to", Err: err}
+	}
+	response, err := codec.ReadFrame(agent, session.buf, s.cfg.MaxMessageSize)
+	if err != nil {
+		return nil, &AgentError{Op: "read from", Err: err}
+	}
+	return response, nil
+}
@@ -0,0 +1,179 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package switcher_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+	"github.com/jmmv/ssh-agent-switcher/discovery"
+	"github.com/jmmv/ssh-agent-switcher/selection"
+	"github.com/jmmv/ssh-agent-switcher/switcher"
+	"github.com/jmmv/ssh-agent-switcher/testutil"
+)
+
+// listen creates a listener on a new socket that is deleted when the test "t" finishes.
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+
+	// Socket paths are limited to about 100 bytes, so we cannot use t.TempDir, whose paths
+	// embed the name of the test.
+	dir, err := os.MkdirTemp("", "switcher")
+	if err != nil {
+		t.Fatalf("Cannot create socket directory: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	l, err := net.Listen("unix", filepath.Join(dir, "socket"))
+	if err != nil {
+		t.Fatalf("Cannot create socket: %v", err)
+	}
+	return l
+}
+
+func TestServeShutdown(t *testing.T) {
+	tree := testutil.NewSSHDTree(t)
+	tree.AddAgent("live", os.Getpid(), testutil.NewAgent(t, "live key"))
+
+	var mu sync.Mutex
+	var closed []error
+	cfg := switcher.NewConfig(
+		switcher.WithAgentsDir(tree.Dir),
+		switcher.WithSelector(&selection.FirstReachable{
+			OwnSockets: &discovery.SocketSet{SharedProcess: true},
+		}),
+		switcher.WithOnClose(func(s *switcher.Session, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			closed = append(closed, err)
+		}),
+	)
+
+	l := listen(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- switcher.Serve(ctx, l, cfg) }()
+
+	client, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatalf("Cannot connect to switcher: %v", err)
+	}
+	defer client.Close()
+	ids, err := codec.RequestIdentities(client, codec.DefaultMaxMessageSize)
+	if err != nil {
+		t.Fatalf("RequestIdentities failed: %v", err)
+	}
+	if len(ids) != 1 || ids[0].Comment != "live key" {
+		t.Fatalf("Switcher returned identities %v; want the live key", ids)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Serve returned %v on shutdown; want nil", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Serve did not return after shutdown")
+	}
+
+	client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Errorf("Client connection is still open after shutdown")
+	}
+	if conn, err := net.Dial("unix", l.Addr().String()); err == nil {
+		conn.Close()
+		t.Errorf("Switcher still accepts connections after shutdown")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(closed) != 1 || closed[0] == nil {
+		t.Errorf("OnClose got errors %v; want one for the connection dropped by the shutdown", closed)
+	}
+}
+
+func TestServeInvalidHandlerResponse(t *testing.T) {
+	for name, response := range map[string][]byte{
+		"nil":             nil,
+		"empty":           {},
+		"short":           {0, 0, 0, 1},
+		"wrong length":    {0, 0, 0, 5, codec.AgentFailure},
+		"trailing bytes":  {0, 0, 0, 1, codec.AgentFailure, 0},
+		"missing message": {0, 0, 0, 0},
+	} {
+		t.Run(name, func(t *testing.T) {
+			closed := make(chan error, 1)
+			cfg := switcher.NewConfig(
+				switcher.WithFindAgent(func(s *switcher.Session) (net.Conn, selection.Decision, error) {
+					return nil, selection.Decision{}, selection.ErrNoAgentFound
+				}),
+				switcher.WithHandleRequest(func(s *switcher.Session, request []byte, next switcher.Handler) ([]byte, error) {
+					return response, nil
+				}),
+				switcher.WithOnClose(func(s *switcher.Session, err error) { closed <- err }),
+			)
+
+			l := listen(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- switcher.Serve(ctx, l, cfg) }()
+			defer func() {
+				cancel()
+				<-done
+			}()
+
+			client, err := net.Dial("unix", l.Addr().String())
+			if err != nil {
+				t.Fatalf("Cannot connect to switcher: %v", err)
+			}
+			defer client.Close()
+			if _, err := codec.RequestIdentities(client, codec.DefaultMaxMessageSize); err == nil {
+				t.Errorf("RequestIdentities succeeded with an invalid response")
+			}
+
+			select {
+			case err := <-closed:
+				if err == nil || !strings.Contains(err.Error(), "invalid response") {
+					t.Errorf("OnClose got error %v; want one about the invalid response", err)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("Connection was not closed")
+			}
+			select {
+			case err := <-done:
+				t.Fatalf("Serve returned %v after dropping the connection", err)
+			default:
+			}
+		})
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package testutil
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/jmmv/ssh-agent-switcher/codec"
+)
+
+// ed25519KeyType is the name of the only key type that the in-memory agent supports.
+const ed25519KeyType = "ssh-ed25519"
+
+// Key is an Ed25519 key held by an Agent.
+type Key struct {
+	// Comment is the comment that the agent reports for the key.
+	Comment string
+
+	// private is the private part of the key.
+	private ed25519.PrivateKey
+}
+
+// Blob returns the public key in the SSH wire format, which is how clients refer to it.
+func (k *Key) Blob() []byte {
+	blob := codec.AppendString(nil, []byte(ed25519KeyType))
+	return codec.AppendString(blob, k.private.Public().(ed25519.PublicKey))
+}
+
+// Verify checks that "signature", as returned in an SSH_AGENT_SIGN_RESPONSE, is a valid
+// signature of "data" made with this key.
+func (k *Key) Verify(data []byte, signature []byte) bool {
+	r := codec.NewReader(signature)
+	keyType, err := r.ReadString()
+	if err != nil || string(keyType) != ed25519KeyType {
+		return false
+	}
+	sig, err := r.ReadString()
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(k.private.Public().(ed25519.PublicKey), data, sig)
+}
+
+// Agent is an in-memory SSH agent that holds Ed25519 keys and speaks the real agent protocol.
+// It answers the requests to list, sign with, add, and remove keys and fails all others, like
+// a real agent does for the requests that it does not support.
+type Agent struct {
+	// t is the test that owns the agent.
+	t testing.TB
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// keys lists the keys held by the agent in the order in which they were added.
+	keys []*Key
+
+	// requests records the types of all the requests received by the agent.
+	requests []byte
+}
+
+// NewAgent creates an agent for the test "t" with new keys that have the given comments.
+func NewAgent(t testing.TB, comments ...string) *Agent {
+	t.Helper()
+	agent := &Agent{t: t}
+	for _, comment := range comments {
+		agent.AddKey(comment)
+	}
+	return agent
+}
+
+// AddKey generates a new key with "comment" and adds it to the agent.
+func (a *Agent) AddKey(comment string) *Key {
+	a.t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		a.t.Fatalf("Cannot generate key: %v", err)
+	}
+	key := &Key{Comment: comment, private: private}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.keys = append(a.keys, key)
+	return key
+}
+
+// Keys returns the keys currently held by the agent.
+func (a *Agent) Keys() []*Key {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]*Key(nil), a.keys...)
+}
+
+// Requests returns the types of all the requests that the agent received so far.
+func (a *Agent) Requests() []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]byte(nil), a.requests...)
+}
+
+// Serve accepts connections on "l" and serves each of them in the background until "l" is
+// closed, at which point it returns the error from Accept.
+func (a *Agent) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go a.ServeConn(conn)
+	}
+}
+
+// Pipe returns the client end of an in-memory connection to the agent.
+func (a *Agent) Pipe() net.Conn {
+	client, server := net.Pipe()
+	go a.ServeConn(server)
+	return client
+}
+
+// ServeConn answers the requests received over "conn" until the client closes it or sends an
+// invalid message, and then closes "conn".
+func (a *Agent) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	requests := codec.NewRequestReader(conn, codec.DefaultMaxMessageSize)
+	for {
+		request, err := requests.Next()
+		if err != nil {
+			return
+		}
+		if err := codec.WriteMessage(conn, a.handle(request)); err != nil {
+			return
+		}
+	}
+}
+
+// handle processes the request "msg", which includes the length prefix, and returns the reply.
+func (a *Agent) handle(msg []byte) []byte {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.requests = append(a.requests, msg[4])
+
+	failure := []byte{codec.AgentFailure}
+	r := codec.NewReader(msg[5:])
+	switch msg[4] {
+	case codec.AgentcRequestIdentities:
+		var ids []codec.Identity
+		for _, key := range a.keys {
+			ids = append(ids, codec.Identity{Blob: key.Blob(), Comment: key.Comment})
+		}
+		return codec.EncodeIdentitiesAnswer(ids)
+
+	case codec.AgentcSignRequest:
+		request, err := codec.ParseSignRequest(msg)
+		if err != nil {
+			return failure
+		}
+		key := a.find(request.KeyBlob)
+		if key == nil {
+			return failure
+		}
+		signature := codec.AppendString(nil, []byte(ed25519KeyType))
+		signature = codec.AppendString(signature, ed25519.Sign(key.private, request.Data))
+		return codec.AppendString([]byte{codec.AgentSignResponse}, signature)
+
+	case codec.AgentcAddIdentity:
+		keyType, err := r.ReadString()
+		if err != nil || string(keyType) != ed25519KeyType {
+			return failure
+		}
+		if _, err := r.ReadString(); err != nil { // Public key.
+			return failure
+		}
+		private, err := r.ReadString()
+		if err != nil || len(private) != ed25519.PrivateKeySize {
+			return failure
+		}
+		comment, err := r.ReadString()
+		if err != nil {
+			return failure
+		}
+		key := &Key{Comment: string(comment), private: ed25519.PrivateKey(bytes.Clone(private))}
+		if a.find(key.Blob()) == nil {
+			a.keys = append(a.keys, key)
+		}
+		return []byte{codec.AgentSuccess}
+
+	case codec.AgentcRemoveIdentity:
+		blob, err := r.ReadString()
+		if err != nil {
+			return failure
+		}
+		for i, key := range a.keys {
+			if bytes.Equal(key.Blob(), blob) {
+				a.keys = append(a.keys[:i], a.keys[i+1:]...)
+				return []byte{codec.AgentSuccess}
+			}
+		}
+		return failure
+
+	case codec.AgentcRemoveAllIdentities:
+		a.keys = nil
+		return []byte{codec.AgentSuccess}
+
+	default:
+		return failure
+	}
+}
+
+// find returns the key whose public key is "blob", or nil if the agent does not hold it.
+func (a *Agent) find(blob []byte) *Key {
+	for _, key := range a.keys {
+		if bytes.Equal(key.Blob(), blob) {
+			return key
+		}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+package testutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Process describes a process to add to a FakeProc.
+type Process struct {
+	// PID is the identifier of the process.
+	PID int
+
+	// Exe is the path to the executable that the process runs, or empty if unknown.
+	Exe string
+
+	// Cmdline holds the arguments of the process, including the program name.
+	Cmdline []string
+
+	// Cgroups lists the paths of the cgroups to which the process belongs.
+	Cgroups []string
+
+	// TTY is the device number of the controlling terminal of the process, or zero if none.
+	TTY uint64
+}
+
+// FakeProc is a fake proc file system with the files that describe processes, to use in place
+// of /proc (e.g. via the -procDir flag of ssh-agent-switcher).
+type FakeProc struct {
+	// Dir is the root of the fake file system.
+	Dir string
+
+	// t is the test that owns the file system.
+	t testing.TB
+}
+
+// NewFakeProc creates an empty proc file system that is deleted when the test "t" finishes.
+func NewFakeProc(t testing.TB) *FakeProc {
+	return &FakeProc{Dir: t.TempDir(), t: t}
+}
+
+// Add creates the exe, cmdline, cgroup, and stat files that describe "proc" and returns the
+// path to the directory of the process.
+func (p *FakeProc) Add(proc Process) string {
+	p.t.Helper()
+	dir := filepath.Join(p.Dir, strconv.Itoa(proc.PID))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		p.t.Fatalf("Cannot create fake process: %v", err)
+	}
+
+	if proc.Exe != "" {
+		if err := os.Symlink(proc.Exe, filepath.Join(dir, "exe")); err != nil {
+			p.t.Fatalf("Cannot create fake process: %v", err)
+		}
+	}
+
+	var cmdline strings.Builder
+	for _, arg := range proc.Cmdline {
+		cmdline.WriteString(arg)
+		cmdline.WriteByte(0)
+	}
+
+	var cgroups strings.Builder
+	for _, cgroup := range proc.Cgroups {
+		fmt.Fprintf(&cgroups, "0::%s\n", cgroup)
+	}
+
+	comm := filepath.Base(proc.Exe)
+	if len(proc.Cmdline) > 0 {
+		comm = filepath.Base(proc.Cmdline[0])
+	}
+	if len(comm) > 15 {
+		comm = comm[:15]
+	}
+	// Fields after the command name: state, ppid, pgrp, session, tty_nr, and then many more
+	// that nothing looks at.
+	stat := fmt.Sprintf("%d (%s) S 1 %d %d %d -1 0 0 0 0 0 0 0 0 0 20 0 1 0\n", proc.PID, comm, proc.PID, proc.PID, proc.TTY)
+
+	files := map[string]string{
+		"cmdline": cmdline.String(),
+		"cgroup":  cgroups.String(),
+		"stat":    stat,
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0444); err != nil {
+			p.t.Fatalf("Cannot create fake process: %v", err)
+		}
+	}
+	return dir
+}
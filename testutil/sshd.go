@@ -0,0 +1,134 @@
+// Copyright 2026 Julio Merino.
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without modification, are permitted
+// provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this list of conditions
+//   and the following disclaimer.
+// * Redistributions in binary form must reproduce the above copyright notice, this list of
+//   conditions and the following disclaimer in the documentation and/or other materials provided with
+//   the distribution.
+// * Neither the name of rules_shtk nor the names of its contributors may be used to endorse or
+//   promote products derived from this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS" AND ANY EXPRESS OR
+// IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF MERCHANTABILITY AND
+// FITNESS FOR A PARTICULAR PURPOSE ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR
+// CONTRIBUTORS BE LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR SERVICES; LOSS OF USE,
+// DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY,
+// WHETHER IN CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY
+// WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+
+// Package testutil helps write tests for code that deals with forwarded SSH agents without
+// needing root, a real sshd, or a real agent: it builds fake sshd session directories, fake
+// proc file systems, and serves in-memory agents that speak the real agent protocol.
+//
+// discovery.Dial refuses to connect to the sockets served by the calling process, which
+// includes the in-memory agents, unless the set of own sockets that it receives has
+// SharedProcess set.
+package testutil
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// SSHDTree is a fake directory, like /tmp, in which sshd places the session directories of
+// forwarded agents.
+type SSHDTree struct {
+	// Dir is the root of the tree, to use as the directory in which to look for agents.
+	Dir string
+
+	// t is the test that owns the tree.
+	t testing.TB
+}
+
+// NewSSHDTree creates an empty tree that is deleted when the test "t" finishes.
+func NewSSHDTree(t testing.TB) *SSHDTree {
+	t.Helper()
+
+	// Socket paths are limited to about 100 bytes, so we cannot use t.TempDir, whose paths
+	// embed the name of the test.
+	dir, err := os.MkdirTemp("", "sshd")
+	if err != nil {
+		t.Fatalf("Cannot create fake sshd tree: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &SSHDTree{Dir: dir, t: t}
+}
+
+// Session creates the session directory ssh-NAME with the permissions that sshd uses, unless it
+// already exists, and returns its path.
+func (tree *SSHDTree) Session(name string) string {
+	tree.t.Helper()
+	path := filepath.Join(tree.Dir, "ssh-"+name)
+	if err := os.Mkdir(path, 0700); err != nil && !os.IsExist(err) {
+		tree.t.Fatalf("Cannot create session directory: %v", err)
+	}
+	// Mkdir is subject to the umask, which could make the directory look suspicious.
+	if err := os.Chmod(path, 0700); err != nil {
+		tree.t.Fatalf("Cannot create session directory: %v", err)
+	}
+	return path
+}
+
+// socketPath returns the path to the socket agent.PID in the session directory ssh-SESSION,
+// which is created if necessary.
+func (tree *SSHDTree) socketPath(session string, pid int) string {
+	return filepath.Join(tree.Session(session), fmt.Sprintf("agent.%d", pid))
+}
+
+// AddAgent makes "agent" serve on the socket agent.PID in the session directory ssh-SESSION
+// and returns the path to the socket.  The agent stops accepting connections when the test
+// finishes.
+//
+// Discovery skips the socket unless "pid" is a live process of the current user, so pass
+// os.Getpid() unless the test is about sessions whose process is gone.
+func (tree *SSHDTree) AddAgent(session string, pid int, agent *Agent) string {
+	tree.t.Helper()
+	path := tree.socketPath(session, pid)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		tree.t.Fatalf("Cannot create agent socket: %v", err)
+	}
+	tree.t.Cleanup(func() { l.Close() })
+	go agent.Serve(l)
+	return path
+}
+
+// AddStaleSocket creates the socket agent.PID in the session directory ssh-SESSION without
+// anything serving it, like the sockets that sshd leaves behind when it dies, and returns the
+// path to the socket.
+func (tree *SSHDTree) AddStaleSocket(session string, pid int) string {
+	tree.t.Helper()
+	path := tree.socketPath(session, pid)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		tree.t.Fatalf("Cannot create agent socket: %v", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	return path
+}
+
+// AddFile creates a regular file at "rel", relative to the root of the tree, with "mode" and
+// returns its path.  Use this to plant the garbage that real directories like /tmp contain.
+func (tree *SSHDTree) AddFile(rel string, mode os.FileMode) string {
+	tree.t.Helper()
+	path := filepath.Join(tree.Dir, rel)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		tree.t.Fatalf("Cannot create file: %v", err)
+	}
+	if err := os.WriteFile(path, nil, mode); err != nil {
+		tree.t.Fatalf("Cannot create file: %v", err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		tree.t.Fatalf("Cannot create file: %v", err)
+	}
+	return path
+}